@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// triggerAPI is the trigger recorded for runs started over the run API.
+const triggerAPI = "api"
+
+// Modes of a run started over the API.
+const (
+	// apiModeIncremental runs the tables as configured.
+	apiModeIncremental = "incremental"
+	// apiModeFull reads the whole source, ignoring ROWVERSION_COLUMN,
+	// INCREMENTAL_COLUMN and CHANGE_TRACKING and leaving their watermarks
+	// as they are.
+	apiModeFull   = "full"
+	apiModeDryRun = "dry-run"
+)
+
+// runQueued is the state of an API run waiting for the one before it; the
+// other states are those of etl_runs.
+const runQueued = "queued"
+
+const (
+	// apiQueueSize is how many runs may wait; POST /runs answers 503
+	// beyond that.
+	apiQueueSize = 10
+	// apiRunsKept is how many finished runs GET /runs/{id} remembers.
+	apiRunsKept = 100
+)
+
+// apiRunRequest is the body of POST /runs. Every field is optional: an
+// empty request runs every table as configured.
+type apiRunRequest struct {
+	Tables []string `json:"tables,omitempty"`
+	// From and To (YYYY-MM-DD) are passed to SOURCE_FILTER as :from and
+	// :to, in place of their SOURCE_FILTER_PARAMS values.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	Mode string `json:"mode,omitempty"`
+}
+
+// apiRun is a run started over the API, as GET /runs/{id} reports it.
+// Tables has the outcome of every table loaded so far.
+type apiRun struct {
+	ID        string                 `json:"run_id"`
+	State     string                 `json:"state"`
+	Request   apiRunRequest          `json:"request"`
+	Submitted time.Time              `json:"submitted"`
+	Started   *time.Time             `json:"started,omitempty"`
+	Finished  *time.Time             `json:"finished,omitempty"`
+	Tables    map[string]tableStatus `json:"tables,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+
+	cfgs []Config
+}
+
+// apiServer is the serve command: an HTTP API that starts runs on request,
+// one at a time, with the connections opened at startup.
+type apiServer struct {
+	ctx              context.Context
+	configs          func() []Config // the current ones, after any reload
+	readDB, targetDB *sql.DB
+
+	mu    sync.Mutex
+	runs  map[string]*apiRun
+	order []string // run IDs, oldest first
+	queue chan *apiRun
+}
+
+// serveAPI serves the run API on API_ADDR, along with /metrics, /healthz
+// and /status, until ctx is cancelled. A run in progress is then stopped
+// like an interrupted run; queued runs are dropped.
+func serveAPI(ctx context.Context, configs func() []Config, readDB, targetDB *sql.DB) error {
+	cfgs := configs()
+	s := &apiServer{ctx: ctx, configs: configs, readDB: readDB, targetDB: targetDB, runs: map[string]*apiRun{}, queue: make(chan *apiRun, apiQueueSize)}
+	mux := newStatusMux()
+	mux.HandleFunc("/runs", s.authorized(s.handleRuns))
+	mux.HandleFunc("/runs/", s.authorized(s.handleRun))
+	srv := &http.Server{Addr: cfgs[0].APIAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	worked := make(chan struct{})
+	go func() {
+		s.work()
+		close(worked)
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving the run API", "addr", cfgs[0].APIAddr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-worked
+	slog.Info("Run API stopped")
+	return nil
+}
+
+// work runs the queued runs in turn until ctx is cancelled.
+func (s *apiServer) work() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case run := <-s.queue:
+			s.execute(run)
+		}
+	}
+}
+
+func (s *apiServer) execute(run *apiRun) {
+	started := time.Now()
+	s.mu.Lock()
+	run.State, run.Started = runRunning, &started
+	s.mu.Unlock()
+	slog.Info("Starting API run", "api_run_id", run.ID, "tables", len(run.cfgs), "mode", run.Request.Mode)
+
+	etlStatus.runStarted()
+	err := runTables(s.ctx, run.cfgs, s.readDB, s.targetDB)
+	etlStatus.runFinished(err)
+	notifyRun(run.cfgs[0], started, err)
+	writeRunReport(run.cfgs[0], started, err)
+
+	finished := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run.State, run.Finished = runSucceeded, &finished
+	run.Tables = map[string]tableStatus{}
+	for name, ts := range etlStatus.tablesSince(started) {
+		if slices.ContainsFunc(run.cfgs, func(cfg Config) bool { return cfg.TargetTable == name }) {
+			run.Tables[name] = ts
+		}
+	}
+	if err != nil {
+		run.State, run.Error = runFailed, err.Error()
+		slog.Error("API run failed", "api_run_id", run.ID, "error", err, "duration", finished.Sub(started))
+		return
+	}
+	slog.Info("API run finished", "api_run_id", run.ID, "duration", finished.Sub(started))
+}
+
+// authorized requires API_TOKEN as a bearer token, if it is set.
+func (s *apiServer) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := s.configs()[0].APIToken
+		got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, errors.New("missing or wrong API token"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleRuns serves POST /runs, which queues a run and answers 202 with
+// its ID, and GET /runs, which lists the runs it remembers.
+func (s *apiServer) handleRuns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		runs := make([]apiRun, 0, len(s.order))
+		for i := len(s.order) - 1; i >= 0; i-- {
+			runs = append(runs, *s.runs[s.order[i]])
+		}
+		s.mu.Unlock()
+		writeAPIJSON(w, http.StatusOK, runs)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed on /runs", r.Method))
+		return
+	}
+
+	var req apiRunRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil && err != io.EOF {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = apiModeIncremental
+	}
+	cfgs, err := s.runConfigs(req)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	run := &apiRun{ID: newRunID(), State: runQueued, Request: req, Submitted: time.Now(), cfgs: cfgs}
+	s.mu.Lock()
+	select {
+	case s.queue <- run:
+	default:
+		s.mu.Unlock()
+		writeAPIError(w, http.StatusServiceUnavailable, fmt.Errorf("%d runs are already queued; try again later", apiQueueSize))
+		return
+	}
+	s.runs[run.ID] = run
+	s.order = append(s.order, run.ID)
+	s.forget()
+	resp := *run
+	s.mu.Unlock()
+
+	slog.Info("Queued API run", "api_run_id", run.ID, "tables", len(cfgs), "mode", req.Mode)
+	w.Header().Set("Location", "/runs/"+run.ID)
+	writeAPIJSON(w, http.StatusAccepted, resp)
+}
+
+// forget drops the oldest finished runs beyond apiRunsKept. Queued and
+// running ones are always kept.
+func (s *apiServer) forget() {
+	for i := 0; len(s.order) > apiRunsKept && i < len(s.order); {
+		if run := s.runs[s.order[i]]; run.Finished != nil {
+			delete(s.runs, run.ID)
+			s.order = slices.Delete(s.order, i, i+1)
+			continue
+		}
+		i++
+	}
+}
+
+// handleRun serves GET /runs/{id}.
+func (s *apiServer) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed on /runs/{id}", r.Method))
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/runs/")
+	s.mu.Lock()
+	run, ok := s.runs[id]
+	var resp apiRun
+	if ok {
+		resp = *run
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("no run %q", id))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, resp)
+}
+
+// runConfigs returns the configuration of the tables req asks for, with
+// its mode and date range applied.
+func (s *apiServer) runConfigs(req apiRunRequest) ([]Config, error) {
+	if req.Mode != apiModeIncremental && req.Mode != apiModeFull && req.Mode != apiModeDryRun {
+		return nil, fmt.Errorf("invalid mode %q: expected incremental, full or dry-run", req.Mode)
+	}
+	for _, d := range []string{req.From, req.To} {
+		if _, err := time.Parse("2006-01-02", d); d != "" && err != nil {
+			return nil, fmt.Errorf("invalid date %q: expected YYYY-MM-DD", d)
+		}
+	}
+
+	all := s.configs()
+	cfgs := all
+	if len(req.Tables) > 0 {
+		cfgs = nil
+		for _, name := range req.Tables {
+			i := slices.IndexFunc(all, func(cfg Config) bool { return cfg.TargetTable == name })
+			if i < 0 {
+				return nil, fmt.Errorf("unknown table %q", name)
+			}
+			cfgs = append(cfgs, all[i])
+		}
+	}
+
+	cfgs = slices.Clone(cfgs)
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		if !cfg.RunTriggerSet {
+			cfg.RunTrigger = triggerAPI
+		}
+		switch req.Mode {
+		case apiModeFull:
+			cfg.RowVersionColumn, cfg.IncrementalColumn, cfg.ChangeTracking = "", "", false
+		case apiModeDryRun:
+			cfg.DryRun = true
+		}
+		if req.From == "" && req.To == "" {
+			continue
+		}
+		switch {
+		case cfg.SourceFilterSpec == "":
+			return nil, fmt.Errorf("a date range needs SOURCE_FILTER to use :from and :to")
+		case cfg.DeleteMissing:
+			return nil, fmt.Errorf("a date range cannot be combined with DELETE_MISSING, which would delete the rows outside it")
+		case cfg.ChangeTracking:
+			return nil, fmt.Errorf("a date range cannot be combined with CHANGE_TRACKING; use mode full")
+		}
+		params := cfg.SourceFilterParams
+		if req.From != "" {
+			params += ";from=" + req.From
+		}
+		if req.To != "" {
+			params += ";to=" + req.To
+		}
+		var err error
+		if cfg.SourceFilter, cfg.SourceFilterArgs, err = parseSourceFilter(cfg.SourceFilterSpec, params, cfg.Source); err != nil {
+			return nil, err
+		}
+	}
+	return cfgs, nil
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Ethiopian calendar has twelve months of 30 days and a thirteenth,
+// Pagume, of five days (six before a leap year, every fourth year). It is
+// seven to eight years behind the Gregorian calendar, and its year starts
+// on Meskerem 1, September 11 or 12. Conversions go through the Julian Day
+// Number; ethiopianEpoch is that of Meskerem 1 of year 1 minus 365.
+const ethiopianEpoch = 1723856
+
+// unixEpochJDN is the Julian Day Number of 1970-01-01.
+const unixEpochJDN = 2440588
+
+// etDate is a date of the Ethiopian calendar.
+type etDate struct {
+	Year, Month, Day int
+}
+
+func (d etDate) String() string {
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+}
+
+func (d etDate) valid() bool {
+	if d.Year < 1 || d.Month < 1 || d.Month > 13 || d.Day < 1 {
+		return false
+	}
+	if d.Month == 13 {
+		days := 5
+		if d.Year%4 == 3 {
+			days = 6
+		}
+		return d.Day <= days
+	}
+	return d.Day <= 30
+}
+
+func (d etDate) jdn() int {
+	return ethiopianEpoch + 365 + 365*(d.Year-1) + d.Year/4 + 30*d.Month + d.Day - 31
+}
+
+func etDateOfJDN(jdn int) etDate {
+	r := (jdn - ethiopianEpoch) % 1461
+	n := r%365 + 365*(r/1460)
+	return etDate{
+		Year:  4*((jdn-ethiopianEpoch)/1461) + r/365 - r/1460,
+		Month: n/30 + 1,
+		Day:   n%30 + 1,
+	}
+}
+
+// toEthiopian converts the calendar date of t, whatever its time zone.
+func toEthiopian(t time.Time) etDate {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return etDateOfJDN(int(day.Unix()/86400) + unixEpochJDN)
+}
+
+func (d etDate) gregorian() time.Time {
+	return time.Unix(int64(d.jdn()-unixEpochJDN)*86400, 0).UTC()
+}
+
+// fiscalYear is the Ethiopian fiscal year, which runs from Hamle 1 (July 8)
+// to Sene 30 (July 7) and is named after the year it ends in, and
+// fiscalQuarter its quarter: Hamle to Meskerem (with Pagume) is the first.
+func (d etDate) fiscalYear() int {
+	if d.Month >= 11 {
+		return d.Year + 1
+	}
+	return d.Year
+}
+
+func (d etDate) fiscalQuarter() int {
+	if d.Month >= 11 || d.Month == 1 {
+		return 1
+	}
+	return (d.Month-2)/3 + 2
+}
+
+// parseEthiopian reads an Ethiopian date written YYYY-MM-DD (or with /).
+func parseEthiopian(s string) (etDate, error) {
+	parts := strings.FieldsFunc(strings.TrimSpace(s), func(r rune) bool { return r == '-' || r == '/' })
+	var d etDate
+	if len(parts) != 3 {
+		return d, fmt.Errorf("invalid Ethiopian date %q: expected YYYY-MM-DD", s)
+	}
+	var err error
+	for i, p := range []*int{&d.Year, &d.Month, &d.Day} {
+		if *p, err = strconv.Atoi(parts[i]); err != nil {
+			return d, fmt.Errorf("invalid Ethiopian date %q: expected YYYY-MM-DD", s)
+		}
+	}
+	if !d.valid() {
+		return d, fmt.Errorf("invalid Ethiopian date %q: no such day", s)
+	}
+	return d, nil
+}
+
+// parseGregorianText reads the date part of a Gregorian date or timestamp
+// read as text: YYYY-MM-DD, optionally followed by a time, as drivers and
+// CSV files write them.
+func parseGregorianText(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > 10 {
+		s = s[:10]
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// calendarFunc makes a transform of a text column that rewrites a date
+// with f. A value f cannot read becomes NULL, with a warning, rather than
+// failing the load.
+func calendarFunc(name string, c column, f func(s string) (string, error)) columnFunc {
+	return func(v any) any {
+		s := v.(*sql.NullString)
+		if !s.Valid {
+			return v
+		}
+		out, err := f(s.String)
+		if err != nil {
+			warnTransform(name, c, err)
+			*s = sql.NullString{}
+			return v
+		}
+		s.String = out
+		return v
+	}
+}
+
+// makeEthiopian converts Gregorian dates to Ethiopian ones, written
+// YYYY-MM-DD. The column is text; its source may be a date column, which
+// is then read as text.
+func makeEthiopian(c column, arg string) (columnFunc, error) {
+	if !c.isText() {
+		return nil, fmt.Errorf("%s is not a text column; Ethiopian dates do not fit a DATE", c.Type)
+	}
+	return calendarFunc("ethiopian", c, func(s string) (string, error) {
+		t, err := parseGregorianText(s)
+		if err != nil {
+			return "", err
+		}
+		return toEthiopian(t).String(), nil
+	}), nil
+}
+
+// makeGregorian converts Ethiopian dates written YYYY-MM-DD to Gregorian
+// ones: into a DATE or TIMESTAMP column, or as YYYY-MM-DD text.
+func makeGregorian(c column, arg string) (columnFunc, error) {
+	switch c.kind() {
+	case kindText:
+		return calendarFunc("gregorian", c, func(s string) (string, error) {
+			d, err := parseEthiopian(s)
+			if err != nil {
+				return "", err
+			}
+			return d.gregorian().Format("2006-01-02"), nil
+		}), nil
+	case kindTime:
+		// The column is read as text (see textInputTransforms).
+		return func(v any) any {
+			s := v.(*sql.NullString)
+			if !s.Valid {
+				return &sql.NullTime{}
+			}
+			d, err := parseEthiopian(s.String)
+			if err != nil {
+				warnTransform("gregorian", c, err)
+				return &sql.NullTime{}
+			}
+			return &sql.NullTime{Time: d.gregorian(), Valid: true}
+		}, nil
+	}
+	return nil, fmt.Errorf("%s is not a text, date or timestamp column", c.Type)
+}
+
+// makeFiscal derives the Ethiopian fiscal year or quarter of a Gregorian
+// date, for a text or integer column whose source is the date column.
+func makeFiscal(quarter bool) columnFuncMaker {
+	name := "fiscal_year"
+	if quarter {
+		name = "fiscal_quarter"
+	}
+	return func(c column, arg string) (columnFunc, error) {
+		if !c.isText() {
+			return nil, fmt.Errorf("%s is not an integer or text column", c.Type)
+		}
+		return calendarFunc(name, c, func(s string) (string, error) {
+			t, err := parseGregorianText(s)
+			if err != nil {
+				return "", err
+			}
+			d := toEthiopian(t)
+			if quarter {
+				return strconv.Itoa(d.fiscalQuarter()), nil
+			}
+			return strconv.Itoa(d.fiscalYear()), nil
+		}), nil
+	}
+}
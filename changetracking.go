@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+// changeRange is what one CHANGE_TRACKING run reads: the rows inserted or
+// updated after version from, and the keys deleted since. full is set on
+// the first run, or when from is older than the change tracking retention,
+// and then the whole table is read and no deletes are known.
+type changeRange struct {
+	from, to int64
+	full     bool
+	deleted  []string // keys as loaded, i.e. transformed
+}
+
+// changeTrackingScope keys the Change Tracking version in etl_watermarks.
+func changeTrackingScope(cfg Config) string {
+	return cfg.TargetTable + ":change_tracking"
+}
+
+// planChangeRange reads the version the last successful run got to and the
+// current one, and collects the keys deleted in between. Changes committed
+// while the run reads may be read already; they come up again next run,
+// where loading them again is harmless.
+func planChangeRange(ctx context.Context, sourceDB, targetDB *sql.DB, cfg Config, cols []column) (*changeRange, error) {
+	exists, err := watermarksReadable(ctx, targetDB, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r := changeRange{full: true}
+	if exists {
+		var stored string
+		err := targetDB.QueryRowContext(ctx, fmt.Sprintf("SELECT value FROM %s WHERE scope = $1 AND value IS NOT NULL", watermarksTableName),
+			changeTrackingScope(cfg)).Scan(&stored)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return nil, fmt.Errorf("failed to read change tracking version: %w", err)
+		default:
+			if r.from, err = strconv.ParseInt(stored, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid change tracking version %q for %s: %w", stored, cfg.TargetTable, err)
+			}
+			r.full = false
+		}
+	}
+
+	var current, minValid sql.NullInt64
+	err = sourceDB.QueryRowContext(ctx, "SELECT CHANGE_TRACKING_CURRENT_VERSION(), CHANGE_TRACKING_MIN_VALID_VERSION(OBJECT_ID(@table))",
+		sql.Named("table", cfg.SourceTable)).Scan(&current, &minValid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source change tracking version: %w", err)
+	}
+	if !current.Valid || !minValid.Valid {
+		return nil, fmt.Errorf("change tracking is not enabled for %s; run ALTER DATABASE ... SET CHANGE_TRACKING = ON and ALTER TABLE %s ENABLE CHANGE_TRACKING", cfg.SourceTable, cfg.SourceTable)
+	}
+	r.to = current.Int64
+
+	switch {
+	case r.full:
+		slog.Info("No change tracking version yet; reading the whole table", "table", cfg.TargetTable, "to", r.to)
+		return &r, nil
+	case r.from < minValid.Int64:
+		slog.Warn("The last synced change tracking version has been cleaned up; reading the whole table, and rows deleted since are not propagated",
+			"table", cfg.TargetTable, "from", r.from, "min_valid", minValid.Int64)
+		r.full = true
+		return &r, nil
+	}
+
+	key := keyOf(cols)
+	rows, err := sourceDB.QueryContext(ctx, fmt.Sprintf(
+		"SELECT ct.%s FROM CHANGETABLE(CHANGES %s, @ctfrom) AS ct WHERE ct.SYS_CHANGE_OPERATION = 'D'", key.Source, cfg.SourceTable),
+		sql.Named("ctfrom", r.from))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deleted keys: %w", err)
+	}
+	defer rows.Close()
+	var stats transformStats
+	for rows.Next() {
+		vals := []any{key.scanDest()}
+		if err := rows.Scan(vals...); err != nil {
+			return nil, fmt.Errorf("failed to read deleted keys: %w", err)
+		}
+		transformRow(cfg, []column{key}, vals, &stats)
+		r.deleted = append(r.deleted, rowKey([]column{key}, vals))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read deleted keys: %w", err)
+	}
+	slog.Info("Reading rows changed since the last change tracking version", "table", cfg.TargetTable, "from", r.from, "to", r.to, "deleted", len(r.deleted))
+	return &r, nil
+}
+
+// changedRowsFilter limits the source read to rows inserted or updated
+// since r.from. Change tracking reports changes by primary key, which must
+// be the mapping's key column.
+func changedRowsFilter(cfg Config, key string) string {
+	return fmt.Sprintf("%s IN (SELECT ct.%s FROM CHANGETABLE(CHANGES %s, @ctfrom) AS ct WHERE ct.SYS_CHANGE_OPERATION <> 'D')",
+		key, key, cfg.SourceTable)
+}
+
+// applyChanges deletes the rows change tracking reported as deleted and
+// stores r.to as the next run's starting version. It runs in the final
+// load transaction.
+func applyChanges(ctx context.Context, target execer, cfg Config, cols []column, r *changeRange) error {
+	deleted, err := deleteKeys(ctx, target, cfg, cols, r.deleted)
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		slog.Info("Deleted rows that were deleted on the source", "table", cfg.TargetTable, "rows", deleted)
+	}
+
+	_, err = target.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s (scope, value) VALUES ($1, $2)
+		ON CONFLICT (scope) DO UPDATE SET value = EXCLUDED.value, updated_at = now()`, watermarksTableName),
+		changeTrackingScope(cfg), strconv.FormatInt(r.to, 10))
+	if err != nil {
+		return fmt.Errorf("failed to save change tracking version: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+const checkpointsTableName = "etl_checkpoints"
+
+func ensureCheckpointsTable(ctx context.Context, db execer) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			table_name VARCHAR(100) PRIMARY KEY,
+			run_id VARCHAR(36) NOT NULL,
+			last_key TEXT NOT NULL,
+			rows_committed BIGINT NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+	`, checkpointsTableName))
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoints table: %w", err)
+	}
+	return nil
+}
+
+// checkpoint records the last fsno of every committed batch, so a run that
+// dies can be resumed after it instead of reading the table from the start.
+// The checkpoint is written in the batch's own transaction and removed when
+// the run completes. All methods are no-ops on a nil receiver.
+type checkpoint struct {
+	cfg    Config
+	runID  string
+	key    column
+	keyIdx int
+	last   any
+}
+
+func newCheckpoint(cfg Config, runID string, cols []column) *checkpoint {
+	c := &checkpoint{cfg: cfg, runID: runID, keyIdx: -1}
+	for i, col := range cols {
+		if col.Key {
+			c.key, c.keyIdx = col, i
+		}
+	}
+	return c
+}
+
+// resumeKey returns the key a failed earlier run got to, or nil if the
+// last run of the table completed.
+func (c *checkpoint) resumeKey(ctx context.Context, db *sql.DB) (any, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if err := ensureCheckpointsTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	var runID, stored string
+	var rows int64
+	err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT run_id, last_key, rows_committed FROM %s WHERE table_name = $1", checkpointsTableName),
+		c.cfg.TargetTable).Scan(&runID, &stored, &rows)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	key, err := parseWatermark(c.key, stored)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %q for %s: %w", stored, c.cfg.TargetTable, err)
+	}
+	slog.Info("Resuming after the checkpoint of a failed run", "table", c.cfg.TargetTable, "failed_run_id", runID, "rows_committed", rows, "after_key", stored)
+	return key, nil
+}
+
+// track remembers the key of a row read from the source, before transforms
+// change it, as the position the next save records.
+func (c *checkpoint) track(vals []any) {
+	if c == nil {
+		return
+	}
+	if v := statValue(c.key, vals[c.keyIdx]); v != nil {
+		c.last = v
+	}
+}
+
+// save records the tracked key as committed. It runs in the transaction
+// that commits the batch.
+func (c *checkpoint) save(ctx context.Context, target execer, rows int) error {
+	if c == nil || c.last == nil {
+		return nil
+	}
+	if err := ensureCheckpointsTable(ctx, target); err != nil {
+		return err
+	}
+	_, err := target.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s (table_name, run_id, last_key, rows_committed) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (table_name) DO UPDATE SET
+			run_id = EXCLUDED.run_id, last_key = EXCLUDED.last_key,
+			rows_committed = EXCLUDED.rows_committed, updated_at = now()`, checkpointsTableName),
+		c.cfg.TargetTable, c.runID, watermarkText(c.last), rows)
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// clear removes the checkpoint once the run has loaded everything.
+func (c *checkpoint) clear(ctx context.Context, target execer) error {
+	if c == nil {
+		return nil
+	}
+	if err := ensureCheckpointsTable(ctx, target); err != nil {
+		return err
+	}
+	if _, err := target.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE table_name = $1", checkpointsTableName), c.cfg.TargetTable); err != nil {
+		return fmt.Errorf("failed to clear checkpoint: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// sourceClock returns the source database's current UTC time. Anything
+// that compares against source timestamps should use this rather than the
+// local clock.
+func sourceClock(ctx context.Context, db *sql.DB, cfg Config) (time.Time, error) {
+	query := "SELECT SYSUTCDATETIME()"
+	switch cfg.Source {
+	case sourceMySQL:
+		query = "SELECT UTC_TIMESTAMP(6)"
+	case sourceOracle:
+		query = "SELECT SYS_EXTRACT_UTC(SYSTIMESTAMP) FROM DUAL"
+	}
+	var now time.Time
+	if err := db.QueryRowContext(ctx, query).Scan(&now); err != nil {
+		return time.Time{}, fmt.Errorf("failed to read source clock: %w", err)
+	}
+	return now.UTC(), nil
+}
+
+// checkClockSkew compares the source clock with the local one. The local
+// reference is the midpoint of the query round-trip, so network latency
+// does not count as skew.
+func checkClockSkew(ctx context.Context, db *sql.DB, cfg Config, force bool) error {
+	before := time.Now()
+	sourceNow, err := sourceClock(ctx, db, cfg)
+	if err != nil {
+		return err
+	}
+	after := time.Now()
+	local := before.Add(after.Sub(before) / 2).UTC()
+
+	skew := sourceNow.Sub(local)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew <= cfg.MaxClockSkew {
+		return nil
+	}
+
+	msg := fmt.Sprintf("clock skew between this host and the source is %v (source %s, local %s), above MAX_CLOCK_SKEW %v",
+		skew.Round(time.Millisecond), sourceNow.Format(time.RFC3339), local.Format(time.RFC3339), cfg.MaxClockSkew)
+	if cfg.ClockSkewAction == clockSkewFail && !force {
+		return fmt.Errorf("%s; fix the clock or rerun with -force", msg)
+	}
+	slog.Warn(msg + "; check NTP on this host")
+	return nil
+}
+
+// Actions for CLOCK_SKEW_ACTION.
+const (
+	clockSkewWarn = "warn"
+	clockSkewFail = "fail"
+)
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// columnFunc changes one scanned value of a column, after the built-in
+// cleanups and before tokenization. It changes v in place and returns it,
+// or returns a new value when it converts to another type.
+type columnFunc func(v any) any
+
+// columnFuncMaker checks a transform's argument against the column it is
+// configured on and returns the function to apply to each value. arg is
+// what follows the name, e.g. "0.0186" in multiply:0.0186, or "".
+type columnFuncMaker func(c column, arg string) (columnFunc, error)
+
+// columnFuncs holds the transforms COLUMN_TRANSFORMS and the transform list
+// of a mapping file can name.
+var columnFuncs = map[string]columnFuncMaker{
+	"trim":     textFunc(func(s, _ string) string { return strings.TrimSpace(s) }),
+	"upper":    textFunc(func(s, _ string) string { return strings.ToUpper(s) }),
+	"lower":    textFunc(func(s, _ string) string { return strings.ToLower(s) }),
+	"nullif":   makeNullIf,
+	"default":  makeDefault,
+	"multiply": makeMultiply,
+	"round":    makeRound,
+	"truncate": makeTruncate,
+	"convert":  makeConvert,
+	"hash":     makeHash,
+	"mask":     makeMask,
+
+	"ethiopian":      makeEthiopian,
+	"gregorian":      makeGregorian,
+	"fiscal_year":    makeFiscal(false),
+	"fiscal_quarter": makeFiscal(true),
+}
+
+// textInputTransforms read the source value as text whatever the column's
+// type, so they must come first on a column that is not text.
+var textInputTransforms = map[string]bool{"gregorian": true}
+
+var transformWarned sync.Map
+
+// warnTransform logs the first value of a column a transform could not
+// convert, so a bad column does not flood the log.
+func warnTransform(name string, c column, err error) {
+	if _, seen := transformWarned.LoadOrStore(c.Target+" "+name, true); !seen {
+		slog.Warn("Transform could not convert a value and wrote NULL; further failures on this column are not logged", "transform", name, "column", c.Target, "error", err)
+	}
+}
+
+// registerTransform makes a transform available under name. Go plugins are
+// not portable enough to ship, so custom transforms are compiled in: call
+// registerTransform from an init function in a file of your own.
+func registerTransform(name string, maker columnFuncMaker) {
+	if _, ok := columnFuncs[name]; ok {
+		panic("transform " + name + " is registered twice")
+	}
+	columnFuncs[name] = maker
+}
+
+// applyColumnTransforms adds the transforms of COLUMN_TRANSFORMS, entries
+// like region=trim,upper;net_pay=multiply:0.0186,round:2, to those already
+// on the columns.
+func applyColumnTransforms(cols []column, spec string) error {
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		target, list, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid COLUMN_TRANSFORMS entry %q: expected column=transform1,transform2", entry)
+		}
+		var names []string
+		for _, name := range strings.Split(list, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		err := markColumns(cols, strings.TrimSpace(target), "COLUMN_TRANSFORMS", func(c *column) {
+			c.Transforms = append(c.Transforms, names...)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compileTransforms resolves the transforms named on each column, so that
+// an unknown name or a bad argument stops the run before it reads a row.
+// salt keys the hash and mask transforms.
+func compileTransforms(cols []column, salt string) error {
+	for i := range cols {
+		c := &cols[i]
+		c.funcs, c.scanText, c.salt = nil, false, salt
+		for j, t := range c.Transforms {
+			if c.Generated != "" || c.computed() {
+				return fmt.Errorf("column %s is not read from the source and cannot be transformed", c.Target)
+			}
+			name, arg, _ := strings.Cut(t, ":")
+			maker, ok := columnFuncs[name]
+			if !ok {
+				return fmt.Errorf("unknown transform %q on column %s: expected one of %s", name, c.Target, strings.Join(transformNames(), ", "))
+			}
+			fn, err := maker(*c, arg)
+			if err != nil {
+				return fmt.Errorf("invalid transform %q on column %s: %w", t, c.Target, err)
+			}
+			if textInputTransforms[name] && !c.isText() {
+				if j > 0 {
+					return fmt.Errorf("transform %s must come first on column %s", name, c.Target)
+				}
+				c.scanText = true
+			}
+			c.funcs = append(c.funcs, fn)
+		}
+
+		// The NULL policy sees the value after the transforms, so that
+		// e.g. nullif:N/A then default:UNKNOWN replaces both.
+		kind, value, err := parseNullPolicy(c.OnNull)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", c.Target, err)
+		}
+		if kind == nullKeep {
+			continue
+		}
+		if c.Key || c.Generated != "" || c.computed() {
+			return fmt.Errorf("column %s cannot have a NULL policy: it is the key or not read from the source", c.Target)
+		}
+		if kind == nullDefault {
+			fn, err := makeNullDefault(*c, value)
+			if err != nil {
+				return fmt.Errorf("invalid NULL default of column %s: %w", c.Target, err)
+			}
+			c.funcs = append(c.funcs, fn)
+		}
+	}
+	return nil
+}
+
+// usesTransform reports whether any column applies the transform name.
+func usesTransform(cols []column, name string) bool {
+	for _, c := range cols {
+		for _, t := range c.Transforms {
+			if n, _, _ := strings.Cut(t, ":"); n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func transformNames() []string {
+	names := make([]string, 0, len(columnFuncs))
+	for name := range columnFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// textFunc makes a transform of text columns out of f. NULL stays NULL.
+func textFunc(f func(s, arg string) string) columnFuncMaker {
+	return func(c column, arg string) (columnFunc, error) {
+		if !c.isText() {
+			return nil, fmt.Errorf("%s is not a text column", c.Type)
+		}
+		return func(v any) any {
+			if s := v.(*sql.NullString); s.Valid {
+				s.String = f(s.String, arg)
+			}
+			return v
+		}, nil
+	}
+}
+
+// makeNullIf turns the text arg into NULL, e.g. nullif:N/A. Without an
+// argument it matches the empty string.
+func makeNullIf(c column, arg string) (columnFunc, error) {
+	if !c.isText() {
+		return nil, fmt.Errorf("%s is not a text column", c.Type)
+	}
+	return func(v any) any {
+		if s := v.(*sql.NullString); s.Valid && s.String == arg {
+			*s = sql.NullString{}
+		}
+		return v
+	}, nil
+}
+
+// makeDefault replaces NULL with arg, e.g. default:Unknown.
+func makeDefault(c column, arg string) (columnFunc, error) {
+	if !c.isText() {
+		return nil, fmt.Errorf("%s is not a text column", c.Type)
+	}
+	return func(v any) any {
+		if s := v.(*sql.NullString); !s.Valid {
+			*s = sql.NullString{String: arg, Valid: true}
+		}
+		return v
+	}, nil
+}
+
+// makeMultiply multiplies a numeric column by a constant, e.g. a currency
+// conversion rate. Raw numerics are multiplied exactly.
+func makeMultiply(c column, arg string) (columnFunc, error) {
+	if c.kind() != kindNumeric {
+		return nil, fmt.Errorf("%s is not a numeric column", c.Type)
+	}
+	factor, ok := new(big.Rat).SetString(arg)
+	if !ok {
+		return nil, fmt.Errorf("expected a number, e.g. multiply:0.0186")
+	}
+	f, _ := factor.Float64()
+	return numericFunc(
+		func(x float64) float64 { return x * f },
+		func(r *big.Rat) string { return r.Mul(r, factor).FloatString(numericScale(c) + 6) },
+	), nil
+}
+
+// makeRound rounds a numeric column to arg decimal places, halves away
+// from zero.
+func makeRound(c column, arg string) (columnFunc, error) {
+	if c.kind() != kindNumeric {
+		return nil, fmt.Errorf("%s is not a numeric column", c.Type)
+	}
+	places, err := strconv.Atoi(arg)
+	if err != nil || places < 0 {
+		return nil, fmt.Errorf("expected a number of decimal places, e.g. round:2")
+	}
+	scale := math.Pow10(places)
+	return numericFunc(
+		func(x float64) float64 { return math.Round(x*scale) / scale },
+		func(r *big.Rat) string { return r.FloatString(places) },
+	), nil
+}
+
+// numericFunc applies a numeric transform to either scan form of a
+// numeric column.
+func numericFunc(float func(float64) float64, raw func(*big.Rat) string) columnFunc {
+	return func(v any) any {
+		switch v := v.(type) {
+		case *sql.NullFloat64:
+			if v.Valid {
+				v.Float64 = float(v.Float64)
+			}
+		case *sql.NullString:
+			// The driver's text form always parses; anything else is left
+			// for Postgres to reject.
+			if r, ok := new(big.Rat).SetString(v.String); v.Valid && ok {
+				v.String = raw(r)
+			}
+		}
+		return v
+	}
+}
+
+// numericScale returns the declared scale of a NUMERIC(p,s) column, or 0.
+func numericScale(c column) int {
+	if m := numericTypeRe.FindStringSubmatch(c.Type); m != nil && m[2] != "" {
+		s, _ := strconv.Atoi(m[2])
+		return s
+	}
+	return 0
+}
+
+// makeTruncate normalizes dates and timestamps to the start of the hour,
+// day, month or year, e.g. truncate:month for monthly reporting.
+func makeTruncate(c column, arg string) (columnFunc, error) {
+	if c.kind() != kindTime {
+		return nil, fmt.Errorf("%s is not a date or timestamp column", c.Type)
+	}
+	var trunc func(t time.Time) time.Time
+	switch arg {
+	case "hour":
+		trunc = func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		}
+	case "day":
+		trunc = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()) }
+	case "month":
+		trunc = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()) }
+	case "year":
+		trunc = func(t time.Time) time.Time { return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location()) }
+	default:
+		return nil, fmt.Errorf("expected hour, day, month or year, e.g. truncate:month")
+	}
+	return func(v any) any {
+		if t := v.(*sql.NullTime); t.Valid {
+			t.Time = trunc(t.Time)
+		}
+		return v
+	}, nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// column maps one source column onto its target column in SalesDB.
+type column struct {
+	Source string // source column or expression; empty for generated columns
+	Target string
+	Type   string // PostgreSQL type
+
+	// Generated holds the expression of a GENERATED ALWAYS AS (...) STORED
+	// column. Postgres computes those itself, so they are never inserted.
+	Generated string
+
+	// Encrypted columns are stored as BYTEA via pgcrypto's pgp_sym_encrypt.
+	Encrypted bool
+
+	// Tokenized columns are replaced with a keyed, format-preserving token.
+	Tokenized bool
+
+	// RawNumeric numeric columns are read in the driver's text form and
+	// passed to Postgres unchanged, so no value goes through a float64.
+	RawNumeric bool
+
+	// Sequence columns are not read from the source; the ETL numbers the
+	// rows of a run in read order instead (LOAD_SEQ).
+	Sequence bool
+
+	// RowHash marks the ROW_HASH column, which the ETL fills with a hash of
+	// the row's other columns instead of reading it.
+	RowHash bool
+
+	// Key marks the column that identifies a row: the target's primary key,
+	// used for conflict handling, and the order the source is read in.
+	Key bool
+
+	// Transforms names the column functions applied to every value, in
+	// order, e.g. "trim" or "multiply:0.0186" (COLUMN_TRANSFORMS).
+	Transforms []string
+	funcs      []columnFunc // compiled from Transforms and OnNull
+	scanText   bool         // read as text for a transform that parses it
+	salt       string       // MASKING_SALT, for the hash and mask transforms
+
+	// OnNull is the column's NULL policy: keep (or empty), reject, or
+	// default:value (NULL_POLICIES, or on_null in the mapping file).
+	OnNull string
+}
+
+// loadSeqColumn is the column added by LOAD_SEQ. Its source is a NULL
+// placeholder so the read and scan stay aligned with the column list.
+var loadSeqColumn = column{Source: "NULL", Target: "load_seq", Type: "BIGINT", Sequence: true}
+
+// rowHashColumn is the column added by ROW_HASH, a NULL placeholder in the
+// read like loadSeqColumn.
+func rowHashColumn(name string) column {
+	return column{Source: "NULL", Target: name, Type: fmt.Sprintf("CHAR(%d)", hashLength), RowHash: true}
+}
+
+// computed reports whether the ETL fills c itself rather than reading it
+// from the source: LOAD_SEQ and ROW_HASH.
+func (c column) computed() bool {
+	return c.Sequence || c.RowHash
+}
+
+// salesColumns is the default Sales -> SalesDB mapping.
+var salesColumns = []column{
+	{Source: "fsno", Target: "fsno", Type: "VARCHAR(50)", Key: true},
+	{Source: "salestype", Target: "salestype", Type: "VARCHAR(50)"},
+	{Source: "attachmentno", Target: "attachmentno", Type: "VARCHAR(50)"},
+	{Source: "customer", Target: "customer", Type: "VARCHAR(100)"},
+	{Source: "region", Target: "region", Type: "VARCHAR(50)"},
+	{Source: "date", Target: "sale_date", Type: "DATE"},
+	{Source: "code", Target: "code", Type: "VARCHAR(50)"},
+	{Source: "name", Target: "item_name", Type: "VARCHAR(100)"},
+	{Source: "measurementunit", Target: "measurement_unit", Type: "VARCHAR(50)"},
+	{Source: "unitprice", Target: "unit_price", Type: "NUMERIC(12, 2)"},
+	{Source: "soldquantity", Target: "sold_quantity", Type: "NUMERIC(12, 2)"},
+	{Source: "netpay", Target: "net_pay", Type: "NUMERIC(12, 2)"},
+}
+
+// parseGeneratedColumns reads GENERATED_COLUMNS, a ';' separated list of
+// "name TYPE AS (expression)" entries.
+func parseGeneratedColumns(spec string) ([]column, error) {
+	var cols []column
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		idx := strings.Index(strings.ToUpper(entry), " AS ")
+		if idx < 0 {
+			return nil, fmt.Errorf("invalid generated column %q: expected \"name TYPE AS (expression)\"", entry)
+		}
+		def := strings.Fields(entry[:idx])
+		expr := strings.TrimSpace(entry[idx+len(" AS "):])
+		if len(def) < 2 || !strings.HasPrefix(expr, "(") || !strings.HasSuffix(expr, ")") {
+			return nil, fmt.Errorf("invalid generated column %q: expected \"name TYPE AS (expression)\"", entry)
+		}
+		cols = append(cols, column{
+			Target:    def[0],
+			Type:      strings.Join(def[1:], " "),
+			Generated: expr[1 : len(expr)-1],
+		})
+	}
+	return cols, nil
+}
+
+// applyCoalesceSources reads COALESCE_SOURCES, a ';' separated list of
+// "target=source1,source2,..." entries, and makes each target take the
+// first non-null of its source columns, in the order given.
+func applyCoalesceSources(cols []column, spec string) error {
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		target, list, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid COALESCE_SOURCES entry %q: expected target=source1,source2", entry)
+		}
+		var sources []string
+		for _, src := range strings.Split(list, ",") {
+			if src = strings.TrimSpace(src); src != "" {
+				sources = append(sources, src)
+			}
+		}
+		if len(sources) == 0 {
+			return fmt.Errorf("invalid COALESCE_SOURCES entry %q: no source columns", entry)
+		}
+
+		target = strings.TrimSpace(target)
+		err := markColumns(cols, target, "COALESCE_SOURCES", func(c *column) {
+			c.Source = "COALESCE(" + strings.Join(sources, ", ") + ")"
+			if len(sources) == 1 {
+				c.Source = sources[0]
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markColumns calls set on every column named in spec, a comma separated
+// list of target column names taken from the option env var.
+func markColumns(cols []column, spec, option string, set func(*column)) error {
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for i := range cols {
+			if cols[i].Target == name && cols[i].Generated == "" {
+				set(&cols[i])
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown column %q in %s", name, option)
+		}
+	}
+	return nil
+}
+
+// markEncrypted flags the ENCRYPTED_COLUMNS for pgcrypto encryption.
+func markEncrypted(cols []column, spec string) error {
+	key := keyOf(cols).Target
+	for _, name := range strings.Split(spec, ",") {
+		if strings.TrimSpace(name) == key {
+			return fmt.Errorf("key column %s cannot be encrypted", key)
+		}
+	}
+	return markColumns(cols, spec, "ENCRYPTED_COLUMNS", func(c *column) { c.Encrypted = true })
+}
+
+func hasEncrypted(cols []column) bool {
+	for _, c := range cols {
+		if c.Encrypted {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTokenized(cols []column) bool {
+	for _, c := range cols {
+		if c.Tokenized {
+			return true
+		}
+	}
+	return false
+}
+
+// targetType is the column type used in the target DDL.
+func (c column) targetType() string {
+	if c.Encrypted {
+		return "BYTEA"
+	}
+	return c.Type
+}
+
+// sequenceIndex returns the position of the LOAD_SEQ column in cols, or -1.
+func sequenceIndex(cols []column) int {
+	for i, c := range cols {
+		if c.Sequence {
+			return i
+		}
+	}
+	return -1
+}
+
+// insertColumns returns the columns the ETL reads and inserts, i.e. all
+// columns except generated ones.
+func insertColumns(cols []column) []column {
+	var out []column
+	for _, c := range cols {
+		if c.Generated == "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Column kinds, derived from the target type.
+const (
+	kindText = iota
+	kindTime
+	kindNumeric
+)
+
+func (c column) kind() int {
+	t := strings.ToUpper(c.Type)
+	switch {
+	case c.Sequence:
+		return kindNumeric
+	case strings.HasPrefix(t, "DATE"), strings.HasPrefix(t, "TIMESTAMP"):
+		return kindTime
+	case strings.HasPrefix(t, "NUMERIC"), strings.HasPrefix(t, "DECIMAL"),
+		strings.HasPrefix(t, "DOUBLE"), strings.HasPrefix(t, "REAL"):
+		return kindNumeric
+	default:
+		return kindText
+	}
+}
+
+func (c column) isText() bool {
+	return c.kind() == kindText
+}
+
+// scanDest returns a nullable destination matching the column's target type.
+func (c column) scanDest() any {
+	if c.Sequence {
+		return new(sql.NullInt64)
+	}
+	if c.scanText {
+		return new(sql.NullString)
+	}
+	switch c.kind() {
+	case kindTime:
+		return new(sql.NullTime)
+	case kindNumeric:
+		if c.RawNumeric {
+			return new(sql.NullString)
+		}
+		return new(sql.NullFloat64)
+	default:
+		return new(sql.NullString)
+	}
+}
+
+// keyOf returns the key column of a mapping.
+func keyOf(cols []column) column {
+	for _, c := range cols {
+		if c.Key {
+			return c
+		}
+	}
+	return column{}
+}
+
+// rowKey returns the key column value of a scanned row as text, for log
+// messages and deduplication.
+func rowKey(cols []column, vals []any) string {
+	for i, c := range cols {
+		if c.Key {
+			if v := jsonValue(c, vals[i]); v != nil {
+				return fmt.Sprint(v)
+			}
+		}
+	}
+	return ""
+}
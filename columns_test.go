@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestGeneratedColumns checks that a GENERATED_COLUMNS entry is created as
+// a stored generated column and left out of the INSERT.
+func TestGeneratedColumns(t *testing.T) {
+	generated, err := parseGeneratedColumns("total NUMERIC(14, 2) AS (unit_price * sold_quantity)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{TargetTable: "sales", Columns: append(append([]column{}, salesColumns...), generated...)}
+
+	ddl := targetTableDDL(cfg)
+	if want := "total NUMERIC(14, 2) GENERATED ALWAYS AS (unit_price * sold_quantity) STORED"; !strings.Contains(ddl, want) {
+		t.Errorf("DDL does not define %q:\n%s", want, ddl)
+	}
+
+	insertSQL := buildInsertSQL(cfg, insertColumns(cfg.Columns))
+	open, end := strings.Index(insertSQL, "("), strings.Index(insertSQL, ")")
+	if open < 0 || end < open {
+		t.Fatalf("INSERT has no column list:\n%s", insertSQL)
+	}
+	list := strings.Split(insertSQL[open+1:end], ", ")
+	if len(list) != len(salesColumns) {
+		t.Errorf("INSERT lists %d columns, want %d: %v", len(list), len(salesColumns), list)
+	}
+	for _, name := range list {
+		if name == "total" {
+			t.Errorf("INSERT lists the generated column: %v", list)
+		}
+	}
+}
+
+func TestApplyCoalesceSources(t *testing.T) {
+	cols := append([]column{}, salesColumns...)
+	if err := applyCoalesceSources(cols, "sale_date=date, posting_date ,entry_date; customer=client"); err != nil {
+		t.Fatal(err)
+	}
+	byTarget := map[string]column{}
+	for _, c := range cols {
+		byTarget[c.Target] = c
+	}
+	if got, want := byTarget["sale_date"].Source, "COALESCE(date, posting_date, entry_date)"; got != want {
+		t.Errorf("sale_date source = %q, want %q", got, want)
+	}
+	if got, want := byTarget["customer"].Source, "client"; got != want {
+		t.Errorf("customer source = %q, want %q", got, want)
+	}
+	if got, want := strings.Join(mappedSourceNames(byTarget["sale_date"]), ","), "date,posting_date,entry_date"; got != want {
+		t.Errorf("sale_date reads %s, want %s", got, want)
+	}
+
+	for _, spec := range []string{"sale_date", "sale_date=", "no_such_column=date"} {
+		if err := applyCoalesceSources(append([]column{}, salesColumns...), spec); err == nil {
+			t.Errorf("COALESCE_SOURCES=%q was accepted", spec)
+		}
+	}
+}
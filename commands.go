@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Subcommands. run is the default when none is given, so existing
+// invocations keep loading.
+const (
+	cmdRun      = "run"
+	cmdValidate = "validate"
+	cmdSchema   = "schema"
+	cmdStatus   = "status"
+	cmdServe    = "serve"
+	cmdService  = "service"
+)
+
+var commands = []string{cmdRun, cmdValidate, cmdSchema, cmdStatus, cmdServe, cmdService}
+
+// splitCommand takes the subcommand off the command line, leaving the flags.
+func splitCommand(args []string) (string, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return cmdRun, args, nil
+	}
+	for _, c := range commands {
+		if args[0] == c {
+			return c, args[1:], nil
+		}
+	}
+	return "", nil, fmt.Errorf("unknown command %q: expected %s", args[0], strings.Join(commands, ", "))
+}
+
+// printSchema prints the DDL the run would apply to the target, without
+// connecting to it.
+func printSchema(cfgs []Config) {
+	for _, cfg := range cfgs {
+		fmt.Printf("-- %s\n", cfg.TargetTable)
+		fmt.Println(strings.TrimSpace(targetTableDDL(cfg)) + "\n")
+		if cfg.ConflictAction == conflictSCD2 {
+			fmt.Printf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s TIMESTAMPTZ NOT NULL DEFAULT now();\n\n", cfg.TargetTable, cfg.ValidFromColumn)
+			fmt.Println(strings.TrimSpace(historyTableDDL(cfg, cfg.Columns)) + "\n")
+		}
+	}
+}
+
+// printStatus prints the last run and the current lease of every table.
+func printStatus(ctx context.Context, db *sql.DB, cfgs []Config) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TABLE\tLAST RUN\tSTATUS\tSTARTED\tDURATION\tROWS\tLEASE")
+	var failures []string
+	for _, cfg := range cfgs {
+		run, err := lastRun(ctx, db, cfg.TargetTable)
+		if err != nil {
+			return err
+		}
+		owner, expires, err := leaseHolder(ctx, db, cfg.TargetTable)
+		if err != nil {
+			return err
+		}
+		lease := "-"
+		if owner != "" {
+			lease = fmt.Sprintf("%s until %s", owner, expires.Format(time.RFC3339))
+		}
+
+		if run == nil {
+			fmt.Fprintf(tw, "%s\t-\tnever run\t-\t-\t-\t%s\n", cfg.TargetTable, lease)
+			continue
+		}
+		duration, rows := "-", "-"
+		if run.Finished.Valid {
+			duration = run.Finished.Time.Sub(run.Started).Round(time.Second).String()
+		}
+		if run.Rows.Valid {
+			rows = fmt.Sprint(run.Rows.Int64)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", cfg.TargetTable, run.RunID, run.Status,
+			run.Started.Format(time.RFC3339), duration, rows, lease)
+		if run.Error.Valid {
+			failures = append(failures, fmt.Sprintf("%s: %s", cfg.TargetTable, run.Error.String))
+		}
+	}
+	tw.Flush()
+	for _, f := range failures {
+		fmt.Println(f)
+	}
+	return nil
+}
+
+// keyTotals summarizes the key column of one side: the row count and an
+// order-independent checksum, the sum of the FNV-1a hashes of the keys.
+type keyTotals struct {
+	Rows     int64
+	Checksum uint64
+}
+
+func sumKeys(rows sourceRows, key column, transform func([]any)) (keyTotals, error) {
+	defer rows.Close()
+	var t keyTotals
+	for rows.Next() {
+		vals := []any{key.scanDest()}
+		if err := rows.Scan(vals...); err != nil {
+			return t, err
+		}
+		transform(vals)
+		h := fnv.New64a()
+		h.Write([]byte(rowKey([]column{key}, vals)))
+		t.Rows++
+		t.Checksum += h.Sum64()
+	}
+	return t, rows.Err()
+}
+
+// validateTable compares the keys of the source and the target table, and
+// for an MSSQL source the column aggregates of reconcileColumns. The source
+// keys go through the same transforms as a load, so a tokenized or
+// sanitized key matches what was written.
+func validateTable(ctx context.Context, sourceDB, targetDB *sql.DB, cfg Config) (bool, error) {
+	key := keyOf(cfg.Columns)
+	key.Key = true
+
+	var src sourceRows
+	var err error
+	if cfg.Source == sourceCSV {
+		src, err = openCSVRows(cfg, []column{key})
+	} else {
+		where, args := filterClause(cfg)
+		src, err = sourceDB.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s%s", key.Source, cfg.SourceTable, where), args...)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read source keys: %w", err)
+	}
+	var stats transformStats
+	source, err := sumKeys(src, key, func(vals []any) { transformRow(cfg, []column{key}, vals, &stats) })
+	if err != nil {
+		return false, fmt.Errorf("failed to read source keys: %w", err)
+	}
+
+	dst, err := targetDB.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s", key.Target, cfg.TargetTable))
+	if err != nil {
+		return false, fmt.Errorf("failed to read target keys: %w", err)
+	}
+	target, err := sumKeys(dst, key, func([]any) {})
+	if err != nil {
+		return false, fmt.Errorf("failed to read target keys: %w", err)
+	}
+
+	// Column aggregates are computed in SQL, which a CSV source has none of.
+	var checks []columnCheck
+	if cfg.Source == sourceMSSQL {
+		if checks, err = reconcileColumns(ctx, sourceDB, targetDB, cfg); err != nil {
+			return false, err
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tROWS\tKEY CHECKSUM\n", cfg.TargetTable)
+	fmt.Fprintf(tw, "source (%s)\t%d\t%016x\n", sourceName(cfg), source.Rows, source.Checksum)
+	fmt.Fprintf(tw, "target\t%d\t%016x\n", target.Rows, target.Checksum)
+	var differing []string
+	if len(checks) > 0 {
+		fmt.Fprintf(tw, "\nCOLUMN\tCHECK\tSOURCE\tTARGET\t\n")
+		for _, c := range checks {
+			mark := ""
+			if !c.matches() {
+				mark = "DIFFERS"
+				differing = append(differing, c.column+" "+c.check)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", c.column, c.check, orNULL(c.source), orNULL(c.target), mark)
+		}
+	}
+	tw.Flush()
+
+	ok := true
+	if source != target {
+		what := "the same rows but different keys"
+		if source.Rows != target.Rows {
+			what = fmt.Sprintf("%d rows where the source has %d", target.Rows, source.Rows)
+		}
+		slog.Warn("Target does not match its source: it has "+what, "table", cfg.TargetTable)
+		ok = false
+	}
+	if len(differing) > 0 {
+		slog.Warn("Target columns do not match their source", "table", cfg.TargetTable, "checks", strings.Join(differing, ", "))
+		ok = false
+	}
+	if ok {
+		slog.Info("Target matches its source", "table", cfg.TargetTable, "rows", source.Rows, "column_checks", len(checks))
+	}
+	return ok, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the layout of the optional YAML config file. It covers the
+// settings that differ between environments; anything else can be given
+// under settings by its environment variable name.
+type fileConfig struct {
+	Source struct {
+		Type   string `yaml:"type"`
+		Conn   string `yaml:"conn"`
+		Table  string `yaml:"table"`
+		Filter string `yaml:"filter"`
+	} `yaml:"source"`
+	Target struct {
+		Conn  string `yaml:"conn"`
+		Table string `yaml:"table"`
+	} `yaml:"target"`
+	BatchSize int               `yaml:"batch_size"`
+	Key       string            `yaml:"key"`
+	Columns   []fileColumn      `yaml:"columns"`
+	Discover  bool              `yaml:"discover"`
+	Tables    []fileTable       `yaml:"tables"`
+	Settings  map[string]string `yaml:"settings"`
+}
+
+// fileTable is one entry of tables, for loading several tables per run.
+type fileTable struct {
+	SourceTable string       `yaml:"source_table"`
+	TargetTable string       `yaml:"target_table"`
+	Key         string       `yaml:"key"`
+	Columns     []fileColumn `yaml:"columns"`
+	Discover    bool         `yaml:"discover"`
+	DDL         string       `yaml:"ddl"`
+}
+
+type fileColumn struct {
+	Source    string   `yaml:"source"`
+	Target    string   `yaml:"target"`
+	Type      string   `yaml:"type"`
+	Transform []string `yaml:"transform"`
+	OnNull    string   `yaml:"on_null"`
+}
+
+// tableSpec is what differs between the tables of one run. Empty table
+// names leave them to SOURCE_TABLE and TARGET_TABLE. With Discover set,
+// Columns is read from the source table once its name is known, with Key
+// (a source or target column name, or empty for the primary key) as the
+// key column.
+type tableSpec struct {
+	SourceTable string
+	TargetTable string
+	Columns     []column
+	Discover    bool
+	Key         string
+	DDL         string
+}
+
+// readConfigFile parses the YAML config file at path.
+func readConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var fc fileConfig
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return &fc, nil
+}
+
+// applyEnv makes the file's values the defaults of the matching environment
+// variables. Like .env files, it never overrides a variable that is already
+// set, so the environment can still adjust a single setting.
+func (fc *fileConfig) applyEnv() {
+	connVar := "MSSQL_CONN"
+	switch fc.Source.Type {
+	case sourceMySQL:
+		connVar = "MYSQL_CONN"
+	case sourceOracle:
+		connVar = "ORACLE_CONN"
+	}
+	values := map[string]string{
+		"SOURCE":        fc.Source.Type,
+		connVar:         fc.Source.Conn,
+		"SOURCE_TABLE":  fc.Source.Table,
+		"SOURCE_FILTER": fc.Source.Filter,
+		"POSTGRES_CONN": fc.Target.Conn,
+		"TARGET_TABLE":  fc.Target.Table,
+	}
+	if fc.BatchSize != 0 {
+		values["BATCH_SIZE"] = strconv.Itoa(fc.BatchSize)
+	}
+	for k, v := range fc.Settings {
+		values[strings.ToUpper(k)] = v
+	}
+	for k, v := range values {
+		if _, set := os.LookupEnv(k); !set && v != "" {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+// tables returns the tables the file asks to load: the entries of tables,
+// or a single table using the top-level columns (the built-in mapping if
+// there are none).
+func (fc *fileConfig) tables() ([]tableSpec, error) {
+	if len(fc.Tables) == 0 {
+		if fc.Discover {
+			if len(fc.Columns) > 0 {
+				return nil, fmt.Errorf("config file: set either columns or discover, not both")
+			}
+			return []tableSpec{{Discover: true, Key: fc.Key}}, nil
+		}
+		if len(fc.Columns) == 0 {
+			spec, err := builtinTable()
+			return []tableSpec{spec}, err
+		}
+		cols, err := fileMapping(fc.Columns, fc.Key)
+		if err != nil {
+			return nil, err
+		}
+		return []tableSpec{{Columns: cols}}, nil
+	}
+
+	if len(fc.Columns) > 0 || fc.Discover {
+		return nil, fmt.Errorf("config file: put columns and discover under each entry of tables")
+	}
+	specs := make([]tableSpec, len(fc.Tables))
+	for i, t := range fc.Tables {
+		if t.SourceTable == "" || t.TargetTable == "" {
+			return nil, fmt.Errorf("config file table %d needs source_table and target_table", i+1)
+		}
+		if t.Discover {
+			if len(t.Columns) > 0 {
+				return nil, fmt.Errorf("config file table %s: set either columns or discover, not both", t.TargetTable)
+			}
+			specs[i] = tableSpec{SourceTable: t.SourceTable, TargetTable: t.TargetTable, Discover: true, Key: t.Key, DDL: t.DDL}
+			continue
+		}
+		cols, err := fileMapping(t.Columns, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("config file table %s: %w", t.TargetTable, err)
+		}
+		specs[i] = tableSpec{SourceTable: t.SourceTable, TargetTable: t.TargetTable, Columns: cols, DDL: t.DDL}
+	}
+	return specs, nil
+}
+
+// builtinTable is the table loaded when no mapping is configured: the Sales
+// mapping, or with DISCOVER_COLUMNS the columns SOURCE_TABLE has.
+func builtinTable() (tableSpec, error) {
+	discover, err := envBool("DISCOVER_COLUMNS", false)
+	if err != nil || !discover {
+		return tableSpec{Columns: salesColumns}, err
+	}
+	return tableSpec{Discover: true}, nil
+}
+
+// fileMapping converts a column list from the file, marking key (a target
+// column, fsno if empty) as the key column.
+func fileMapping(fcols []fileColumn, key string) ([]column, error) {
+	if key == "" {
+		key = "fsno"
+	}
+	if len(fcols) == 0 {
+		return nil, fmt.Errorf("no columns")
+	}
+	cols := make([]column, len(fcols))
+	hasKey := false
+	for i, c := range fcols {
+		if c.Source == "" || c.Target == "" || c.Type == "" {
+			return nil, fmt.Errorf("column %d needs source, target and type", i+1)
+		}
+		cols[i] = column{Source: c.Source, Target: c.Target, Type: c.Type, Key: c.Target == key, Transforms: c.Transform, OnNull: c.OnNull}
+		hasKey = hasKey || cols[i].Key
+	}
+	if !hasKey {
+		return nil, fmt.Errorf("the key column %s is not in the columns", key)
+	}
+	return cols, nil
+}
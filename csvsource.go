@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Sources for SOURCE.
+const (
+	sourceMSSQL = "mssql"
+	// sourceMySQL reads the table from MySQL or MariaDB, for the branch
+	// systems that do not run SQL Server.
+	sourceMySQL = "mysql"
+	// sourceOracle reads the table from Oracle, for the legacy finance
+	// system.
+	sourceOracle = "oracle"
+	// sourceCSV reads a CSV extract (optionally gzip-compressed) instead of
+	// the Sales table, for partners who deliver dumps rather than access.
+	sourceCSV = "csv"
+)
+
+// sourceName names what the run reads from, for logs and lineage.
+func sourceName(cfg Config) string {
+	if cfg.Source == sourceCSV {
+		return cfg.SourceFile
+	}
+	return cfg.SourceTable
+}
+
+// parseCSVColumns reads CSV_COLUMNS, a comma-separated list of
+// "header=source" pairs mapping CSV headers onto the source column names of
+// the mapping (fsno, date, name, ...). Unlisted columns are matched by name.
+func parseCSVColumns(spec string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		header, source, ok := strings.Cut(pair, "=")
+		header, source = strings.TrimSpace(header), strings.TrimSpace(source)
+		if !ok || header == "" || source == "" {
+			return nil, fmt.Errorf("invalid CSV_COLUMNS entry %q: expected header=column", pair)
+		}
+		m[strings.ToLower(source)] = header
+	}
+	return m, nil
+}
+
+// parseDelimiter reads CSV_DELIMITER: a single character, or "tab".
+func parseDelimiter(v string) (rune, error) {
+	if strings.EqualFold(v, "tab") || v == `\t` {
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(v)
+	if size != len(v) || r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		return 0, fmt.Errorf("invalid CSV_DELIMITER %q: expected a single character", v)
+	}
+	return r, nil
+}
+
+// csvRows reads the source rows from a CSV file. Fields are matched to
+// cols by header, parsed into the scan destinations the way the driver
+// would fill them, and empty fields are NULL.
+type csvRows struct {
+	file   *os.File
+	gz     *gzip.Reader
+	reader *csv.Reader
+	fields []int // CSV field index per column, -1 for none
+	record []string
+	line   int
+	err    error
+}
+
+func openCSVRows(cfg Config, cols []column) (*csvRows, error) {
+	f, err := os.Open(cfg.SourceFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source file: %w", err)
+	}
+	r := &csvRows{file: f}
+
+	// Detect gzip by its magic bytes rather than by the file name.
+	br := bufio.NewReader(f)
+	var in io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		if r.gz, err = gzip.NewReader(br); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read gzip source file %s: %w", cfg.SourceFile, err)
+		}
+		in = r.gz
+	}
+
+	r.reader = csv.NewReader(in)
+	r.reader.Comma = cfg.CSVDelimiter
+	r.reader.FieldsPerRecord = -1
+
+	header, err := r.reader.Read()
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to read header of %s: %w", cfg.SourceFile, err)
+	}
+	r.line = 1
+	index := map[string]int{}
+	for i, h := range header {
+		index[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))] = i
+	}
+
+	var missing []string
+	r.fields = make([]int, len(cols))
+	for i, c := range cols {
+		r.fields[i] = -1
+		if c.computed() {
+			continue
+		}
+		name := c.Source
+		if h, ok := cfg.CSVColumns[strings.ToLower(c.Source)]; ok {
+			name = h
+		}
+		idx, ok := index[strings.ToLower(name)]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		r.fields[i] = idx
+	}
+	if len(missing) > 0 {
+		r.Close()
+		return nil, fmt.Errorf("%s has no column(s) %s; map them with CSV_COLUMNS", cfg.SourceFile, strings.Join(missing, ", "))
+	}
+	return r, nil
+}
+
+func (r *csvRows) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	record, err := r.reader.Read()
+	if err == io.EOF {
+		return false
+	}
+	if err != nil {
+		r.err = err
+		return false
+	}
+	r.record = record
+	r.line++
+	return true
+}
+
+func (r *csvRows) Scan(dest ...any) error {
+	for i, d := range dest {
+		idx := r.fields[i]
+		if idx >= len(r.record) {
+			return fmt.Errorf("record %d has %d fields, expected at least %d", r.line, len(r.record), idx+1)
+		}
+		v := ""
+		if idx >= 0 {
+			v = strings.TrimSpace(r.record[idx])
+		}
+		if err := scanCSVField(d, v); err != nil {
+			return fmt.Errorf("record %d, field %d: %w", r.line, idx+1, err)
+		}
+	}
+	return nil
+}
+
+// scanCSVField stores one CSV field into a scan destination.
+func scanCSVField(dest any, v string) error {
+	var err error
+	switch d := dest.(type) {
+	case *sql.NullString:
+		*d = sql.NullString{String: v, Valid: v != ""}
+	case *sql.NullFloat64:
+		*d = sql.NullFloat64{}
+		if v != "" {
+			d.Float64, err = strconv.ParseFloat(v, 64)
+			d.Valid = err == nil
+		}
+	case *sql.NullInt64:
+		*d = sql.NullInt64{}
+		if v != "" {
+			d.Int64, err = strconv.ParseInt(v, 10, 64)
+			d.Valid = err == nil
+		}
+	case *sql.NullTime:
+		*d = sql.NullTime{}
+		if v != "" {
+			d.Time, err = parseTimestamp(v)
+			d.Valid = err == nil
+		}
+	case *any:
+		*d = nil
+		if v != "" {
+			*d = v
+		}
+	default:
+		return fmt.Errorf("unsupported scan destination %T", dest)
+	}
+	return err
+}
+
+func (r *csvRows) Err() error {
+	return r.err
+}
+
+func (r *csvRows) Close() error {
+	if r.gz != nil {
+		r.gz.Close()
+	}
+	return r.file.Close()
+}
+
+// csvSource reads SOURCE_FILE. There is nothing to plan: the whole file is
+// read, in file order.
+type csvSource struct {
+	cfg Config
+}
+
+func (s csvSource) plan(ctx context.Context, targetDB *sql.DB, cols []column) (readPlan, error) {
+	return readPlan{}, nil
+}
+
+func (s csvSource) extract(ctx context.Context, cols []column, plan readPlan) (sourceRows, error) {
+	rows, err := openCSVRows(s.cfg, cols)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Reading source file", "table", s.cfg.TargetTable, "file", s.cfg.SourceFile)
+	return rows, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var csvTestColumns = []column{
+	{Source: "fsno", Target: "fsno", Type: "VARCHAR(50)", Key: true},
+	{Source: "customer", Target: "customer", Type: "VARCHAR(100)"},
+	{Source: "netpay", Target: "net_pay", Type: "NUMERIC(12, 2)"},
+}
+
+// readCSV reads every row of extract through csvRows, each value printed
+// with fmt and NULL as <nil>.
+func readCSV(t *testing.T, cfg Config, extract string) ([][]string, error) {
+	t.Helper()
+	cfg.SourceFile = filepath.Join(t.TempDir(), "sales.csv")
+	cfg.CSVDelimiter = ','
+	if err := os.WriteFile(cfg.SourceFile, []byte(extract), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openCSVRows(cfg, csvTestColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var out [][]string
+	for r.Next() {
+		vals := make([]any, len(csvTestColumns))
+		for i, c := range csvTestColumns {
+			vals[i] = c.scanDest()
+		}
+		if err := r.Scan(vals...); err != nil {
+			return out, err
+		}
+		row := make([]string, len(vals))
+		for i, v := range vals {
+			row[i] = fmt.Sprint(jsonValue(csvTestColumns[i], v))
+		}
+		out = append(out, row)
+	}
+	return out, r.Err()
+}
+
+func TestCSVQuotedFields(t *testing.T) {
+	extract := "\"netpay\",\"fsno\",\"region\",\"customer\"\n" +
+		"3000.00,FS-0001,Addis Ababa,\"Kebede, Abebe\"\n" +
+		"1351.50,\"FS-0002\",Oromia,\"Hana \"\"Hanu\"\" Tesfaye\"\n" +
+		"1500,FS-0003,Amhara,\"Dawit\nAlemu\"\n" +
+		"\"\",FS-0004,,\"\"\n"
+	got, err := readCSV(t, Config{}, extract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"FS-0001", "Kebede, Abebe", "3000"},
+		{"FS-0002", `Hana "Hanu" Tesfaye`, "1351.5"},
+		{"FS-0003", "Dawit\nAlemu", "1500"},
+		{"FS-0004", "<nil>", "<nil>"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+func TestCSVMissingColumns(t *testing.T) {
+	// A header without a mapped column fails before any row is read.
+	_, err := readCSV(t, Config{}, "fsno,client,netpay\nFS-0001,Abebe Kebede,3000.00\n")
+	if err == nil || !strings.Contains(err.Error(), "no column(s) customer") {
+		t.Errorf("header without customer: got error %v", err)
+	}
+
+	// CSV_COLUMNS maps it onto another header.
+	got, err := readCSV(t, Config{CSVColumns: map[string]string{"customer": "client"}}, "fsno,client,netpay\nFS-0001,Abebe Kebede,3000.00\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"FS-0001", "Abebe Kebede", "3000"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with CSV_COLUMNS read %q, want %q", got, want)
+	}
+
+	// A record that stops before a mapped field is an error, not NULLs.
+	got, err = readCSV(t, Config{}, "fsno,netpay,customer\nFS-0001,3000.00,Abebe Kebede\nFS-0002,1351.50\n")
+	if err == nil || !strings.Contains(err.Error(), "record 3 has 2 fields") {
+		t.Errorf("short record: got error %v", err)
+	}
+	if len(got) != 1 {
+		t.Errorf("read %d rows before the short record, want 1", len(got))
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exchangeRates caches the rates the convert transform multiplies by, for
+// CURRENCY_RATES_TTL. They are read once before a load starts, so every row
+// of a run uses the same rate and a rate that cannot be read stops the run
+// before it reads anything.
+var exchangeRates = struct {
+	mu    sync.Mutex
+	rates map[string]cachedRate // "ETB:USD"
+}{rates: map[string]cachedRate{}}
+
+type cachedRate struct {
+	rate    *big.Rat
+	fetched time.Time
+}
+
+func ratePair(from, to string) string { return from + ":" + to }
+
+// parseCurrencyPair reads the argument of convert, e.g. ETB:USD.
+func parseCurrencyPair(arg string) (from, to string, err error) {
+	from, to, ok := strings.Cut(strings.ToUpper(arg), ":")
+	if !ok || !isCurrencyCode(from) || !isCurrencyCode(to) {
+		return "", "", fmt.Errorf("expected two currency codes, e.g. convert:ETB:USD")
+	}
+	return from, to, nil
+}
+
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, r := range s {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// makeConvert converts a numeric column from one currency to another at
+// the rate read for the run (see prepareRates). Raw numerics are
+// converted exactly.
+func makeConvert(c column, arg string) (columnFunc, error) {
+	if c.kind() != kindNumeric {
+		return nil, fmt.Errorf("%s is not a numeric column", c.Type)
+	}
+	from, to, err := parseCurrencyPair(arg)
+	if err != nil {
+		return nil, err
+	}
+	pair, scale := ratePair(from, to), numericScale(c)+6
+	return func(v any) any {
+		exchangeRates.mu.Lock()
+		rate := exchangeRates.rates[pair].rate
+		exchangeRates.mu.Unlock()
+		switch v := v.(type) {
+		case *sql.NullFloat64:
+			f, _ := rate.Float64()
+			v.Float64 *= f
+		case *sql.NullString:
+			if r, ok := new(big.Rat).SetString(v.String); v.Valid && ok {
+				v.String = r.Mul(r, rate).FloatString(scale)
+			}
+		}
+		return v
+	}, nil
+}
+
+// prepareRates makes sure every rate the columns of cfg convert with is
+// cached and no older than CURRENCY_RATES_TTL. targetDB is nil for a file
+// target. A rate that cannot be refreshed is used as cached, with a
+// warning, as long as there is one.
+func prepareRates(ctx context.Context, cfg Config, targetDB *sql.DB) error {
+	for _, c := range cfg.Columns {
+		for _, t := range c.Transforms {
+			name, arg, _ := strings.Cut(t, ":")
+			if name != "convert" {
+				continue
+			}
+			from, to, err := parseCurrencyPair(arg)
+			if err != nil {
+				return err
+			}
+			pair := ratePair(from, to)
+			exchangeRates.mu.Lock()
+			cached, ok := exchangeRates.rates[pair]
+			exchangeRates.mu.Unlock()
+			if ok && time.Since(cached.fetched) < cfg.CurrencyRatesTTL {
+				continue
+			}
+
+			rate, err := fetchRate(ctx, cfg, targetDB, from, to)
+			if err != nil {
+				if !ok {
+					return fmt.Errorf("failed to read the %s rate: %w", pair, err)
+				}
+				slog.Warn("Failed to refresh exchange rate; using the cached one", "pair", pair, "rate", cached.rate.FloatString(6), "fetched", cached.fetched.Format(time.RFC3339), "error", err)
+				continue
+			}
+			exchangeRates.mu.Lock()
+			exchangeRates.rates[pair] = cachedRate{rate: rate, fetched: time.Now()}
+			exchangeRates.mu.Unlock()
+			slog.Info("Read exchange rate", "table", cfg.TargetTable, "pair", pair, "rate", rate.FloatString(6))
+		}
+	}
+	return nil
+}
+
+func fetchRate(ctx context.Context, cfg Config, targetDB *sql.DB, from, to string) (*big.Rat, error) {
+	if cfg.CurrencyRatesTable != "" {
+		return rateFromTable(ctx, cfg, targetDB, from, to)
+	}
+	return rateFromURL(ctx, cfg, from, to)
+}
+
+// rateFromTable reads the latest rate in effect today from
+// CURRENCY_RATES_TABLE in the target database, a table with the columns
+// from_currency, to_currency, rate and valid_from (DATE).
+func rateFromTable(ctx context.Context, cfg Config, db *sql.DB, from, to string) (*big.Rat, error) {
+	var text string
+	err := db.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT rate::text FROM %s
+		WHERE from_currency = $1 AND to_currency = $2 AND valid_from <= current_date
+		ORDER BY valid_from DESC LIMIT 1`, cfg.CurrencyRatesTable), from, to).Scan(&text)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s has no rate from %s to %s", cfg.CurrencyRatesTable, from, to)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rate, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return nil, fmt.Errorf("%s holds the invalid rate %q", cfg.CurrencyRatesTable, text)
+	}
+	return rate, nil
+}
+
+// rateFromURL asks CURRENCY_RATES_URL, with {from} replaced by the source
+// currency, for a JSON object whose rates member maps currency codes to
+// rates, as most rate APIs answer.
+func rateFromURL(ctx context.Context, cfg Config, from, to string) (*big.Rat, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(cfg.CurrencyRatesURL, "{from}", from), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("rates API returned %s", resp.Status)
+	}
+	var body struct {
+		Rates map[string]json.Number `json:"rates"`
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid rates API response: %w", err)
+	}
+	n, ok := body.Rates[to]
+	if !ok {
+		return nil, fmt.Errorf("rates API has no rate from %s to %s", from, to)
+	}
+	rate, ok := new(big.Rat).SetString(n.String())
+	if !ok {
+		return nil, fmt.Errorf("rates API returned the invalid rate %q", n)
+	}
+	return rate, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/lib/pq"
+)
+
+const deadLettersTableName = "etl_dead_letters"
+
+// Stages a row can be rejected at.
+const (
+	stageScan   = "scan"
+	stageInsert = "insert"
+	// stageDuplicate is a row DEDUP_WINNER discarded for another row with
+	// the same key.
+	stageDuplicate = "duplicate"
+)
+
+func ensureDeadLettersTable(ctx context.Context, db execer) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id BIGSERIAL PRIMARY KEY,
+			run_id VARCHAR(36) NOT NULL,
+			table_name VARCHAR(100) NOT NULL,
+			stage VARCHAR(10) NOT NULL,
+			row_key TEXT,
+			error TEXT NOT NULL,
+			row_data JSONB,
+			rejected_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+	`, deadLettersTableName))
+	if err != nil {
+		return fmt.Errorf("failed to create dead letters table: %w", err)
+	}
+	return nil
+}
+
+// isDataError reports whether err is Postgres rejecting the row itself: a
+// data exception (class 22) or an integrity constraint violation (class
+// 23). Those fail the same way on every attempt; anything else is a
+// problem with the load, not the row.
+func isDataError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	class := pqErr.Code.Class()
+	return class == "22" || class == "23"
+}
+
+// deadLetters stores the rows a run rejects in etl_dead_letters, with the
+// error and the row as JSONB, instead of skipping them or failing the run.
+// A row is written in the transaction of its batch. All methods are no-ops
+// on a nil receiver.
+type deadLetters struct {
+	cfg      Config
+	runID    string
+	cols     []column
+	rejected map[string]int // per stage
+}
+
+func newDeadLetters(cfg Config, runID string, cols []column) *deadLetters {
+	if !cfg.DeadLetter || cfg.DryRun {
+		return nil
+	}
+	return &deadLetters{cfg: cfg, runID: runID, cols: cols, rejected: map[string]int{}}
+}
+
+// rejectScan records a source row that could not be scanned. The row is
+// scanned again as the driver returns it, since the typed scan failed.
+func (d *deadLetters) rejectScan(ctx context.Context, target execer, rows sourceRows, scanErr error) error {
+	if d == nil {
+		return nil
+	}
+	raw := make([]any, len(d.cols))
+	dest := make([]any, len(d.cols))
+	for i := range raw {
+		dest[i] = &raw[i]
+	}
+	data := map[string]any{}
+	var key string
+	if err := rows.Scan(dest...); err == nil {
+		for i, c := range d.cols {
+			v := raw[i]
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			if c.Key && v != nil {
+				key = fmt.Sprint(v)
+			}
+			// Not transformed yet, so tokenized and masked columns are still
+			// clear text.
+			if (c.Encrypted || c.Tokenized || isMasked(c)) && v != nil {
+				v = "<redacted>"
+			}
+			data[c.Target] = v
+		}
+	}
+	return d.reject(ctx, target, stageScan, key, data, scanErr)
+}
+
+// rejectInsert records a transformed row the target refused.
+func (d *deadLetters) rejectInsert(ctx context.Context, target execer, vals []any, insertErr error) error {
+	if d == nil {
+		return nil
+	}
+	data := make(map[string]any, len(d.cols))
+	for i, c := range d.cols {
+		v := jsonValue(c, vals[i])
+		if c.Encrypted && v != nil {
+			v = "<redacted>"
+		}
+		data[c.Target] = v
+	}
+	return d.reject(ctx, target, stageInsert, rowKey(d.cols, vals), data, insertErr)
+}
+
+// rejectRow records a scanned row dropped at stage. A duplicate is not
+// transformed yet, so its tokenized and masked columns are redacted too.
+func (d *deadLetters) rejectRow(ctx context.Context, target execer, stage string, vals []any, reason error) error {
+	if d == nil {
+		return nil
+	}
+	data := make(map[string]any, len(d.cols))
+	for i, c := range d.cols {
+		v := jsonValue(c, vals[i])
+		if (c.Encrypted || (c.Tokenized || isMasked(c)) && stage == stageDuplicate) && v != nil {
+			v = "<redacted>"
+		}
+		data[c.Target] = v
+	}
+	return d.reject(ctx, target, stage, rowKey(d.cols, vals), data, reason)
+}
+
+func (d *deadLetters) reject(ctx context.Context, target execer, stage, key string, data map[string]any, rowErr error) error {
+	if err := ensureDeadLettersTable(ctx, target); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode rejected row as JSON: %w", err)
+	}
+	_, err = target.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s (run_id, table_name, stage, row_key, error, row_data) VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6)`, deadLettersTableName),
+		d.runID, d.cfg.TargetTable, stage, key, rowErr.Error(), string(payload))
+	if err != nil {
+		return fmt.Errorf("failed to record rejected row: %w", err)
+	}
+	d.rejected[stage]++
+	slog.Warn("Rejected row written to "+deadLettersTableName, "table", d.cfg.TargetTable, "run_id", d.runID, "stage", stage, "key", key, "error", rowErr)
+	return nil
+}
+
+// count returns how many rows were dead-lettered at stage so far.
+func (d *deadLetters) count(stage string) int {
+	if d == nil {
+		return 0
+	}
+	return d.rejected[stage]
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// recentKeys remembers the last N keys written in a run, so a batch the
+// source sends twice can be dropped before it reaches the target.
+type recentKeys struct {
+	ring []string
+	next int
+	seen map[string]int // key -> occurrences in ring
+}
+
+func newRecentKeys(size int) *recentKeys {
+	if size <= 0 {
+		return nil
+	}
+	return &recentKeys{ring: make([]string, 0, size), seen: make(map[string]int, size)}
+}
+
+// contains reports whether key is in the window. A nil window contains
+// nothing.
+func (r *recentKeys) contains(key string) bool {
+	if r == nil {
+		return false
+	}
+	return r.seen[key] > 0
+}
+
+// add records key, evicting the oldest key once the window is full.
+func (r *recentKeys) add(key string) {
+	if r == nil {
+		return
+	}
+	if len(r.ring) < cap(r.ring) {
+		r.ring = append(r.ring, key)
+	} else {
+		old := r.ring[r.next]
+		if r.seen[old]--; r.seen[old] == 0 {
+			delete(r.seen, old)
+		}
+		r.ring[r.next] = key
+		r.next = (r.next + 1) % len(r.ring)
+	}
+	r.seen[key]++
+}
+
+// winnerTerm is one column of DEDUP_WINNER: the mapped column whose value
+// decides which of several source rows with the same fsno is loaded.
+type winnerTerm struct {
+	Column column
+	Desc   bool
+}
+
+// parseDedupWinner parses DEDUP_WINNER, a comma-separated list of source
+// or target columns of the mapping, each optionally followed by asc or
+// desc (the default), e.g. "date desc, netpay desc".
+func parseDedupWinner(s string, cols []column) ([]winnerTerm, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var terms []winnerTerm
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid DEDUP_WINNER entry %q: expected a column, then asc or desc", strings.TrimSpace(part))
+		}
+		c, ok := incrementalColumn(cols, fields[0])
+		if !ok {
+			return nil, fmt.Errorf("DEDUP_WINNER column %q is not a source or target column of the mapping", fields[0])
+		}
+		t := winnerTerm{Column: c, Desc: true}
+		if len(fields) == 2 {
+			switch strings.ToLower(fields[1]) {
+			case "desc":
+			case "asc":
+				t.Desc = false
+			default:
+				return nil, fmt.Errorf("invalid DEDUP_WINNER entry %q: expected a column, then asc or desc", strings.TrimSpace(part))
+			}
+		}
+		terms = append(terms, t)
+	}
+	return terms, nil
+}
+
+// winnerOrder is the ORDER BY fragment that puts the winner first among
+// the rows of each fsno.
+func winnerOrder(terms []winnerTerm) string {
+	var b strings.Builder
+	for _, t := range terms {
+		b.WriteString(", " + t.Column.Source)
+		if t.Desc {
+			b.WriteString(" DESC")
+		}
+	}
+	return b.String()
+}
+
+// winnerText describes DEDUP_WINNER for logs and dead letters.
+func winnerText(terms []winnerTerm) string {
+	parts := make([]string, len(terms))
+	for i, t := range terms {
+		parts[i] = t.Column.Target + " asc"
+		if t.Desc {
+			parts[i] = t.Column.Target + " desc"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
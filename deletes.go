@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Modes for DELETE_MODE.
+const (
+	// deleteHard removes the row.
+	deleteHard = "hard"
+	// deleteSoft keeps the row and sets its DELETED_AT_COLUMN.
+	deleteSoft = "soft"
+)
+
+// deleteKeys deletes the rows with the given keys from the target, in
+// chunks of BatchSize, as DELETE_MODE says. A hard delete under
+// CONFLICT_ACTION=scd2 archives the current version to the history table
+// first, closed at the time of the delete. It returns the number of rows
+// deleted.
+func deleteKeys(ctx context.Context, target execer, cfg Config, cols []column, keys []string) (int, error) {
+	key := keyOf(cols).Target
+	var targetList []string
+	for _, c := range insertColumns(cols) {
+		targetList = append(targetList, c.Target)
+	}
+
+	deleted := 0
+	for len(keys) > 0 {
+		n := min(len(keys), cfg.BatchSize)
+		chunk := pq.Array(keys[:n])
+		keys = keys[n:]
+
+		if cfg.DeleteMode == deleteSoft {
+			affected, err := rowsAffected(target.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s = now() WHERE %s::text = ANY($1) AND %s IS NULL",
+				cfg.TargetTable, cfg.DeletedAtColumn, key, cfg.DeletedAtColumn), chunk))
+			if err != nil {
+				return deleted, fmt.Errorf("failed to soft-delete rows: %w", err)
+			}
+			deleted += int(affected)
+			continue
+		}
+
+		if cfg.ConflictAction == conflictSCD2 {
+			_, err := target.ExecContext(ctx, fmt.Sprintf(`
+				INSERT INTO %s (%s, %s, %s)
+				SELECT %s, %s, now() FROM %s WHERE %s::text = ANY($1)`,
+				cfg.HistoryTable, strings.Join(targetList, ", "), cfg.ValidFromColumn, cfg.ValidToColumn,
+				strings.Join(targetList, ", "), cfg.ValidFromColumn, cfg.TargetTable, key), chunk)
+			if err != nil {
+				return deleted, fmt.Errorf("failed to archive deleted rows: %w", err)
+			}
+		}
+		affected, err := rowsAffected(target.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s::text = ANY($1)", cfg.TargetTable, key), chunk))
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete rows: %w", err)
+		}
+		deleted += int(affected)
+	}
+	return deleted, nil
+}
+
+// restoreKeys clears DELETED_AT_COLUMN of soft-deleted rows whose key is
+// back on the source. It returns the number of rows restored.
+func restoreKeys(ctx context.Context, target execer, cfg Config, cols []column, keys []string) (int, error) {
+	if cfg.DeleteMode != deleteSoft {
+		return 0, nil
+	}
+	key := keyOf(cols).Target
+	restored := 0
+	for len(keys) > 0 {
+		n := min(len(keys), cfg.BatchSize)
+		affected, err := rowsAffected(target.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s = NULL WHERE %s::text = ANY($1) AND %s IS NOT NULL",
+			cfg.TargetTable, cfg.DeletedAtColumn, key, cfg.DeletedAtColumn), pq.Array(keys[:n])))
+		if err != nil {
+			return restored, fmt.Errorf("failed to restore soft-deleted rows: %w", err)
+		}
+		keys = keys[n:]
+		restored += int(affected)
+	}
+	return restored, nil
+}
+
+// propagateDeletes compares all keys of the source with those of the
+// target after a load and deletes, as DELETE_MODE says, the target rows
+// whose key is gone from the source. Soft-deleted rows whose key is back
+// are restored. It refuses to run against an empty source, which is far
+// more likely a wrong table or missing permissions than a real wipe. A dry
+// run only reports what it would do.
+func propagateDeletes(ctx context.Context, sourceDB, targetDB *sql.DB, cfg Config) error {
+	cols := insertColumns(cfg.Columns)
+	key := keyOf(cols)
+
+	var src sourceRows
+	var err error
+	if cfg.Source == sourceCSV {
+		src, err = openCSVRows(cfg, []column{key})
+	} else {
+		src, err = sourceDB.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s", key.Source, cfg.SourceTable))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read source keys: %w", err)
+	}
+	source := map[string]bool{}
+	var stats transformStats
+	err = func() error {
+		defer src.Close()
+		for src.Next() {
+			vals := []any{key.scanDest()}
+			if err := src.Scan(vals...); err != nil {
+				return err
+			}
+			transformRow(cfg, []column{key}, vals, &stats)
+			source[rowKey([]column{key}, vals)] = true
+		}
+		return src.Err()
+	}()
+	if err != nil {
+		return fmt.Errorf("failed to read source keys: %w", err)
+	}
+	if len(source) == 0 {
+		return fmt.Errorf("the source has no rows; refusing to delete every row of %s", cfg.TargetTable)
+	}
+
+	if cfg.DryRun {
+		var exists bool
+		if err := targetDB.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", cfg.TargetTable).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to look up target table: %w", err)
+		}
+		if !exists {
+			return nil
+		}
+	}
+
+	// A dry run may come before DELETED_AT_COLUMN was added, so it counts
+	// soft-deleted rows as if they were still there.
+	softDeleted := "false"
+	if cfg.DeleteMode == deleteSoft && !cfg.DryRun {
+		softDeleted = cfg.DeletedAtColumn + " IS NOT NULL"
+	}
+	rows, err := targetDB.QueryContext(ctx, fmt.Sprintf("SELECT %s::text, %s FROM %s", key.Target, softDeleted, cfg.TargetTable))
+	if err != nil {
+		return fmt.Errorf("failed to read target keys: %w", err)
+	}
+	var missing, back []string
+	err = func() error {
+		defer rows.Close()
+		for rows.Next() {
+			var k string
+			var deleted bool
+			if err := rows.Scan(&k, &deleted); err != nil {
+				return err
+			}
+			switch {
+			case !source[k] && !deleted:
+				missing = append(missing, k)
+			case source[k] && deleted:
+				back = append(back, k)
+			}
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		return fmt.Errorf("failed to read target keys: %w", err)
+	}
+
+	if cfg.DryRun {
+		slog.Info("DRY RUN: rows whose key is gone from the source would be deleted", "table", cfg.TargetTable, "rows", len(missing), "delete_mode", cfg.DeleteMode, "restored", len(back))
+		return nil
+	}
+	if len(missing) == 0 && len(back) == 0 {
+		slog.Info("No rows to delete: every target key is still on the source", "table", cfg.TargetTable)
+		return nil
+	}
+
+	tx, err := targetDB.BeginTx(ctx, &sql.TxOptions{Isolation: cfg.TargetIsolation})
+	if err != nil {
+		return fmt.Errorf("failed to start target transaction: %w", err)
+	}
+	defer tx.Rollback()
+	deleted, err := deleteKeys(ctx, tx, cfg, cols, missing)
+	if err != nil {
+		return err
+	}
+	restored, err := restoreKeys(ctx, tx, cfg, cols, back)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit deletes: %w", err)
+	}
+	slog.Info("Deleted rows whose key is gone from the source", "table", cfg.TargetTable, "rows", deleted, "delete_mode", cfg.DeleteMode, "restored", restored)
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// discoverTimeout bounds the INFORMATION_SCHEMA lookups done while loading
+// the config.
+const discoverTimeout = 30 * time.Second
+
+// plainIdentifier matches column names that need no quoting on either side.
+var plainIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// discoverColumns builds the mapping of a source table from its
+// INFORMATION_SCHEMA entry: every column, in table order, under its
+// lowercased name and with the closest Postgres type. key names the key
+// column; empty uses the table's single-column primary key.
+func discoverColumns(conn, table, key string) ([]column, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoverTimeout)
+	defer cancel()
+
+	db, err := sql.Open("sqlserver", conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the source for column discovery: %w", err)
+	}
+	defer db.Close()
+
+	schema, name := splitTableName(table)
+	rows, err := db.QueryContext(ctx, `
+		SELECT COLUMN_NAME, DATA_TYPE,
+			COALESCE(CHARACTER_MAXIMUM_LENGTH, 0), COALESCE(NUMERIC_PRECISION, 0), COALESCE(NUMERIC_SCALE, 0)
+		FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = COALESCE(NULLIF(@schema, ''), SCHEMA_NAME()) AND TABLE_NAME = @table
+		ORDER BY ORDINAL_POSITION`,
+		sql.Named("schema", schema), sql.Named("table", name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover the columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var cols []column
+	for rows.Next() {
+		var colName, dataType string
+		var length, precision, scale int
+		if err := rows.Scan(&colName, &dataType, &length, &precision, &scale); err != nil {
+			return nil, fmt.Errorf("failed to discover the columns of %s: %w", table, err)
+		}
+		if !plainIdentifier.MatchString(colName) {
+			return nil, fmt.Errorf("column %q of %s needs quoting; list the columns of this table in the config file", colName, table)
+		}
+		pgType, ok := postgresType(dataType, length, precision, scale)
+		if !ok {
+			return nil, fmt.Errorf("column %s of %s has type %s, which discovery cannot map; list the columns of this table in the config file", colName, table, dataType)
+		}
+		if pgType == "" {
+			continue
+		}
+		cols = append(cols, column{Source: colName, Target: strings.ToLower(colName), Type: pgType})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to discover the columns of %s: %w", table, err)
+	}
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("source table %s not found or has no columns", table)
+	}
+
+	if key == "" {
+		if key, err = primaryKeyColumn(ctx, db, schema, name); err != nil {
+			return nil, fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	found := false
+	for i := range cols {
+		if strings.EqualFold(cols[i].Source, key) || cols[i].Target == key {
+			cols[i].Key = true
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("the key column %s is not in %s", key, table)
+	}
+	return cols, nil
+}
+
+// primaryKeyColumn returns the column of a single-column primary key.
+func primaryKeyColumn(ctx context.Context, db *sql.DB, schema, name string) (string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT kcu.COLUMN_NAME
+		FROM INFORMATION_SCHEMA.TABLE_CONSTRAINTS tc
+		JOIN INFORMATION_SCHEMA.KEY_COLUMN_USAGE kcu
+			ON kcu.CONSTRAINT_SCHEMA = tc.CONSTRAINT_SCHEMA AND kcu.CONSTRAINT_NAME = tc.CONSTRAINT_NAME
+		WHERE tc.CONSTRAINT_TYPE = 'PRIMARY KEY'
+			AND tc.TABLE_SCHEMA = COALESCE(NULLIF(@schema, ''), SCHEMA_NAME()) AND tc.TABLE_NAME = @table`,
+		sql.Named("schema", schema), sql.Named("table", name))
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the primary key: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return "", fmt.Errorf("failed to look up the primary key: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to look up the primary key: %w", err)
+	}
+	if len(keys) != 1 {
+		return "", fmt.Errorf("no single-column primary key to use as the key; set key in the config file")
+	}
+	return keys[0], nil
+}
+
+// splitTableName splits "schema.table" (either part possibly in brackets);
+// the schema is empty if not given.
+func splitTableName(table string) (schema, name string) {
+	unquote := func(s string) string { return strings.TrimSuffix(strings.TrimPrefix(s, "["), "]") }
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		return unquote(table[:i]), unquote(table[i+1:])
+	}
+	return "", unquote(table)
+}
+
+// postgresType maps an SQL Server type to the Postgres type it is loaded
+// as. It returns "" for columns that are skipped, and false for types the
+// pipeline cannot read.
+func postgresType(dataType string, length, precision, scale int) (string, bool) {
+	switch strings.ToLower(dataType) {
+	case "char", "varchar", "nchar", "nvarchar":
+		if length <= 0 { // (max)
+			return "TEXT", true
+		}
+		return fmt.Sprintf("VARCHAR(%d)", length), true
+	case "text", "ntext":
+		return "TEXT", true
+	case "tinyint", "smallint":
+		return "SMALLINT", true
+	case "int":
+		return "INTEGER", true
+	case "bigint":
+		return "BIGINT", true
+	case "bit":
+		return "BOOLEAN", true
+	case "decimal", "numeric":
+		return fmt.Sprintf("NUMERIC(%d, %d)", precision, scale), true
+	case "money":
+		return "NUMERIC(19, 4)", true
+	case "smallmoney":
+		return "NUMERIC(10, 4)", true
+	case "float":
+		return "DOUBLE PRECISION", true
+	case "real":
+		return "REAL", true
+	case "date":
+		return "DATE", true
+	case "datetime", "datetime2", "smalldatetime":
+		return "TIMESTAMP", true
+	case "datetimeoffset":
+		return "TIMESTAMPTZ", true
+	case "timestamp", "rowversion":
+		// Change tracking for ROWVERSION_COLUMN, not data.
+		return "", true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// dryRunSamples is how many transformed rows a dry run prints.
+const dryRunSamples = 5
+
+// dryRunWriter stands in for the real writers with -dry-run. It writes
+// nothing: it prints the first rows and counts, a batch at a time, the
+// keys that are already in the target.
+type dryRunWriter struct {
+	ctx  context.Context
+	db   *sql.DB
+	cfg  Config
+	cols []column
+
+	exists    bool
+	rows      int
+	keys      []string
+	conflicts int
+}
+
+// newDryRunWriter starts a writer for the batch after the first done rows.
+func newDryRunWriter(ctx context.Context, db *sql.DB, cfg Config, cols []column, done int) (*dryRunWriter, error) {
+	w := &dryRunWriter{ctx: ctx, db: db, cfg: cfg, cols: cols, rows: done}
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", cfg.TargetTable).Scan(&w.exists); err != nil {
+		return nil, fmt.Errorf("failed to look up target table: %w", err)
+	}
+	return w, nil
+}
+
+func (w *dryRunWriter) Write(vals []any) error {
+	w.rows++
+	if w.rows <= dryRunSamples {
+		fields := make([]string, len(w.cols))
+		for i, c := range w.cols {
+			v := jsonValue(c, vals[i])
+			switch {
+			case c.Encrypted && v != nil:
+				v = "<encrypted>"
+			case v == nil:
+				v = "NULL"
+			}
+			fields[i] = fmt.Sprintf("%s=%v", c.Target, v)
+		}
+		slog.Info("Dry run row", "table", w.cfg.TargetTable, "row", w.rows, "values", strings.Join(fields, " "))
+	}
+
+	if !w.exists {
+		return nil
+	}
+	w.keys = append(w.keys, rowKey(w.cols, vals))
+	if len(w.keys) >= w.cfg.BatchSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush counts how many of the buffered keys the target already has. Keys
+// are compared as text, the way rowKey prints them.
+func (w *dryRunWriter) Flush() error {
+	if len(w.keys) == 0 {
+		return nil
+	}
+	var n int
+	err := w.db.QueryRowContext(w.ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s::text = ANY($1)", w.cfg.TargetTable, keyOf(w.cols).Target),
+		pq.Array(w.keys)).Scan(&n)
+	if err != nil {
+		return fmt.Errorf("failed to look up existing keys: %w", err)
+	}
+	w.conflicts += n
+	w.keys = w.keys[:0]
+	return nil
+}
+
+func (w *dryRunWriter) Close() error { return nil }
+
+func (w *dryRunWriter) Conflicts() int { return w.conflicts }
+
+// dryRunTable reads and transforms the table like a run but changes
+// nothing in the target: no DDL, grants, lease, run record, lineage or
+// watermark. The schema check and EXPECTED_ROWS only warn.
+func dryRunTable(ctx context.Context, cfg Config, readDB, targetDB *sql.DB) error {
+	slog.Info("DRY RUN: nothing will be written to the target", "table", cfg.TargetTable, "source", sourceName(cfg))
+
+	var exists bool
+	if err := targetDB.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", cfg.TargetTable).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up target table: %w", err)
+	}
+	switch {
+	case !exists:
+		slog.Info("Target table does not exist yet; a run would create it", "table", cfg.TargetTable)
+	case cfg.Migrate:
+		diffs, err := diffTargetSchema(ctx, targetDB, cfg)
+		if err != nil {
+			return err
+		}
+		if stmts := migrationStatements(cfg, diffs); len(stmts) > 0 {
+			slog.Info("A run would migrate the target table:\n"+strings.Join(stmts, ";\n"), "table", cfg.TargetTable)
+		}
+		if cfg.SkipSchemaCheck {
+			break
+		}
+		fallthrough
+	case !cfg.SkipSchemaCheck:
+		if err := checkTargetSchema(ctx, targetDB, cfg); err != nil {
+			slog.Warn("A run would stop at the schema check", "table", cfg.TargetTable, "error", err)
+		}
+	}
+
+	start := time.Now()
+	count, err := runETLWithTxRetry(ctx, cfg, newRunID(), readDB, targetDB)
+	if err != nil {
+		return fmt.Errorf("dry run failed: %w", err)
+	}
+	slog.Info("DRY RUN complete", "table", cfg.TargetTable, "rows", count, "duration", time.Since(start))
+
+	if err := checkExpectedRows(cfg, count); err != nil {
+		slog.Warn("A run would fail the completeness check", "table", cfg.TargetTable, "error", err)
+	}
+	return nil
+}
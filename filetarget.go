@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Targets for TARGET.
+const (
+	targetPostgres = "postgres"
+	// targetCSV writes the transformed rows to a CSV file (gzip-compressed
+	// if the name ends in .gz), locally or on S3, for ad-hoc exports without
+	// a Postgres instance.
+	targetCSV = "csv"
+	// targetParquet writes them to a Parquet file, e.g. for the data lake.
+	targetParquet = "parquet"
+	// targetNDJSON writes them as newline-delimited JSON, one object per
+	// row, e.g. for a lakehouse landing zone.
+	targetNDJSON = "ndjson"
+	// targetSnowflake loads a table in the Snowflake warehouse.
+	targetSnowflake = "snowflake"
+	// targetKafka publishes the rows to a Kafka topic (kafka.go).
+	targetKafka = "kafka"
+)
+
+// newFileWriter returns the rowWriter of a file target. Close finishes the
+// file's content.
+func newFileWriter(cfg Config, cols []column, out io.Writer) (rowWriter, error) {
+	switch cfg.Target {
+	case targetParquet:
+		return newParquetWriter(cfg, cols, out)
+	case targetNDJSON:
+		return &ndjsonTargetWriter{out: out, cols: cols}, nil
+	}
+	return newCSVTargetWriter(cfg, cols, out)
+}
+
+// targetFile is the output of a file target. Rows go to a temporary file
+// that commit moves into place, or uploads, so a failed run never leaves a
+// truncated file where a complete one is expected.
+type targetFile struct {
+	cfg  Config
+	tmp  *os.File
+	buf  *bufio.Writer
+	gz   *gzip.Writer
+	w    io.Writer
+	s3   s3Object
+	isS3 bool
+}
+
+func openTargetFile(cfg Config) (*targetFile, error) {
+	f := &targetFile{cfg: cfg}
+	var err error
+	f.s3, f.isS3, err = parseS3URL(cfg.TargetFile)
+	if err != nil {
+		return nil, err
+	}
+	dir, pattern := "", "nvi_etl-*"
+	if !f.isS3 {
+		// Next to the final file, so that commit is an atomic rename.
+		dir, pattern = filepath.Dir(cfg.TargetFile), "."+filepath.Base(cfg.TargetFile)+".*.tmp"
+	}
+	if f.tmp, err = os.CreateTemp(dir, pattern); err != nil {
+		return nil, fmt.Errorf("failed to create target file: %w", err)
+	}
+	f.buf = bufio.NewWriterSize(f.tmp, 1<<20)
+	f.w = f.buf
+	if cfg.Target != targetParquet && strings.HasSuffix(cfg.TargetFile, ".gz") {
+		f.gz = gzip.NewWriter(f.buf)
+		f.w = f.gz
+	}
+	return f, nil
+}
+
+// commit finishes the file and puts it at TARGET_FILE.
+func (f *targetFile) commit(ctx context.Context) error {
+	if f.gz != nil {
+		if err := f.gz.Close(); err != nil {
+			return fmt.Errorf("failed to write target file: %w", err)
+		}
+	}
+	if err := f.buf.Flush(); err != nil {
+		return fmt.Errorf("failed to write target file: %w", err)
+	}
+	if f.isS3 {
+		if err := uploadS3(ctx, f.cfg, f.s3, f.tmp); err != nil {
+			return err
+		}
+		f.abort()
+		return nil
+	}
+	// CreateTemp makes the file private; the export is an ordinary file.
+	if err := f.tmp.Chmod(0o644); err != nil {
+		return fmt.Errorf("failed to write target file: %w", err)
+	}
+	if err := f.tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write target file: %w", err)
+	}
+	if err := os.Rename(f.tmp.Name(), f.cfg.TargetFile); err != nil {
+		os.Remove(f.tmp.Name())
+		return fmt.Errorf("failed to move target file into place: %w", err)
+	}
+	f.tmp = nil
+	return nil
+}
+
+// abort removes the temporary file. It does nothing after commit.
+func (f *targetFile) abort() {
+	if f == nil || f.tmp == nil {
+		return
+	}
+	f.tmp.Close()
+	os.Remove(f.tmp.Name())
+	f.tmp = nil
+}
+
+// csvTargetWriter writes transformed rows as CSV records. NULL is an empty
+// field. It implements rowWriter, with nothing to conflict with.
+type csvTargetWriter struct {
+	w      *csv.Writer
+	cfg    Config
+	cols   []column
+	record []string
+}
+
+func newCSVTargetWriter(cfg Config, cols []column, out io.Writer) (*csvTargetWriter, error) {
+	w := &csvTargetWriter{w: csv.NewWriter(out), cfg: cfg, cols: cols, record: make([]string, len(cols))}
+	w.w.Comma = cfg.TargetDelimiter
+	if cfg.TargetHeader {
+		for i, c := range cols {
+			w.record[i] = c.Target
+		}
+		if err := w.w.Write(w.record); err != nil {
+			return nil, fmt.Errorf("failed to write target file header: %w", err)
+		}
+	}
+	return w, nil
+}
+
+func (w *csvTargetWriter) Write(vals []any) error {
+	for i, c := range w.cols {
+		w.record[i] = formatField(w.cfg, c, vals[i])
+	}
+	return w.w.Write(w.record)
+}
+
+func (w *csvTargetWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+func (w *csvTargetWriter) Close() error { return nil }
+
+func (w *csvTargetWriter) Conflicts() int { return 0 }
+
+// ndjsonTargetWriter writes transformed rows as JSON objects keyed by
+// target column, in mapping order, one per line. Values are written as for
+// WRITE_METHOD=json.
+type ndjsonTargetWriter struct {
+	out  io.Writer
+	cols []column
+	line []byte
+}
+
+func (w *ndjsonTargetWriter) Write(vals []any) error {
+	w.line = append(w.line[:0], '{')
+	for i, c := range w.cols {
+		if i > 0 {
+			w.line = append(w.line, ',')
+		}
+		name, _ := json.Marshal(c.Target)
+		v, err := json.Marshal(jsonValue(c, vals[i]))
+		if err != nil {
+			return fmt.Errorf("column %s: %w", c.Target, err)
+		}
+		w.line = append(append(append(w.line, name...), ':'), v...)
+	}
+	w.line = append(w.line, '}', '\n')
+	_, err := w.out.Write(w.line)
+	return err
+}
+
+func (w *ndjsonTargetWriter) Flush() error { return nil }
+
+func (w *ndjsonTargetWriter) Close() error { return nil }
+
+func (w *ndjsonTargetWriter) Conflicts() int { return 0 }
+
+// formatField prints one transformed value for a file target. Dates and
+// timestamps use TARGET_DATE_FORMAT and TARGET_TIMESTAMP_FORMAT.
+func formatField(cfg Config, c column, v any) string {
+	switch v := v.(type) {
+	case *sql.NullString:
+		return v.String
+	case *sql.NullFloat64:
+		if v.Valid {
+			return strconv.FormatFloat(v.Float64, 'f', -1, 64)
+		}
+	case *sql.NullInt64:
+		if v.Valid {
+			return strconv.FormatInt(v.Int64, 10)
+		}
+	case *sql.NullTime:
+		if !v.Valid {
+			return ""
+		}
+		if strings.HasPrefix(strings.ToUpper(c.Type), "DATE") {
+			return v.Time.Format(cfg.TargetDateFormat)
+		}
+		return v.Time.Format(cfg.TargetTimestampFormat)
+	}
+	return ""
+}
+
+// fileSink is the rowSink of a file target. The whole run is one batch,
+// so the file only replaces TARGET_FILE once it is complete, unless
+// TARGET_PART_ROWS splits it into parts that are each written as they
+// fill up. A dry run writes to nowhere.
+type fileSink struct {
+	ctx    context.Context
+	cfg    Config
+	cols   []column
+	runID  string
+	file   *targetFile
+	writer rowWriter
+
+	date      string // of the first part, so a run stays in one partition
+	part      int
+	partStart int // rows written before the current part
+}
+
+func (s *fileSink) begin() error {
+	out := io.Writer(io.Discard)
+	if !s.cfg.DryRun {
+		cfg := s.cfg
+		cfg.TargetFile = s.nextFile()
+		if _, isS3, _ := parseS3URL(cfg.TargetFile); !isS3 && s.cfg.TargetPartRows > 0 {
+			if err := os.MkdirAll(filepath.Dir(cfg.TargetFile), 0o755); err != nil {
+				return fmt.Errorf("failed to create target directory: %w", err)
+			}
+		}
+		file, err := openTargetFile(cfg)
+		if err != nil {
+			return err
+		}
+		s.file, out = file, file.w
+	}
+	writer, err := newFileWriter(s.cfg, s.cols, out)
+	if err != nil {
+		s.file.abort()
+		return err
+	}
+	s.writer = writer
+	return nil
+}
+
+func (s *fileSink) write(vals []any) error {
+	if err := s.writer.Write(vals); err != nil {
+		return fmt.Errorf("failed to write target file: %w", err)
+	}
+	return nil
+}
+
+// nextFile is the name of the next part: TARGET_FILE with {date} replaced
+// by the UTC date the run started, {run_id} by the run ID and {part} by
+// the part number, counting from 0001.
+func (s *fileSink) nextFile() string {
+	if s.date == "" {
+		s.date = time.Now().UTC().Format("2006-01-02")
+	}
+	s.part++
+	return strings.NewReplacer("{date}", s.date, "{run_id}", s.runID, "{part}", fmt.Sprintf("%04d", s.part)).Replace(s.cfg.TargetFile)
+}
+
+func (s *fileSink) batchDone(rows int) bool {
+	return s.cfg.TargetPartRows > 0 && rows%s.cfg.TargetPartRows == 0
+}
+
+func (s *fileSink) flush() error {
+	if err := s.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write target file: %w", err)
+	}
+	return nil
+}
+
+// commit finishes the file and moves it into place. A last part left
+// empty because the previous one was exactly full is dropped.
+func (s *fileSink) commit(rows int) error {
+	if err := s.writer.Close(); err != nil {
+		return fmt.Errorf("failed to write target file: %w", err)
+	}
+	if s.file == nil {
+		return nil
+	}
+	if rows == s.partStart && s.part > 1 {
+		s.file.abort()
+		return nil
+	}
+	if err := s.file.commit(s.ctx); err != nil {
+		return err
+	}
+	etlMetrics.rowsInserted.add(s.cfg.TargetTable, float64(rows-s.partStart))
+	if s.cfg.TargetPartRows > 0 {
+		slog.Debug("Wrote target file part", "table", s.cfg.TargetTable, "file", s.file.cfg.TargetFile, "rows", rows-s.partStart)
+	}
+	s.partStart = rows
+	return nil
+}
+
+func (s *fileSink) abort() { s.file.abort() }
+
+func (s *fileSink) state() execer { return nil }
+
+func (s *fileSink) rejectScan(rows sourceRows, err error) (bool, error) { return false, nil }
+
+func (s *fileSink) rejectRow(stage string, vals []any, reason error) (bool, error) { return false, nil }
+
+func (s *fileSink) report(res *loadResult) {}
+
+// exportTable reads the source of cfg and writes it to TARGET_FILE, or
+// publishes it to KAFKA_TOPIC, in place of runTable for a file or Kafka
+// target.
+func exportTable(ctx context.Context, cfg Config, sourceDB *sql.DB) error {
+	runID := newRunID()
+	dest := []any{"file", cfg.TargetFile}
+	if cfg.Target == targetKafka {
+		dest = []any{"topic", cfg.KafkaTopic}
+	}
+	slog.Info("Starting export", append([]any{"table", cfg.TargetTable, "run_id", runID, "source", sourceName(cfg)}, dest...)...)
+	start := time.Now()
+	counts := startRunCounts(cfg.TargetTable)
+
+	count, err := runETLWithTxRetry(ctx, cfg, runID, sourceDB, nil)
+	etlMetrics.runDuration.observe(cfg.TargetTable, time.Since(start))
+	etlStatus.tableDone(cfg.TargetTable, runID, start, count, counts, err)
+	if err != nil {
+		return fmt.Errorf("export %s stopped after %d rows: %w", runID, count, err)
+	}
+	if cfg.DryRun {
+		slog.Info("DRY RUN complete", "table", cfg.TargetTable, "rows", count, "duration", time.Since(start))
+	} else {
+		slog.Info("Export successful", append([]any{"table", cfg.TargetTable, "run_id", runID, "rows", count, "duration", time.Since(start)}, dest...)...)
+	}
+
+	if err := checkExpectedRows(cfg, count); err != nil {
+		return exitCodeError{exitRowCountOutOfBand, fmt.Errorf("completeness check failed: %w", err)}
+	}
+	return nil
+}
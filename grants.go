@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// tableGrant is one role and the privileges it should hold on the target.
+type tableGrant struct {
+	Role       string
+	Privileges []string
+}
+
+var grantablePrivileges = map[string]bool{
+	"SELECT": true, "INSERT": true, "UPDATE": true, "DELETE": true,
+	"TRUNCATE": true, "REFERENCES": true, "TRIGGER": true,
+}
+
+// parseGrants reads TARGET_GRANTS, a ';' separated list of
+// "role=PRIVILEGE,PRIVILEGE" entries, e.g. "reporting=SELECT;metabase=SELECT".
+func parseGrants(spec string) ([]tableGrant, error) {
+	var grants []tableGrant
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		role, list, ok := strings.Cut(entry, "=")
+		role = strings.TrimSpace(role)
+		if !ok || role == "" {
+			return nil, fmt.Errorf("invalid TARGET_GRANTS entry %q: expected role=PRIVILEGE,...", entry)
+		}
+		g := tableGrant{Role: role}
+		for _, p := range strings.Split(list, ",") {
+			p = strings.ToUpper(strings.TrimSpace(p))
+			if !grantablePrivileges[p] {
+				return nil, fmt.Errorf("invalid privilege %q in TARGET_GRANTS", p)
+			}
+			g.Privileges = append(g.Privileges, p)
+		}
+		grants = append(grants, g)
+	}
+	return grants, nil
+}
+
+// applyTableAccess sets the owner and grants of the target tables. Both are
+// checked first, so reruns don't issue DDL when nothing needs to change.
+func applyTableAccess(ctx context.Context, db *sql.DB, cfg Config) error {
+	tables := []string{cfg.TargetTable}
+	if cfg.ConflictAction == conflictSCD2 {
+		tables = append(tables, cfg.HistoryTable)
+	}
+
+	for _, table := range tables {
+		if cfg.TargetOwner != "" {
+			var owner string
+			err := db.QueryRowContext(ctx, "SELECT tableowner FROM pg_tables WHERE schemaname = current_schema() AND tablename = lower($1)", table).Scan(&owner)
+			if err != nil {
+				return fmt.Errorf("failed to look up owner of %s: %w", table, err)
+			}
+			if owner != cfg.TargetOwner {
+				if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s OWNER TO %s", table, pq.QuoteIdentifier(cfg.TargetOwner))); err != nil {
+					return fmt.Errorf("failed to set owner of %s: %w", table, err)
+				}
+				slog.Info("Changed table owner", "table", table, "from", owner, "to", cfg.TargetOwner)
+			}
+		}
+
+		for _, g := range cfg.TargetGrants {
+			for _, priv := range g.Privileges {
+				var has bool
+				if err := db.QueryRowContext(ctx, "SELECT has_table_privilege($1, $2, $3)", g.Role, table, priv).Scan(&has); err != nil {
+					return fmt.Errorf("failed to check %s on %s for %s: %w", priv, table, g.Role, err)
+				}
+				if has {
+					continue
+				}
+				if _, err := db.ExecContext(ctx, fmt.Sprintf("GRANT %s ON %s TO %s", priv, table, pq.QuoteIdentifier(g.Role))); err != nil {
+					return fmt.Errorf("failed to grant %s on %s to %s: %w", priv, table, g.Role, err)
+				}
+				slog.Info("Granted privilege", "table", table, "privilege", priv, "role", g.Role)
+			}
+		}
+	}
+
+	return nil
+}
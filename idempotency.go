@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const runKeysTableName = "etl_run_keys"
+
+func ensureRunKeysTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			scope VARCHAR(100) NOT NULL,
+			idempotency_key VARCHAR(200) NOT NULL,
+			completed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			rows_processed BIGINT NOT NULL,
+			PRIMARY KEY (scope, idempotency_key)
+		);
+	`, runKeysTableName))
+	if err != nil {
+		return fmt.Errorf("failed to create run keys table: %w", err)
+	}
+	return nil
+}
+
+// runKeyCompleted reports when a successful run with this key finished, or
+// a zero time if it has not been seen in the scope.
+func runKeyCompleted(ctx context.Context, db *sql.DB, scope, key string) (time.Time, error) {
+	if err := ensureRunKeysTable(ctx, db); err != nil {
+		return time.Time{}, err
+	}
+
+	var completed time.Time
+	err := db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT completed_at FROM %s WHERE scope = $1 AND idempotency_key = $2", runKeysTableName),
+		scope, key).Scan(&completed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to look up idempotency key: %w", err)
+	}
+	return completed, nil
+}
+
+func recordRunKey(ctx context.Context, db *sql.DB, scope, key string, rows int) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s (scope, idempotency_key, rows_processed) VALUES ($1, $2, $3)
+		ON CONFLICT (scope, idempotency_key) DO NOTHING`, runKeysTableName),
+		scope, key, rows)
+	if err != nil {
+		return fmt.Errorf("failed to record idempotency key: %w", err)
+	}
+	return nil
+}
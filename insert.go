@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Conflict actions for CONFLICT_ACTION.
+const (
+	conflictNothing = "nothing"
+	// conflictUpdate overwrites the non-key columns of an existing row when
+	// any of them changed (upsert).
+	conflictUpdate = "update"
+	// conflictReplace deletes the existing row and inserts the new one, so
+	// columns outside the mapping go back to their defaults.
+	conflictReplace = "replace"
+	// conflictSCD2 archives the current version of a changed row into the
+	// history table before overwriting it (slowly changing dimension type 2).
+	conflictSCD2 = "scd2"
+)
+
+// buildInsertSQL returns the INSERT for one source row. Parameters $1..$n
+// are the values of cols in order; if any column is encrypted the
+// encryption key follows as $n+1.
+func buildInsertSQL(cfg Config, cols []column) string {
+	keyColumn := keyOf(cols).Target
+	keyParam := fmt.Sprintf("$%d", len(cols)+1)
+
+	targetList := make([]string, len(cols))
+	placeholders := make([]string, len(cols))
+	for i, c := range cols {
+		targetList[i] = c.Target
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		if c.Encrypted {
+			placeholders[i] = fmt.Sprintf("pgp_sym_encrypt($%d::text, %s)", i+1, keyParam)
+		}
+	}
+
+	insertSQL := fmt.Sprintf(`
+		INSERT INTO %s (%s)
+		VALUES (%s)`, cfg.TargetTable, strings.Join(targetList, ", "), strings.Join(placeholders, ", "))
+
+	keyIdx := 0
+	for i, c := range cols {
+		if c.Key {
+			keyIdx = i + 1
+		}
+	}
+
+	switch cfg.ConflictAction {
+	case conflictUpdate:
+		return insertSQL + upsertClause(cfg, cols, keyParam)
+	case conflictReplace:
+		// The DELETE and the INSERT share a snapshot; the unique check does
+		// not count the row this statement deletes.
+		return fmt.Sprintf(`
+		WITH replaced AS (
+			DELETE FROM %s WHERE %s = $%d
+		)%s`, cfg.TargetTable, keyColumn, keyIdx, insertSQL)
+	case conflictSCD2:
+	default:
+		return insertSQL + fmt.Sprintf(`
+		ON CONFLICT (%s) DO NOTHING`, conflictColumns(cfg, cols))
+	}
+
+	// Compare decrypted values for encrypted columns, since pgp_sym_encrypt
+	// never produces the same ciphertext twice.
+	plain := func(table string, c column) string {
+		if c.Encrypted {
+			return fmt.Sprintf("pgp_sym_decrypt(%s.%s, %s)", table, c.Target, keyParam)
+		}
+		return table + "." + c.Target
+	}
+
+	var sets, current, incoming, excluded, existing []string
+	for i, c := range cols {
+		if c.Key {
+			continue
+		}
+		// load_seq differs on every run; comparing it would version every row.
+		if c.Sequence {
+			sets = append(sets, fmt.Sprintf("%s = EXCLUDED.%s", c.Target, c.Target))
+			continue
+		}
+		sets = append(sets, fmt.Sprintf("%s = EXCLUDED.%s", c.Target, c.Target))
+		current = append(current, plain("t", c))
+		if c.Encrypted {
+			incoming = append(incoming, fmt.Sprintf("$%d::text", i+1))
+		} else {
+			incoming = append(incoming, fmt.Sprintf("$%d", i+1))
+		}
+		existing = append(existing, plain(cfg.TargetTable, c))
+		excluded = append(excluded, plain("EXCLUDED", c))
+	}
+	sets = append(sets, cfg.ValidFromColumn+" = now()")
+
+	// Both statements see the same snapshot, so the archived row is the
+	// version that is about to be overwritten.
+	return fmt.Sprintf(`
+		WITH archived AS (
+			INSERT INTO %[1]s (%[2]s, %[3]s, %[4]s)
+			SELECT %[5]s, t.%[3]s, now()
+			FROM %[6]s t
+			WHERE t.%[7]s = $%[8]d AND ROW(%[9]s) IS DISTINCT FROM ROW(%[10]s)
+			RETURNING 1
+		)%[11]s
+		ON CONFLICT (%[15]s) DO UPDATE SET %[12]s
+		WHERE ROW(%[13]s) IS DISTINCT FROM ROW(%[14]s)`,
+		cfg.HistoryTable, strings.Join(targetList, ", "), cfg.ValidFromColumn, cfg.ValidToColumn,
+		"t."+strings.Join(targetList, ", t."), cfg.TargetTable, keyColumn, keyIdx,
+		strings.Join(current, ", "), strings.Join(incoming, ", "), insertSQL,
+		strings.Join(sets, ", "), strings.Join(existing, ", "), strings.Join(excluded, ", "), conflictColumns(cfg, cols))
+}
+
+// upsertClause returns the ON CONFLICT clause for CONFLICT_ACTION=update.
+// Unchanged rows are left alone, so they are not rewritten and count as
+// conflicts; with ROW_HASH only the hash is compared. keyParam is the
+// encryption key parameter.
+func upsertClause(cfg Config, cols []column, keyParam string) string {
+	keyColumn := conflictColumns(cfg, cols)
+	var sets, existing, excluded []string
+	for _, c := range cols {
+		if c.Key {
+			continue
+		}
+		sets = append(sets, fmt.Sprintf("%s = EXCLUDED.%s", c.Target, c.Target))
+		if c.Sequence || cfg.RowHash && !c.RowHash {
+			continue
+		}
+		if c.Encrypted {
+			existing = append(existing, fmt.Sprintf("pgp_sym_decrypt(%s.%s, %s)", cfg.TargetTable, c.Target, keyParam))
+			excluded = append(excluded, fmt.Sprintf("pgp_sym_decrypt(EXCLUDED.%s, %s)", c.Target, keyParam))
+		} else {
+			existing = append(existing, cfg.TargetTable+"."+c.Target)
+			excluded = append(excluded, "EXCLUDED."+c.Target)
+		}
+	}
+	if len(sets) == 0 {
+		return fmt.Sprintf(`
+		ON CONFLICT (%s) DO NOTHING`, keyColumn)
+	}
+	return fmt.Sprintf(`
+		ON CONFLICT (%s) DO UPDATE SET %s
+		WHERE ROW(%s) IS DISTINCT FROM ROW(%s)`,
+		keyColumn, strings.Join(sets, ", "), strings.Join(existing, ", "), strings.Join(excluded, ", "))
+}
+
+// historyTableDDL creates the SCD2 history table and its lookup index.
+func historyTableDDL(cfg Config, cols []column) string {
+	keyColumn := keyOf(cols).Target
+	defs := make([]string, 0, len(cols)+2)
+	for _, c := range insertColumns(cols) {
+		defs = append(defs, fmt.Sprintf("%s %s", c.Target, c.targetType()))
+	}
+	defs = append(defs,
+		fmt.Sprintf("%s TIMESTAMPTZ NOT NULL", cfg.ValidFromColumn),
+		fmt.Sprintf("%s TIMESTAMPTZ NOT NULL", cfg.ValidToColumn))
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			%s
+		);
+		CREATE INDEX IF NOT EXISTS %s_%s_idx ON %s (%s, %s);
+	`, cfg.HistoryTable, strings.Join(defs, ",\n\t\t\t"),
+		strings.ToLower(cfg.HistoryTable), keyColumn, cfg.HistoryTable, keyColumn, cfg.ValidToColumn)
+}
+
+// ensureHistoryTable prepares SCD2 tracking: the current row's valid-from
+// column on the main table and the history table for prior versions.
+func ensureHistoryTable(ctx context.Context, db *sql.DB, cfg Config, cols []column) error {
+	alterSQL := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s TIMESTAMPTZ NOT NULL DEFAULT now()",
+		cfg.TargetTable, cfg.ValidFromColumn)
+	if _, err := db.ExecContext(ctx, alterSQL); err != nil {
+		return fmt.Errorf("failed to add %s to target table: %w", cfg.ValidFromColumn, err)
+	}
+
+	if _, err := db.ExecContext(ctx, historyTableDDL(cfg, cols)); err != nil {
+		return fmt.Errorf("failed to create history table: %w", err)
+	}
+	if cfg.LoadSeq {
+		alterSQL := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", cfg.HistoryTable, loadSeqColumn.Target, loadSeqColumn.Type)
+		if _, err := db.ExecContext(ctx, alterSQL); err != nil {
+			return fmt.Errorf("failed to add %s to history table: %w", loadSeqColumn.Target, err)
+		}
+	}
+	slog.Info("History table is ready", "table", cfg.HistoryTable, "valid_from", cfg.ValidFromColumn, "valid_to", cfg.ValidToColumn)
+
+	return nil
+}
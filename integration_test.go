@@ -0,0 +1,562 @@
+//go:build integration
+
+// The integration tests start SQL Server and Postgres in Docker, seed
+// Sales and run the pipeline against them:
+//
+//	go test -tags integration ./...
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+const integrationSAPassword = "Etl_Test_Pass1"
+
+// itest holds the databases TestMain starts for the integration tests.
+var itest struct {
+	mssqlConn    string
+	postgresConn string
+	source       *sql.DB // the NVI database on SQL Server
+	target       *sql.DB // salesdb on Postgres
+}
+
+func TestMain(m *testing.M) {
+	os.Exit(runIntegration(m))
+}
+
+func runIntegration(m *testing.M) int {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		log.Printf("Failed to reach Docker: %v", err)
+		return 1
+	}
+	pool.MaxWait = 3 * time.Minute
+	autoRemove := func(hc *docker.HostConfig) {
+		hc.AutoRemove = true
+		hc.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	}
+
+	pg, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "postgres",
+		Tag:        "16",
+		Env:        []string{"POSTGRES_USER=etl", "POSTGRES_PASSWORD=etl", "POSTGRES_DB=salesdb"},
+	}, autoRemove)
+	if err != nil {
+		log.Printf("Failed to start Postgres: %v", err)
+		return 1
+	}
+	defer pool.Purge(pg)
+	pg.Expire(600)
+
+	ms, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "mcr.microsoft.com/mssql/server",
+		Tag:        "2022-latest",
+		Env:        []string{"ACCEPT_EULA=Y", "MSSQL_SA_PASSWORD=" + integrationSAPassword},
+	}, autoRemove)
+	if err != nil {
+		log.Printf("Failed to start SQL Server: %v", err)
+		return 1
+	}
+	defer pool.Purge(ms)
+	ms.Expire(600)
+
+	itest.postgresConn = fmt.Sprintf("postgres://etl:etl@%s/salesdb?sslmode=disable", pg.GetHostPort("5432/tcp"))
+	if itest.target, err = connect(pool, "postgres", itest.postgresConn); err != nil {
+		log.Printf("Failed to connect to Postgres: %v", err)
+		return 1
+	}
+	defer itest.target.Close()
+
+	master := fmt.Sprintf("sqlserver://sa:%s@%s", integrationSAPassword, ms.GetHostPort("1433/tcp"))
+	db, err := connect(pool, "sqlserver", master+"?encrypt=disable")
+	if err != nil {
+		log.Printf("Failed to connect to SQL Server: %v", err)
+		return 1
+	}
+	_, err = db.Exec("CREATE DATABASE NVI")
+	db.Close()
+	if err != nil {
+		log.Printf("Failed to create the source database: %v", err)
+		return 1
+	}
+	itest.mssqlConn = master + "?database=NVI&encrypt=disable"
+	if itest.source, err = connect(pool, "sqlserver", itest.mssqlConn); err != nil {
+		log.Printf("Failed to connect to the source database: %v", err)
+		return 1
+	}
+	defer itest.source.Close()
+
+	return m.Run()
+}
+
+// connect opens conn once the database in the container accepts
+// connections.
+func connect(pool *dockertest.Pool, driverName, conn string) (*sql.DB, error) {
+	var db *sql.DB
+	err := pool.Retry(func() error {
+		var err error
+		if db, err = sql.Open(driverName, conn); err != nil {
+			return err
+		}
+		if err = db.Ping(); err != nil {
+			db.Close()
+		}
+		return err
+	})
+	return db, err
+}
+
+// seedSales (re)creates the Sales table of the NVI database with five
+// rows.
+func seedSales(t testing.TB) {
+	t.Helper()
+	_, err := itest.source.Exec(`
+		DROP TABLE IF EXISTS Sales;
+		CREATE TABLE Sales (
+			fsno            VARCHAR(50) NOT NULL PRIMARY KEY,
+			salestype       VARCHAR(50),
+			attachmentno    VARCHAR(50),
+			customer        VARCHAR(100),
+			region          VARCHAR(50),
+			date            DATE,
+			code            VARCHAR(50),
+			name            VARCHAR(100),
+			measurementunit VARCHAR(50),
+			unitprice       DECIMAL(12, 2),
+			soldquantity    DECIMAL(12, 2),
+			netpay          DECIMAL(12, 2)
+		);
+		INSERT INTO Sales VALUES
+			('FS-0001', 'Cash',   'AT-1', 'Abebe Kebede',  'Addis Ababa', '2024-01-05', 'P-100', 'Teff 25kg',      'bag',   1500.00, 2,   3000.00),
+			('FS-0002', 'Credit', 'AT-2', 'Hana Tesfaye',  'Oromia',      '2024-01-06', 'P-200', 'Coffee 1kg',     'kg',     450.50, 3,   1351.50),
+			('FS-0003', 'Cash',   NULL,   'Dawit Alemu',   'Amhara',      '2024-02-11', 'P-100', 'Teff 25kg',      'bag',   1500.00, 1,   1500.00),
+			('FS-0004', 'Cash',   'AT-4', N'Selam Girma',  NULL,          '2024-02-29', 'P-300', 'Sugar 50kg',     'bag',   3200.00, 0.5, 1600.00),
+			('FS-0005', 'Credit', 'AT-5', 'Yonas Bekele',  'Sidama',      '2024-03-01', 'P-400', 'Cooking oil 5l', 'liter',  780.25, 4,   3121.00);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runPipeline loads Sales into TARGET_TABLE with the settings of env, as
+// the run command would.
+func runPipeline(t *testing.T, env ...string) {
+	t.Helper()
+	runConfig(t, "", env...)
+}
+
+// runConfig is runPipeline with the config file path.
+func runConfig(t *testing.T, path string, env ...string) {
+	t.Helper()
+	t.Setenv("MSSQL_CONN", itest.mssqlConn)
+	t.Setenv("POSTGRES_CONN", itest.postgresConn)
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		t.Setenv(k, v)
+	}
+	cfgs, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if err := runTables(ctx, cfgs, itest.source, itest.target); err != nil {
+		t.Fatalf("ETL run with %v failed: %v", env, err)
+	}
+}
+
+// expect checks that query on the target returns one row whose columns,
+// joined by |, are want. NULL reads as an empty column.
+func expect(t *testing.T, what, query, want string) {
+	t.Helper()
+	rows, err := itest.target.Query(query)
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	if !rows.Next() {
+		t.Fatalf("%s: no rows (err %v)", what, rows.Err())
+	}
+	vals := make([]sql.NullString, len(cols))
+	dest := make([]any, len(cols))
+	for i := range vals {
+		dest[i] = &vals[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	got := make([]string, len(vals))
+	for i, v := range vals {
+		got[i] = v.String
+	}
+	if g := strings.Join(got, "|"); g != want {
+		t.Errorf("%s: got %q, want %q", what, g, want)
+	}
+}
+
+func TestIntegrationLoadSales(t *testing.T) {
+	seedSales(t)
+
+	runPipeline(t)
+	expect(t, "all rows loaded", "SELECT count(*) FROM salesdb", "5")
+	expect(t, "values and types",
+		"SELECT customer, region, sale_date::text, unit_price, sold_quantity, net_pay FROM salesdb WHERE fsno = 'FS-0002'",
+		"Hana Tesfaye|Oromia|2024-01-06|450.50|3.00|1351.50")
+	expect(t, "NULL kept", "SELECT region IS NULL, attachmentno FROM salesdb WHERE fsno = 'FS-0004'", "true|AT-4")
+	expect(t, "run recorded", "SELECT status, rows_processed FROM etl_runs ORDER BY started_at DESC LIMIT 1", "succeeded|5")
+
+	runPipeline(t)
+	expect(t, "rerun adds nothing", "SELECT count(*) FROM salesdb", "5")
+
+	if _, err := itest.source.Exec("UPDATE Sales SET netpay = 3100.00 WHERE fsno = 'FS-0001'"); err != nil {
+		t.Fatal(err)
+	}
+	runPipeline(t, "CONFLICT_ACTION=update")
+	expect(t, "changed row updated", "SELECT net_pay FROM salesdb WHERE fsno = 'FS-0001'", "3100.00")
+
+	if _, err := itest.source.Exec("DELETE FROM Sales WHERE fsno = 'FS-0005'"); err != nil {
+		t.Fatal(err)
+	}
+	runPipeline(t, "SWAP_LOAD=true", "LEASE_TTL=1m")
+	expect(t, "deleted row gone after swap", "SELECT count(*), count(*) FILTER (WHERE fsno = 'FS-0005') FROM salesdb", "4|0")
+	expect(t, "staging table swapped in", "SELECT to_regclass('salesdb_staging') IS NULL, to_regclass('salesdb_pkey') IS NOT NULL", "true|true")
+}
+
+// TestIntegrationEncryptedColumns inserts with the pgp_sym_encrypt INSERT
+// of ENCRYPTED_COLUMNS and checks pgp_sym_decrypt gives the values back.
+func TestIntegrationEncryptedColumns(t *testing.T) {
+	cfg := Config{
+		TargetTable:   "sales_encrypted",
+		EncryptionKey: "integration-key",
+		Columns: []column{
+			{Source: "fsno", Target: "fsno", Type: "VARCHAR(50)", Key: true},
+			{Source: "customer", Target: "customer", Type: "VARCHAR(100)", Encrypted: true},
+		},
+	}
+	ctx := context.Background()
+	if err := ensureTargetTable(ctx, itest.target, cfg); err != nil {
+		t.Fatal(err)
+	}
+	insertSQL := buildInsertSQL(cfg, cfg.Columns)
+
+	values := []string{"Abebe Kebede", "Selam Girma", "Café Ñandú", "ቡና ቤት", ""}
+	for i, v := range values {
+		fsno := fmt.Sprintf("FS-%04d", i+1)
+		if _, err := itest.target.ExecContext(ctx, insertSQL, fsno, v, cfg.EncryptionKey); err != nil {
+			t.Fatal(err)
+		}
+		var stored []byte
+		var decrypted string
+		err := itest.target.QueryRowContext(ctx, "SELECT customer, pgp_sym_decrypt(customer, $2) FROM sales_encrypted WHERE fsno = $1",
+			fsno, cfg.EncryptionKey).Scan(&stored, &decrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decrypted != v {
+			t.Errorf("pgp_sym_decrypt gave %q, want %q", decrypted, v)
+		}
+		if v != "" && strings.Contains(string(stored), v) {
+			t.Errorf("%q is stored in the clear", v)
+		}
+	}
+}
+
+// TestIntegrationCoalesceSources loads sale_date from the first non-null
+// of date, posting_date and entry_date, with each of them the populated one
+// in turn.
+func TestIntegrationCoalesceSources(t *testing.T) {
+	seedSales(t)
+	_, err := itest.source.Exec(`
+		ALTER TABLE Sales ADD posting_date DATE, entry_date DATE;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = itest.source.Exec(`
+		UPDATE Sales SET posting_date = '2024-06-01', entry_date = '2024-07-01' WHERE fsno = 'FS-0001';
+		UPDATE Sales SET date = NULL, posting_date = '2024-06-02', entry_date = '2024-07-02' WHERE fsno = 'FS-0002';
+		UPDATE Sales SET date = NULL, posting_date = NULL, entry_date = '2024-07-03' WHERE fsno = 'FS-0003';
+		UPDATE Sales SET date = NULL, posting_date = NULL, entry_date = NULL WHERE fsno = 'FS-0004';`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runPipeline(t, "TARGET_TABLE=sales_coalesced", "COALESCE_SOURCES=sale_date=date,posting_date,entry_date")
+	expect(t, "date first", "SELECT sale_date::text FROM sales_coalesced WHERE fsno = 'FS-0001'", "2024-01-05")
+	expect(t, "posting_date when date is NULL", "SELECT sale_date::text FROM sales_coalesced WHERE fsno = 'FS-0002'", "2024-06-02")
+	expect(t, "entry_date when both are NULL", "SELECT sale_date::text FROM sales_coalesced WHERE fsno = 'FS-0003'", "2024-07-03")
+	expect(t, "NULL when all are NULL", "SELECT sale_date IS NULL FROM sales_coalesced WHERE fsno = 'FS-0004'", "true")
+}
+
+// TestIntegrationNumericAsString loads DECIMAL(38, 9) values beyond float64
+// precision into NUMERIC(38, 9) with NUMERIC_AS_STRING.
+func TestIntegrationNumericAsString(t *testing.T) {
+	_, err := itest.source.Exec(`
+		DROP TABLE IF EXISTS Amounts;
+		CREATE TABLE Amounts (id VARCHAR(20) NOT NULL PRIMARY KEY, amount DECIMAL(38, 9));
+		INSERT INTO Amounts VALUES
+			('big', 12345678901234567890.123456789),
+			('tiny', -0.000000001),
+			('none', NULL);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := `
+source:
+  table: Amounts
+target:
+  table: amounts_exact
+key: id
+columns:
+  - {source: id, target: id, type: VARCHAR(20)}
+  - {source: amount, target: amount, type: "NUMERIC(38, 9)"}
+`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	runConfig(t, path, "NUMERIC_AS_STRING=true")
+	expect(t, "digits beyond float64 kept", "SELECT amount::text FROM amounts_exact WHERE id = 'big'", "12345678901234567890.123456789")
+	expect(t, "smallest fraction kept", "SELECT amount::text FROM amounts_exact WHERE id = 'tiny'", "-0.000000001")
+	expect(t, "NULL kept", "SELECT amount IS NULL FROM amounts_exact WHERE id = 'none'", "true")
+}
+
+// TestIntegrationRowVersionBounds runs the rowversion range read on SQL
+// Server with bounds where a byte-wise and a little-endian comparison
+// disagree, and checks the bytes are compared in order.
+func TestIntegrationRowVersionBounds(t *testing.T) {
+	_, err := itest.source.Exec(`
+		DROP TABLE IF EXISTS RowVersions;
+		CREATE TABLE RowVersions (fsno VARCHAR(50) NOT NULL PRIMARY KEY, rv BINARY(8) NOT NULL);
+		INSERT INTO RowVersions VALUES
+			('below',    0x00000000000000FE),
+			('from',     0x00000000000000FF),
+			('between',  0x0000000000000100),
+			('to',       0x0000000000000200),
+			('above',    0x0100000000000000);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Source: sourceMSSQL, SourceTable: "RowVersions", RowVersionColumn: "rv"}
+	cols := []column{{Source: "fsno", Target: "fsno", Type: "VARCHAR(50)", Key: true}}
+	r := &rowVersionRange{
+		from: []byte{0, 0, 0, 0, 0, 0, 0, 0xff},
+		to:   []byte{0, 0, 0, 0, 0, 0, 0x02, 0},
+	}
+	query, args := sourceQuery(cfg, cols, nil, readPlan{ordered: true, delta: r}, 0)
+	rows, err := itest.source.Query(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var fsno string
+		if err := rows.Scan(&fsno); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fsno)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "between,from" {
+		t.Errorf("read %v, want [between from]", got)
+	}
+}
+
+// TestIntegrationRowVersionLoad loads a table with a rowversion column
+// twice, and checks the second run reads only the changed row and stores
+// MIN_ACTIVE_ROWVERSION() as the watermark.
+func TestIntegrationRowVersionLoad(t *testing.T) {
+	seedSales(t)
+	if _, err := itest.source.Exec("ALTER TABLE Sales ADD rv ROWVERSION"); err != nil {
+		t.Fatal(err)
+	}
+	env := []string{"TARGET_TABLE=sales_delta", "ROWVERSION_COLUMN=rv", "CONFLICT_ACTION=update"}
+	runPipeline(t, env...)
+	expect(t, "first run reads every row", "SELECT count(*) FROM sales_delta", "5")
+
+	if _, err := itest.source.Exec("UPDATE Sales SET netpay = 3100.00 WHERE fsno = 'FS-0001'"); err != nil {
+		t.Fatal(err)
+	}
+	runPipeline(t, env...)
+	expect(t, "changed row read", "SELECT net_pay FROM sales_delta WHERE fsno = 'FS-0001'", "3100.00")
+	expect(t, "only the changed row read",
+		"SELECT rows_extracted FROM etl_runs WHERE table_name = 'sales_delta' ORDER BY started_at DESC LIMIT 1", "1")
+
+	var active []byte
+	if err := itest.source.QueryRow("SELECT CAST(MIN_ACTIVE_ROWVERSION() AS binary(8))").Scan(&active); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "watermark is MIN_ACTIVE_ROWVERSION()",
+		"SELECT encode(row_version, 'hex') FROM etl_watermarks WHERE scope = 'sales_delta'", fmt.Sprintf("%x", active))
+}
+
+// benchSalesRows is the size of the table the source read benchmarks read.
+const benchSalesRows = 200000
+
+// seedBenchSales fills BenchSales with benchSalesRows rows shaped like
+// Sales, unless an earlier benchmark did.
+func seedBenchSales(b *testing.B) {
+	b.Helper()
+	var n int
+	if err := itest.source.QueryRow("SELECT COUNT(*) FROM sys.tables WHERE name = 'BenchSales'").Scan(&n); err != nil {
+		b.Fatal(err)
+	}
+	if n > 0 {
+		return
+	}
+	_, err := itest.source.Exec(fmt.Sprintf(`
+		SELECT * INTO BenchSales FROM Sales WHERE 1 = 0;
+		ALTER TABLE BenchSales ADD PRIMARY KEY (fsno);
+		WITH n AS (
+			SELECT TOP (%d) ROW_NUMBER() OVER (ORDER BY (SELECT NULL)) AS i
+			FROM sys.all_objects a CROSS JOIN sys.all_objects b
+		)
+		INSERT INTO BenchSales
+		SELECT CONCAT('FS-', FORMAT(i, '0000000')), 'Cash', CONCAT('AT-', i), CONCAT('Customer ', i %% 5000), 'Addis Ababa',
+			DATEADD(day, i %% 1000, '2022-01-01'), CONCAT('P-', i %% 300), 'Teff 25kg', 'bag', 1500.00, i %% 10, 1500.00 * (i %% 10)
+		FROM n;`, benchSalesRows))
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkIntegrationSourceRead reads BenchSales with the plain streaming
+// query and through the SOURCE_CURSOR cursor at two fetch sizes:
+//
+//	go test -tags integration -run '^$' -bench SourceRead ./...
+func BenchmarkIntegrationSourceRead(b *testing.B) {
+	seedSales(b)
+	seedBenchSales(b)
+	cols := insertColumns(salesColumns)
+	cfg := Config{Source: sourceMSSQL, SourceTable: "BenchSales"}
+	query, args := sourceQuery(cfg, cols, nil, readPlan{ordered: true}, 0)
+
+	for _, bc := range []struct {
+		name      string
+		cursor    bool
+		fetchSize int
+	}{
+		{"streaming", false, 0},
+		{"cursor/fetch=1000", true, 1000},
+		{"cursor/fetch=10000", true, 10000},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			cfg := cfg
+			cfg.SourceCursor, cfg.SourceFetchSize = bc.cursor, bc.fetchSize
+			for i := 0; i < b.N; i++ {
+				rows, err := querySource(context.Background(), itest.source, cfg, query, args...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n := 0
+				vals := make([]any, len(cols))
+				for rows.Next() {
+					for j, c := range cols {
+						vals[j] = c.scanDest()
+					}
+					if err := rows.Scan(vals...); err != nil {
+						b.Fatal(err)
+					}
+					n++
+				}
+				if err := rows.Err(); err != nil {
+					b.Fatal(err)
+				}
+				rows.Close()
+				if n != benchSalesRows {
+					b.Fatalf("read %d rows, want %d", n, benchSalesRows)
+				}
+			}
+			b.ReportMetric(float64(benchSalesRows*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+// genRows generates n Sales rows in fsno order.
+type genRows struct {
+	n, i int
+}
+
+func (r *genRows) Next() bool {
+	r.i++
+	return r.i <= r.n
+}
+
+func (r *genRows) Scan(dest ...any) error {
+	for j, d := range dest {
+		switch d := d.(type) {
+		case *sql.NullString:
+			*d = sql.NullString{String: fmt.Sprintf("%s-%07d", salesColumns[j].Source, r.i), Valid: true}
+		case *sql.NullTime:
+			*d = sql.NullTime{Time: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, r.i%1000), Valid: true}
+		case *sql.NullFloat64:
+			*d = sql.NullFloat64{Float64: float64(r.i%10000) / 4, Valid: true}
+		}
+	}
+	return nil
+}
+
+func (r *genRows) Err() error   { return nil }
+func (r *genRows) Close() error { return nil }
+
+// benchWriterRows is how many rows one writer benchmark iteration loads.
+const benchWriterRows = 20000
+
+// BenchmarkIntegrationWriter loads generated rows into an empty target with
+// each WRITE_METHOD, at the default BATCH_SIZE:
+//
+//	go test -tags integration -run '^$' -bench Writer ./...
+func BenchmarkIntegrationWriter(b *testing.B) {
+	b.Setenv("MSSQL_CONN", itest.mssqlConn)
+	b.Setenv("POSTGRES_CONN", itest.postgresConn)
+	for _, method := range []string{writeInsert, writeJSON, writeCopy} {
+		b.Run(method, func(b *testing.B) {
+			b.Setenv("WRITE_METHOD", method)
+			b.Setenv("TARGET_TABLE", "bench_writer_"+method)
+			cfgs, err := loadConfig("")
+			if err != nil {
+				b.Fatal(err)
+			}
+			cfg := cfgs[0]
+			ctx := context.Background()
+			if err := ensureTargetTable(ctx, itest.target, cfg); err != nil {
+				b.Fatal(err)
+			}
+			cols := insertColumns(cfg.Columns)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if _, err := itest.target.Exec("TRUNCATE " + cfg.TargetTable); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				sink := newSink(ctx, cfg, "bench", itest.target, cols, nil)
+				res, err := loadRows(ctx, cfg, "bench", sink, cols, &genRows{n: benchWriterRows}, nil, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if res.rows != benchWriterRows {
+					b.Fatalf("loaded %d rows, want %d", res.rows, benchWriterRows)
+				}
+			}
+			b.ReportMetric(float64(benchWriterRows*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values of KAFKA_FORMAT and KAFKA_DELIVERY.
+const (
+	kafkaJSON = "json"
+	kafkaAvro = "avro"
+
+	// kafkaAtLeastOnce retries a failed publish and fails the run if it
+	// cannot be delivered; a rerun may publish rows again.
+	kafkaAtLeastOnce = "at-least-once"
+	// kafkaBestEffort logs a failed publish and carries on.
+	kafkaBestEffort = "best-effort"
+)
+
+// kafkaChunk is how many records go into one request to the REST proxy.
+const kafkaChunk = 500
+
+// kafkaRecord is one message: the key column and the row keyed by target
+// column, in the REST proxy's embedded format.
+type kafkaRecord struct {
+	Key   any `json:"key"`
+	Value any `json:"value"`
+}
+
+// kafkaPublisher publishes rows to KAFKA_TOPIC through a Kafka REST Proxy
+// (Confluent REST Proxy API v2), as JSON or as Avro with a schema derived
+// from the mapping. Rows are held until send, which a Postgres load calls
+// as it commits each batch. A nil publisher does nothing.
+type kafkaPublisher struct {
+	ctx     context.Context
+	cfg     Config
+	cols    []column
+	keyIdx  int
+	client  *http.Client
+	pending []kafkaRecord
+
+	keySchema, valueSchema string
+	// The proxy registers the schemas on the first request and returns
+	// their IDs, which later requests send instead.
+	keySchemaID, valueSchemaID int
+	sent                       int
+}
+
+func newKafkaPublisher(ctx context.Context, cfg Config, cols []column) *kafkaPublisher {
+	if cfg.KafkaTopic == "" || cfg.DryRun {
+		return nil
+	}
+	p := &kafkaPublisher{ctx: ctx, cfg: cfg, cols: cols, client: &http.Client{Timeout: 30 * time.Second}}
+	for i, c := range cols {
+		if c.Key {
+			p.keyIdx = i
+		}
+	}
+	if cfg.KafkaFormat == kafkaAvro {
+		p.keySchema = avroSchema(cfg.TargetTable+"_key", cols[p.keyIdx:p.keyIdx+1])
+		p.valueSchema = avroSchema(cfg.TargetTable, cols)
+	}
+	return p
+}
+
+// add queues one transformed row.
+func (p *kafkaPublisher) add(vals []any) {
+	if p == nil {
+		return
+	}
+	value := make(map[string]any, len(p.cols))
+	for i, c := range p.cols {
+		value[c.Target] = p.encode(c, vals[i])
+	}
+	p.pending = append(p.pending, kafkaRecord{Key: p.encode(p.cols[p.keyIdx], vals[p.keyIdx]), Value: value})
+}
+
+func (p *kafkaPublisher) encode(c column, v any) any {
+	if p.cfg.KafkaFormat == kafkaAvro {
+		return avroValue(c, v)
+	}
+	return jsonValue(c, v)
+}
+
+// discard drops the rows queued since the last send.
+func (p *kafkaPublisher) discard() {
+	if p == nil {
+		return
+	}
+	p.pending = nil
+}
+
+// send publishes the queued rows. With KAFKA_DELIVERY=at-least-once a
+// failed request is retried with the RETRY_BACKOFF schedule, up to
+// TX_RETRIES times, and then fails the load; with best-effort the rows are
+// dropped with a warning.
+func (p *kafkaPublisher) send() error {
+	if p == nil {
+		return nil
+	}
+	defer p.discard()
+	for start := 0; start < len(p.pending); start += kafkaChunk {
+		chunk := p.pending[start:min(start+kafkaChunk, len(p.pending))]
+		err := p.post(chunk)
+		for attempt := 0; err != nil && p.cfg.KafkaDelivery == kafkaAtLeastOnce && attempt < p.cfg.TxRetries; attempt++ {
+			wait := retryBackoff(p.cfg, attempt)
+			slog.Warn("Failed to publish to Kafka; retrying", "table", p.cfg.TargetTable, "topic", p.cfg.KafkaTopic, "error", err, "wait", wait, "attempt", attempt+1)
+			if !sleepContext(p.ctx, wait) {
+				break
+			}
+			err = p.post(chunk)
+		}
+		if err != nil && p.cfg.KafkaDelivery == kafkaAtLeastOnce {
+			return fmt.Errorf("failed to publish to Kafka topic %s: %w", p.cfg.KafkaTopic, err)
+		}
+		if err != nil {
+			slog.Warn("Failed to publish to Kafka; dropping the rows", "table", p.cfg.TargetTable, "topic", p.cfg.KafkaTopic, "rows", len(chunk), "error", err)
+			continue
+		}
+		p.sent += len(chunk)
+	}
+	return nil
+}
+
+// post sends one request. A record the proxy could not write fails the
+// whole request, which is then sent again: at least once.
+func (p *kafkaPublisher) post(records []kafkaRecord) error {
+	body := map[string]any{"records": records}
+	contentType := "application/vnd.kafka.json.v2+json"
+	if p.cfg.KafkaFormat == kafkaAvro {
+		contentType = "application/vnd.kafka.avro.v2+json"
+		if p.valueSchemaID == 0 {
+			body["key_schema"], body["value_schema"] = p.keySchema, p.valueSchema
+		} else {
+			body["key_schema_id"], body["value_schema_id"] = p.keySchemaID, p.valueSchemaID
+		}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodPost, strings.TrimRight(p.cfg.KafkaRESTURL, "/")+"/topics/"+p.cfg.KafkaTopic, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if p.cfg.KafkaUser != "" {
+		req.SetBasicAuth(p.cfg.KafkaUser, p.cfg.KafkaPassword)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("REST proxy returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		KeySchemaID   *int `json:"key_schema_id"`
+		ValueSchemaID *int `json:"value_schema_id"`
+		Offsets       []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid REST proxy response: %w", err)
+	}
+	for _, o := range result.Offsets {
+		if o.ErrorCode != nil {
+			return fmt.Errorf("REST proxy could not write a record: %s (error code %d)", o.Error, *o.ErrorCode)
+		}
+	}
+	if result.KeySchemaID != nil && result.ValueSchemaID != nil {
+		p.keySchemaID, p.valueSchemaID = *result.KeySchemaID, *result.ValueSchemaID
+	}
+	return nil
+}
+
+// avroSchema derives an Avro record schema from cols, as newParquetColumn
+// does for Parquet: every field is nullable, numbers are doubles, DATE is
+// a date and TIMESTAMP microseconds since the epoch.
+func avroSchema(name string, cols []column) string {
+	fields := make([]map[string]any, len(cols))
+	for i, c := range cols {
+		fields[i] = map[string]any{"name": c.Target, "type": []any{"null", avroType(c)}, "default": nil}
+	}
+	schema, _ := json.Marshal(map[string]any{"type": "record", "name": avroName(name), "fields": fields})
+	return string(schema)
+}
+
+func avroType(c column) any {
+	switch {
+	case c.Sequence:
+		return "long"
+	case c.kind() == kindTime && strings.HasPrefix(strings.ToUpper(c.Type), "DATE"):
+		return map[string]string{"type": "int", "logicalType": "date"}
+	case c.kind() == kindTime:
+		return map[string]string{"type": "long", "logicalType": "timestamp-micros"}
+	case c.kind() == kindNumeric:
+		return "double"
+	}
+	return "string"
+}
+
+// avroName makes a valid Avro name of a table name such as public.SalesDB.
+func avroName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// avroValue encodes a value for the REST proxy's Avro JSON format, in
+// which a non-null value of a nullable field names its type.
+func avroValue(c column, v any) any {
+	switch v := v.(type) {
+	case *sql.NullString:
+		if !v.Valid {
+			return nil
+		}
+		if c.kind() == kindNumeric {
+			f, _ := strconv.ParseFloat(strings.TrimSpace(v.String), 64)
+			return map[string]any{"double": f}
+		}
+		return map[string]any{"string": v.String}
+	case *sql.NullFloat64:
+		if v.Valid {
+			return map[string]any{"double": v.Float64}
+		}
+	case *sql.NullInt64:
+		if v.Valid && c.kind() == kindNumeric && !c.Sequence {
+			return map[string]any{"double": float64(v.Int64)}
+		}
+		if v.Valid {
+			return map[string]any{"long": v.Int64}
+		}
+	case *sql.NullTime:
+		if !v.Valid {
+			return nil
+		}
+		if strings.HasPrefix(strings.ToUpper(c.Type), "DATE") {
+			return map[string]any{"int": v.Time.Unix() / 86400}
+		}
+		return map[string]any{"long": v.Time.UnixMicro()}
+	}
+	return nil
+}
+
+// kafkaSink is the rowSink of TARGET=kafka: rows are only published. It
+// sends every kafkaChunk rows rather than holding a whole batch, since
+// there is no transaction to wait for.
+type kafkaSink struct {
+	cfg     Config
+	publish *kafkaPublisher
+}
+
+func (s *kafkaSink) begin() error { return nil }
+
+func (s *kafkaSink) write(vals []any) error {
+	s.publish.add(vals)
+	if s.publish != nil && len(s.publish.pending) >= kafkaChunk {
+		return s.publish.send()
+	}
+	return nil
+}
+
+func (s *kafkaSink) batchDone(rows int) bool { return false }
+
+func (s *kafkaSink) flush() error { return nil }
+
+func (s *kafkaSink) commit(rows int) error {
+	if err := s.publish.send(); err != nil {
+		return err
+	}
+	if s.publish != nil {
+		etlMetrics.rowsInserted.add(s.cfg.TargetTable, float64(s.publish.sent))
+		s.publish.sent = 0
+	}
+	return nil
+}
+
+func (s *kafkaSink) abort() { s.publish.discard() }
+
+func (s *kafkaSink) state() execer { return nil }
+
+func (s *kafkaSink) rejectScan(rows sourceRows, err error) (bool, error) { return false, nil }
+
+func (s *kafkaSink) rejectRow(stage string, vals []any, reason error) (bool, error) {
+	return false, nil
+}
+
+func (s *kafkaSink) report(res *loadResult) {}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const leaseTableName = "etl_leases"
+
+// errLeaseLost is the cause a run's context is cancelled with when its
+// lease was broken or taken over.
+var errLeaseLost = errors.New("the run lease was broken or taken over")
+
+// lease is a visible run lock in the target database. Unlike a session lock
+// it survives as a row operators can inspect, and it expires on its own if
+// the holder dies without releasing it.
+type lease struct {
+	db    *sql.DB
+	name  string
+	owner string
+	ttl   time.Duration
+	stop  chan struct{}
+	done  chan struct{}
+
+	// ctx is the run's context under the lease. It is cancelled with
+	// errLeaseLost once renewal finds the lease gone, so the run stops
+	// writing before another owner starts.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+func ensureLeaseTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			name VARCHAR(100) PRIMARY KEY,
+			owner VARCHAR(200) NOT NULL,
+			acquired_at TIMESTAMPTZ NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+	`, leaseTableName))
+	if err != nil {
+		return fmt.Errorf("failed to create lease table: %w", err)
+	}
+	return nil
+}
+
+func leaseOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// acquireLease takes the lease named name, or fails if another owner holds
+// one that has not expired yet. The lease is renewed every ttl/3 until
+// release is called. The run must use the lease's ctx from then on.
+func acquireLease(ctx context.Context, db *sql.DB, name string, ttl time.Duration) (*lease, error) {
+	if err := ensureLeaseTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	l := &lease{db: db, name: name, owner: leaseOwner(), ttl: ttl}
+
+	var owner string
+	err := db.QueryRowContext(ctx, fmt.Sprintf(`
+		INSERT INTO %[1]s (name, owner, acquired_at, expires_at)
+		VALUES ($1, $2, now(), now() + $3 * interval '1 millisecond')
+		ON CONFLICT (name) DO UPDATE
+			SET owner = EXCLUDED.owner, acquired_at = EXCLUDED.acquired_at, expires_at = EXCLUDED.expires_at
+			WHERE %[1]s.expires_at < now()
+		RETURNING owner`, leaseTableName), name, l.owner, ttl.Milliseconds()).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		var holder string
+		var expires time.Time
+		if err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT owner, expires_at FROM %s WHERE name = $1", leaseTableName), name).Scan(&holder, &expires); err != nil {
+			return nil, fmt.Errorf("lease %s is held by another run", name)
+		}
+		return nil, fmt.Errorf("lease %s is held by %s until %s", name, holder, expires.Format(time.RFC3339))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire lease %s: %w", name, err)
+	}
+
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	l.ctx, l.cancel = context.WithCancelCause(ctx)
+	go l.heartbeat()
+
+	slog.Info("Acquired lease", "lease", name, "owner", l.owner, "ttl", ttl)
+	return l, nil
+}
+
+func (l *lease) heartbeat() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			res, err := l.db.ExecContext(context.Background(), fmt.Sprintf(`
+				UPDATE %s SET expires_at = now() + $3 * interval '1 millisecond'
+				WHERE name = $1 AND owner = $2`, leaseTableName), l.name, l.owner, l.ttl.Milliseconds())
+			if err != nil {
+				slog.Warn("Failed to renew lease", "lease", l.name, "error", err)
+				continue
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				slog.Error("Lease was broken or taken over; stopping the run", "lease", l.name)
+				l.cancel(fmt.Errorf("lease %s: %w", l.name, errLeaseLost))
+				return
+			}
+		}
+	}
+}
+
+// release stops the heartbeat and deletes the lease if we still own it.
+// It runs after a shutdown too, so it does not use the run's context.
+func (l *lease) release() {
+	close(l.stop)
+	<-l.done
+	l.cancel(nil)
+
+	if _, err := l.db.ExecContext(context.Background(), fmt.Sprintf("DELETE FROM %s WHERE name = $1 AND owner = $2", leaseTableName), l.name, l.owner); err != nil {
+		slog.Warn("Failed to release lease", "lease", l.name, "error", err)
+		return
+	}
+	slog.Info("Released lease", "lease", l.name)
+}
+
+// lost returns the error the run was stopped with if its lease was lost,
+// and nil otherwise or without a lease.
+func (l *lease) lost() error {
+	if l == nil {
+		return nil
+	}
+	if cause := context.Cause(l.ctx); errors.Is(cause, errLeaseLost) {
+		return cause
+	}
+	return nil
+}
+
+// breakLease removes the lease regardless of owner. It is the operator's
+// escape hatch for a stale lease left by a hung run.
+func breakLease(ctx context.Context, db *sql.DB, name string) error {
+	if err := ensureLeaseTable(ctx, db); err != nil {
+		return err
+	}
+
+	var owner string
+	err := db.QueryRowContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE name = $1 RETURNING owner", leaseTableName), name).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		slog.Info("No lease to break", "lease", name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to break lease %s: %w", name, err)
+	}
+	slog.Info("Broke lease", "lease", name, "owner", owner)
+	return nil
+}
+
+// leaseHolder returns the owner and expiry of the lease named name, or an
+// empty owner if nobody holds a valid one.
+func leaseHolder(ctx context.Context, db *sql.DB, name string) (string, time.Time, error) {
+	if err := ensureLeaseTable(ctx, db); err != nil {
+		return "", time.Time{}, err
+	}
+
+	var owner string
+	var expires time.Time
+	err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT owner, expires_at FROM %s WHERE name = $1 AND expires_at >= now()", leaseTableName), name).Scan(&owner, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to look up lease %s: %w", name, err)
+	}
+	return owner, expires, nil
+}
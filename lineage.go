@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// newRunID returns a random (version 4) UUID identifying one ETL run.
+func newRunID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("run-%d", time.Now().UnixNano())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+type lineageDataset struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	AsOf     string `json:"as_of,omitempty"`
+}
+
+type lineageColumn struct {
+	Source     string   `json:"source,omitempty"`
+	Target     string   `json:"target"`
+	Transforms []string `json:"transforms"`
+}
+
+type lineageDoc struct {
+	RunID       string          `json:"run_id"`
+	GeneratedAt time.Time       `json:"generated_at"`
+	Source      lineageDataset  `json:"source"`
+	Target      lineageDataset  `json:"target"`
+	Columns     []lineageColumn `json:"columns"`
+}
+
+// dsnParts returns the host and database of a URL-style connection
+// string (or a MySQL DSN), leaving out credentials so the result is safe
+// to publish.
+func dsnParts(dsn string) (host, database string) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.Host == "" {
+		return mysqlDSNParts(dsn)
+	}
+	database = u.Query().Get("database")
+	if database == "" {
+		database = strings.TrimPrefix(u.Path, "/")
+	}
+	return u.Host, database
+}
+
+// dsnDatabase returns "host/database" for a connection string.
+func dsnDatabase(dsn string) string {
+	host, database := dsnParts(dsn)
+	if host == "" {
+		return ""
+	}
+	return host + "/" + database
+}
+
+// columnTransforms lists, in order, what the pipeline does to a column
+// between reading it and storing it.
+func columnTransforms(cfg Config, c column) []string {
+	transforms := []string{}
+	if c.Generated != "" {
+		return append(transforms, "generated("+c.Generated+")")
+	}
+	if c.Sequence {
+		return append(transforms, "load_sequence")
+	}
+	if c.RowHash {
+		return append(transforms, "row_hash")
+	}
+	if c.isText() {
+		if cfg.SourceEncoding != nil {
+			transforms = append(transforms, "transcode_to_utf8")
+		}
+		if cfg.SanitizeText != sanitizeOff {
+			transforms = append(transforms, "sanitize_control_chars("+cfg.SanitizeText+")")
+		}
+	}
+	// COLUMN_TRANSFORMS, including hash and mask, by name and argument.
+	transforms = append(transforms, c.Transforms...)
+	if kind, value, _ := parseNullPolicy(c.OnNull); kind == nullDefault {
+		transforms = append(transforms, "null_default("+value+")")
+	}
+	if c.Tokenized {
+		transforms = append(transforms, "format_preserving_token")
+	}
+	if c.Encrypted {
+		transforms = append(transforms, "pgp_sym_encrypt")
+	}
+	return transforms
+}
+
+func buildLineage(cfg Config, runID string) lineageDoc {
+	doc := lineageDoc{
+		RunID:       runID,
+		GeneratedAt: time.Now().UTC(),
+		Source:      lineageDataset{Database: dsnDatabase(cfg.MSSQLConn), Table: cfg.SourceTable},
+		Target:      lineageDataset{Database: dsnDatabase(cfg.PostgresConn), Table: cfg.TargetTable},
+	}
+	switch cfg.Source {
+	case sourceCSV:
+		doc.Source = lineageDataset{Table: cfg.SourceFile}
+	case sourceMySQL:
+		doc.Source.Database = dsnDatabase(cfg.MySQLConn)
+	case sourceOracle:
+		doc.Source.Database = dsnDatabase(cfg.OracleConn)
+	}
+	if !cfg.AsOf.IsZero() {
+		doc.Source.AsOf = cfg.AsOf.Format(time.RFC3339)
+	}
+	for _, c := range cfg.Columns {
+		source := c.Source
+		if c.computed() {
+			source = ""
+		}
+		doc.Columns = append(doc.Columns, lineageColumn{
+			Source:     source,
+			Target:     c.Target,
+			Transforms: columnTransforms(cfg, c),
+		})
+	}
+	return doc
+}
+
+// writeLineage writes the run's column-level lineage as JSON to path.
+func writeLineage(path string, doc lineageDoc) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode lineage: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write lineage to %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Formats for LOG_FORMAT.
+const (
+	logText = "text"
+	logJSON = "json"
+)
+
+// parseLogLevel reads LOG_LEVEL: debug, info, warn or error.
+func parseLogLevel(v string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(v)); err != nil {
+		return 0, fmt.Errorf("invalid LOG_LEVEL %q: expected debug, info, warn or error", v)
+	}
+	return level, nil
+}
+
+// setupLogging installs the process-wide logger. Anything still written
+// with the standard log package goes through it at INFO.
+func setupLogging(cfg Config) {
+	if cfg.LogFile != "" {
+		f, err := os.OpenFile(cfg.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			fatal("Failed to open LOG_FILE", "error", err)
+		}
+		logOutput.out = f
+	}
+	opts := &slog.HandlerOptions{Level: cfg.LogLevel}
+	var handler slog.Handler = slog.NewTextHandler(logOutput, opts)
+	if cfg.LogFormat == logJSON {
+		handler = slog.NewJSONHandler(logOutput, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// fatal logs msg at ERROR and exits with status 1, like log.Fatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
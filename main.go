@@ -1,173 +1,690 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"strings"
 	"time"
 	_ "github.com/denisenkom/go-mssqldb"
 	_ "github.com/lib/pq"
 	"github.com/joho/godotenv" // Library for loading .env files
 )
 
-type DataRow struct {
-	FsNo            string
-	SaleType        string
-	AttachmentNo    string
-	Customer        string
-	Region          string
-	Date            time.Time 
-	Code            string
-	Name            string
-	MeasurementUnit string
-	UnitPrice       float64
-	SoldQuantity    float64
-	NetPay          float64
+// Exit codes other than the default 1 used by fatal, so the orchestrator
+// can tell a failed data check apart from a crashed run.
+const (
+	exitRowCountOutOfBand = 3
+	exitValidationFailed  = 4
+	exitMirrorFailed      = 5
+)
+
+// exitCodeError is a failure that exits with code rather than 1.
+type exitCodeError struct {
+	code int
+	err  error
 }
 
+func (e exitCodeError) Error() string { return e.err.Error() }
 
-const (
-	sourceTableName = "Sales"   // MSSQL Source Table
-	targetTableName = "SalesDB" // PostgreSQL Target Table
-)
+func (e exitCodeError) Unwrap() error { return e.err }
+
+// exitOnError exits the process for a failed run: exitInterrupted if ctx
+// was cancelled, the code of an exitCodeError, and 1 otherwise.
+func exitOnError(ctx context.Context, cfg Config, err error) {
+	if ctx.Err() != nil {
+		slog.Error("ETL Process interrupted", "table", cfg.TargetTable, "error", err)
+		os.Exit(exitInterrupted)
+	}
+	slog.Error("ETL Process failed", "table", cfg.TargetTable, "error", err)
+	var ec exitCodeError
+	if errors.As(err, &ec) {
+		os.Exit(ec.code)
+	}
+	os.Exit(1)
+}
 
 func main() {
-	log.Println("Starting Go ETL Pipeline...")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [run|validate|schema|status|serve|service] [flags]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "  run       load the source into the target (the default)")
+		fmt.Fprintln(flag.CommandLine.Output(), "  validate  compare row counts, key checksums and column aggregates of source and target")
+		fmt.Fprintln(flag.CommandLine.Output(), "  schema    print the target DDL without connecting")
+		fmt.Fprintln(flag.CommandLine.Output(), "  status    print the last run and lease of each table")
+		fmt.Fprintln(flag.CommandLine.Output(), "  serve     serve an HTTP API that starts runs on request (API_ADDR)")
+		fmt.Fprintln(flag.CommandLine.Output(), "  service   install or uninstall the Windows service, e.g. service install run -schedule \"0 2 * * *\"")
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
+	breakLeaseFlag := flag.Bool("break-lease", false, "remove the run lease regardless of its owner and exit")
+	force := flag.Bool("force", false, "start even if a safety check (e.g. clock skew) would refuse to")
+	detokenize := flag.String("detokenize", "", "print the original value of a token using TOKENIZATION_KEY and exit")
+	conflictAction := flag.String("conflict-action", "", "what to do with rows whose fsno is already loaded: nothing, update, replace or scd2 (overrides CONFLICT_ACTION)")
+	dryRun := flag.Bool("dry-run", false, "read and transform the source but write nothing to the target (sets DRY_RUN)")
+	migrate := flag.Bool("migrate", false, "add missing columns to the target table and widen their types before loading (sets MIGRATE)")
+	configPath := flag.String("config", "", "YAML config file with connections, tables and column mapping (default $CONFIG_FILE)")
+	scheduleSpec := flag.String("schedule", "", "keep running and load on a schedule: an interval such as 15m, or a cron expression such as \"0 2 * * *\"")
+	workdir := flag.String("workdir", "", "change to this directory first, so .env and relative paths are found there")
+	asService := flag.Bool("service", false, "run under the Windows service manager (set by service install)")
 
-	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
-		log.Fatalf("Error loading .env file: %v", err)
+	command, args, err := splitCommand(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	flag.CommandLine.Parse(args)
+	ctx, stop := shutdownContext()
+
+	if command == cmdService {
+		switch flag.Arg(0) {
+		case "install":
+			err = installService(flag.Args()[1:])
+		case "uninstall":
+			err = uninstallService()
+		default:
+			err = fmt.Errorf("expected service install <command line> or service uninstall")
+		}
+		if err != nil {
+			fatal("Service command failed", "error", err)
+		}
+		return
+	}
+	if *workdir != "" {
+		if err := os.Chdir(*workdir); err != nil {
+			fatal("Failed to change to the working directory", "error", err)
+		}
+	}
+	if *asService {
+		serviceDone, err := startWindowsService(stop)
+		if err != nil {
+			fatal("Failed to start as a service", "error", err)
+		}
+		defer serviceDone(0)
 	}
 
-	mssqlDSN := os.Getenv("MSSQL_CONN")
-	postgresDSN := os.Getenv("POSTGRES_CONN")
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		fatal("Error loading .env file", "error", err)
+	}
 
-	if mssqlDSN == "" || postgresDSN == "" {
-		log.Fatal("MSSQL_CONN and POSTGRES_CONN environment variables must be set. Check your .env file.")
+	if *detokenize != "" {
+		key := os.Getenv("TOKENIZATION_KEY")
+		if key == "" {
+			fatal("TOKENIZATION_KEY must be set to detokenize")
+		}
+		fmt.Println(tokenizer{key: []byte(key)}.Detokenize(*detokenize))
+		return
 	}
 
-	sourceDB, err := sql.Open("sqlserver", mssqlDSN)
+	if *configPath == "" {
+		*configPath = os.Getenv("CONFIG_FILE")
+	}
+	// loadTables reads the table configurations, at startup and again on
+	// every reload of a long-running process.
+	loadTables := func() ([]Config, error) {
+		// Flags override the environment, after a reload too.
+		if *conflictAction != "" {
+			os.Setenv("CONFLICT_ACTION", *conflictAction)
+		}
+		if *dryRun {
+			os.Setenv("DRY_RUN", "true")
+		}
+		if *migrate {
+			os.Setenv("MIGRATE", "true")
+		}
+		cfgs, err := loadConfig(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		if *scheduleSpec != "" {
+			if cfgs[0].IdempotencyKey != "" {
+				return nil, fmt.Errorf("IDEMPOTENCY_KEY cannot be used with -schedule: every run after the first would be a no-op")
+			}
+			for i := range cfgs {
+				if !cfgs[i].RunTriggerSet {
+					cfgs[i].RunTrigger = triggerSchedule
+				}
+			}
+		}
+		if command == cmdServe && cfgs[0].IdempotencyKey != "" {
+			return nil, fmt.Errorf("IDEMPOTENCY_KEY cannot be used with serve: every run after the first would be a no-op")
+		}
+		return cfgs, nil
+	}
+	if *scheduleSpec != "" && command != cmdRun {
+		fatal("-schedule only applies to the run command")
+	}
+	cfgs, err := loadTables()
 	if err != nil {
-		log.Fatalf("Error connecting to MSSQL Source: %v", err)
+		fatal("Invalid configuration", "error", err)
 	}
-	defer sourceDB.Close()
-	if err = sourceDB.Ping(); err != nil {
-		log.Fatalf("Error pinging MSSQL Source: %v", err)
+	var sched schedule
+	if *scheduleSpec != "" {
+		if sched, err = parseSchedule(*scheduleSpec); err != nil {
+			fatal("Invalid configuration", "error", err)
+		}
+	}
+	// Logging is process-wide, so the first table's settings apply.
+	setupLogging(cfgs[0])
+	if command == cmdRun || command == cmdServe {
+		slog.Info("Starting Go ETL Pipeline")
+	}
+	if command == cmdSchema {
+		printSchema(cfgs)
+		return
 	}
-	log.Println("Successfully connected to MSSQL Source.")
+	// Connections and source settings are shared by all tables.
+	cfg := cfgs[0]
 
-	targetDB, err := sql.Open("postgres", postgresDSN)
-	if err != nil {
-		log.Fatalf("Error connecting to PostgreSQL Target: %v", err)
+	var targetDB *sql.DB
+	if cfg.Target == targetPostgres {
+		targetDB, err = openDB("postgres", cfg.PostgresConn, "POSTGRES_CONN", cfg, targetSessionSetup(cfg)...)
+		if err != nil {
+			fatal("Error connecting to PostgreSQL Target", "error", err)
+		}
+		defer targetDB.Close()
+		cfg.TargetPool.apply(targetDB)
+		if err = pingDB(ctx, targetDB, cfg, "PostgreSQL Target"); err != nil {
+			fatal("Error pinging PostgreSQL Target", "error", err)
+		}
+		slog.Info("Successfully connected to PostgreSQL Target")
+	} else if command != cmdRun && command != cmdServe || *breakLeaseFlag {
+		fatal("Only the run command applies to TARGET=" + cfg.Target)
+	} else if cfg.Target == targetSnowflake {
+		targetDB, err = openDB(snowflakeDriver, cfg.SnowflakeConn, "SNOWFLAKE_CONN", cfg)
+		if err != nil {
+			fatal("Error connecting to Snowflake Target", "error", err)
+		}
+		defer targetDB.Close()
+		cfg.TargetPool.apply(targetDB)
+		if err = pingDB(ctx, targetDB, cfg, "Snowflake Target"); err != nil {
+			fatal("Error pinging Snowflake Target", "error", err)
+		}
+		slog.Info("Successfully connected to Snowflake Target")
+	}
+
+	if command == cmdStatus {
+		if err := printStatus(ctx, targetDB, cfgs); err != nil {
+			fatal("Status failed", "error", err)
+		}
+		return
+	}
+
+	if *breakLeaseFlag {
+		for _, cfg := range cfgs {
+			if err := breakLease(ctx, targetDB, cfg.TargetTable); err != nil {
+				fatal("Failed to break lease", "table", cfg.TargetTable, "error", err)
+			}
+		}
+		return
+	}
+
+	var readDB *sql.DB
+	if cfg.Source == sourceMSSQL {
+		sourceDB, err := openDB("sqlserver", cfg.MSSQLConn, "MSSQL_CONN", cfg)
+		if err != nil {
+			fatal("Error connecting to MSSQL Source", "error", err)
+		}
+		defer sourceDB.Close()
+		cfg.SourcePool.apply(sourceDB)
+		if err = pingDB(ctx, sourceDB, cfg, "MSSQL Source"); err != nil {
+			fatal("Error pinging MSSQL Source", "error", err)
+		}
+		slog.Info("Successfully connected to MSSQL Source")
+
+		readDB = sourceDB
+		if cfg.MSSQLReplicaConn != "" {
+			readDB = pickReadSource(ctx, sourceDB, cfg)
+			if readDB != sourceDB {
+				defer readDB.Close()
+			}
+		}
+
+		if cfg.MaxClockSkew > 0 {
+			if err := checkClockSkew(ctx, readDB, cfg, *force); err != nil {
+				fatal("Refusing to start", "error", err)
+			}
+		}
+	} else if cfg.Source != sourceCSV {
+		driver, conn, option, name := sqlSourceConn(cfg)
+		sourceDB, err := openDB(driver, conn, option, cfg)
+		if err != nil {
+			fatal("Error connecting to Source", "source", name, "error", err)
+		}
+		defer sourceDB.Close()
+		cfg.SourcePool.apply(sourceDB)
+		if err = pingDB(ctx, sourceDB, cfg, name); err != nil {
+			fatal("Error pinging Source", "source", name, "error", err)
+		}
+		slog.Info("Successfully connected to Source", "source", name)
+		readDB = sourceDB
+
+		if cfg.MaxClockSkew > 0 {
+			if err := checkClockSkew(ctx, readDB, cfg, *force); err != nil {
+				fatal("Refusing to start", "error", err)
+			}
+		}
+	}
+
+	if cfg.MetricsAddr != "" && command == cmdRun {
+		serveMetrics(cfg.MetricsAddr)
+	}
+
+	if command == cmdValidate {
+		mismatched := 0
+		for _, cfg := range cfgs {
+			ok, err := validateTable(ctx, readDB, targetDB, cfg)
+			if err != nil {
+				fatal("Validation failed", "table", cfg.TargetTable, "error", err)
+			}
+			if !ok {
+				mismatched++
+			}
+		}
+		if mismatched > 0 {
+			os.Exit(exitValidationFailed)
+		}
+		return
+	}
+
+	// A long-running process reloads its configuration on request and
+	// tells systemd when it is ready.
+	live := newLiveConfig(cfgs, loadTables)
+	if command == cmdServe || sched != nil {
+		watchReloads(live)
+		sdNotify("READY=1")
+	}
+	if command == cmdServe {
+		if err := serveAPI(ctx, live.get, readDB, targetDB); err != nil {
+			fatal("Run API failed", "error", err)
+		}
+		return
+	}
+	if sched != nil {
+		runScheduled(ctx, sched, func() error {
+			started := time.Now()
+			cfgs := live.get()
+			err := runTables(ctx, cfgs, readDB, targetDB)
+			notifyRun(cfgs[0], started, err)
+			writeRunReport(cfgs[0], started, err)
+			return err
+		})
+		return
+	}
+	etlStatus.runStarted()
+	started := time.Now()
+	for _, cfg := range cfgs {
+		if err := runTable(ctx, cfg, readDB, targetDB); err != nil {
+			runErr := fmt.Errorf("table %s: %w", cfg.TargetTable, err)
+			notifyRun(cfg, started, runErr)
+			writeRunReport(cfg, started, runErr)
+			exitOnError(ctx, cfg, err)
+		}
+	}
+	notifyRun(cfg, started, nil)
+	writeRunReport(cfg, started, nil)
+}
+
+// runTables loads every table in turn, stopping at the first failure.
+func runTables(ctx context.Context, cfgs []Config, readDB, targetDB *sql.DB) error {
+	for _, cfg := range cfgs {
+		if err := runTable(ctx, cfg, readDB, targetDB); err != nil {
+			return fmt.Errorf("table %s: %w", cfg.TargetTable, err)
+		}
+	}
+	return nil
+}
+
+// runTable prepares the target table of cfg and loads it, or exports to
+// the file of a file target or the topic of a Kafka target.
+func runTable(ctx context.Context, cfg Config, readDB, targetDB *sql.DB) error {
+	if cfg.Target == targetSnowflake {
+		return loadSnowflake(ctx, cfg, readDB, targetDB)
+	}
+	if cfg.Target != targetPostgres {
+		return exportTable(ctx, cfg, readDB)
+	}
+	if cfg.DryRun {
+		return dryRunTable(ctx, cfg, readDB, targetDB)
+	}
+	if err := ensureTargetTable(ctx, targetDB, cfg); err != nil {
+		return fmt.Errorf("failed to prepare target table: %w", err)
+	}
+	if cfg.Migrate {
+		if err := migrateTargetTable(ctx, targetDB, cfg); err != nil {
+			return err
+		}
+	}
+	if !cfg.SkipSchemaCheck {
+		if err := checkTargetSchema(ctx, targetDB, cfg); err != nil {
+			return fmt.Errorf("schema check failed: %w", err)
+		}
 	}
-	defer targetDB.Close()
-	if err = targetDB.Ping(); err != nil {
-		log.Fatalf("Error pinging PostgreSQL Target: %v", err)
+	if err := applyTableAccess(ctx, targetDB, cfg); err != nil {
+		return fmt.Errorf("failed to apply target table grants: %w", err)
 	}
-	log.Println("Successfully connected to PostgreSQL Target.")
 
-	if err := ensureTargetTable(targetDB); err != nil {
-		log.Fatalf("Failed to prepare target table: %v", err)
+	var runLease *lease
+	if cfg.LeaseTTL > 0 {
+		var err error
+		runLease, err = acquireLease(ctx, targetDB, cfg.TargetTable, cfg.LeaseTTL)
+		if err != nil {
+			return fmt.Errorf("refusing to start: %w", err)
+		}
+		// Held until the idempotency key is recorded, so a resubmission
+		// cannot find the load done but its key missing.
+		defer runLease.release()
+		ctx = runLease.ctx
 	}
 
-	log.Printf("Starting ETL from %s to %s...", sourceTableName, targetTableName)
+	if cfg.IdempotencyKey != "" {
+		completed, err := runKeyCompleted(ctx, targetDB, cfg.IdempotencyScope, cfg.IdempotencyKey)
+		if err != nil {
+			return fmt.Errorf("idempotency check failed: %w", err)
+		}
+		if !completed.IsZero() {
+			slog.Info("Run with this idempotency key was already processed; nothing to do", "table", cfg.TargetTable, "idempotency_key", cfg.IdempotencyKey, "completed_at", completed.Format(time.RFC3339))
+			return nil
+		}
+	}
+
+	// With SWAP_LOAD the rows go to the staging table, which takes the
+	// owner and grants of the target before it replaces it. It is only
+	// dropped and recreated under the lease, so a second run cannot empty
+	// the staging table of a load in progress.
+	loadCfg := cfg
+	if cfg.SwapLoad {
+		loadCfg.TargetTable = stagingTableName(cfg.TargetTable)
+		err := prepareStagingTable(ctx, targetDB, cfg)
+		if err == nil {
+			if err = applyTableAccess(ctx, targetDB, loadCfg); err != nil {
+				err = fmt.Errorf("failed to apply staging table grants: %w", err)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	runID := newRunID()
+	slog.Info("Starting ETL run", "table", cfg.TargetTable, "run_id", runID, "source", sourceName(cfg))
 	startTime := time.Now()
 
-	count, err := runETL(sourceDB, targetDB)
+	var lineage *openLineageClient
+	if cfg.OpenLineageURL != "" {
+		lineage = newOpenLineageClient(cfg, runID)
+	}
+	lineage.emit(olStart, 0, nil)
+	recordRunStart(ctx, targetDB, cfg, runID)
+	counts := startRunCounts(cfg.TargetTable)
+
+	count, err := runETLWithTxRetry(ctx, loadCfg, runID, readDB, targetDB)
+	// The target is loaded even when a mirror failed; that is reported
+	// once the run is recorded as a success.
+	var mirrorErr error
+	if isMirrorFailure(err) {
+		mirrorErr, err = err, nil
+	}
+	if err == nil && cfg.SwapLoad {
+		// A load outside the expected row count is not swapped in.
+		if err = checkExpectedRows(cfg, count); err != nil {
+			err = exitCodeError{exitRowCountOutOfBand, fmt.Errorf("completeness check failed; %s was left in place: %w", cfg.TargetTable, err)}
+		} else {
+			err = swapStagingTable(ctx, targetDB, cfg)
+		}
+	}
+	if lostErr := runLease.lost(); err != nil && lostErr != nil {
+		err = lostErr
+	}
+	etlMetrics.runDuration.observe(cfg.TargetTable, time.Since(startTime))
+	etlStatus.tableDone(cfg.TargetTable, runID, startTime, count, counts, err)
+	// Recorded even when the run was interrupted, so not under ctx.
+	recordRunEnd(context.Background(), targetDB, runID, count, counts, err)
 	if err != nil {
-		log.Fatalf("ETL Process failed: %v", err)
+		lineage.emit(olFail, count, err)
+		return fmt.Errorf("run %s stopped after %d rows: %w", runID, count, err)
 	}
+	lineage.emit(olComplete, count, nil)
 
 	duration := time.Since(startTime)
-	log.Printf("ETL Process successful! Migrated %d rows in %v.", count, duration)
+	slog.Info("ETL Process successful", "table", cfg.TargetTable, "run_id", runID, "rows", count, "duration", duration)
+	if cfg.SamplePercent > 0 {
+		slog.Info("This was a sample load; rows were selected by the key hash", "table", cfg.TargetTable, "sample_percent", cfg.SamplePercent, "rows", count)
+	}
+
+	if cfg.LineagePath != "" {
+		if err := writeLineage(cfg.LineagePath, buildLineage(cfg, runID)); err != nil {
+			slog.Warn("Failed to write lineage", "table", cfg.TargetTable, "error", err)
+		} else {
+			slog.Info("Wrote lineage", "table", cfg.TargetTable, "path", cfg.LineagePath)
+		}
+	}
+
+	if !cfg.SwapLoad {
+		if err := checkExpectedRows(cfg, count); err != nil {
+			return exitCodeError{exitRowCountOutOfBand, fmt.Errorf("completeness check failed: %w", err)}
+		}
+	}
+	// Without the key recorded, a retry with the same key catches the
+	// mirrors up.
+	if mirrorErr != nil {
+		return exitCodeError{exitMirrorFailed, mirrorErr}
+	}
+
+	if cfg.IdempotencyKey != "" {
+		if err := recordRunKey(ctx, targetDB, cfg.IdempotencyScope, cfg.IdempotencyKey, count); err != nil {
+			return fmt.Errorf("failed to record the idempotency key: %w", err)
+		}
+	}
+	return nil
 }
 
-func ensureTargetTable(db *sql.DB) error {
-	createTableSQL := fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s (
-			fsno VARCHAR(50) PRIMARY KEY,
-			salestype VARCHAR(50),
-			attachmentno VARCHAR(50),
-			customer VARCHAR(100),
-			region VARCHAR(50),
-			sale_date DATE,
-			code VARCHAR(50),
-			item_name VARCHAR(100),
-			measurement_unit VARCHAR(50),
-			unit_price NUMERIC(12, 2),
-			sold_quantity NUMERIC(12, 2),
-			net_pay NUMERIC(12, 2)
-		);
-	`, targetTableName)
+// checkExpectedRows fails when the processed row count falls outside the
+// EXPECTED_ROWS tolerance band, which usually means a truncated extract.
+func checkExpectedRows(cfg Config, count int) error {
+	if cfg.ExpectedRows == 0 {
+		return nil
+	}
 
-	if _, err := db.Exec(createTableSQL); err != nil {
-		return fmt.Errorf("failed to create target table: %w", err)
+	lower := float64(cfg.ExpectedRows) * (1 - cfg.ExpectedRowsTolerance)
+	upper := float64(cfg.ExpectedRows) * (1 + cfg.ExpectedRowsTolerance)
+	if float64(count) < lower || float64(count) > upper {
+		return fmt.Errorf("processed %d rows, expected %d (allowed range %.0f-%.0f)", count, cfg.ExpectedRows, lower, upper)
 	}
-	log.Printf("Target table '%s' is ready (fsno is PRIMARY KEY).", targetTableName)
+	slog.Info("Row count is within the expected range", "table", cfg.TargetTable, "rows", count, "expected", cfg.ExpectedRows)
 
 	return nil
 }
 
-func runETL(sourceDB *sql.DB, targetDB *sql.DB) (int, error) {
-	query := fmt.Sprintf(`
-		SELECT fsno, salestype, attachmentno, customer, region, date, code, name, measurementunit, unitprice, soldquantity, netpay
-		FROM %s ORDER BY fsno`, sourceTableName)
-	rows, err := sourceDB.Query(query)
-	if err != nil {
-		return 0, fmt.Errorf("failed to query source data: %w", err)
+// targetTableDDL is the CREATE TABLE statement for the target table:
+// the table's ddl from the config file, or one generated from the mapping.
+func targetTableDDL(cfg Config) string {
+	if cfg.TargetDDL != "" {
+		return cfg.TargetDDL
+	}
+	pc, partitioned := partitionColumn(cfg, cfg.Columns)
+	defs := make([]string, 0, len(cfg.Columns)+1)
+	for _, c := range cfg.Columns {
+		def := fmt.Sprintf("%s %s", c.Target, c.targetType())
+		if c.Key && !partitioned {
+			def += " PRIMARY KEY"
+		}
+		if c.Generated != "" {
+			def += fmt.Sprintf(" GENERATED ALWAYS AS (%s) STORED", c.Generated)
+		}
+		defs = append(defs, def)
+	}
+	if !partitioned {
+		return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			%s
+		);
+	`, cfg.TargetTable, strings.Join(defs, ",\n\t\t\t"))
 	}
-	defer rows.Close()
+	// A partitioned table can only have a primary key that includes the
+	// partition column. The default partition takes any row whose
+	// partition does not exist, rather than failing the insert.
+	defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", conflictColumns(cfg, cfg.Columns)))
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			%s
+		)%s;
+		CREATE TABLE IF NOT EXISTS %s PARTITION OF %s DEFAULT;
+	`, cfg.TargetTable, strings.Join(defs, ",\n\t\t\t"), partitionClause(pc), partitionName(cfg.TargetTable, "default"), cfg.TargetTable)
+}
 
-	tx, err := targetDB.Begin()
-	if err != nil {
-		return 0, fmt.Errorf("failed to start target transaction: %w", err)
+func ensureTargetTable(ctx context.Context, db *sql.DB, cfg Config) error {
+	cols := cfg.Columns
+	if hasEncrypted(cols) {
+		if _, err := db.ExecContext(ctx, "CREATE EXTENSION IF NOT EXISTS pgcrypto"); err != nil {
+			return fmt.Errorf("failed to enable pgcrypto for encrypted columns: %w", err)
+		}
 	}
-	defer tx.Rollback() 
 
-	insertSQL := fmt.Sprintf(`
-		INSERT INTO %s (fsno, salestype, attachmentno, customer, region, sale_date, code, item_name, measurement_unit, unit_price, sold_quantity, net_pay)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
-		ON CONFLICT (fsno) DO NOTHING`, targetTableName) 
+	if _, err := db.ExecContext(ctx, targetTableDDL(cfg)); err != nil {
+		return fmt.Errorf("failed to create target table: %w", err)
+	}
+	if cfg.PartitionBy != "" {
+		if err := checkPartitionedTarget(ctx, db, cfg); err != nil {
+			return err
+		}
+	}
+	slog.Info("Target table is ready", "table", cfg.TargetTable, "key", keyOf(cols).Target)
 
-	stmt, err := tx.Prepare(insertSQL)
-	if err != nil {
-		return 0, fmt.Errorf("failed to prepare insert statement: %w", err)
+	// Tables created before LOAD_SEQ or ROW_HASH was turned on need the
+	// column added.
+	for _, c := range cols {
+		if !c.computed() {
+			continue
+		}
+		alterSQL := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", cfg.TargetTable, c.Target, c.Type)
+		if _, err := db.ExecContext(ctx, alterSQL); err != nil {
+			return fmt.Errorf("failed to add %s to target table: %w", c.Target, err)
+		}
 	}
-	defer stmt.Close()
 
-	totalRows := 0
-	log.Println("Starting data transfer...")
+	if cfg.DeleteMode == deleteSoft {
+		alterSQL := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s TIMESTAMPTZ", cfg.TargetTable, cfg.DeletedAtColumn)
+		if _, err := db.ExecContext(ctx, alterSQL); err != nil {
+			return fmt.Errorf("failed to add %s to target table: %w", cfg.DeletedAtColumn, err)
+		}
+	}
+
+	if cfg.ConflictAction == conflictSCD2 {
+		if err := ensureHistoryTable(ctx, db, cfg, cols); err != nil {
+			return err
+		}
+	}
 
-	for rows.Next() {
-		var fsno, salestype, attachmentno, customer, region, code, name, measurementunit sql.NullString
-		var date sql.NullTime
-		var unitprice, soldquantity, netpay sql.NullFloat64
+	return nil
+}
 
-		if err := rows.Scan(
-			&fsno, &salestype, &attachmentno, &customer, &region, &date,
-			&code, &name, &measurementunit, &unitprice, &soldquantity, &netpay,
-		); err != nil {
-			log.Printf("Error scanning source row (count %d): %v. Skipping row.", totalRows+1, err)
-			continue 
+// runETL plans and reads the source of cfg and loads it into its sink.
+func runETL(ctx context.Context, cfg Config, runID string, sourceDB *sql.DB, targetDB *sql.DB) (int, error) {
+	if err := prepareRates(ctx, cfg, targetDB); err != nil {
+		return 0, err
+	}
+	if err := checkSourceSchema(ctx, sourceDB, targetDB, cfg); err != nil {
+		return 0, err
+	}
+	if needsClock(cfg.QualityRules) {
+		cfg.QualityNow = time.Now().UTC()
+		if sourceDB != nil {
+			var err error
+			if cfg.QualityNow, err = sourceClock(ctx, sourceDB, cfg); err != nil {
+				return 0, err
+			}
 		}
+	}
+	cols := insertColumns(cfg.Columns)
+	src := newSource(cfg, sourceDB)
+	plan, err := src.plan(ctx, targetDB, cols)
+	if err != nil {
+		return 0, err
+	}
+	if len(cfg.DedupWinner) > 0 && !plan.ordered {
+		return 0, fmt.Errorf("DEDUP_WINNER needs the source read in key order; the read is unordered (see ORDER_BY_POLICY)")
+	}
 
-		if _, err := stmt.Exec(
-			fsno, salestype, attachmentno, customer, region, date,
-			code, name, measurementunit, unitprice, soldquantity, netpay,
-		); err != nil {
-			log.Printf("Failed to insert row with fsno %s: %v", fsno.String, err)
-			return totalRows, fmt.Errorf("error executing insert statement: %w", err)
+	total := int64(-1)
+	if cfg.ProgressInterval > 0 && cfg.ProgressCount && sourceDB != nil {
+		if total, err = countSource(ctx, sourceDB, cfg, cols, plan); err != nil {
+			slog.Warn("Failed to count the source rows; progress is logged without an ETA", "table", cfg.TargetTable, "error", err)
+			total = -1
+		} else {
+			slog.Info("Counted the source rows", "table", cfg.TargetTable, "rows", total)
 		}
-		totalRows++
+	}
+	progress := startProgress(cfg, total)
+	defer progress.finish()
+
+	known := loadRowHashes(ctx, targetDB, cfg, cols, plan)
+	if cfg.Parallelism > 1 {
+		count, err := runParallel(ctx, cfg, runID, sourceDB, targetDB, cols, plan, known)
+		noteWatermark(runID, plan, err)
+		return count, err
 	}
 
-	if err := rows.Err(); err != nil {
-		return totalRows, fmt.Errorf("error iterating over source rows: %w", err)
+	var ckpt *checkpoint
+	if cfg.Checkpoint && !cfg.DryRun {
+		if plan.ordered {
+			ckpt = newCheckpoint(cfg, runID, cols)
+			if plan.after, err = ckpt.resumeKey(ctx, targetDB); err != nil {
+				return 0, err
+			}
+		} else {
+			slog.Warn("The source is read unordered, so CHECKPOINT is off for this run", "table", cfg.TargetTable)
+		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		return totalRows, fmt.Errorf("failed to commit transaction: %w", err)
+	query := startSpan(ctx, "extract.query", "etl.source", cfg.Source, "etl.source_table", cfg.SourceTable)
+	rows, err := src.extract(ctx, cols, plan)
+	query.end(err)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query source data: %w", err)
+	}
+	sink := newSink(ctx, cfg, runID, targetDB, cols, known)
+	if len(cfg.Mirrors) > 0 {
+		mirrors := openMirrors(ctx, cfg, runID, cols)
+		defer closeMirrors(mirrors)
+		sink = &fanoutSink{rowSink: sink, mirrors: mirrors}
+	}
+	res, err := loadRows(ctx, cfg, runID, sink, cols, rows, ckpt, func(target execer) error {
+		if err := ckpt.clear(ctx, target); err != nil {
+			return err
+		}
+		return saveProgress(ctx, target, cfg, plan)
+	})
+	res.log(cfg)
+	noteWatermark(runID, plan, err)
+	if err == nil {
+		err = logMirrors(cfg, res.mirrors)
 	}
+	return res.rows, err
+}
 
-	return totalRows, nil
+// saveProgress stores where an incremental read stopped, as the next run's
+// starting point.
+func saveProgress(ctx context.Context, target execer, cfg Config, plan readPlan) error {
+	if plan.delta != nil {
+		if err := saveRowVersion(ctx, target, cfg, plan.delta); err != nil {
+			return err
+		}
+	}
+	if plan.since != nil {
+		if err := saveWatermark(ctx, target, cfg, plan.since); err != nil {
+			return err
+		}
+	}
+	if plan.changes != nil {
+		if err := applyChanges(ctx, target, cfg, insertColumns(cfg.Columns), plan.changes); err != nil {
+			return err
+		}
+	}
+	return nil
 }
+
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maskTransforms are the transforms that hide a value for good. Their
+// columns are redacted in dead letters, which hold rows before they are
+// transformed.
+var maskTransforms = []string{"hash", "mask"}
+
+// hashLength is the length of a hashed value: SHA-256 in hex.
+const hashLength = sha256.Size * 2
+
+var varcharTypeRe = regexp.MustCompile(`(?i)^\s*(?:VARCHAR|CHARACTER VARYING|CHAR|CHARACTER)\s*\(\s*(\d+)\s*\)`)
+
+// isMasked reports whether c applies hash or mask.
+func isMasked(c column) bool {
+	for _, t := range c.Transforms {
+		name, _, _ := strings.Cut(t, ":")
+		for _, m := range maskTransforms {
+			if name == m {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// saltedHash is the hex HMAC-SHA256 of s keyed with the salt. The same
+// value always gives the same hash, so a hashed column still joins and
+// counts distinct customers, while without the salt a hash cannot be
+// matched against a list of known names.
+func saltedHash(salt, s string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// makeHash replaces a text value with its salted hash, e.g. for customer
+// names. The column must hold 64 characters.
+func makeHash(c column, arg string) (columnFunc, error) {
+	if !c.isText() {
+		return nil, fmt.Errorf("%s is not a text column", c.Type)
+	}
+	if arg != "" {
+		return nil, fmt.Errorf("hash takes no argument")
+	}
+	if c.salt == "" {
+		return nil, fmt.Errorf("MASKING_SALT must be set")
+	}
+	if m := varcharTypeRe.FindStringSubmatch(c.Type); m != nil {
+		if n, _ := strconv.Atoi(m[1]); n < hashLength {
+			return nil, fmt.Errorf("%s is too short for a %d-character hash", c.Type, hashLength)
+		}
+	}
+	salt := c.salt
+	return func(v any) any {
+		if s := v.(*sql.NullString); s.Valid {
+			s.String = saltedHash(salt, s.String)
+		}
+		return v
+	}, nil
+}
+
+// makeMask replaces every letter and digit of a text value with another
+// of the same kind, keeping its length, case, spaces and punctuation, so
+// "Abebe Kebede" becomes something like "Kriwo Tubalo". mask:4 leaves the
+// last four characters as they are. Unlike TOKENIZE_COLUMNS it cannot be
+// reversed: each character is drawn from a salted HMAC of the whole value.
+func makeMask(c column, arg string) (columnFunc, error) {
+	if !c.isText() {
+		return nil, fmt.Errorf("%s is not a text column", c.Type)
+	}
+	keep := 0
+	if arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("expected the number of trailing characters to keep, e.g. mask:4")
+		}
+		keep = n
+	}
+	if c.salt == "" {
+		return nil, fmt.Errorf("MASKING_SALT must be set")
+	}
+	salt := c.salt
+	return func(v any) any {
+		if s := v.(*sql.NullString); s.Valid {
+			s.String = maskText(salt, s.String, keep)
+		}
+		return v
+	}, nil
+}
+
+// maskText masks all but the last keep characters of s.
+func maskText(salt, s string, keep int) string {
+	r := []rune(s)
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(s))
+	seed := mac.Sum(nil)
+	for i := 0; i < len(r)-keep; i++ {
+		alphabet := maskAlphabet(r[i])
+		if alphabet == "" {
+			continue
+		}
+		// Every position gets its own draw from the value's HMAC.
+		pos := hmac.New(sha256.New, seed)
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(i))
+		pos.Write(buf[:])
+		n := binary.BigEndian.Uint64(pos.Sum(nil)[:8])
+		r[i] = rune(alphabet[n%uint64(len(alphabet))])
+	}
+	return string(r)
+}
+
+// maskAlphabet is what a character is replaced from: its own class of
+// tokenAlphabets, lowercase letters for a letter of any other script, and
+// nothing for spaces and punctuation, which are kept.
+func maskAlphabet(c rune) string {
+	for _, alphabet := range tokenAlphabets {
+		if strings.ContainsRune(alphabet, c) {
+			return alphabet
+		}
+	}
+	switch {
+	case unicode.IsLetter(c):
+		return tokenAlphabets[1]
+	case unicode.IsDigit(c):
+		return tokenAlphabets[0]
+	}
+	return ""
+}
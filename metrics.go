@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus metrics, exposed in the text exposition format on /metrics
+// when METRICS_ADDR is set. The format is simple enough that the pipeline
+// does not pull in the client library for a handful of series. Every
+// series is labelled with the target table.
+
+// counterVec is a counter per table.
+type counterVec struct {
+	name, help string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (c *counterVec) add(table string, v float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[table] += v
+}
+
+func (c *counterVec) get(table string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[table]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, table := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{table=%q} %g\n", c.name, table, c.values[table])
+	}
+}
+
+// histogramVec is a histogram of durations in seconds per table.
+type histogramVec struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogramVec) observe(table string, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[table]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[table] = s
+	}
+	v := d.Seconds()
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, table := range sortedKeys(h.series) {
+		s := h.series[table]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{table=%q,le=\"%g\"} %d\n", h.name, table, le, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{table=%q,le=\"+Inf\"} %d\n", h.name, table, s.count)
+		fmt.Fprintf(w, "%s_sum{table=%q} %g\n", h.name, table, s.sum)
+		fmt.Fprintf(w, "%s_count{table=%q} %d\n", h.name, table, s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newCounterVec(name, help string) *counterVec {
+	return &counterVec{name: name, help: help, values: map[string]float64{}}
+}
+
+func newHistogramVec(name, help string, buckets ...float64) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, series: map[string]*histogram{}}
+}
+
+// etlMetrics holds every series the pipeline exports. They are recorded
+// whether or not the endpoint is served.
+var etlMetrics = struct {
+	rowsExtracted  *counterVec
+	rowsInserted   *counterVec
+	rowsConflicted *counterVec
+	scanErrors     *counterVec
+	rowsRejected   *counterVec
+	batchDuration  *histogramVec
+	runDuration    *histogramVec
+}{
+	rowsExtracted:  newCounterVec("etl_rows_extracted_total", "Rows read from the source."),
+	rowsInserted:   newCounterVec("etl_rows_inserted_total", "Rows inserted or updated in the target, counted when committed."),
+	rowsConflicted: newCounterVec("etl_rows_conflicted_total", "Rows left unchanged by ON CONFLICT, counted when committed."),
+	scanErrors:     newCounterVec("etl_scan_errors_total", "Source rows skipped because they could not be scanned."),
+	rowsRejected:   newCounterVec("etl_rows_rejected_total", "Rows the target refused, written to etl_dead_letters, counted when committed."),
+	batchDuration:  newHistogramVec("etl_batch_duration_seconds", "Time from the start of a batch to its commit.", 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120),
+	runDuration:    newHistogramVec("etl_run_duration_seconds", "Duration of whole runs, failed ones included.", 10, 30, 60, 300, 600, 1800, 3600, 7200, 14400, 28800),
+}
+
+func writeMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	var b strings.Builder
+	for _, c := range []*counterVec{etlMetrics.rowsExtracted, etlMetrics.rowsInserted, etlMetrics.rowsConflicted, etlMetrics.scanErrors, etlMetrics.rowsRejected} {
+		c.write(&b)
+	}
+	etlMetrics.batchDuration.write(&b)
+	etlMetrics.runDuration.write(&b)
+	io.WriteString(w, b.String())
+}
+
+// newStatusMux serves the /metrics, /healthz and /status endpoints.
+func newStatusMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writeMetrics)
+	mux.HandleFunc("/healthz", writeHealth)
+	mux.HandleFunc("/status", writeStatus)
+	return mux
+}
+
+// serveMetrics starts the /metrics, /healthz and /status endpoints in the
+// background. A port that cannot be bound is logged and otherwise ignored,
+// so monitoring never stops a load.
+func serveMetrics(addr string) {
+	mux := newStatusMux()
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Warn("Metrics endpoint stopped", "addr", addr, "error", err)
+		}
+	}()
+	slog.Info("Serving /metrics, /healthz and /status", "addr", addr)
+}
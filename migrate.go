@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	lengthTypeRe  = regexp.MustCompile(`^(character varying|character)(?:\((\d+)\))?$`)
+	numericSpecRe = regexp.MustCompile(`^numeric(?:\((\d+)(?:,(\d+))?\))?$`)
+)
+
+// integerTypes orders the integer types by width, with the digits each
+// can hold.
+var integerTypes = map[string]struct{ rank, digits int }{
+	"smallint": {1, 5},
+	"integer":  {2, 10},
+	"bigint":   {3, 19},
+}
+
+// isWideningChange reports whether a column of type actual can be altered
+// to expected without losing or rewriting any value: a longer or unbounded
+// varchar, a wider integer, a NUMERIC with room for at least as many
+// integer and fractional digits, or real to double precision. Both types
+// are normalized.
+func isWideningChange(actual, expected string) bool {
+	if actual == expected {
+		return false
+	}
+	if a := lengthTypeRe.FindStringSubmatch(actual); a != nil {
+		if expected == "text" {
+			return true
+		}
+		e := lengthTypeRe.FindStringSubmatch(expected)
+		if e == nil || e[1] != "character varying" {
+			return false
+		}
+		if e[2] == "" {
+			return true
+		}
+		al, _ := strconv.Atoi(a[2])
+		el, _ := strconv.Atoi(e[2])
+		return a[2] != "" && el >= al
+	}
+	if a, ok := integerTypes[actual]; ok {
+		if e, ok := integerTypes[expected]; ok {
+			return e.rank > a.rank
+		}
+		e := numericSpecRe.FindStringSubmatch(expected)
+		switch {
+		case e == nil:
+			return false
+		case e[1] == "":
+			return true
+		}
+		p, _ := strconv.Atoi(e[1])
+		s, _ := strconv.Atoi(e[2])
+		return p-s >= a.digits
+	}
+	if a := numericSpecRe.FindStringSubmatch(actual); a != nil {
+		e := numericSpecRe.FindStringSubmatch(expected)
+		switch {
+		case e == nil || a[1] == "" && e[1] != "":
+			return false
+		case e[1] == "":
+			return true
+		}
+		ap, _ := strconv.Atoi(a[1])
+		as, _ := strconv.Atoi(a[2])
+		ep, _ := strconv.Atoi(e[1])
+		es, _ := strconv.Atoi(e[2])
+		return es >= as && ep-es >= ap-as
+	}
+	return actual == "real" && expected == "double precision"
+}
+
+// migrationStatements returns the ALTER TABLE statements that bring the
+// target table in line with the mapping: missing columns are added and
+// widened types altered. Missing key columns and other type changes are
+// left for the schema check to report, since they may need a rewrite or
+// lose data. Mapped columns are added to and widened in the SCD2 history
+// table too.
+func migrationStatements(cfg Config, diffs []schemaDiff) []string {
+	byTarget := map[string]column{}
+	for _, c := range cfg.Columns {
+		byTarget[c.Target] = c
+	}
+	var stmts []string
+	for _, d := range diffs {
+		c, mapped := byTarget[d.Column]
+		if !mapped {
+			// Columns of optional features are added by ensureTargetTable.
+			continue
+		}
+		tables := []string{cfg.TargetTable}
+		if cfg.ConflictAction == conflictSCD2 && c.Generated == "" {
+			tables = append(tables, cfg.HistoryTable)
+		}
+		switch {
+		case d.Status == schemaMissing && !c.Key:
+			for i, table := range tables {
+				def := c.targetType()
+				if i == 0 && c.Generated != "" {
+					def += fmt.Sprintf(" GENERATED ALWAYS AS (%s) STORED", c.Generated)
+				}
+				stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, c.Target, def))
+			}
+		case d.Status == schemaMismatch && c.Generated == "" && isWideningChange(normalizeType(d.Actual), d.Expected):
+			for _, table := range tables {
+				stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", table, c.Target, c.targetType()))
+			}
+		}
+	}
+	return stmts
+}
+
+// migrateTargetTable applies the migration statements of the target table
+// in one transaction, so a failed ALTER leaves the table as it was.
+func migrateTargetTable(ctx context.Context, db *sql.DB, cfg Config) error {
+	diffs, err := diffTargetSchema(ctx, db, cfg)
+	if err != nil {
+		return err
+	}
+	stmts := migrationStatements(cfg, diffs)
+	if len(stmts) == 0 {
+		slog.Info("Target table needs no migration", "table", cfg.TargetTable)
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to migrate target table: %w", err)
+	}
+	defer tx.Rollback()
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to migrate target table: %s: %w", stmt, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to migrate target table: %w", err)
+	}
+	slog.Warn("Migrated target table:\n"+strings.Join(stmts, ";\n"), "table", cfg.TargetTable, "statements", len(stmts))
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// mirrorTarget is one entry of MIRROR_TARGETS: a second place the rows of
+// a run are written to, next to the Postgres target.
+type mirrorTarget struct {
+	Kind string // postgres, csv, ndjson or parquet
+	Dest string // the connection string or file name
+}
+
+// name identifies the mirror in logs without its credentials.
+func (m mirrorTarget) name() string {
+	if m.Kind == targetPostgres {
+		return m.Kind + ":" + dsnDatabase(m.Dest)
+	}
+	return m.Kind + ":" + m.Dest
+}
+
+// parseMirrorTargets reads MIRROR_TARGETS, ';' separated kind:destination
+// entries such as csv:/archive/{table}_{date}.csv.gz or
+// postgres:postgres://etl@dr-host/salesdb.
+func parseMirrorTargets(spec, table string) ([]mirrorTarget, error) {
+	var mirrors []mirrorTarget
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kind, dest, ok := strings.Cut(entry, ":")
+		kind, dest = strings.ToLower(strings.TrimSpace(kind)), strings.TrimSpace(dest)
+		if !ok || dest == "" {
+			return nil, fmt.Errorf("invalid MIRROR_TARGETS entry %q: expected kind:destination, e.g. csv:/archive/sales.csv", entry)
+		}
+		switch kind {
+		case targetPostgres:
+		case targetCSV, targetNDJSON, targetParquet:
+			if strings.Contains(dest, "{part}") {
+				return nil, fmt.Errorf("invalid MIRROR_TARGETS entry %q: a mirror file is written in one part", entry)
+			}
+			dest = strings.ReplaceAll(dest, "{table}", table)
+		default:
+			return nil, fmt.Errorf("invalid MIRROR_TARGETS entry %q: expected postgres, csv, ndjson or parquet", entry)
+		}
+		mirrors = append(mirrors, mirrorTarget{Kind: kind, Dest: dest})
+	}
+	return mirrors, nil
+}
+
+// mirror is a mirror target during a run. Once it fails it is left out of
+// the rest of the run; the target and the other mirrors carry on.
+type mirror struct {
+	target mirrorTarget
+	sink   rowSink
+	db     *sql.DB // for a Postgres mirror
+	rows   int     // written, including rows not committed yet
+	err    error
+}
+
+func (m *mirror) fail(err error) {
+	slog.Warn("Mirror target failed; the run goes on without it", "mirror", m.target.name(), "rows", m.rows, "error", err)
+	m.sink.abort()
+	m.err = err
+}
+
+// openMirrors connects to the mirrors of cfg and prepares them. A mirror
+// that cannot be opened counts as failed, rather than failing the run.
+func openMirrors(ctx context.Context, cfg Config, runID string, cols []column) []*mirror {
+	if cfg.DryRun {
+		return nil
+	}
+	var mirrors []*mirror
+	for _, t := range cfg.Mirrors {
+		m := &mirror{target: t}
+		mirrors = append(mirrors, m)
+		mcfg := cfg
+		if t.Kind != targetPostgres {
+			mcfg.Target, mcfg.TargetFile, mcfg.TargetPartRows = t.Kind, t.Dest, 0
+			m.sink = &fileSink{ctx: ctx, cfg: mcfg, cols: cols, runID: runID}
+			continue
+		}
+		db, err := openMirrorDB(ctx, mcfg, t)
+		if err != nil {
+			m.err = err
+			slog.Warn("Mirror target failed; the run goes on without it", "mirror", t.name(), "rows", 0, "error", err)
+			continue
+		}
+		m.db = db
+		m.sink = &loadTarget{ctx: ctx, db: db, cfg: mcfg, cols: cols, parts: newPartitioner(ctx, mcfg, cols), mirror: true}
+	}
+	return mirrors
+}
+
+// openMirrorDB connects to a Postgres mirror and creates and checks its
+// target table like the target's.
+func openMirrorDB(ctx context.Context, cfg Config, t mirrorTarget) (*sql.DB, error) {
+	db, err := openDB("postgres", t.Dest, "MIRROR_TARGETS", cfg, targetSessionSetup(cfg)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	if err := ensureTargetTable(ctx, db, cfg); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to prepare target table: %w", err)
+	}
+	if !cfg.SkipSchemaCheck {
+		if err := checkTargetSchema(ctx, db, cfg); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("schema check failed: %w", err)
+		}
+	}
+	return db, nil
+}
+
+func closeMirrors(mirrors []*mirror) {
+	for _, m := range mirrors {
+		if m.db != nil {
+			m.db.Close()
+		}
+	}
+}
+
+// fanoutSink writes every row to the target and to its mirrors, so the
+// source is read once. The target drives the batches and keeps the run's
+// state; each mirror commits on its own schedule, as it would as the only
+// target, and is committed last when the run finishes.
+type fanoutSink struct {
+	rowSink
+	mirrors []*mirror
+	rows    int
+	final   bool
+}
+
+// each calls fn on every mirror that has not failed, and retires those
+// it fails for.
+func (f *fanoutSink) each(fn func(m *mirror) error) {
+	for _, m := range f.mirrors {
+		if m.err != nil {
+			continue
+		}
+		if err := fn(m); err != nil {
+			m.fail(err)
+		}
+	}
+}
+
+func (f *fanoutSink) begin() error {
+	if err := f.rowSink.begin(); err != nil {
+		return err
+	}
+	// Mirrors begin once, and again after each of their own commits.
+	if f.rows == 0 && !f.final {
+		f.each(func(m *mirror) error { return m.sink.begin() })
+	}
+	return nil
+}
+
+func (f *fanoutSink) write(vals []any) error {
+	if err := f.rowSink.write(vals); err != nil {
+		return err
+	}
+	f.rows++
+	f.each(func(m *mirror) error {
+		if err := m.sink.write(vals); err != nil {
+			return err
+		}
+		m.rows++
+		if !m.sink.batchDone(f.rows) {
+			return nil
+		}
+		if err := m.sink.commit(f.rows); err != nil {
+			return err
+		}
+		return m.sink.begin()
+	})
+	return nil
+}
+
+// flush is only called at the end of the load, before the last commit.
+func (f *fanoutSink) flush() error {
+	f.final = true
+	if err := f.rowSink.flush(); err != nil {
+		return err
+	}
+	f.each(func(m *mirror) error { return m.sink.flush() })
+	return nil
+}
+
+// commit commits the target, and the mirrors after the last batch. Their
+// last batch commits after the target's, so a run whose final commit
+// fails does not finish in the mirrors alone.
+func (f *fanoutSink) commit(rows int) error {
+	if err := f.rowSink.commit(rows); err != nil {
+		return err
+	}
+	if f.final {
+		f.each(func(m *mirror) error { return m.sink.commit(rows) })
+	}
+	return nil
+}
+
+func (f *fanoutSink) abort() {
+	f.rowSink.abort()
+	for _, m := range f.mirrors {
+		if m.err == nil {
+			m.sink.abort()
+		}
+	}
+}
+
+func (f *fanoutSink) report(res *loadResult) {
+	f.rowSink.report(res)
+	for _, m := range f.mirrors {
+		res.mirrors = append(res.mirrors, mirrorResult{name: m.target.name(), rows: m.rows, err: m.err})
+	}
+}
+
+// mirrorResult is how one mirror fared in a run.
+type mirrorResult struct {
+	name string
+	rows int
+	err  error
+}
+
+// mirrorFailure is the error of a run whose target was loaded but some of
+// whose mirrors failed. It is not retried, since the target already holds
+// the rows.
+type mirrorFailure struct {
+	failed []mirrorResult
+}
+
+func (e *mirrorFailure) Error() string {
+	msgs := make([]string, len(e.failed))
+	for i, m := range e.failed {
+		msgs[i] = fmt.Sprintf("%s: %v", m.name, m.err)
+	}
+	return "mirror targets failed: " + strings.Join(msgs, "; ")
+}
+
+// logMirrors logs how each mirror fared and returns a *mirrorFailure if
+// any failed.
+func logMirrors(cfg Config, results []mirrorResult) error {
+	var failed []mirrorResult
+	for _, m := range results {
+		if m.err != nil {
+			failed = append(failed, m)
+			continue
+		}
+		slog.Info("Mirror target loaded", "table", cfg.TargetTable, "mirror", m.name, "rows", m.rows)
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &mirrorFailure{failed: failed}
+}
+
+func isMirrorFailure(err error) bool {
+	var mf *mirrorFailure
+	return errors.As(err, &mf)
+}
@@ -0,0 +1,8 @@
+//go:build mysql
+
+package main
+
+// The MySQL driver is opt-in, so the default build does not carry it:
+//
+//	go build -tags mysql
+import _ "github.com/go-sql-driver/mysql"
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// mysqlDriver is the database/sql driver name of go-sql-driver/mysql,
+// which is only linked into builds with the mysql tag (mysqldriver.go).
+const mysqlDriver = "mysql"
+
+// checkMySQLConn validates MYSQL_CONN for SOURCE=mysql. DATE and DATETIME
+// columns only scan into time values with parseTime=true.
+func checkMySQLConn(conn string) error {
+	switch {
+	case conn == "":
+		return fmt.Errorf("MYSQL_CONN (or MYSQL_CONN_SECRET) environment variable must be set for SOURCE=mysql. Check your .env file")
+	case !slices.Contains(sql.Drivers(), mysqlDriver):
+		return fmt.Errorf("SOURCE=mysql needs the MySQL driver, which this binary was built without; build with -tags mysql")
+	case !strings.Contains(conn, "parseTime=true"):
+		return fmt.Errorf("MYSQL_CONN must set parseTime=true, e.g. user:password@tcp(host:3306)/sales?parseTime=true, so dates are read as dates")
+	}
+	return nil
+}
+
+// mysqlDSNRe picks the address and database out of a go-sql-driver DSN.
+var mysqlDSNRe = regexp.MustCompile(`@\w+\(([^)]*)\)/([^?]*)`)
+
+// mysqlDSNParts is dsnParts for a MySQL DSN, which is not a URL.
+func mysqlDSNParts(dsn string) (host, database string) {
+	m := mysqlDSNRe.FindStringSubmatch(dsn)
+	if m == nil {
+		return "", ""
+	}
+	return m[1], m[2]
+}
+
+// mysqlKeyIndexed is sourceKeyIndexed for MySQL and MariaDB, which keep
+// their indexes in information_schema. table may be qualified with the
+// database; otherwise it is looked up in the current one.
+func mysqlKeyIndexed(ctx context.Context, db *sql.DB, table, keyColumn string) (bool, error) {
+	schema, name, ok := strings.Cut(table, ".")
+	if !ok {
+		schema, name = "", table
+	}
+	var n int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*)
+		FROM information_schema.statistics
+		WHERE table_schema = COALESCE(NULLIF(?, ''), DATABASE()) AND table_name = ? AND column_name = ? AND seq_in_index = 1`,
+		strings.Trim(schema, "`"), strings.Trim(name, "`"), keyColumn).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up indexes on source table %s: %w", table, err)
+	}
+	return n > 0, nil
+}
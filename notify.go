@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Values of NOTIFY_ON.
+const (
+	notifyAlways  = "always"
+	notifyFailure = "failure"
+)
+
+// runSummary is what a notification says about one run of all tables.
+type runSummary struct {
+	started time.Time
+	tables  map[string]tableStatus
+	err     error
+}
+
+// title is the one-line outcome, used as the mail subject.
+func (s runSummary) title() string {
+	rows := 0
+	for _, t := range s.tables {
+		rows += t.Rows
+	}
+	if s.err != nil {
+		return fmt.Sprintf("NVI ETL failed after %s", time.Since(s.started).Round(time.Second))
+	}
+	return fmt.Sprintf("NVI ETL succeeded: %d rows in %s", rows, time.Since(s.started).Round(time.Second))
+}
+
+func (s runSummary) text(cfg Config) string {
+	var b strings.Builder
+	names := make([]string, 0, len(s.tables))
+	for name := range s.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := s.tables[name]
+		fmt.Fprintf(&b, "%s: %d rows in %s", name, t.Rows, time.Duration(t.Duration*float64(time.Second)).Round(time.Second))
+		if t.Error != "" {
+			fmt.Fprintf(&b, ", failed: %s", t.Error)
+		}
+		b.WriteString("\n")
+	}
+	var ec exitCodeError
+	switch {
+	case errors.As(s.err, &ec) && ec.code == exitRowCountOutOfBand:
+		b.WriteString("Row count check: failed\n")
+	case cfg.ExpectedRows > 0 && s.err == nil:
+		b.WriteString("Row count check: passed\n")
+	}
+	if s.err != nil {
+		fmt.Fprintf(&b, "Error: %s\n", s.err)
+	}
+	return b.String()
+}
+
+// notifyRun sends the summary of a run that started at started to the
+// configured Slack webhook and mail recipients. Delivery is best effort:
+// a failure is logged and never fails the run.
+func notifyRun(cfg Config, started time.Time, runErr error) {
+	if cfg.SlackWebhook == "" && cfg.SMTPAddr == "" {
+		return
+	}
+	if runErr == nil && cfg.NotifyOn == notifyFailure {
+		return
+	}
+	s := runSummary{started: started, tables: etlStatus.tablesSince(started), err: runErr}
+	if cfg.SlackWebhook != "" {
+		if err := sendSlack(cfg, s); err != nil {
+			slog.Warn("Failed to send Slack notification", "error", err)
+		}
+	}
+	if cfg.SMTPAddr != "" {
+		if err := sendMail(cfg, s); err != nil {
+			slog.Warn("Failed to send notification mail", "error", err)
+		}
+	}
+}
+
+func sendSlack(cfg Config, s runSummary) error {
+	body, _ := json.Marshal(map[string]string{"text": "*" + s.title() + "*\n" + s.text(cfg)})
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(cfg.SlackWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// sendMail sends the summary over SMTP. net/smtp upgrades to TLS when the
+// server offers STARTTLS, and only sends the password over TLS.
+func sendMail(cfg Config, s runSummary) error {
+	var auth smtp.Auth
+	if cfg.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(cfg.SMTPAddr)
+		auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.SMTPTo, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", s.title())
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(s.text(cfg), "\n", "\r\n"))
+	return smtp.SendMail(cfg.SMTPAddr, auth, cfg.SMTPFrom, cfg.SMTPTo, msg.Bytes())
+}
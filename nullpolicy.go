@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// NULL policies of a column: what a NULL left after its transforms
+// becomes.
+const (
+	// nullKeep loads the NULL (the default).
+	nullKeep = "keep"
+	// nullReject drops the row, as a not_null quality rule with reject.
+	nullReject = "reject"
+	// nullDefault replaces the NULL with a value, e.g. default:UNKNOWN.
+	nullDefault = "default"
+)
+
+// parseNullPolicy splits a policy such as default:0 into its kind and
+// value.
+func parseNullPolicy(policy string) (kind, value string, err error) {
+	kind, value, hasValue := strings.Cut(strings.TrimSpace(policy), ":")
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	switch {
+	case kind == "":
+		return nullKeep, "", nil
+	case kind == nullDefault && hasValue:
+		return kind, value, nil
+	case (kind == nullKeep || kind == nullReject) && !hasValue:
+		return kind, "", nil
+	}
+	return "", "", fmt.Errorf("invalid NULL policy %q: expected keep, reject or default:value", policy)
+}
+
+// applyNullPolicies sets the policies of NULL_POLICIES, entries like
+// region=default:UNKNOWN;measurement_unit=reject, over those of the
+// mapping.
+func applyNullPolicies(cols []column, spec string) error {
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		target, policy, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid NULL_POLICIES entry %q: expected column=keep, column=reject or column=default:value", entry)
+		}
+		err := markColumns(cols, strings.TrimSpace(target), "NULL_POLICIES", func(c *column) {
+			c.OnNull = strings.TrimSpace(policy)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nullRules returns a not_null reject rule for every column whose policy is
+// reject, so those rows are dropped, dead-lettered and reported like any
+// other rejected row.
+func nullRules(cols []column) []qualityRule {
+	var rules []qualityRule
+	for _, c := range cols {
+		if kind, _, _ := parseNullPolicy(c.OnNull); kind == nullReject {
+			rules = append(rules, qualityRule{Column: c.Target, Check: "not_null", Action: qualityReject})
+		}
+	}
+	return rules
+}
+
+// makeNullDefault returns the function that replaces NULL with value,
+// which must be a valid value of the column's type: a number for a
+// numeric column, a date or timestamp for a time column.
+func makeNullDefault(c column, value string) (columnFunc, error) {
+	switch {
+	case c.kind() == kindNumeric:
+		if _, ok := new(big.Rat).SetString(value); !ok {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+	case c.kind() == kindTime:
+		if _, err := parseTimestamp(value); err != nil {
+			return nil, fmt.Errorf("%q is not a date or timestamp: %w", value, err)
+		}
+	}
+	f, _ := strconv.ParseFloat(value, 64)
+	t, _ := parseTimestamp(value)
+	return func(v any) any {
+		switch v := v.(type) {
+		case *sql.NullString:
+			if !v.Valid {
+				*v = sql.NullString{String: value, Valid: true}
+			}
+		case *sql.NullFloat64:
+			if !v.Valid {
+				*v = sql.NullFloat64{Float64: f, Valid: true}
+			}
+		case *sql.NullTime:
+			if !v.Valid {
+				*v = sql.NullTime{Time: t, Valid: true}
+			}
+		}
+		return v
+	}, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestNumericAsString runs a CSV extract with numbers beyond float64
+// precision to a CSV file and checks they come out digit for digit.
+func TestNumericAsString(t *testing.T) {
+	const exact = "12345678901234567890.123456789"
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "sales.csv"), filepath.Join(dir, "out.csv")
+	extract := "fsno,salestype,attachmentno,customer,region,date,code,name,measurementunit,unitprice,soldquantity,netpay\n" +
+		"FS-0001,Cash,AT-1,Abebe Kebede,Addis Ababa,2024-01-05,P-100,Teff 25kg,bag," + exact + ",-0.000000001," + exact + "\n"
+	if err := os.WriteFile(in, []byte(extract), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOURCE", sourceCSV)
+	t.Setenv("SOURCE_FILE", in)
+	t.Setenv("TARGET", "csv")
+	t.Setenv("TARGET_FILE", out)
+
+	for _, tt := range []struct {
+		numericAsString string
+		want            string
+	}{
+		{"true", exact + ",-0.000000001," + exact},
+		// Without it the values go through a float64.
+		{"false", "12345678901234567000,-0.000000001,12345678901234567000"},
+	} {
+		t.Run("NUMERIC_AS_STRING="+tt.numericAsString, func(t *testing.T) {
+			t.Setenv("NUMERIC_AS_STRING", tt.numericAsString)
+			cfgs, err := loadConfig("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := runTables(context.Background(), cfgs, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("wrote %d lines, want a header and one row:\n%s", len(lines), b)
+			}
+			if !strings.HasSuffix(lines[1], ","+tt.want) {
+				t.Errorf("row = %s, want unit_price,sold_quantity,net_pay %s", lines[1], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Object is an object addressed as s3://bucket/key in TARGET_FILE.
+type s3Object struct {
+	bucket, key string
+}
+
+// parseS3URL splits an s3://bucket/key URL; ok is false for anything else,
+// which is then a local path.
+func parseS3URL(v string) (obj s3Object, ok bool, err error) {
+	rest, found := strings.CutPrefix(v, "s3://")
+	if !found {
+		return obj, false, nil
+	}
+	obj.bucket, obj.key, _ = strings.Cut(rest, "/")
+	if obj.bucket == "" || obj.key == "" || strings.HasSuffix(obj.key, "/") {
+		return obj, true, fmt.Errorf("invalid S3 URL %q: expected s3://bucket/key", v)
+	}
+	return obj, true, nil
+}
+
+// s3Endpoint is where S3 requests go: S3_ENDPOINT (e.g. http://minio:9000
+// for MinIO), or AWS in S3_REGION.
+func s3Endpoint(cfg Config) string {
+	if cfg.S3Endpoint != "" {
+		return strings.TrimSuffix(cfg.S3Endpoint, "/")
+	}
+	return fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.S3Region)
+}
+
+// uploadS3 stores the file f as obj with a single signed PUT. Objects are
+// addressed path-style (endpoint/bucket/key), which both AWS and MinIO
+// accept. A single PUT is limited to 5 GB.
+func uploadS3(ctx context.Context, cfg Config, obj s3Object, f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(s3Endpoint(cfg))
+	if err != nil {
+		return fmt.Errorf("invalid S3_ENDPOINT %q: %w", cfg.S3Endpoint, err)
+	}
+	u.Path = u.Path + "/" + obj.bucket + "/" + obj.key
+	u.RawPath = u.Path[:len(u.Path)-len(obj.key)] + s3Escape(obj.key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	creds := awsCredentials{cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3SessionToken}
+	signAWS(req, creds, cfg.S3Region, "s3", hex.EncodeToString(hash.Sum(nil)), time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload to s3://%s/%s: %w", obj.bucket, obj.key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to upload to s3://%s/%s: %s: %s", obj.bucket, obj.key, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// awsCredentials are the keys requests to AWS are signed with.
+type awsCredentials struct {
+	accessKey, secretKey, sessionToken string
+}
+
+// signAWS adds AWS Signature Version 4 headers for service in region to
+// req, whose body has the given hex SHA-256.
+func signAWS(req *http.Request, creds awsCredentials, region, service, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if n := strings.ToLower(name); strings.HasPrefix(n, "x-amz-") {
+			headers[n] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for n := range headers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, n := range names {
+		canonicalHeaders.WriteString(n + ":" + headers[n] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.secretKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKey, scope, signedHeaders, signature))
+}
+
+// s3Escape percent-encodes a key the way Signature Version 4 expects:
+// everything but unreserved characters and the slashes between segments.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
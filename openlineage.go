@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	openLineageProducer  = "https://github.com/abenezer/nvi_etl"
+	openLineageSchemaURL = "https://openlineage.io/spec/2-0-2/OpenLineage.json#/definitions/RunEvent"
+)
+
+// OpenLineage run event types.
+const (
+	olStart    = "START"
+	olComplete = "COMPLETE"
+	olFail     = "FAIL"
+)
+
+// openLineageClient posts run events to an OpenLineage endpoint such as
+// Marquez (http://marquez:5000/api/v1/lineage). Delivery is best effort:
+// a lineage outage is logged and never fails the ETL.
+type openLineageClient struct {
+	cfg    Config
+	runID  string
+	client *http.Client
+}
+
+func newOpenLineageClient(cfg Config, runID string) *openLineageClient {
+	return &openLineageClient{cfg: cfg, runID: runID, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type olField struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+func olFacet(schemaURL string, fields map[string]any) map[string]any {
+	facet := map[string]any{"_producer": openLineageProducer, "_schemaURL": schemaURL}
+	for k, v := range fields {
+		facet[k] = v
+	}
+	return facet
+}
+
+// olDataset names a table the way OpenLineage expects for SQL databases:
+// namespace "scheme://host:port", name "database.schema.table".
+func olDataset(scheme, dsn, schema, table string, fields []olField) map[string]any {
+	host, database := dsnParts(dsn)
+	return map[string]any{
+		"namespace": scheme + "://" + host,
+		"name":      fmt.Sprintf("%s.%s.%s", database, schema, table),
+		"facets": map[string]any{
+			"schema": olFacet("https://openlineage.io/spec/facets/1-1-1/SchemaDatasetFacet.json#/$defs/SchemaDatasetFacet",
+				map[string]any{"fields": fields}),
+		},
+	}
+}
+
+// emit sends one run event. rows is only reported on COMPLETE and err only
+// on FAIL.
+func (c *openLineageClient) emit(eventType string, rows int, runErr error) {
+	if c == nil {
+		return
+	}
+
+	var inFields, outFields []olField
+	for _, col := range c.cfg.Columns {
+		if col.Source != "" && !col.computed() {
+			inFields = append(inFields, olField{Name: col.Source})
+		}
+		outFields = append(outFields, olField{Name: col.Target, Type: col.targetType()})
+	}
+
+	input := olDataset("sqlserver", c.cfg.MSSQLConn, "dbo", c.cfg.SourceTable, inFields)
+	switch c.cfg.Source {
+	case sourceCSV:
+		input["namespace"], input["name"] = "file", c.cfg.SourceFile
+	case sourceMySQL:
+		// MySQL has no schemas within a database.
+		host, database := dsnParts(c.cfg.MySQLConn)
+		input["namespace"], input["name"] = "mysql://"+host, database+"."+c.cfg.SourceTable
+	case sourceOracle:
+		// The table is qualified with its schema (owner) if at all.
+		host, database := dsnParts(c.cfg.OracleConn)
+		input["namespace"], input["name"] = "oracle://"+host, database+"."+c.cfg.SourceTable
+	}
+	output := olDataset("postgres", c.cfg.PostgresConn, "public", c.cfg.TargetTable, outFields)
+	if eventType == olComplete {
+		output["outputFacets"] = map[string]any{
+			"outputStatistics": olFacet("https://openlineage.io/spec/facets/1-0-2/OutputStatisticsOutputDatasetFacet.json#/$defs/OutputStatisticsOutputDatasetFacet",
+				map[string]any{"rowCount": rows}),
+		}
+	}
+
+	run := map[string]any{"runId": c.runID}
+	if eventType == olFail && runErr != nil {
+		run["facets"] = map[string]any{
+			"errorMessage": olFacet("https://openlineage.io/spec/facets/1-0-1/ErrorMessageRunFacet.json#/$defs/ErrorMessageRunFacet",
+				map[string]any{"message": runErr.Error(), "programmingLanguage": "go"}),
+		}
+	}
+
+	event := map[string]any{
+		"eventType": eventType,
+		"eventTime": time.Now().UTC().Format(time.RFC3339Nano),
+		"producer":  openLineageProducer,
+		"schemaURL": openLineageSchemaURL,
+		"run":       run,
+		"job":       map[string]any{"namespace": c.cfg.OpenLineageNamespace, "name": c.cfg.SourceTable + "_to_" + c.cfg.TargetTable},
+		"inputs":    []any{input},
+		"outputs":   []any{output},
+	}
+
+	if err := c.post(event); err != nil {
+		slog.Warn("Failed to send OpenLineage event", "event", eventType, "error", err)
+	}
+}
+
+func (c *openLineageClient) post(event map[string]any) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.cfg.OpenLineageURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.cfg.OpenLineageAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.OpenLineageAPIKey)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build oracle
+
+package main
+
+// The Oracle driver is opt-in, since it needs cgo and the Oracle Instant
+// Client at run time:
+//
+//	CGO_ENABLED=1 go build -tags oracle
+import _ "github.com/godror/godror"
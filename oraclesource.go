@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// oracleDriver is the database/sql driver name of godror, which is only
+// linked into builds with the oracle tag (oracledriver.go).
+const oracleDriver = "godror"
+
+// checkOracleConn validates ORACLE_CONN for SOURCE=oracle.
+func checkOracleConn(conn string) error {
+	switch {
+	case conn == "":
+		return fmt.Errorf("ORACLE_CONN (or ORACLE_CONN_SECRET) environment variable must be set for SOURCE=oracle. Check your .env file")
+	case !slices.Contains(sql.Drivers(), oracleDriver):
+		return fmt.Errorf("SOURCE=oracle needs the godror driver, which this binary was built without; build with -tags oracle")
+	}
+	return nil
+}
+
+// oracleKeyIndexed is sourceKeyIndexed for Oracle. Unquoted names are
+// stored in upper case, so table and keyColumn are looked up that way;
+// table may be qualified with its owner, and is otherwise one of the
+// user's own.
+func oracleKeyIndexed(ctx context.Context, db *sql.DB, table, keyColumn string) (bool, error) {
+	owner, name, ok := strings.Cut(table, ".")
+	if !ok {
+		owner, name = "", table
+	}
+	var n int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*)
+		FROM all_ind_columns
+		WHERE table_owner = COALESCE(:owner, SYS_CONTEXT('USERENV', 'CURRENT_SCHEMA'))
+			AND table_name = :name AND column_name = :col AND column_position = 1`,
+		sql.Named("owner", oracleName(owner)), sql.Named("name", oracleName(name)), sql.Named("col", oracleName(keyColumn))).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up indexes on source table %s: %w", table, err)
+	}
+	return n > 0, nil
+}
+
+// oracleName returns the dictionary name of an identifier: as written if
+// quoted, upper case otherwise. Oracle stores an empty string as NULL,
+// which oracleKeyIndexed relies on for a missing owner.
+func oracleName(s string) string {
+	if len(s) > 1 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return strings.ToUpper(s)
+}
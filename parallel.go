@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// sourcePartitions splits the source into n fsno ranges of about equal row
+// count and returns the upper bound of each range but the last, which is
+// left open so rows added during the run are still read.
+func sourcePartitions(ctx context.Context, db *sql.DB, cfg Config, key column, n int) ([]any, error) {
+	p, arg := sourceParam(cfg.Source, "n", n)
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT MAX(%[1]s)
+		FROM (SELECT %[1]s, NTILE(%[3]s) OVER (ORDER BY %[1]s) AS part FROM %[2]s) t
+		GROUP BY part
+		ORDER BY part`, key.Source, cfg.SourceTable, p), arg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split %s into ranges: %w", cfg.SourceTable, err)
+	}
+	defer rows.Close()
+
+	var bounds []any
+	for rows.Next() {
+		dest := key.scanDest()
+		if err := rows.Scan(dest); err != nil {
+			return nil, fmt.Errorf("failed to split %s into ranges: %w", cfg.SourceTable, err)
+		}
+		if v := statValue(key, dest); v != nil {
+			bounds = append(bounds, v)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to split %s into ranges: %w", cfg.SourceTable, err)
+	}
+	if len(bounds) > 0 {
+		bounds = bounds[:len(bounds)-1]
+	}
+	return bounds, nil
+}
+
+// runParallel loads the fsno ranges of the source concurrently, one worker
+// per range. The first failure cancels the other workers. Incremental
+// positions are saved only once every range has been loaded.
+func runParallel(ctx context.Context, cfg Config, runID string, sourceDB, targetDB *sql.DB, cols []column, plan readPlan, known rowHashes) (int, error) {
+	bounds, err := sourcePartitions(ctx, sourceDB, cfg, keyOf(cols), cfg.Parallelism)
+	if err != nil {
+		return 0, err
+	}
+	plans := make([]readPlan, len(bounds)+1)
+	for i := range plans {
+		plans[i] = plan
+		if i > 0 {
+			plans[i].after = bounds[i-1]
+		}
+		if i < len(bounds) {
+			plans[i].upTo = bounds[i]
+		}
+	}
+	slog.Info("Loading the source in parallel ranges", "table", cfg.TargetTable, "ranges", len(plans), "key", keyOf(cols).Source)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var total loadResult
+	var firstErr error
+	var wg sync.WaitGroup
+	for i, p := range plans {
+		wg.Add(1)
+		go func(i int, p readPlan) {
+			defer wg.Done()
+			res, err := loadRange(ctx, cfg, runID, sourceDB, targetDB, cols, p, known)
+
+			mu.Lock()
+			defer mu.Unlock()
+			total.add(res)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("range %d of %d: %w", i+1, len(plans), err)
+				cancel()
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	total.log(cfg)
+	if firstErr != nil {
+		return total.rows, firstErr
+	}
+
+	if cfg.DryRun {
+		return total.rows, nil
+	}
+	if err := saveProgress(ctx, targetDB, cfg, plan); err != nil {
+		return total.rows, err
+	}
+	return total.rows, nil
+}
+
+func loadRange(ctx context.Context, cfg Config, runID string, sourceDB, targetDB *sql.DB, cols []column, plan readPlan, known rowHashes) (loadResult, error) {
+	rows, err := newSource(cfg, sourceDB).extract(ctx, cols, plan)
+	if err != nil {
+		return loadResult{}, fmt.Errorf("failed to query source data: %w", err)
+	}
+	return loadRows(ctx, cfg, runID, newSink(ctx, cfg, runID, targetDB, cols, known), cols, rows, nil, nil)
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Compression codecs for PARQUET_COMPRESSION.
+const (
+	parquetSnappy = "snappy"
+	parquetGzip   = "gzip"
+	parquetNone   = "none"
+)
+
+// Parquet format enums, as numbered in parquet.thrift.
+const (
+	pqTypeInt32     = 1
+	pqTypeInt64     = 2
+	pqTypeDouble    = 5
+	pqTypeByteArray = 6
+
+	pqConvertedUTF8            = 0
+	pqConvertedDecimal         = 5
+	pqConvertedDate            = 6
+	pqConvertedTimestampMicros = 10
+
+	pqOptional = 1
+
+	pqEncodingPlain = 0
+	pqEncodingRLE   = 3
+
+	pqCodecUncompressed = 0
+	pqCodecSnappy       = 1
+	pqCodecGzip         = 2
+
+	pqPageData = 0
+)
+
+var parquetMagic = []byte("PAR1")
+
+// parquetColumn buffers one column of the current row group: a definition
+// level per row (0 for NULL) and the PLAIN-encoded non-null values.
+type parquetColumn struct {
+	col       column
+	typ       int32
+	converted int32 // -1 for none
+	precision int32
+	scale     int32
+	defs      []byte
+	values    bytes.Buffer
+}
+
+// newParquetColumn derives the Parquet type of c from its target type:
+// text as UTF-8 strings, NUMERIC(p,s) up to 18 digits as decimals stored
+// in INT64, other numbers as DOUBLE, DATE as days and TIMESTAMP as
+// microseconds since the epoch.
+func newParquetColumn(c column) *parquetColumn {
+	pc := &parquetColumn{col: c, converted: -1}
+	switch {
+	case c.Sequence:
+		pc.typ = pqTypeInt64
+	case c.kind() == kindTime && strings.HasPrefix(strings.ToUpper(c.Type), "DATE"):
+		pc.typ, pc.converted = pqTypeInt32, pqConvertedDate
+	case c.kind() == kindTime:
+		pc.typ, pc.converted = pqTypeInt64, pqConvertedTimestampMicros
+	case c.kind() == kindNumeric:
+		pc.typ = pqTypeDouble
+		if m := numericTypeRe.FindStringSubmatch(c.Type); m != nil {
+			p, _ := strconv.Atoi(m[1])
+			s, _ := strconv.Atoi(m[2])
+			if p <= 18 {
+				pc.typ, pc.converted, pc.precision, pc.scale = pqTypeInt64, pqConvertedDecimal, int32(p), int32(s)
+			}
+		}
+	default:
+		pc.typ, pc.converted = pqTypeByteArray, pqConvertedUTF8
+	}
+	return pc
+}
+
+// add appends one transformed value.
+func (pc *parquetColumn) add(v any) error {
+	var b [8]byte
+	switch v := v.(type) {
+	case *sql.NullString:
+		if !v.Valid {
+			break
+		}
+		switch pc.typ {
+		case pqTypeByteArray:
+			binary.LittleEndian.PutUint32(b[:], uint32(len(v.String)))
+			pc.values.Write(b[:4])
+			pc.values.WriteString(v.String)
+			pc.defs = append(pc.defs, 1)
+			return nil
+		case pqTypeDouble:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v.String), 64)
+			if err != nil {
+				return fmt.Errorf("column %s: %w", pc.col.Target, err)
+			}
+			return pc.add(&sql.NullFloat64{Float64: f, Valid: true})
+		}
+		return pc.addDecimal(v)
+	case *sql.NullFloat64:
+		if !v.Valid {
+			break
+		}
+		if pc.typ == pqTypeInt64 {
+			return pc.addDecimal(v)
+		}
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v.Float64))
+		pc.values.Write(b[:])
+		pc.defs = append(pc.defs, 1)
+		return nil
+	case *sql.NullInt64:
+		if !v.Valid {
+			break
+		}
+		binary.LittleEndian.PutUint64(b[:], uint64(v.Int64))
+		pc.values.Write(b[:])
+		pc.defs = append(pc.defs, 1)
+		return nil
+	case *sql.NullTime:
+		if !v.Valid {
+			break
+		}
+		if pc.typ == pqTypeInt32 {
+			// The calendar date as read, whatever its time zone.
+			y, m, d := v.Time.Date()
+			days := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+			binary.LittleEndian.PutUint32(b[:], uint32(int32(days)))
+			pc.values.Write(b[:4])
+		} else {
+			binary.LittleEndian.PutUint64(b[:], uint64(v.Time.UnixMicro()))
+			pc.values.Write(b[:])
+		}
+		pc.defs = append(pc.defs, 1)
+		return nil
+	}
+	pc.defs = append(pc.defs, 0)
+	return nil
+}
+
+// addDecimal stores a number as an unscaled INT64, rounded half away from
+// zero to the column's scale, like Postgres does on insert.
+func (pc *parquetColumn) addDecimal(v any) error {
+	n, ok := numericValue(v)
+	if !ok {
+		return fmt.Errorf("column %s: %v is not a number", pc.col.Target, v)
+	}
+	r := new(big.Rat).Mul(n, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(pc.scale)), nil)))
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if m.Abs(m).Lsh(m, 1).Cmp(r.Denom()) >= 0 {
+		q.Add(q, big.NewInt(int64(r.Num().Sign())))
+	}
+	limit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(pc.precision)), nil)
+	if new(big.Int).Abs(q).Cmp(limit) >= 0 {
+		return fmt.Errorf("column %s: %s does not fit %s", pc.col.Target, n.FloatString(int(pc.scale)), pc.col.Type)
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(q.Int64()))
+	pc.values.Write(b[:])
+	pc.defs = append(pc.defs, 1)
+	return nil
+}
+
+// parquetWriter writes transformed rows as a Parquet file: one row group
+// per PARQUET_ROW_GROUP_SIZE rows, one PLAIN-encoded data page per column
+// chunk, every column optional. Close writes the footer. It implements
+// rowWriter, with nothing to conflict with.
+type parquetWriter struct {
+	out       io.Writer
+	offset    int64
+	cfg       Config
+	cols      []*parquetColumn
+	rows      int // in the current row group
+	total     int64
+	rowGroups [][]byte // encoded RowGroup structs
+}
+
+func newParquetWriter(cfg Config, cols []column, out io.Writer) (*parquetWriter, error) {
+	w := &parquetWriter{out: out, cfg: cfg}
+	for _, c := range cols {
+		w.cols = append(w.cols, newParquetColumn(c))
+	}
+	return w, w.write(parquetMagic)
+}
+
+func (w *parquetWriter) write(b []byte) error {
+	n, err := w.out.Write(b)
+	w.offset += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write target file: %w", err)
+	}
+	return nil
+}
+
+func (w *parquetWriter) Write(vals []any) error {
+	for i, pc := range w.cols {
+		if err := pc.add(vals[i]); err != nil {
+			return err
+		}
+	}
+	w.rows++
+	if w.rows >= w.cfg.ParquetRowGroupSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush writes the buffered rows as a row group.
+func (w *parquetWriter) Flush() error {
+	if w.rows == 0 {
+		return nil
+	}
+	var chunks [][]byte
+	var groupSize int64
+	for _, pc := range w.cols {
+		page := rleLevels(pc.defs)
+		page = append(page, pc.values.Bytes()...)
+		compressed, codec, err := parquetCompress(w.cfg.ParquetCompression, page)
+		if err != nil {
+			return err
+		}
+
+		var h thriftWriter
+		h.i32(1, pqPageData)
+		h.i32(2, int32(len(page)))
+		h.i32(3, int32(len(compressed)))
+		h.structBegin(5)
+		h.i32(1, int32(w.rows))
+		h.i32(2, pqEncodingPlain)
+		h.i32(3, pqEncodingRLE)
+		h.i32(4, pqEncodingRLE)
+		h.structEnd()
+		h.stop()
+
+		pageOffset := w.offset
+		if err := w.write(h.buf); err != nil {
+			return err
+		}
+		if err := w.write(compressed); err != nil {
+			return err
+		}
+
+		var c thriftWriter
+		c.i64(2, pageOffset)
+		c.structBegin(3)
+		c.i32(1, pc.typ)
+		c.listBegin(2, thriftI32, 2)
+		c.listI32(pqEncodingPlain)
+		c.listI32(pqEncodingRLE)
+		c.listBegin(3, thriftBinary, 1)
+		c.listString(pc.col.Target)
+		c.i32(4, codec)
+		c.i64(5, int64(w.rows))
+		c.i64(6, int64(len(h.buf)+len(page)))
+		c.i64(7, int64(len(h.buf)+len(compressed)))
+		c.i64(9, pageOffset)
+		c.structEnd()
+		c.stop()
+		chunks = append(chunks, c.buf)
+		groupSize += int64(len(h.buf) + len(page))
+
+		pc.defs = pc.defs[:0]
+		pc.values.Reset()
+	}
+
+	var g thriftWriter
+	g.listBegin(1, thriftStruct, len(chunks))
+	for _, c := range chunks {
+		g.raw(c)
+	}
+	g.i64(2, groupSize)
+	g.i64(3, int64(w.rows))
+	g.stop()
+	w.rowGroups = append(w.rowGroups, g.buf)
+	w.total += int64(w.rows)
+	w.rows = 0
+	return nil
+}
+
+// Close writes the file footer: the schema and where every column chunk
+// is.
+func (w *parquetWriter) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	var f thriftWriter
+	f.i32(1, 1)
+	f.listBegin(2, thriftStruct, len(w.cols)+1)
+	var root thriftWriter
+	root.str(4, "schema")
+	root.i32(5, int32(len(w.cols)))
+	root.stop()
+	f.raw(root.buf)
+	for _, pc := range w.cols {
+		var s thriftWriter
+		s.i32(1, pc.typ)
+		s.i32(3, pqOptional)
+		s.str(4, pc.col.Target)
+		if pc.converted >= 0 {
+			s.i32(6, pc.converted)
+		}
+		if pc.converted == pqConvertedDecimal {
+			s.i32(7, pc.scale)
+			s.i32(8, pc.precision)
+		}
+		s.stop()
+		f.raw(s.buf)
+	}
+	f.i64(3, w.total)
+	f.listBegin(4, thriftStruct, len(w.rowGroups))
+	for _, g := range w.rowGroups {
+		f.raw(g)
+	}
+	f.str(6, "nvi_etl")
+	f.stop()
+
+	if err := w.write(f.buf); err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(f.buf)))
+	if err := w.write(size[:]); err != nil {
+		return err
+	}
+	return w.write(parquetMagic)
+}
+
+func (w *parquetWriter) Conflicts() int { return 0 }
+
+// rleLevels encodes definition levels of bit width 1 as RLE runs, with the
+// length prefix of a v1 data page.
+func rleLevels(levels []byte) []byte {
+	out := make([]byte, 4, 16)
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		out = binary.AppendUvarint(out, uint64(j-i)<<1)
+		out = append(out, levels[i])
+		i = j
+	}
+	binary.LittleEndian.PutUint32(out, uint32(len(out)-4))
+	return out
+}
+
+func parquetCompress(codec string, page []byte) ([]byte, int32, error) {
+	switch codec {
+	case parquetSnappy:
+		return snappyEncode(page), pqCodecSnappy, nil
+	case parquetGzip:
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(page); err != nil {
+			return nil, 0, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, 0, err
+		}
+		return buf.Bytes(), pqCodecGzip, nil
+	}
+	return page, pqCodecUncompressed, nil
+}
+
+// Thrift compact protocol type ids.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes one struct in the Thrift compact protocol, which is
+// what Parquet metadata is written in. Nested structs are written inline
+// with structBegin/structEnd; list elements that are structs are encoded
+// separately and added with raw.
+type thriftWriter struct {
+	buf    []byte
+	last   int16
+	parent []int16
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if d := id - t.last; d > 0 && d <= 15 {
+		t.buf = append(t.buf, byte(d)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.buf = binary.AppendVarint(t.buf, int64(id))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.buf = binary.AppendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.buf = binary.AppendVarint(t.buf, v)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.listString(s)
+}
+
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.parent = append(t.parent, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) structEnd() {
+	t.stop()
+	t.last = t.parent[len(t.parent)-1]
+	t.parent = t.parent[:len(t.parent)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.buf = append(t.buf, 0)
+}
+
+func (t *thriftWriter) listBegin(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|elem)
+		return
+	}
+	t.buf = append(t.buf, 0xf0|elem)
+	t.buf = binary.AppendUvarint(t.buf, uint64(n))
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	t.buf = binary.AppendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) listString(s string) {
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+func (t *thriftWriter) raw(b []byte) {
+	t.buf = append(t.buf, b...)
+}
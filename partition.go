@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// partitionColumn returns the PARTITION_BY column of cols, if the target is
+// partitioned.
+func partitionColumn(cfg Config, cols []column) (column, bool) {
+	if cfg.PartitionBy == "" {
+		return column{}, false
+	}
+	for _, c := range cols {
+		if c.Target == cfg.PartitionBy {
+			return c, true
+		}
+	}
+	return column{}, false
+}
+
+// partitionClause is the PARTITION BY clause of the target table: monthly
+// ranges of a date or timestamp column, or a list of the values of a text
+// column.
+func partitionClause(c column) string {
+	if c.kind() == kindTime {
+		return fmt.Sprintf(" PARTITION BY RANGE (%s)", c.Target)
+	}
+	return fmt.Sprintf(" PARTITION BY LIST (%s)", c.Target)
+}
+
+// conflictColumns is what ON CONFLICT names: the key, plus the partition
+// column when the table is partitioned on another column, since Postgres
+// only enforces a unique key that includes the partition column.
+func conflictColumns(cfg Config, cols []column) string {
+	key := keyOf(cols).Target
+	if pc, ok := partitionColumn(cfg, cfg.Columns); ok && pc.Target != key {
+		return key + ", " + pc.Target
+	}
+	return key
+}
+
+// checkPartitionedTarget makes sure an existing target table is
+// partitioned as PARTITION_BY asks, since CREATE TABLE IF NOT EXISTS
+// leaves a plain table as it is.
+func checkPartitionedTarget(ctx context.Context, db *sql.DB, cfg Config) error {
+	var key sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT pg_get_partkeydef(c.oid)
+		FROM pg_class c
+		WHERE c.oid = to_regclass($1)`, cfg.TargetTable).Scan(&key)
+	if err != nil {
+		return fmt.Errorf("failed to read the partitioning of %s: %w", cfg.TargetTable, err)
+	}
+	pc, _ := partitionColumn(cfg, cfg.Columns)
+	want := strings.TrimPrefix(partitionClause(pc), " PARTITION BY ")
+	if !key.Valid || !strings.EqualFold(key.String, want) {
+		got := "not partitioned"
+		if key.Valid {
+			got = "partitioned by " + key.String
+		}
+		return fmt.Errorf("PARTITION_BY=%s expects %s to be partitioned by %s, but it is %s; recreate the table or copy it into a partitioned one", cfg.PartitionBy, cfg.TargetTable, want, got)
+	}
+	return nil
+}
+
+// partitioner creates the partition of each row before it is written: one
+// per month or per value, on first sight. A nil partitioner does nothing.
+type partitioner struct {
+	ctx   context.Context
+	cfg   Config
+	idx   int
+	known map[string]bool
+	// pending are the partitions created in the current transaction, which
+	// are forgotten if it is rolled back.
+	pending []string
+}
+
+func newPartitioner(ctx context.Context, cfg Config, cols []column) *partitioner {
+	if cfg.PartitionBy == "" || cfg.DryRun {
+		return nil
+	}
+	for i, c := range cols {
+		if c.Target == cfg.PartitionBy {
+			return &partitioner{ctx: ctx, cfg: cfg, idx: i, known: map[string]bool{}}
+		}
+	}
+	return nil
+}
+
+// ensure creates the partition the row vals belongs to, unless it was
+// already created in this load. A NULL is left to the primary key, which
+// refuses it.
+func (p *partitioner) ensure(target execer, vals []any) error {
+	if p == nil {
+		return nil
+	}
+	name, bounds, ok := p.partition(vals[p.idx])
+	if !ok || p.known[name] {
+		return nil
+	}
+	ddl := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES %s", name, p.cfg.TargetTable, bounds)
+	if _, err := target.ExecContext(p.ctx, ddl); err != nil {
+		return fmt.Errorf("failed to create partition %s: %w", name, err)
+	}
+	p.known[name] = true
+	p.pending = append(p.pending, name)
+	slog.Debug("Partition is ready", "table", p.cfg.TargetTable, "partition", name, "values", bounds)
+	return nil
+}
+
+// committed keeps the partitions created so far; rolledBack forgets the
+// ones the rolled back transaction created.
+func (p *partitioner) committed() {
+	if p != nil {
+		p.pending = nil
+	}
+}
+
+func (p *partitioner) rolledBack() {
+	if p == nil {
+		return
+	}
+	for _, name := range p.pending {
+		delete(p.known, name)
+	}
+	p.pending = nil
+}
+
+// partition returns the name and bounds of the partition of v.
+func (p *partitioner) partition(v any) (name, bounds string, ok bool) {
+	switch v := v.(type) {
+	case *sql.NullTime:
+		if !v.Valid {
+			return "", "", false
+		}
+		from := time.Date(v.Time.Year(), v.Time.Month(), 1, 0, 0, 0, 0, time.UTC)
+		to := from.AddDate(0, 1, 0)
+		return p.name(from.Format("2006_01")), fmt.Sprintf("FROM ('%s') TO ('%s')", from.Format("2006-01-02"), to.Format("2006-01-02")), true
+	case *sql.NullString:
+		if !v.Valid {
+			return "", "", false
+		}
+		return p.name(partitionSuffix(v.String)), fmt.Sprintf("IN (%s)", pq.QuoteLiteral(v.String)), true
+	}
+	return "", "", false
+}
+
+// name is the partition table for suffix, next to the target table.
+func (p *partitioner) name(suffix string) string {
+	return partitionName(p.cfg.TargetTable, suffix)
+}
+
+func partitionName(table, suffix string) string {
+	schema, name := splitTableName(table)
+	name = strings.ToLower(name) + "_" + suffix
+	if len(name) > 63 {
+		name = fmt.Sprintf("%s_%08x", name[:54], crc32.ChecksumIEEE([]byte(name)))
+	}
+	if schema != "" {
+		return schema + "." + name
+	}
+	return name
+}
+
+// partitionSuffix makes an identifier of a list value. A value that had
+// to be changed gets a checksum, so North-East, North East and north_east
+// do not share a partition, and a region named default does not take the
+// default partition.
+func partitionSuffix(s string) string {
+	clean := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, s)
+	if clean != s || clean == "" || clean == "default" {
+		clean = fmt.Sprintf("%s_%08x", clean, crc32.ChecksumIEEE([]byte(s)))
+	}
+	return clean
+}
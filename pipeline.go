@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// rowSource is what a run reads from: the MSSQL table (mssqlSource), a
+// MySQL, MariaDB or Oracle table (sqlSource) or a CSV file (csvSource). A new source only has to implement it; loadRows
+// does not change.
+type rowSource interface {
+	// plan decides what this run reads, e.g. the range of an incremental
+	// load, and checks what the read depends on.
+	plan(ctx context.Context, targetDB *sql.DB, cols []column) (readPlan, error)
+	// extract starts reading the rows of cols as planned. The rows are
+	// pulled one at a time rather than sent on a channel, so a row that
+	// failed to scan can still be read again for the dead letters. With
+	// READ_AHEAD, loadRows pulls them in a goroutine of its own instead.
+	extract(ctx context.Context, cols []column, plan readPlan) (sourceRows, error)
+}
+
+func newSource(cfg Config, sourceDB *sql.DB) rowSource {
+	switch cfg.Source {
+	case sourceCSV:
+		return csvSource{cfg: cfg}
+	case sourceMySQL, sourceOracle:
+		return sqlSource{db: sourceDB, cfg: cfg}
+	}
+	return mssqlSource{db: sourceDB, cfg: cfg}
+}
+
+// rowSink is what a run writes to: the Postgres target table (loadTarget),
+// a Snowflake table (snowflakeSink), a Kafka topic (kafkaSink) or a file
+// (fileSink). loadRows drives it one batch at a time: begin,
+// write every row, flush, and commit once batchDone says so or the source
+// is exhausted. abort undoes whatever was not committed.
+type rowSink interface {
+	begin() error
+	write(vals []any) error
+	batchDone(rows int) bool
+	flush() error
+	commit(rows int) error
+	abort()
+	// state is what checkpoints, column stats and the final step of a run
+	// are written through, within the current batch. It is nil for a sink
+	// that keeps no state, which the configuration then rules out.
+	state() execer
+	// rejectScan records a source row that failed to scan. It reports
+	// false if the sink keeps no dead letters, and the row is skipped.
+	rejectScan(rows sourceRows, err error) (bool, error)
+	// rejectRow records a scanned row dropped at stage, a duplicate or a
+	// row that broke a quality rule, like rejectScan.
+	rejectRow(stage string, vals []any, reason error) (bool, error)
+	// report adds what the sink counted to res.
+	report(res *loadResult)
+}
+
+// newSink returns the sink of cfg's target. known are the row hashes the
+// target already has, if ROW_HASH loaded them.
+func newSink(ctx context.Context, cfg Config, runID string, targetDB *sql.DB, cols []column, known rowHashes) rowSink {
+	if cfg.Target == targetSnowflake {
+		return newSnowflakeSink(ctx, cfg, runID, targetDB, cols)
+	}
+	if cfg.Target == targetKafka {
+		return &kafkaSink{cfg: cfg, publish: newKafkaPublisher(ctx, cfg, cols)}
+	}
+	if cfg.Target != targetPostgres {
+		return &fileSink{ctx: ctx, cfg: cfg, cols: cols, runID: runID}
+	}
+	l := &loadTarget{ctx: ctx, db: targetDB, cfg: cfg, cols: cols, dead: newDeadLetters(cfg, runID, cols), publish: newKafkaPublisher(ctx, cfg, cols), parts: newPartitioner(ctx, cfg, cols), known: known}
+	if cfg.MaxReplicationLag > 0 {
+		l.throttle = newLagThrottle(ctx, targetDB, cfg)
+	}
+	return l
+}
+
+// loadResult is what loading one stream of source rows reports back.
+type loadResult struct {
+	rows       int
+	duplicates int
+	discarded  int
+	// violations counts the rows that broke each of QUALITY_RULES.
+	violations []int
+	conflicts  int
+	stats      transformStats
+	engaged    int
+	throttled  time.Duration
+	rejected   int
+	mirrors    []mirrorResult
+}
+
+func (r *loadResult) add(o loadResult) {
+	r.rows += o.rows
+	r.duplicates += o.duplicates
+	r.discarded += o.discarded
+	if r.violations == nil {
+		r.violations = make([]int, len(o.violations))
+	}
+	for i, n := range o.violations {
+		r.violations[i] += n
+	}
+	r.conflicts += o.conflicts
+	r.stats.Transcoded += o.stats.Transcoded
+	r.stats.Sanitized += o.stats.Sanitized
+	r.engaged += o.engaged
+	r.throttled += o.throttled
+	r.rejected += o.rejected
+}
+
+func (r loadResult) log(cfg Config) {
+	if r.engaged > 0 {
+		slog.Info("Replication lag throttling paused the load", "table", cfg.TargetTable, "times", r.engaged, "paused", r.throttled)
+	}
+	if r.duplicates > 0 {
+		slog.Info("Skipped rows whose key was already written within DEDUP_WINDOW", "table", cfg.TargetTable, "rows", r.duplicates, "window", cfg.DedupWindow)
+	}
+	if r.discarded > 0 {
+		slog.Warn("Discarded source rows that share their key with a row that won DEDUP_WINNER", "table", cfg.TargetTable, "rows", r.discarded, "winner", winnerText(cfg.DedupWinner))
+	}
+	if r.conflicts > 0 && cfg.DryRun {
+		slog.Info("Rows have a key that is already in the target; CONFLICT_ACTION decides what happens to them", "table", cfg.TargetTable, "rows", r.conflicts, "conflict_action", cfg.ConflictAction)
+	} else if r.conflicts > 0 {
+		slog.Info("Rows were left unchanged by ON CONFLICT", "table", cfg.TargetTable, "rows", r.conflicts)
+	}
+	if r.stats.Transcoded > 0 {
+		slog.Info("Transcoded text values to UTF-8", "table", cfg.TargetTable, "values", r.stats.Transcoded)
+	}
+	if r.stats.Sanitized > 0 {
+		slog.Info("Sanitized control characters in text values", "table", cfg.TargetTable, "values", r.stats.Sanitized)
+	}
+	if r.rejected > 0 {
+		slog.Warn("Rows were rejected into "+deadLettersTableName, "table", cfg.TargetTable, "rows", r.rejected)
+	}
+	logQualityReport(cfg, r.rows, r.violations)
+}
+
+// loadRows writes rows to sink and closes them. ckpt, if set, is saved
+// with every batch. final, if set, runs in the last batch just before it
+// commits.
+func loadRows(ctx context.Context, cfg Config, runID string, sink rowSink, cols []column, rows sourceRows, ckpt *checkpoint, final func(execer) error) (res loadResult, err error) {
+	if cfg.ReadAhead > 0 {
+		rows = newReadAheadRows(rows, cols, cfg.ReadAhead)
+	}
+	defer rows.Close()
+
+	if err := sink.begin(); err != nil {
+		return res, err
+	}
+	defer sink.abort()
+	defer sink.report(&res)
+
+	profile := newColumnStats(cfg, cols)
+	qc, err := newQuality(cfg, cols)
+	if err != nil {
+		return res, err
+	}
+	defer qc.report(&res)
+	seqIdx := sequenceIndex(cols)
+	hasher := newRowHasher(cfg, cols)
+	var seq int64
+	recent := newRecentKeys(cfg.DedupWindow)
+	lastKey := ""
+	trace := newBatchTrace(ctx, cfg.BatchSize)
+	defer func() { trace.end(err) }()
+	slog.Info("Starting data transfer", "table", cfg.TargetTable)
+
+	for rows.Next() {
+		etlMetrics.rowsExtracted.add(cfg.TargetTable, 1)
+		vals := make([]any, len(cols))
+		for i, c := range cols {
+			vals[i] = c.scanDest()
+		}
+
+		if err := rows.Scan(vals...); err != nil {
+			etlMetrics.scanErrors.add(cfg.TargetTable, 1)
+			rejected, rejectErr := sink.rejectScan(rows, err)
+			if rejectErr != nil {
+				return res, rejectErr
+			}
+			if !rejected {
+				slog.Warn("Error scanning source row; skipping it", "table", cfg.TargetTable, "row", res.rows+1, "error", err)
+			}
+			continue
+		}
+		trace.lap(stageTimeRead)
+		key := rowKey(cols, vals)
+		// With DEDUP_WINNER the rows of a key arrive together, the winner
+		// first.
+		if len(cfg.DedupWinner) > 0 && key != "" && key == lastKey {
+			res.discarded++
+			reason := fmt.Errorf("duplicate key; kept the first row by %s", winnerText(cfg.DedupWinner))
+			rejected, err := sink.rejectRow(stageDuplicate, vals, reason)
+			if err != nil {
+				return res, err
+			}
+			if !rejected {
+				slog.Info("Discarded a duplicate source row", "table", cfg.TargetTable, "key", key, "winner", winnerText(cfg.DedupWinner))
+			}
+			continue
+		}
+		lastKey = key
+		if recent.contains(key) {
+			res.duplicates++
+			continue
+		}
+
+		ckpt.track(vals)
+		transformRow(cfg, cols, vals, &res.stats)
+		broken, err := qc.check(vals, key)
+		if err != nil {
+			return res, err
+		}
+		if broken != nil {
+			// check logged the rule's first violation; the rest are counted.
+			if _, err := sink.rejectRow(stageQuality, vals, fmt.Errorf("breaks quality rule %s", broken)); err != nil {
+				return res, err
+			}
+			continue
+		}
+		// Numbered last, so skipped and rejected rows leave no gaps.
+		if seqIdx >= 0 {
+			seq++
+			vals[seqIdx] = &sql.NullInt64{Int64: seq, Valid: true}
+		}
+		hasher.set(vals)
+		trace.lap(stageTimeTransform)
+
+		if err := sink.write(vals); err != nil {
+			return res, err
+		}
+		trace.lap(stageTimeWrite)
+		trace.written()
+		recent.add(key)
+		profile.add(vals)
+		res.rows++
+
+		if sink.batchDone(res.rows) {
+			if err := ckpt.save(ctx, sink.state(), res.rows); err != nil {
+				return res, err
+			}
+			if err := sink.commit(res.rows); err != nil {
+				return res, err
+			}
+			if err := sink.begin(); err != nil {
+				return res, err
+			}
+			trace.skip()
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return res, fmt.Errorf("error iterating over source rows: %w", err)
+	}
+
+	if err := sink.flush(); err != nil {
+		return res, err
+	}
+	trace.lap(stageTimeWrite)
+	trace.end(nil)
+
+	if !cfg.DryRun {
+		if err := profile.save(ctx, sink.state(), runID); err != nil {
+			return res, err
+		}
+		if final != nil {
+			if err := final(sink.state()); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	if err := sink.commit(res.rows); err != nil {
+		return res, err
+	}
+	return res, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+// fakeRows is a source of fsno, customer rows, plus the NULL placeholder of
+// load_seq. A row with a nil customer fails to scan.
+type fakeRows struct {
+	rows [][2]*string
+	i    int
+}
+
+func (r *fakeRows) Next() bool {
+	r.i++
+	return r.i <= len(r.rows)
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	row := r.rows[r.i-1]
+	if row[1] == nil {
+		return errors.New("converting NULL to string is unsupported")
+	}
+	*dest[0].(*sql.NullString) = sql.NullString{String: *row[0], Valid: true}
+	*dest[1].(*sql.NullString) = sql.NullString{String: *row[1], Valid: *row[1] != ""}
+	*dest[2].(*sql.NullInt64) = sql.NullInt64{}
+	return nil
+}
+
+func (r *fakeRows) Err() error   { return nil }
+func (r *fakeRows) Close() error { return nil }
+
+// fakeSink keeps the rows written and committed, and the keys of rejected
+// ones. It commits every batch rows.
+type fakeSink struct {
+	batch     int
+	pending   [][]any
+	committed [][]any
+	rejected  []string
+}
+
+func (s *fakeSink) begin() error            { return nil }
+func (s *fakeSink) batchDone(rows int) bool { return rows%s.batch == 0 }
+func (s *fakeSink) flush() error            { return nil }
+func (s *fakeSink) abort()                  { s.pending = nil }
+func (s *fakeSink) state() execer           { return nil }
+func (s *fakeSink) report(res *loadResult)  {}
+func (s *fakeSink) write(vals []any) error  { s.pending = append(s.pending, vals); return nil }
+func (s *fakeSink) commit(rows int) error {
+	s.committed = append(s.committed, s.pending...)
+	s.pending = nil
+	return nil
+}
+
+func (s *fakeSink) rejectScan(rows sourceRows, err error) (bool, error) {
+	s.rejected = append(s.rejected, "scan")
+	return true, nil
+}
+
+func (s *fakeSink) rejectRow(stage string, vals []any, reason error) (bool, error) {
+	s.rejected = append(s.rejected, vals[0].(*sql.NullString).String)
+	return true, nil
+}
+
+// TestLoadRowsSequence loads rows with one that fails to scan and one that
+// a NULL policy rejects in the middle, and checks LOAD_SEQ numbers the rest
+// 1, 2, 3... in read order.
+func TestLoadRowsSequence(t *testing.T) {
+	cols := []column{
+		{Source: "fsno", Target: "fsno", Type: "VARCHAR(50)", Key: true},
+		{Source: "customer", Target: "customer", Type: "VARCHAR(100)", OnNull: nullReject},
+		loadSeqColumn,
+	}
+	cfg := Config{TargetTable: "sales", BatchSize: 2, LoadSeq: true, QualityRules: nullRules(cols)}
+	s := func(v string) *string { return &v }
+	src := &fakeRows{rows: [][2]*string{
+		{s("FS-0001"), s("Abebe Kebede")},
+		{s("FS-0002"), nil}, // fails to scan
+		{s("FS-0003"), s("Hana Tesfaye")},
+		{s("FS-0004"), s("")}, // NULL customer, rejected
+		{s("FS-0005"), s("Dawit Alemu")},
+		{s("FS-0006"), s("Selam Girma")},
+		{s("FS-0007"), s("Yonas Bekele")},
+	}}
+	sink := &fakeSink{batch: 2}
+
+	res, err := loadRows(context.Background(), cfg, "run", sink, cols, src, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.rows != 5 {
+		t.Errorf("loaded %d rows, want 5", res.rows)
+	}
+	if got := len(sink.rejected); got != 2 || sink.rejected[0] != "scan" || sink.rejected[1] != "FS-0004" {
+		t.Errorf("rejected %v, want a scan failure and FS-0004", sink.rejected)
+	}
+
+	wantKeys := []string{"FS-0001", "FS-0003", "FS-0005", "FS-0006", "FS-0007"}
+	if len(sink.committed) != len(wantKeys) {
+		t.Fatalf("committed %d rows, want %d", len(sink.committed), len(wantKeys))
+	}
+	for i, vals := range sink.committed {
+		if key := vals[0].(*sql.NullString).String; key != wantKeys[i] {
+			t.Errorf("row %d is %s, want %s", i+1, key, wantKeys[i])
+		}
+		seq := vals[2].(*sql.NullInt64)
+		if !seq.Valid || seq.Int64 != int64(i+1) {
+			t.Errorf("row %d (%s) has load_seq %v, want %d", i+1, wantKeys[i], seq, i+1)
+		}
+	}
+}
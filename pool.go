@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// poolSettings size the connection pool of one database. Zero values keep
+// the database/sql defaults: unlimited open connections, two idle ones,
+// and no age limit.
+type poolSettings struct {
+	MaxOpen     int
+	MaxIdle     int
+	MaxLifetime time.Duration
+	MaxIdleTime time.Duration
+}
+
+// readPoolSettings reads <prefix>_MAX_OPEN_CONNS, <prefix>_MAX_IDLE_CONNS,
+// <prefix>_CONN_MAX_LIFETIME and <prefix>_CONN_MAX_IDLE_TIME.
+func readPoolSettings(prefix string) (poolSettings, error) {
+	var p poolSettings
+	var err error
+	if p.MaxOpen, err = envInt(prefix+"_MAX_OPEN_CONNS", 0); err != nil {
+		return p, err
+	}
+	if p.MaxIdle, err = envInt(prefix+"_MAX_IDLE_CONNS", 0); err != nil {
+		return p, err
+	}
+	if p.MaxLifetime, err = envDuration(prefix+"_CONN_MAX_LIFETIME", 0); err != nil {
+		return p, err
+	}
+	if p.MaxIdleTime, err = envDuration(prefix+"_CONN_MAX_IDLE_TIME", 0); err != nil {
+		return p, err
+	}
+	if p.MaxOpen < 0 || p.MaxIdle < 0 || p.MaxLifetime < 0 || p.MaxIdleTime < 0 {
+		return p, fmt.Errorf("%s connection pool settings must not be negative", prefix)
+	}
+	if p.MaxOpen > 0 && p.MaxIdle > p.MaxOpen {
+		return p, fmt.Errorf("%s_MAX_IDLE_CONNS must not exceed %s_MAX_OPEN_CONNS", prefix, prefix)
+	}
+	return p, nil
+}
+
+func (p poolSettings) apply(db *sql.DB) {
+	if p.MaxOpen > 0 {
+		db.SetMaxOpenConns(p.MaxOpen)
+	}
+	if p.MaxIdle > 0 {
+		db.SetMaxIdleConns(p.MaxIdle)
+	}
+	if p.MaxLifetime > 0 {
+		db.SetConnMaxLifetime(p.MaxLifetime)
+	}
+	if p.MaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(p.MaxIdleTime)
+	}
+}
+
+// pingDB checks that db can be reached. A transient failure, such as a
+// database that is still starting, is retried up to PingRetries times with
+// the RETRY_BACKOFF schedule.
+func pingDB(ctx context.Context, db *sql.DB, cfg Config, name string) error {
+	for attempt := 0; ; attempt++ {
+		err := db.PingContext(ctx)
+		if err == nil || attempt >= cfg.PingRetries || !isTransient(err) {
+			return err
+		}
+		wait := retryBackoff(cfg, attempt)
+		slog.Warn("Database is unreachable; retrying", "database", name, "attempt", attempt+1, "max_retries", cfg.PingRetries, "wait", wait, "error", err)
+		if !sleepContext(ctx, wait) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressCountTimeout bounds the preliminary COUNT(*), so a slow count
+// only costs the ETA and not the start of the load.
+const progressCountTimeout = time.Minute
+
+// countSource counts the rows the read of plan returns, for the ETA of the
+// progress logs. Order does not matter for a count.
+func countSource(ctx context.Context, db *sql.DB, cfg Config, cols []column, plan readPlan) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, progressCountTimeout)
+	defer cancel()
+	plan.ordered = false
+	query, args := sourceQuery(cfg, cols, plan.after, plan, 0)
+	var n int64
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM ("+query+") src", args...).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// progress reports how far a run has read every PROGRESS_INTERVAL, and
+// redraws a progress bar every second if stderr is a terminal. It follows
+// the etl_rows_extracted_total metric, so it counts the rows of every
+// PARALLELISM worker without the load reporting to it. A nil progress
+// does nothing.
+type progress struct {
+	cfg   Config
+	total int64 // -1 if unknown
+	base  float64
+	start time.Time
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// startProgress starts reporting on the run of cfg, whose source has
+// total rows, or -1 if that is not known.
+func startProgress(cfg Config, total int64) *progress {
+	if cfg.ProgressInterval <= 0 {
+		return nil
+	}
+	p := &progress{cfg: cfg, total: total, base: etlMetrics.rowsExtracted.get(cfg.TargetTable), start: time.Now(), stop: make(chan struct{}), done: make(chan struct{})}
+	go p.run(cfg.ProgressBar && cfg.LogFormat == logText && cfg.LogFile == "" && isTerminal(os.Stderr))
+	return p
+}
+
+func (p *progress) run(bar bool) {
+	defer close(p.done)
+	logTick := time.NewTicker(p.cfg.ProgressInterval)
+	defer logTick.Stop()
+	var barTick <-chan time.Time
+	if bar {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		barTick = t.C
+		defer logOutput.setBar("")
+	}
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-logTick.C:
+			p.log()
+		case <-barTick:
+			logOutput.setBar(p.bar())
+		}
+	}
+}
+
+// finish stops reporting.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+}
+
+// measure returns the rows read so far, their rate, and the estimated time
+// left, which is zero if it cannot be estimated.
+func (p *progress) measure() (rows int64, rate float64, eta time.Duration) {
+	rows = int64(etlMetrics.rowsExtracted.get(p.cfg.TargetTable) - p.base)
+	rate = float64(rows) / time.Since(p.start).Seconds()
+	if p.total >= rows && rate > 0 {
+		eta = time.Duration(float64(p.total-rows) / rate * float64(time.Second))
+	}
+	return rows, rate, eta
+}
+
+func (p *progress) log() {
+	rows, rate, eta := p.measure()
+	attrs := []any{"table", p.cfg.TargetTable, "rows", rows, "rows_per_sec", int64(rate)}
+	if p.total > 0 {
+		attrs = append(attrs, "total", p.total, "percent", min(100, rows*100/p.total))
+	}
+	if eta > 0 {
+		attrs = append(attrs, "eta", eta.Round(time.Second))
+	}
+	slog.Info("Load progress", attrs...)
+}
+
+func (p *progress) bar() string {
+	const width = 30
+	rows, rate, eta := p.measure()
+	if p.total <= 0 {
+		return fmt.Sprintf("%s: %d rows, %d rows/s", p.cfg.TargetTable, rows, int64(rate))
+	}
+	done := min(width, int(rows*width/p.total))
+	s := fmt.Sprintf("%s [%s%s] %3d%% %d/%d rows, %d rows/s", p.cfg.TargetTable, strings.Repeat("=", done), strings.Repeat(" ", width-done), min(100, rows*100/p.total), rows, p.total, int64(rate))
+	if eta > 0 {
+		s += ", ETA " + eta.Round(time.Second).String()
+	}
+	return s
+}
+
+// logOutput is where the logger writes. While a progress bar is shown,
+// every log line is written over it and the bar redrawn below.
+var logOutput = &barWriter{out: os.Stderr}
+
+type barWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+	bar string
+}
+
+func (w *barWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.bar != "" {
+		io.WriteString(w.out, "\r\033[K")
+	}
+	n, err := w.out.Write(b)
+	if w.bar != "" {
+		io.WriteString(w.out, w.bar)
+	}
+	return n, err
+}
+
+// setBar replaces the progress bar; an empty bar removes it.
+func (w *barWriter) setBar(bar string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.bar != "" || bar != "" {
+		io.WriteString(w.out, "\r\033[K"+bar)
+	}
+	w.bar = bar
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Actions of a quality rule on a row that breaks it.
+const (
+	// qualityWarn loads the row and counts it.
+	qualityWarn = "warn"
+	// qualityReject drops the row, into etl_dead_letters with DEAD_LETTER.
+	qualityReject = "reject"
+	// qualityFail stops the run.
+	qualityFail = "fail"
+)
+
+// stageQuality is a row a reject rule dropped.
+const stageQuality = "quality"
+
+// qualityRule is one entry of QUALITY_RULES, e.g.
+// net_pay=equals:unit_price*sold_quantity~0.01/reject.
+type qualityRule struct {
+	Column string
+	Check  string
+	Arg    string
+	Action string
+}
+
+func (r qualityRule) String() string {
+	s := r.Column + "=" + r.Check
+	if r.Arg != "" {
+		s += ":" + r.Arg
+	}
+	return s
+}
+
+// qualityTest reports whether the row vals passes a rule. now is the
+// source clock at the start of the run.
+type qualityTest func(vals []any, now time.Time) bool
+
+// qualityCheckMaker checks a rule's argument against the loaded columns and
+// returns its test. idx is the position of the rule's column in cols.
+type qualityCheckMaker func(cols []column, idx int, arg string) (qualityTest, error)
+
+// qualityChecks holds the checks QUALITY_RULES can name. A NULL value
+// passes every check but not_null.
+var qualityChecks = map[string]qualityCheckMaker{
+	"not_null":   makeNotNull,
+	"equals":     makeEquals,
+	"range":      makeRange,
+	"not_future": makeNotFuture,
+	"in":         makeIn,
+}
+
+// parseQualityRules parses QUALITY_RULES: entries like
+// column=check:arg/action separated by ';'. The action defaults to warn.
+func parseQualityRules(spec string) ([]qualityRule, error) {
+	var rules []qualityRule
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		col, check, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid QUALITY_RULES entry %q: expected column=check:arg/action", entry)
+		}
+		r := qualityRule{Column: strings.TrimSpace(col), Action: qualityWarn}
+		if i := strings.LastIndexByte(check, '/'); i >= 0 {
+			check, r.Action = check[:i], strings.ToLower(strings.TrimSpace(check[i+1:]))
+		}
+		name, arg, _ := strings.Cut(check, ":")
+		r.Check, r.Arg = strings.TrimSpace(name), strings.TrimSpace(arg)
+		switch r.Action {
+		case qualityWarn, qualityReject, qualityFail:
+		default:
+			return nil, fmt.Errorf("invalid action %q in QUALITY_RULES entry %q: expected warn, reject or fail", r.Action, entry)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// compileQualityRules resolves each rule against cols, so an unknown column
+// or check stops the run before it reads a row.
+func compileQualityRules(rules []qualityRule, cols []column) ([]qualityTest, error) {
+	tests := make([]qualityTest, len(rules))
+	for i, r := range rules {
+		idx := slices.IndexFunc(cols, func(c column) bool { return c.Target == r.Column })
+		if idx < 0 {
+			return nil, fmt.Errorf("quality rule %s: %s is not a loaded target column", r, r.Column)
+		}
+		maker, ok := qualityChecks[r.Check]
+		if !ok {
+			return nil, fmt.Errorf("quality rule %s: unknown check %q: expected one of %s", r, r.Check, strings.Join(sortedKeys(qualityChecks), ", "))
+		}
+		test, err := maker(cols, idx, r.Arg)
+		if err != nil {
+			return nil, fmt.Errorf("quality rule %s: %w", r, err)
+		}
+		tests[i] = test
+	}
+	return tests, nil
+}
+
+// needsClock reports whether any rule compares with the current time.
+func needsClock(rules []qualityRule) bool {
+	return slices.ContainsFunc(rules, func(r qualityRule) bool { return r.Check == "not_future" })
+}
+
+func isNull(v any) bool {
+	switch v := v.(type) {
+	case *sql.NullString:
+		return !v.Valid
+	case *sql.NullFloat64:
+		return !v.Valid
+	case *sql.NullInt64:
+		return !v.Valid
+	case *sql.NullTime:
+		return !v.Valid
+	}
+	return v == nil
+}
+
+func makeNotNull(cols []column, idx int, arg string) (qualityTest, error) {
+	if arg != "" {
+		return nil, fmt.Errorf("not_null takes no argument")
+	}
+	return func(vals []any, _ time.Time) bool { return !isNull(vals[idx]) }, nil
+}
+
+// numberOf returns a numeric value as a float64, or false for NULL.
+func numberOf(v any) (float64, bool) {
+	r, ok := numericValue(v)
+	if !ok {
+		return 0, false
+	}
+	f, _ := r.Float64()
+	return f, true
+}
+
+// makeEquals checks the column against other columns of the row, added
+// or multiplied, within a tolerance (default 0.01): e.g.
+// equals:unit_price*sold_quantity~0.01.
+func makeEquals(cols []column, idx int, arg string) (qualityTest, error) {
+	if cols[idx].kind() != kindNumeric {
+		return nil, fmt.Errorf("%s is not a numeric column", cols[idx].Type)
+	}
+	expr, tolText, hasTol := strings.Cut(arg, "~")
+	tolerance := 0.01
+	if hasTol {
+		var err error
+		if tolerance, err = strconv.ParseFloat(strings.TrimSpace(tolText), 64); err != nil || tolerance < 0 {
+			return nil, fmt.Errorf("invalid tolerance %q: expected a non-negative number", tolText)
+		}
+	}
+	op := "*"
+	if strings.Contains(expr, "+") {
+		op = "+"
+	}
+	var terms []int
+	for _, name := range strings.Split(expr, op) {
+		name = strings.TrimSpace(name)
+		i := slices.IndexFunc(cols, func(c column) bool { return c.Target == name })
+		if i < 0 || cols[i].kind() != kindNumeric {
+			return nil, fmt.Errorf("expected numeric target columns joined by * or +, e.g. equals:unit_price*sold_quantity~0.01; %q is not one", name)
+		}
+		terms = append(terms, i)
+	}
+	return func(vals []any, _ time.Time) bool {
+		got, ok := numberOf(vals[idx])
+		if !ok {
+			return true
+		}
+		want := 1.0
+		if op == "+" {
+			want = 0
+		}
+		for _, i := range terms {
+			x, ok := numberOf(vals[i])
+			if !ok {
+				return true
+			}
+			if op == "+" {
+				want += x
+			} else {
+				want *= x
+			}
+		}
+		// A little slack for float64 reads of exact decimals.
+		return math.Abs(got-want) <= tolerance+1e-9
+	}, nil
+}
+
+// makeRange checks a numeric column against bounds, either of which may be
+// left out: range:0..1000000, range:0..
+func makeRange(cols []column, idx int, arg string) (qualityTest, error) {
+	if cols[idx].kind() != kindNumeric {
+		return nil, fmt.Errorf("%s is not a numeric column", cols[idx].Type)
+	}
+	lo, hi, ok := strings.Cut(arg, "..")
+	if !ok || lo == "" && hi == "" {
+		return nil, fmt.Errorf("expected range:min..max, e.g. range:0..1000000")
+	}
+	bound := func(s string) (*big.Rat, error) {
+		if s = strings.TrimSpace(s); s == "" {
+			return nil, nil
+		}
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return nil, fmt.Errorf("invalid bound %q: expected a number", s)
+		}
+		return r, nil
+	}
+	lower, err := bound(lo)
+	if err != nil {
+		return nil, err
+	}
+	upper, err := bound(hi)
+	if err != nil {
+		return nil, err
+	}
+	return func(vals []any, _ time.Time) bool {
+		v, ok := numericValue(vals[idx])
+		return !ok || (lower == nil || v.Cmp(lower) >= 0) && (upper == nil || v.Cmp(upper) <= 0)
+	}, nil
+}
+
+// makeNotFuture checks that a date or timestamp is not after the source
+// clock at the start of the run.
+func makeNotFuture(cols []column, idx int, arg string) (qualityTest, error) {
+	if cols[idx].kind() != kindTime {
+		return nil, fmt.Errorf("%s is not a date or timestamp column", cols[idx].Type)
+	}
+	if arg != "" {
+		return nil, fmt.Errorf("not_future takes no argument")
+	}
+	return func(vals []any, now time.Time) bool {
+		t, ok := vals[idx].(*sql.NullTime)
+		return !ok || !t.Valid || !t.Time.After(now)
+	}, nil
+}
+
+// makeIn checks a text column against a list of allowed values separated
+// by |, e.g. in:North|South|East|West.
+func makeIn(cols []column, idx int, arg string) (qualityTest, error) {
+	if !cols[idx].isText() {
+		return nil, fmt.Errorf("%s is not a text column", cols[idx].Type)
+	}
+	if arg == "" {
+		return nil, fmt.Errorf("expected allowed values separated by |, e.g. in:North|South")
+	}
+	allowed := map[string]bool{}
+	for _, v := range strings.Split(arg, "|") {
+		allowed[strings.TrimSpace(v)] = true
+	}
+	return func(vals []any, _ time.Time) bool {
+		s, ok := vals[idx].(*sql.NullString)
+		return !ok || !s.Valid || allowed[s.String]
+	}, nil
+}
+
+// quality applies QUALITY_RULES to the transformed rows of a load and
+// counts what broke them. A nil quality does nothing.
+type quality struct {
+	cfg        Config
+	rules      []qualityRule
+	tests      []qualityTest
+	violations []int
+}
+
+func newQuality(cfg Config, cols []column) (*quality, error) {
+	if len(cfg.QualityRules) == 0 {
+		return nil, nil
+	}
+	tests, err := compileQualityRules(cfg.QualityRules, cols)
+	if err != nil {
+		return nil, err
+	}
+	return &quality{cfg: cfg, rules: cfg.QualityRules, tests: tests, violations: make([]int, len(tests))}, nil
+}
+
+// check runs every rule on a row. It returns the first reject rule the row
+// broke, if any, and an error for a fail rule. Every broken rule is
+// counted, and its first violation logged.
+func (q *quality) check(vals []any, key string) (reject *qualityRule, err error) {
+	if q == nil {
+		return nil, nil
+	}
+	for i, test := range q.tests {
+		if test(vals, q.cfg.QualityNow) {
+			continue
+		}
+		r := &q.rules[i]
+		q.violations[i]++
+		switch {
+		case r.Action == qualityFail:
+			return nil, fmt.Errorf("row %s breaks quality rule %s", key, r)
+		case r.Action == qualityReject && reject == nil:
+			reject = r
+		}
+		if q.violations[i] == 1 {
+			slog.Warn("Row breaks a quality rule; further violations are only counted", "table", q.cfg.TargetTable, "rule", r.String(), "action", r.Action, "key", key)
+		}
+	}
+	return reject, nil
+}
+
+// report adds the violations to res.
+func (q *quality) report(res *loadResult) {
+	if q == nil {
+		return
+	}
+	res.violations = q.violations
+}
+
+// logQualityReport logs a table of the rules and how many rows broke each.
+func logQualityReport(cfg Config, rows int, violations []int) {
+	if len(cfg.QualityRules) == 0 {
+		return
+	}
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RULE\tACTION\tVIOLATIONS")
+	total := 0
+	for i, r := range cfg.QualityRules {
+		n := 0
+		if i < len(violations) {
+			n = violations[i]
+		}
+		total += n
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", r, r.Action, n)
+	}
+	tw.Flush()
+	if total > 0 {
+		slog.Warn("Data quality report:\n"+b.String(), "table", cfg.TargetTable, "rows", rows, "violations", total)
+		return
+	}
+	slog.Info("Data quality report:\n"+b.String(), "table", cfg.TargetTable, "rows", rows, "violations", 0)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+)
+
+// readAheadRow is one row scanned by the read-ahead goroutine. raw is the
+// row as the driver returns it, kept only when the typed scan failed, for
+// the dead letters.
+type readAheadRow struct {
+	vals []any
+	raw  []any
+	err  error
+}
+
+// readAheadRows reads and scans the source in a goroutine of its own, up
+// to READ_AHEAD rows ahead of the load, so the next rows are already on
+// their way while a batch is written to the target. It is a sourceRows, so
+// loadRows does not change: Scan hands out the rows the goroutine scanned.
+type readAheadRows struct {
+	inner sourceRows
+	rows  chan readAheadRow
+	done  chan struct{}
+	wg    sync.WaitGroup
+	row   readAheadRow
+	err   error
+	once  sync.Once
+}
+
+func newReadAheadRows(inner sourceRows, cols []column, size int) *readAheadRows {
+	r := &readAheadRows{inner: inner, rows: make(chan readAheadRow, size), done: make(chan struct{})}
+	r.wg.Add(1)
+	go r.read(cols)
+	return r
+}
+
+func (r *readAheadRows) read(cols []column) {
+	defer r.wg.Done()
+	defer close(r.rows)
+	for r.inner.Next() {
+		row := readAheadRow{vals: make([]any, len(cols))}
+		for i, c := range cols {
+			row.vals[i] = c.scanDest()
+		}
+		if row.err = r.inner.Scan(row.vals...); row.err != nil {
+			row.raw = make([]any, len(cols))
+			dest := make([]any, len(cols))
+			for i := range dest {
+				dest[i] = &row.raw[i]
+			}
+			if r.inner.Scan(dest...) != nil {
+				row.raw = nil
+			}
+		}
+		select {
+		case r.rows <- row:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *readAheadRows) Next() bool {
+	row, ok := <-r.rows
+	if !ok {
+		// The goroutine has finished with inner, so its error is final.
+		r.err = r.inner.Err()
+		return false
+	}
+	r.row = row
+	return true
+}
+
+// Scan copies the scanned row into dest, which must be the scan
+// destinations of the same columns, or *any for the dead letters of a row
+// that failed to scan.
+func (r *readAheadRows) Scan(dest ...any) error {
+	if r.row.err != nil {
+		if r.row.raw == nil || len(dest) != len(r.row.raw) {
+			return r.row.err
+		}
+		for i, d := range dest {
+			p, ok := d.(*any)
+			if !ok {
+				return r.row.err
+			}
+			*p = r.row.raw[i]
+		}
+		return nil
+	}
+	for i, d := range dest {
+		reflect.ValueOf(d).Elem().Set(reflect.ValueOf(r.row.vals[i]).Elem())
+	}
+	return nil
+}
+
+func (r *readAheadRows) Err() error {
+	return r.err
+}
+
+// Close stops the goroutine, once it is done with the row it is reading,
+// and closes the source rows.
+func (r *readAheadRows) Close() error {
+	r.once.Do(func() { close(r.done) })
+	r.wg.Wait()
+	return r.inner.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// columnCheck is one aggregate of one column, computed on both sides by
+// validate.
+type columnCheck struct {
+	column, check  string
+	source, target sql.NullString
+	// approximate compares floating point results with a relative
+	// tolerance, since the two servers may add them up in different orders.
+	approximate bool
+}
+
+// matches reports whether both sides agree. Numbers are compared by value,
+// so 1.50 and 1.5 are equal.
+func (c columnCheck) matches() bool {
+	if !c.source.Valid || !c.target.Valid {
+		return c.source.Valid == c.target.Valid
+	}
+	s, ok1 := new(big.Rat).SetString(strings.TrimSpace(c.source.String))
+	t, ok2 := new(big.Rat).SetString(strings.TrimSpace(c.target.String))
+	if !ok1 || !ok2 {
+		return c.source.String == c.target.String
+	}
+	if !c.approximate {
+		return s.Cmp(t) == 0
+	}
+	sf, _ := s.Float64()
+	tf, _ := t.Float64()
+	return math.Abs(sf-tf) <= 1e-9*math.Max(math.Abs(sf), math.Abs(tf))
+}
+
+// orNULL prints an aggregate, NULL included, for the report.
+func orNULL(v sql.NullString) string {
+	if !v.Valid {
+		return "NULL"
+	}
+	return v.String
+}
+
+// reconcileColumns computes, on the whole source and target table, the
+// null count of every loaded column and SUM, MIN and MAX of the numeric
+// ones. The source side casts numeric columns to the target's scale first,
+// so rounding on insert does not show up as a difference. Encrypted
+// columns only get the null count.
+func reconcileColumns(ctx context.Context, sourceDB, targetDB *sql.DB, cfg Config) ([]columnCheck, error) {
+	var checks []columnCheck
+	var sourceExprs, targetExprs []string
+	add := func(c column, check, sourceExpr, targetExpr string, approximate bool) {
+		checks = append(checks, columnCheck{column: c.Target, check: check, approximate: approximate})
+		sourceExprs = append(sourceExprs, sourceExpr)
+		targetExprs = append(targetExprs, "("+targetExpr+")::text")
+	}
+	for _, c := range insertColumns(cfg.Columns) {
+		if c.computed() {
+			continue
+		}
+		add(c, "nulls", fmt.Sprintf("COUNT_BIG(*) - COUNT_BIG(%s)", c.Source), fmt.Sprintf("COUNT(*) - COUNT(%s)", c.Target), false)
+		if c.kind() != kindNumeric || c.Encrypted {
+			continue
+		}
+		cast, approximate := "FLOAT", true
+		if m := numericTypeRe.FindStringSubmatch(c.Type); m != nil {
+			scale, _ := strconv.Atoi(m[2])
+			cast, approximate = fmt.Sprintf("DECIMAL(38, %d)", scale), false
+		}
+		for _, agg := range []string{"SUM", "MIN", "MAX"} {
+			add(c, strings.ToLower(agg), fmt.Sprintf("%s(CAST(%s AS %s))", agg, c.Source, cast), fmt.Sprintf("%s(%s)", agg, c.Target), approximate)
+		}
+	}
+
+	source := make([]any, len(checks))
+	target := make([]any, len(checks))
+	for i := range checks {
+		source[i], target[i] = &checks[i].source, &checks[i].target
+	}
+	where, args := filterClause(cfg)
+	query := fmt.Sprintf("SELECT %s FROM %s%s", strings.Join(sourceExprs, ", "), cfg.SourceTable, where)
+	if err := sourceDB.QueryRowContext(ctx, query, args...).Scan(source...); err != nil {
+		return nil, fmt.Errorf("failed to aggregate source columns: %w", err)
+	}
+	query = fmt.Sprintf("SELECT %s FROM %s", strings.Join(targetExprs, ", "), cfg.TargetTable)
+	if err := targetDB.QueryRowContext(ctx, query).Scan(target...); err != nil {
+		return nil, fmt.Errorf("failed to aggregate target columns: %w", err)
+	}
+	return checks, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// runWatermarks holds, by run ID, where the next incremental run starts
+// once a run has saved it, for tableDone to pick up.
+var runWatermarks sync.Map
+
+// noteWatermark remembers the watermark plan saves, if the run succeeded.
+func noteWatermark(runID string, plan readPlan, err error) {
+	if err != nil {
+		return
+	}
+	switch {
+	case plan.delta != nil:
+		runWatermarks.Store(runID, fmt.Sprintf("0x%X", plan.delta.to))
+	case plan.since != nil:
+		runWatermarks.Store(runID, watermarkText(plan.since.to))
+	case plan.changes != nil:
+		runWatermarks.Store(runID, strconv.FormatInt(plan.changes.to, 10))
+	}
+}
+
+// takeWatermark returns and forgets the watermark noted for runID.
+func takeWatermark(runID string) string {
+	w, _ := runWatermarks.LoadAndDelete(runID)
+	s, _ := w.(string)
+	return s
+}
+
+// runReport is the RUN_REPORT document of one run of all tables.
+type runReport struct {
+	Status      string        `json:"status"`
+	Started     time.Time     `json:"started"`
+	Finished    time.Time     `json:"finished"`
+	Duration    float64       `json:"duration_seconds"`
+	RowsRead    int64         `json:"rows_read"`
+	RowsWritten int64         `json:"rows_written"`
+	RowsSkipped int64         `json:"rows_skipped"`
+	RowsErrored int64         `json:"rows_errored"`
+	ExitCode    int           `json:"exit_code"`
+	Error       string        `json:"error,omitempty"`
+	Tables      []tableReport `json:"tables"`
+}
+
+type tableReport struct {
+	Table  string `json:"table"`
+	Status string `json:"status"`
+	tableStatus
+}
+
+// writeRunReport writes the report of a run that started at started to
+// RUN_REPORT: a file, replaced whole, or stdout for "-". Like notifications
+// it never fails the run; a report that cannot be written is logged.
+func writeRunReport(cfg Config, started time.Time, runErr error) {
+	if cfg.RunReport == "" {
+		return
+	}
+	r := runReport{Status: runSucceeded, Started: started, Finished: time.Now(), Tables: []tableReport{}}
+	r.Duration = r.Finished.Sub(started).Seconds()
+	if runErr != nil {
+		r.Status, r.Error, r.ExitCode = runFailed, runErr.Error(), 1
+		var ec exitCodeError
+		switch {
+		case errors.Is(runErr, context.Canceled):
+			r.ExitCode = exitInterrupted
+		case errors.As(runErr, &ec):
+			r.ExitCode = ec.code
+		}
+	}
+	for name, t := range etlStatus.tablesSince(started) {
+		status := runSucceeded
+		if t.Error != "" {
+			status = runFailed
+		}
+		r.Tables = append(r.Tables, tableReport{Table: name, Status: status, tableStatus: t})
+		r.RowsRead += t.RowsRead
+		r.RowsWritten += t.RowsWritten
+		r.RowsSkipped += t.RowsSkipped
+		r.RowsErrored += t.RowsErrored
+	}
+	sort.Slice(r.Tables, func(i, j int) bool { return r.Tables[i].LastRun.Before(r.Tables[j].LastRun) })
+
+	if err := saveRunReport(cfg.RunReport, r); err != nil {
+		slog.Warn("Failed to write the run report", "path", cfg.RunReport, "error", err)
+	}
+}
+
+// saveRunReport writes r as one line to stdout, so a -schedule process
+// writes one line per run, or to a file through a temporary file, so a
+// reader never sees half a report.
+func saveRunReport(path string, r runReport) error {
+	if path == "-" {
+		return json.NewEncoder(os.Stdout).Encode(r)
+	}
+	body, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".run-report-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(body, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// isSerializationFailure reports whether err is a Postgres serialization
+// failure (40001), which under SERIALIZABLE or REPEATABLE READ means the
+// whole transaction can safely be retried from the start.
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "40001"
+}
+
+// mssqlDeadlock is the SQL Server error number of a deadlock victim.
+const mssqlDeadlock = 1205
+
+// isTransient reports whether err is a failure that is likely to go away on
+// its own: a dropped or reset connection, a network timeout, a deadlock, or
+// a server shutting down. Anything else, a constraint violation or a bad
+// query, fails the same way on every attempt.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, errSourceQueryTimeout) || isMirrorFailure(err) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// 08: connection exception, 40P01: deadlock, 57P01-57P03: the
+		// server is shutting down or not yet accepting connections.
+		switch pqErr.Code {
+		case "40P01", "57P01", "57P02", "57P03":
+			return true
+		}
+		return pqErr.Code.Class() == "08"
+	}
+	// go-mssqldb errors expose their number without importing the driver.
+	var msErr interface{ SQLErrorNumber() int32 }
+	if errors.As(err, &msErr) {
+		return msErr.SQLErrorNumber() == mssqlDeadlock
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || isTimeout(err)
+}
+
+// retryBackoff is the wait before retry number attempt (from 0): RetryBackoff
+// doubled per attempt up to RetryMaxBackoff, with jitter so parallel workers
+// and other jobs hitting the same outage do not retry in lockstep. The wait
+// is drawn from the upper half of the interval.
+func retryBackoff(cfg Config, attempt int) time.Duration {
+	d := cfg.RetryBackoff
+	for i := 0; i < attempt && d < cfg.RetryMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > cfg.RetryMaxBackoff {
+		d = cfg.RetryMaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleepContext waits for d, returning false early if ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// runETLWithTxRetry reruns the complete load, source read included, when it
+// fails with a serialization failure or a transient error, up to TxRetries
+// times. Committed batches are not lost: the rerun skips them through ON
+// CONFLICT, or resumes after them with CHECKPOINT. DELETE_MISSING runs
+// after the load, so a failure there retries both. With tracing, the
+// attempts share the run's root span.
+func runETLWithTxRetry(ctx context.Context, cfg Config, runID string, sourceDB *sql.DB, targetDB *sql.DB) (count int, err error) {
+	ctx, run := startRunTrace(ctx, cfg, runID)
+	defer func() { run.endRun(count, err) }()
+	for attempt := 0; ; attempt++ {
+		count, err = runETL(ctx, cfg, runID, sourceDB, targetDB)
+		if err == nil && cfg.DeleteMissing {
+			err = propagateDeletes(ctx, sourceDB, targetDB, cfg)
+		}
+		if err == nil || ctx.Err() != nil || attempt >= cfg.TxRetries {
+			return count, err
+		}
+		reason := "transient error"
+		switch {
+		case isSerializationFailure(err):
+			reason = "serialization failure"
+		case !isTransient(err):
+			return count, err
+		}
+
+		wait := retryBackoff(cfg, attempt)
+		slog.Warn("Load failed with a "+reason+"; retrying the load",
+			"table", cfg.TargetTable, "error", err, "wait", wait, "attempt", attempt+1, "max_attempts", cfg.TxRetries)
+		if !sleepContext(ctx, wait) {
+			return count, err
+		}
+	}
+}
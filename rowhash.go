@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// rowHasher fills the ROW_HASH column of each row.
+type rowHasher struct {
+	idx  int
+	cols []column
+	key  []byte
+}
+
+// newRowHasher returns nil unless cols has a ROW_HASH column. With
+// ENCRYPTED_COLUMNS the hash is keyed with ENCRYPTION_KEY, so the hash of
+// a short encrypted value cannot be matched against guesses.
+func newRowHasher(cfg Config, cols []column) *rowHasher {
+	for i, c := range cols {
+		if c.RowHash {
+			h := &rowHasher{idx: i, cols: cols}
+			if hasEncrypted(cols) {
+				h.key = []byte(cfg.EncryptionKey)
+			}
+			return h
+		}
+	}
+	return nil
+}
+
+// set hashes the non-key columns of vals, by target name, into the hash
+// column. Values are hashed as they are written, after transforms, so
+// changing a transform rewrites the rows it changes.
+func (h *rowHasher) set(vals []any) {
+	if h == nil {
+		return
+	}
+	fields := make([][2]any, 0, len(h.cols))
+	for i, c := range h.cols {
+		if c.Key || c.computed() {
+			continue
+		}
+		fields = append(fields, [2]any{c.Target, jsonValue(c, vals[i])})
+	}
+	// Marshalling strings, numbers and nil cannot fail.
+	body, _ := json.Marshal(fields)
+	var sum hash.Hash
+	if h.key != nil {
+		sum = hmac.New(sha256.New, h.key)
+	} else {
+		sum = sha256.New()
+	}
+	sum.Write(body)
+	vals[h.idx] = &sql.NullString{String: hex.EncodeToString(sum.Sum(nil)), Valid: true}
+}
+
+// rowHashes are the row hashes already in the target, by key. Only the
+// first 64 bits of each are kept, which is plenty to tell a changed row
+// from an unchanged one and keeps a few million keys in memory.
+type rowHashes map[string]uint64
+
+// loadRowHashes reads the hashes of the target's rows before a full read,
+// so rows that have not changed need not be sent at all. An incremental
+// read only returns changed rows, and the staging table of SWAP_LOAD
+// starts empty, so neither loads them. A table without hashes yet, or a
+// failure to read them, just means every row is sent and the target
+// compares the hashes itself.
+func loadRowHashes(ctx context.Context, db *sql.DB, cfg Config, cols []column, plan readPlan) rowHashes {
+	if !cfg.RowHash || cfg.DryRun || cfg.SwapLoad || plan.delta != nil || plan.since != nil || plan.changes != nil {
+		return nil
+	}
+	started := time.Now()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT %s::text, %s FROM %s WHERE %s IS NOT NULL",
+		keyOf(cols).Target, cfg.RowHashColumn, cfg.TargetTable, cfg.RowHashColumn))
+	if err != nil {
+		slog.Warn("Failed to read the row hashes of the target; every row is sent", "table", cfg.TargetTable, "error", err)
+		return nil
+	}
+	defer rows.Close()
+	known := rowHashes{}
+	for rows.Next() {
+		var key, sum string
+		if err := rows.Scan(&key, &sum); err != nil {
+			slog.Warn("Failed to read the row hashes of the target; every row is sent", "table", cfg.TargetTable, "error", err)
+			return nil
+		}
+		if prefix, ok := hashPrefix(sum); ok {
+			known[key] = prefix
+		}
+	}
+	if err := rows.Err(); err != nil {
+		slog.Warn("Failed to read the row hashes of the target; every row is sent", "table", cfg.TargetTable, "error", err)
+		return nil
+	}
+	slog.Info("Read the row hashes of the target", "table", cfg.TargetTable, "rows", len(known), "duration", time.Since(started))
+	return known
+}
+
+func hashPrefix(sum string) (uint64, bool) {
+	if len(sum) < 16 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(sum[:16], 16, 64)
+	return n, err == nil
+}
+
+// unchanged reports whether the target already holds vals as they are.
+func (k rowHashes) unchanged(cols []column, vals []any) bool {
+	if len(k) == 0 {
+		return false
+	}
+	known, ok := k[rowKey(cols, vals)]
+	if !ok {
+		return false
+	}
+	for i, c := range cols {
+		if c.RowHash {
+			s := vals[i].(*sql.NullString)
+			prefix, ok := hashPrefix(s.String)
+			return ok && prefix == known
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+const watermarksTableName = "etl_watermarks"
+
+// rowVersionRange is the slice of MSSQL rowversion values one incremental
+// run reads: from (inclusive, nil on the first run) up to to (exclusive).
+type rowVersionRange struct {
+	from, to []byte
+}
+
+// ensureWatermarksTable creates the table holding incremental load
+// positions: row_version for ROWVERSION_COLUMN, value for
+// INCREMENTAL_COLUMN. Tables created before value existed are upgraded.
+func ensureWatermarksTable(ctx context.Context, db execer) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			scope VARCHAR(100) PRIMARY KEY,
+			row_version BYTEA,
+			value TEXT,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS value TEXT;
+		ALTER TABLE %[1]s ALTER COLUMN row_version DROP NOT NULL;
+	`, watermarksTableName))
+	if err != nil {
+		return fmt.Errorf("failed to create watermarks table: %w", err)
+	}
+	return nil
+}
+
+// watermarksReadable prepares etl_watermarks for reading. A dry run does
+// not create it, and only reports whether it exists.
+func watermarksReadable(ctx context.Context, db *sql.DB, cfg Config) (bool, error) {
+	if !cfg.DryRun {
+		return true, ensureWatermarksTable(ctx, db)
+	}
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", watermarksTableName).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to look up watermarks table: %w", err)
+	}
+	return exists, nil
+}
+
+// planRowVersionRange picks up where the last successful run stopped and
+// reads up to MIN_ACTIVE_ROWVERSION(). Every row below that value belongs
+// to a committed transaction, so rows still being written are left for the
+// next run instead of being skipped.
+//
+// rowversion is binary(8) and SQL Server compares it byte by byte, so the
+// bounds are passed as varbinary and never converted to numbers.
+func planRowVersionRange(ctx context.Context, sourceDB, targetDB *sql.DB, cfg Config) (*rowVersionRange, error) {
+	exists, err := watermarksReadable(ctx, targetDB, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var r rowVersionRange
+	if exists {
+		err := targetDB.QueryRowContext(ctx, fmt.Sprintf("SELECT row_version FROM %s WHERE scope = $1 AND row_version IS NOT NULL", watermarksTableName),
+			cfg.TargetTable).Scan(&r.from)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("failed to read rowversion watermark: %w", err)
+		}
+	}
+	if err := sourceDB.QueryRowContext(ctx, "SELECT CAST(MIN_ACTIVE_ROWVERSION() AS binary(8))").Scan(&r.to); err != nil {
+		return nil, fmt.Errorf("failed to read source rowversion: %w", err)
+	}
+
+	if r.from == nil {
+		slog.Info("No rowversion watermark yet; reading all rows below the upper bound", "table", cfg.TargetTable, "to", fmt.Sprintf("0x%X", r.to))
+	} else {
+		slog.Info("Reading rows changed within the rowversion range", "table", cfg.TargetTable, "from", fmt.Sprintf("0x%X", r.from), "to", fmt.Sprintf("0x%X", r.to))
+	}
+	return &r, nil
+}
+
+// saveRowVersion stores the upper bound of a finished read as the next
+// run's starting point. It runs in the final load transaction.
+func saveRowVersion(ctx context.Context, db execer, cfg Config, r *rowVersionRange) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s (scope, row_version) VALUES ($1, $2)
+		ON CONFLICT (scope) DO UPDATE SET row_version = EXCLUDED.row_version, updated_at = now()`, watermarksTableName),
+		cfg.TargetTable, r.to)
+	if err != nil {
+		return fmt.Errorf("failed to save rowversion watermark: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// TestRowVersionQuery checks the read of a rowversion range is the
+// half-open [watermark, MIN_ACTIVE_ROWVERSION()) with both bounds passed as
+// the raw binary(8) values.
+func TestRowVersionQuery(t *testing.T) {
+	cfg := Config{Source: sourceMSSQL, SourceTable: "Sales", RowVersionColumn: "rv"}
+	from := []byte{0, 0, 0, 0, 0, 0, 0, 0xff}
+	to := []byte{0, 0, 0, 0, 0, 0, 0x01, 0x00}
+
+	query, args := sourceQuery(cfg, salesColumns, nil, readPlan{delta: &rowVersionRange{from: from, to: to}}, 0)
+	if !strings.Contains(query, "WHERE rv >= @rvfrom AND rv < @rvto") {
+		t.Errorf("query does not read [rvfrom, rvto):\n%s", query)
+	}
+	bound := func(name string) []byte {
+		for _, a := range args {
+			if n, ok := a.(sql.NamedArg); ok && n.Name == name {
+				b, ok := n.Value.([]byte)
+				if !ok {
+					t.Errorf("%s is a %T, want the binary value", name, n.Value)
+				}
+				return b
+			}
+		}
+		t.Errorf("no %s argument in %v", name, args)
+		return nil
+	}
+	if got := bound("rvfrom"); !bytes.Equal(got, from) {
+		t.Errorf("rvfrom = %x, want %x", got, from)
+	}
+	if got := bound("rvto"); !bytes.Equal(got, to) {
+		t.Errorf("rvto = %x, want %x", got, to)
+	}
+
+	// The first run has no watermark and reads everything below the bound.
+	query, args = sourceQuery(cfg, salesColumns, nil, readPlan{delta: &rowVersionRange{to: to}}, 0)
+	if strings.Contains(query, ">=") || !strings.Contains(query, "WHERE rv < @rvto") {
+		t.Errorf("first run query is not bounded by rvto alone:\n%s", query)
+	}
+	if len(args) != 1 {
+		t.Errorf("first run has %d arguments, want 1", len(args))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const runsTableName = "etl_runs"
+
+// Run states recorded in etl_runs.
+const (
+	runRunning   = "running"
+	runSucceeded = "succeeded"
+	runFailed    = "failed"
+)
+
+func ensureRunsTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			run_id VARCHAR(36) PRIMARY KEY,
+			table_name VARCHAR(100) NOT NULL,
+			source VARCHAR(500) NOT NULL,
+			started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			finished_at TIMESTAMPTZ,
+			status VARCHAR(20) NOT NULL,
+			rows_processed BIGINT,
+			error TEXT
+		);
+		ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS trigger VARCHAR(50),
+			ADD COLUMN IF NOT EXISTS rows_extracted BIGINT,
+			ADD COLUMN IF NOT EXISTS rows_inserted BIGINT,
+			ADD COLUMN IF NOT EXISTS rows_skipped BIGINT;
+		CREATE INDEX IF NOT EXISTS %[1]s_table_idx ON %[1]s (table_name, started_at);
+	`, runsTableName))
+	if err != nil {
+		return fmt.Errorf("failed to create runs table: %w", err)
+	}
+	return nil
+}
+
+// Values of ETL_TRIGGER, recorded as the trigger of a run. Any other value,
+// e.g. the name of an orchestrator, is recorded as given.
+const (
+	triggerManual   = "manual"
+	triggerSchedule = "schedule"
+)
+
+// runCounts are the row counts of one run, taken from the difference of
+// the table's metrics over the run so every write path reports the same
+// way. A retried load counts the rows of every attempt as extracted.
+type runCounts struct {
+	table                                                 string
+	extracted, inserted, conflicted, unreadable, rejected float64
+}
+
+func startRunCounts(table string) runCounts {
+	return runCounts{
+		table:      table,
+		extracted:  etlMetrics.rowsExtracted.get(table),
+		inserted:   etlMetrics.rowsInserted.get(table),
+		conflicted: etlMetrics.rowsConflicted.get(table),
+		unreadable: etlMetrics.scanErrors.get(table),
+		rejected:   etlMetrics.rowsRejected.get(table),
+	}
+}
+
+// since returns the rows extracted, inserted (or updated) and skipped
+// since c was taken. Skipped rows are those ON CONFLICT left unchanged,
+// that could not be read, or that the target refused.
+func (c runCounts) since() (extracted, inserted, skipped int64) {
+	now := startRunCounts(c.table)
+	skipped = int64(now.conflicted - c.conflicted + now.unreadable - c.unreadable + now.rejected - c.rejected)
+	return int64(now.extracted - c.extracted), int64(now.inserted - c.inserted), skipped
+}
+
+// outcome returns the rows read since c was taken and, of those, the rows
+// written, the ones ON CONFLICT left unchanged, and the ones that could not
+// be read or that the target refused.
+func (c runCounts) outcome() (read, written, skipped, errored int64) {
+	now := startRunCounts(c.table)
+	return int64(now.extracted - c.extracted), int64(now.inserted - c.inserted),
+		int64(now.conflicted - c.conflicted), int64(now.unreadable - c.unreadable + now.rejected - c.rejected)
+}
+
+// recordRunStart adds the run to etl_runs as running. Run history is for
+// operators, so failing to write it only logs a warning.
+func recordRunStart(ctx context.Context, db *sql.DB, cfg Config, runID string) {
+	err := ensureRunsTable(ctx, db)
+	if err == nil {
+		_, err = db.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (run_id, table_name, source, status, trigger) VALUES ($1, $2, $3, $4, $5)", runsTableName),
+			runID, cfg.TargetTable, sourceName(cfg), runRunning, cfg.RunTrigger)
+	}
+	if err != nil {
+		slog.Warn("Failed to record run", "run_id", runID, "error", err)
+	}
+}
+
+// recordRunEnd stores the outcome of a run started with recordRunStart.
+func recordRunEnd(ctx context.Context, db *sql.DB, runID string, rows int, counts runCounts, runErr error) {
+	status, errText := runSucceeded, sql.NullString{}
+	if runErr != nil {
+		status, errText = runFailed, sql.NullString{String: runErr.Error(), Valid: true}
+	}
+	extracted, inserted, skipped := counts.since()
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		UPDATE %s SET finished_at = now(), status = $2, rows_processed = $3, error = $4,
+			rows_extracted = $5, rows_inserted = $6, rows_skipped = $7
+		WHERE run_id = $1`, runsTableName), runID, status, rows, errText, extracted, inserted, skipped)
+	if err != nil {
+		slog.Warn("Failed to record the end of run", "run_id", runID, "error", err)
+	}
+}
+
+// runRecord is one row of etl_runs.
+type runRecord struct {
+	RunID    string
+	Source   string
+	Started  time.Time
+	Finished sql.NullTime
+	Status   string
+	Rows     sql.NullInt64
+	Error    sql.NullString
+}
+
+// lastRun returns the most recent run into table, or nil if there is none.
+func lastRun(ctx context.Context, db *sql.DB, table string) (*runRecord, error) {
+	if err := ensureRunsTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	var r runRecord
+	err := db.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT run_id, source, started_at, finished_at, status, rows_processed, error
+		FROM %s WHERE table_name = $1
+		ORDER BY started_at DESC LIMIT 1`, runsTableName), table).
+		Scan(&r.RunID, &r.Source, &r.Started, &r.Finished, &r.Status, &r.Rows, &r.Error)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the last run of %s: %w", table, err)
+	}
+	return &r, nil
+}
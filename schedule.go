@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule decides when -schedule runs the load next.
+type schedule interface {
+	// next returns the first run time strictly after t, or the zero time
+	// if there is none.
+	next(t time.Time) time.Time
+}
+
+// parseSchedule reads -schedule: a Go duration such as 15m, a five-field
+// cron expression, or one of @hourly, @daily and @weekly.
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	}
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d < time.Second {
+			return nil, fmt.Errorf("invalid schedule %q: the interval must be at least 1s", spec)
+		}
+		return intervalSchedule(d), nil
+	}
+	return parseCron(spec)
+}
+
+// intervalSchedule runs every d, counted from the start of the previous run.
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// cronSchedule is a standard five-field cron expression, in local time.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	// Like cron, a day matches either day field when both are restricted;
+	// a field starting with * (such as */2) counts as unrestricted.
+	domAny, dowAny bool
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected a duration such as 15m or a cron expression \"minute hour day-of-month month day-of-week\"", spec)
+	}
+	s := &cronSchedule{domAny: strings.HasPrefix(fields[2], "*"), dowAny: strings.HasPrefix(fields[4], "*")}
+	var err error
+	for _, f := range []struct {
+		set      *map[int]bool
+		min, max int
+	}{{&s.minute, 0, 59}, {&s.hour, 0, 23}, {&s.dom, 1, 31}, {&s.month, 1, 12}, {&s.dow, 0, 7}} {
+		field := fields[0]
+		fields = fields[1:]
+		if *f.set, err = parseCronField(field, f.min, f.max); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+	}
+	// Sunday is 0 or 7.
+	if s.dow[7] {
+		s.dow[0] = true
+	}
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("invalid schedule %q: it never matches", spec)
+	}
+	return s, nil
+}
+
+// parseCronField reads one comma separated cron field of *, n, a-b and
+// either with a /step.
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return nil, fmt.Errorf("bad step in %q", part)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(a)
+			hi, err2 = lo, nil
+			if isRange {
+				hi, err2 = strconv.Atoi(b)
+			} else if hasStep {
+				hi = max
+			}
+			if err1 != nil || err2 != nil || lo < min || hi > max || lo > hi {
+				return nil, fmt.Errorf("%q is not a value or range within %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom[t.Day()], s.dow[int(t.Weekday())]
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Any date that exists, Feb 29 included, comes up within five years.
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case !s.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// runScheduled calls run at every time of sched until ctx is cancelled. Runs
+// never overlap: a run that is still going when its successor is due makes
+// that successor, and any other missed one, be skipped. A failed run is
+// logged and the schedule goes on.
+func runScheduled(ctx context.Context, sched schedule, run func() error) {
+	start := time.Now()
+	due := start
+	if _, ok := sched.(*cronSchedule); ok {
+		due = sched.next(start)
+	}
+	for {
+		slog.Info("Next scheduled run", "at", due.Format(time.RFC3339))
+		etlStatus.scheduled(due)
+		if !sleepContext(ctx, time.Until(due)) {
+			slog.Info("Scheduler stopped")
+			return
+		}
+
+		started := time.Now()
+		etlStatus.runStarted()
+		err := run()
+		etlStatus.runFinished(err)
+		if ctx.Err() != nil {
+			slog.Info("Scheduler stopped")
+			return
+		}
+		if err != nil {
+			slog.Error("Scheduled run failed; waiting for the next one", "error", err, "duration", time.Since(started))
+		}
+
+		due = sched.next(due)
+		skipped := 0
+		for !due.After(time.Now()) {
+			due = sched.next(due)
+			skipped++
+		}
+		if skipped > 0 {
+			slog.Warn("The run took longer than the schedule allows; skipped the runs that were due meanwhile", "skipped", skipped)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestCronStepDayIsUnrestricted checks a day field starting with * counts
+// as unrestricted, as in Vixie cron: "0 0 */2 * 1" runs on Mondays only,
+// not on every other day as well.
+func TestCronStepDayIsUnrestricted(t *testing.T) {
+	s, err := parseCron("0 0 */2 * 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.Local) // a Monday
+	for i := 0; i < 6; i++ {
+		at = s.next(at)
+		if at.Weekday() != time.Monday || at.Hour() != 0 || at.Minute() != 0 {
+			t.Fatalf("run %d at %s, want midnight on a Monday", i, at.Format(time.RFC1123))
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// schemaDiff is one line of the expected-vs-actual target schema report.
+type schemaDiff struct {
+	Column   string
+	Expected string
+	Actual   string
+	Status   string
+}
+
+const (
+	schemaOK       = "ok"
+	schemaMissing  = "MISSING"
+	schemaExtra    = "extra"
+	schemaMismatch = "TYPE MISMATCH"
+)
+
+var typeAliases = map[string]string{
+	"varchar":     "character varying",
+	"char":        "character",
+	"int":         "integer",
+	"int4":        "integer",
+	"int8":        "bigint",
+	"int2":        "smallint",
+	"decimal":     "numeric",
+	"float8":      "double precision",
+	"float4":      "real",
+	"bool":        "boolean",
+	"timestamptz": "timestamp with time zone",
+	"timestamp":   "timestamp without time zone",
+}
+
+var spaceRe = regexp.MustCompile(`\s+`)
+
+// normalizeType brings a type as written in the mapping and as reported by
+// format_type() into the same form, e.g. "VARCHAR(50)" and
+// "character varying(50)" both become "character varying(50)".
+func normalizeType(t string) string {
+	t = strings.ToLower(strings.TrimSpace(spaceRe.ReplaceAllString(t, " ")))
+	t = strings.ReplaceAll(t, ", ", ",")
+	t = strings.ReplaceAll(t, " (", "(")
+	base, mod := t, ""
+	if i := strings.IndexByte(t, '('); i >= 0 {
+		base, mod = t[:i], t[i:]
+	}
+	if alias, ok := typeAliases[base]; ok {
+		base = alias
+	}
+	return base + mod
+}
+
+// expectedTargetColumns lists the columns the pipeline relies on in the
+// target, including ones added by optional features.
+func expectedTargetColumns(cfg Config) map[string]string {
+	expected := map[string]string{}
+	for _, c := range cfg.Columns {
+		expected[c.Target] = c.targetType()
+	}
+	if cfg.ConflictAction == conflictSCD2 {
+		expected[cfg.ValidFromColumn] = "TIMESTAMPTZ"
+	}
+	return expected
+}
+
+// diffTargetSchema compares the live target columns with the mapping.
+func diffTargetSchema(ctx context.Context, db *sql.DB, cfg Config) ([]schemaDiff, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod)
+		FROM pg_attribute a
+		WHERE a.attrelid = to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum`, cfg.TargetTable)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read target schema: %w", err)
+	}
+	defer rows.Close()
+
+	actual := map[string]string{}
+	var order []string
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, fmt.Errorf("failed to read target schema: %w", err)
+		}
+		actual[name] = typ
+		order = append(order, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read target schema: %w", err)
+	}
+
+	expected := expectedTargetColumns(cfg)
+	var diffs []schemaDiff
+	seen := map[string]bool{}
+	addExpected := func(name string) {
+		typ := expected[name]
+		seen[name] = true
+		act, ok := actual[name]
+		switch {
+		case !ok:
+			diffs = append(diffs, schemaDiff{name, normalizeType(typ), "-", schemaMissing})
+		case cfg.AutoWiden && isWidenedNumeric(typ, act):
+			diffs = append(diffs, schemaDiff{name, normalizeType(typ), act, schemaOK})
+		case normalizeType(typ) != normalizeType(act):
+			diffs = append(diffs, schemaDiff{name, normalizeType(typ), act, schemaMismatch})
+		default:
+			diffs = append(diffs, schemaDiff{name, normalizeType(typ), act, schemaOK})
+		}
+	}
+	for _, c := range cfg.Columns {
+		addExpected(c.Target)
+	}
+	for name := range expected {
+		if !seen[name] {
+			addExpected(name)
+		}
+	}
+	for _, name := range order {
+		if !seen[name] {
+			diffs = append(diffs, schemaDiff{name, "-", actual[name], schemaExtra})
+		}
+	}
+	return diffs, nil
+}
+
+// isWidenedNumeric reports whether actual is the expected NUMERIC type with
+// more precision and the same scale, as left behind by AUTO_WIDEN.
+func isWidenedNumeric(expected, actual string) bool {
+	e := numericTypeRe.FindStringSubmatch(expected)
+	a := numericTypeRe.FindStringSubmatch(actual)
+	if e == nil || a == nil || e[2] != a[2] {
+		return false
+	}
+	ep, _ := strconv.Atoi(e[1])
+	ap, _ := strconv.Atoi(a[1])
+	return ap >= ep
+}
+
+// checkTargetSchema aborts before any data is moved if the target table
+// does not match the mapping, printing a column-by-column diff. Extra
+// target columns are reported but allowed.
+func checkTargetSchema(ctx context.Context, db *sql.DB, cfg Config) error {
+	diffs, err := diffTargetSchema(ctx, db, cfg)
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	for _, d := range diffs {
+		if d.Status == schemaMissing || d.Status == schemaMismatch {
+			problems++
+		}
+	}
+	if problems == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLUMN\tEXPECTED\tACTUAL\tSTATUS")
+	for _, d := range diffs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.Column, d.Expected, d.Actual, d.Status)
+	}
+	tw.Flush()
+	slog.Error("Target table does not match the column mapping:\n"+b.String(), "table", cfg.TargetTable)
+
+	return fmt.Errorf("%d column(s) of %s are missing or have the wrong type; fix the table, run with -migrate, or set SKIP_SCHEMA_CHECK=true", problems, cfg.TargetTable)
+}
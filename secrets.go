@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretConns are the connection strings that can be read from a secret
+// store instead of the environment: <name>_SECRET holds a reference such
+// as vault:secret/data/nvi_etl#mssql_conn or aws:prod/nvi_etl#mssql_conn.
+var secretConns = []string{"MSSQL_CONN", "MSSQL_REPLICA_CONN", "MYSQL_CONN", "ORACLE_CONN", "POSTGRES_CONN", "SNOWFLAKE_CONN"}
+
+// secretTimeout bounds one request to the secret store.
+const secretTimeout = 30 * time.Second
+
+// secretRef points at one value in Vault or AWS Secrets Manager.
+type secretRef struct {
+	store  string // "vault" or "aws"
+	path   string // the Vault path, or the Secrets Manager secret ID
+	field  string // the key within the secret; required for Vault
+	access secretAccess
+}
+
+// secretAccess is how the secret stores are reached. It is read from the
+// environment with the reference, so a refresh during a run does not see
+// the environment a reload is rebuilding.
+type secretAccess struct {
+	vaultAddr      string
+	vaultToken     string
+	vaultNamespace string
+	aws            awsCredentials
+	awsRegion      string
+	awsEndpoint    string
+}
+
+func readSecretAccess() secretAccess {
+	a := secretAccess{
+		vaultAddr:      strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/"),
+		vaultToken:     os.Getenv("VAULT_TOKEN"),
+		vaultNamespace: os.Getenv("VAULT_NAMESPACE"),
+		aws:            awsCredentials{os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")},
+		awsRegion:      os.Getenv("AWS_REGION"),
+		awsEndpoint:    strings.TrimSuffix(os.Getenv("SECRETS_MANAGER_ENDPOINT"), "/"),
+	}
+	if a.awsRegion == "" {
+		a.awsRegion = "us-east-1"
+	}
+	if a.awsEndpoint == "" {
+		a.awsEndpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com", a.awsRegion)
+	}
+	return a
+}
+
+func parseSecretRef(option, v string) (secretRef, error) {
+	store, rest, _ := strings.Cut(v, ":")
+	path, field, _ := strings.Cut(rest, "#")
+	ref := secretRef{store: store, path: path, field: field, access: readSecretAccess()}
+	switch {
+	case store != "vault" && store != "aws":
+		return ref, fmt.Errorf("invalid %s %q: expected vault:<path>#<field> or aws:<secret id>[#<field>]", option, v)
+	case path == "":
+		return ref, fmt.Errorf("invalid %s %q: no path", option, v)
+	case store == "vault" && field == "":
+		return ref, fmt.Errorf("invalid %s %q: a Vault reference needs #<field>", option, v)
+	}
+	return ref, nil
+}
+
+// resolveSecrets reads every connection string that has a <name>_SECRET
+// reference and sets it in the environment, so the rest of the
+// configuration reads it as if it had been given directly. It returns the
+// references by connection option, for openDB to refresh them.
+func resolveSecrets() (map[string]secretRef, error) {
+	refs := map[string]secretRef{}
+	for _, name := range secretConns {
+		v := os.Getenv(name + "_SECRET")
+		if v == "" {
+			continue
+		}
+		if os.Getenv(name) != "" {
+			return nil, fmt.Errorf("set only one of %s and %s_SECRET", name, name)
+		}
+		ref, err := parseSecretRef(name+"_SECRET", v)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+		value, err := ref.fetch(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name+"_SECRET", err)
+		}
+		os.Setenv(name, value)
+		refs[name] = ref
+		slog.Info("Read connection string from secret store", "option", name, "store", ref.store, "path", ref.path)
+	}
+	return refs, nil
+}
+
+func (r secretRef) fetch(ctx context.Context) (string, error) {
+	if r.store == "vault" {
+		return r.fetchVault(ctx)
+	}
+	return r.fetchAWS(ctx)
+}
+
+// fetchVault reads a KV secret from VAULT_ADDR with VAULT_TOKEN. Both KV
+// version 1 and version 2 (secret/data/...) paths work.
+func (r secretRef) fetchVault(ctx context.Context) (string, error) {
+	a := r.access
+	if a.vaultAddr == "" || a.vaultToken == "" {
+		return "", fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set to read from Vault")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.vaultAddr+"/v1/"+strings.TrimPrefix(r.path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", a.vaultToken)
+	if ns := a.vaultNamespace; ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	var resp struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := doSecretRequest(req, "Vault", &resp); err != nil {
+		return "", err
+	}
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = inner
+	}
+	v, ok := data[r.field].(string)
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no text field %s", r.path, r.field)
+	}
+	return v, nil
+}
+
+// fetchAWS reads a secret from AWS Secrets Manager in AWS_REGION with the
+// AWS_* credentials. With a field the secret must be a JSON object, as
+// the console stores key/value secrets.
+func (r secretRef) fetchAWS(ctx context.Context) (string, error) {
+	creds, region, endpoint := r.access.aws, r.access.awsRegion, r.access.awsEndpoint
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return "", fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to read from AWS Secrets Manager")
+	}
+
+	body, _ := json.Marshal(map[string]string{"SecretId": r.path})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	hash := sha256.Sum256(body)
+	signAWS(req, creds, region, "secretsmanager", hex.EncodeToString(hash[:]), time.Now().UTC())
+
+	var resp struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if err := doSecretRequest(req, "AWS Secrets Manager", &resp); err != nil {
+		return "", err
+	}
+	if resp.SecretString == nil {
+		return "", fmt.Errorf("secret %s is binary; store the connection string as text", r.path)
+	}
+	if r.field == "" {
+		return *resp.SecretString, nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(*resp.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object, so it has no field %s", r.path, r.field)
+	}
+	v, ok := fields[r.field].(string)
+	if !ok {
+		return "", fmt.Errorf("secret %s has no text field %s", r.path, r.field)
+	}
+	return v, nil
+}
+
+func doSecretRequest(req *http.Request, store string, out any) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s request failed: %w", store, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned %s: %s", store, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid %s response: %w", store, err)
+	}
+	return nil
+}
+
+// openDB opens a database handle for the connection string of option
+// (e.g. MSSQL_CONN). When that came from a secret of cfg and
+// SECRETS_REFRESH is set, the secret is read again before a new connection
+// is made once the last read is older than the refresh, so rotated
+// credentials are picked up by a long-running -schedule process without a
+// restart. Connections already open keep the credentials they were made
+// with. setup, if any, is run on every new connection, e.g. to set session
+// parameters.
+func openDB(driverName, dsn, option string, cfg Config, setup ...string) (*sql.DB, error) {
+	ref, fromSecret := cfg.SecretRefs[option]
+	refresh := cfg.SecretsRefresh
+	rotate := fromSecret && refresh > 0
+	if !rotate && len(setup) == 0 {
+		return sql.Open(driverName, dsn)
+	}
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	db.Close()
+	var connector driver.Connector = dsnConnector{drv: drv, dsn: dsn}
+	if rotate {
+		connector = &secretConnector{drv: drv, ref: ref, option: option, refresh: refresh, dsn: dsn, read: time.Now()}
+	}
+	if len(setup) > 0 {
+		connector = sessionConnector{inner: connector, setup: setup}
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// secretConnector is a driver.Connector whose connection string is read
+// from a secret store and re-read every refresh.
+type secretConnector struct {
+	drv     driver.Driver
+	ref     secretRef
+	option  string
+	refresh time.Duration
+
+	mu   sync.Mutex
+	dsn  string
+	read time.Time
+}
+
+func (c *secretConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	if time.Since(c.read) >= c.refresh {
+		fetchCtx, cancel := context.WithTimeout(ctx, secretTimeout)
+		dsn, err := c.ref.fetch(fetchCtx)
+		cancel()
+		if err != nil {
+			// The credentials read last are most likely still valid.
+			slog.Warn("Failed to refresh connection string; using the one read before", "option", c.option, "error", err)
+		} else {
+			if dsn != c.dsn {
+				slog.Info("Connection string changed in the secret store", "option", c.option)
+			}
+			c.dsn = dsn
+		}
+		c.read = time.Now()
+	}
+	dsn := c.dsn
+	c.mu.Unlock()
+	return c.drv.Open(dsn)
+}
+
+func (c *secretConnector) Driver() driver.Driver { return c.drv }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/joho/godotenv"
+)
+
+// liveConfig holds the table configurations of a long-running process
+// (-schedule or serve) and reloads them on request: SIGHUP, systemctl
+// reload, or a parameter change from the Windows service manager. A run
+// in progress keeps the configuration it started with.
+type liveConfig struct {
+	load func() ([]Config, error)
+
+	mu   sync.Mutex
+	cfgs []Config
+	// base is the environment the process started with. Loading the
+	// configuration adds to it (.env, the config file's settings, secrets
+	// and flags), and none of those override what is already set, so a
+	// reload starts over from base.
+	base map[string]string
+}
+
+// baseEnv is the environment the process started with, before .env.
+var baseEnv = envSnapshot()
+
+func envSnapshot() map[string]string {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	return env
+}
+
+func newLiveConfig(cfgs []Config, load func() ([]Config, error)) *liveConfig {
+	return &liveConfig{load: load, cfgs: cfgs, base: baseEnv}
+}
+
+// restoreEnv puts the environment back to base: variables added since are
+// removed and changed ones reset.
+func (l *liveConfig) restoreEnv() {
+	for k := range envSnapshot() {
+		if _, ok := l.base[k]; !ok {
+			os.Unsetenv(k)
+		}
+	}
+	for k, v := range l.base {
+		os.Setenv(k, v)
+	}
+}
+
+func (l *liveConfig) get() []Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cfgs
+}
+
+// reload reads .env, the config file and the secrets again, from the
+// environment the process started with. A broken configuration is logged
+// and the old one kept, so a typo does not stop the service. Connection
+// strings and the log, metrics and API settings are only read at startup.
+func (l *liveConfig) reload() {
+	sdNotify("RELOADING=1")
+	defer sdNotify("READY=1")
+
+	l.restoreEnv()
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to reload .env; keeping the current configuration", "error", err)
+		return
+	}
+	cfgs, err := l.load()
+	if err != nil {
+		slog.Error("Failed to reload the configuration; keeping the current one", "error", err)
+		return
+	}
+	l.mu.Lock()
+	old := l.cfgs[0]
+	l.cfgs = cfgs
+	l.mu.Unlock()
+	if cfgs[0].PostgresConn != old.PostgresConn || cfgs[0].MSSQLConn != old.MSSQLConn || cfgs[0].Source != old.Source || cfgs[0].Target != old.Target {
+		slog.Warn("Connection settings changed; they only take effect after a restart")
+	}
+	slog.Info("Reloaded the configuration; it applies from the next run", "tables", len(cfgs))
+}
+
+// reloadRequests receives a value for every reload request.
+var reloadRequests = make(chan struct{}, 1)
+
+// requestReload asks for a reload, unless one is already pending.
+func requestReload() {
+	select {
+	case reloadRequests <- struct{}{}:
+	default:
+	}
+}
+
+// watchReloads reloads l whenever a reload is requested, including by
+// SIGHUP, until the process exits.
+func watchReloads(l *liveConfig) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			requestReload()
+		}
+	}()
+	go func() {
+		for range reloadRequests {
+			slog.Info("Reloading the configuration")
+			l.reload()
+		}
+	}()
+}
+
+// sdNotify sends state to systemd when it started the process as a
+// Type=notify service, e.g. READY=1 once the connections are up. Outside
+// systemd it does nothing.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// An abstract socket.
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Debug("Failed to notify systemd", "state", state, "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
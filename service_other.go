@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// errNotWindows is returned by the Windows service functions elsewhere;
+// systemd runs the process as it is (see the README).
+var errNotWindows = errors.New("Windows services are only available on Windows; under systemd, use a Type=notify unit instead")
+
+func startWindowsService(context.CancelFunc) (func(code int), error) { return nil, errNotWindows }
+
+func installService([]string) error { return errNotWindows }
+
+func uninstallService() error { return errNotWindows }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// TestLiveConfigReload reloads twice with POSTGRES_CONN read from Vault and
+// BATCH_SIZE edited in the config file in between.
+func TestLiveConfigReload(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"pg": "postgres://etl@db/salesdb"}})
+	}))
+	defer vault.Close()
+
+	dir := t.TempDir()
+	// No .env is read from the test's working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	t.Setenv("MSSQL_CONN", "sqlserver://etl@src?database=NVI")
+	t.Setenv("POSTGRES_CONN_SECRET", "vault:secret/etl#pg")
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "token")
+	// Set by loading; registered so the test environment is restored.
+	t.Setenv("POSTGRES_CONN", "")
+	os.Unsetenv("POSTGRES_CONN")
+	t.Setenv("BATCH_SIZE", "")
+	os.Unsetenv("BATCH_SIZE")
+
+	path := filepath.Join(dir, "config.yaml")
+	writeBatchSize := func(n int) {
+		if err := os.WriteFile(path, []byte("settings:\n  BATCH_SIZE: \""+strconv.Itoa(n)+"\"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeBatchSize(100)
+
+	load := func() ([]Config, error) { return loadConfig(path) }
+	base := envSnapshot()
+	cfgs, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &liveConfig{load: load, cfgs: cfgs, base: base}
+
+	for _, n := range []int{200, 300} {
+		writeBatchSize(n)
+		l.reload()
+		cfg := l.get()[0]
+		if cfg.BatchSize != n {
+			t.Errorf("after reload BatchSize = %d, want %d", cfg.BatchSize, n)
+		}
+		if cfg.PostgresConn != "postgres://etl@db/salesdb" {
+			t.Errorf("after reload PostgresConn = %q, want the secret", cfg.PostgresConn)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// windowsServiceName is the name the service is registered under.
+const windowsServiceName = "NVI_ETL"
+
+// Service states, controls and types of the Windows service API.
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	serviceControlParamChange = 6
+
+	serviceAcceptStop        = 0x1
+	serviceAcceptShutdown    = 0x4
+	serviceAcceptParamChange = 0x8
+)
+
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// windowsService is the process as the service manager sees it: it reports
+// the service running once started, cancels the run on stop or shutdown,
+// and turns a parameter change (sc control NVI_ETL paramchange) into a
+// reload.
+type windowsService struct {
+	stop    context.CancelFunc
+	started chan error
+	done    chan uint32
+	stopped chan struct{}
+
+	mu     sync.Mutex
+	handle uintptr
+	status serviceStatus
+}
+
+// The service manager calls back into the process through these, which
+// can only be created once.
+var (
+	activeService      *windowsService
+	serviceMainCb      = syscall.NewCallback(serviceMain)
+	serviceHandlerCb   = syscall.NewCallback(serviceHandler)
+	serviceNamePointer = syscall.StringToUTF16Ptr(windowsServiceName)
+)
+
+// startWindowsService connects the process to the service manager, which
+// started it with -service. It returns once the service is reported
+// running; the caller then does its work and calls the returned function
+// with the exit code when it is done. stop is called when the service
+// manager asks the service to stop.
+func startWindowsService(stop context.CancelFunc) (func(code int), error) {
+	s := &windowsService{stop: stop, started: make(chan error, 1), done: make(chan uint32), stopped: make(chan struct{})}
+	activeService = s
+	dispatched := make(chan error, 1)
+	go func() {
+		// The dispatcher keeps this thread until the service has stopped.
+		runtime.LockOSThread()
+		table := []serviceTableEntry{{name: serviceNamePointer, proc: serviceMainCb}, {}}
+		r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+		if r == 0 {
+			dispatched <- fmt.Errorf("failed to connect to the service manager (run the service command to install the service): %w", err)
+		}
+	}()
+	select {
+	case err := <-dispatched:
+		return nil, err
+	case err := <-s.started:
+		if err != nil {
+			return nil, err
+		}
+	}
+	var once sync.Once
+	return func(code int) {
+		once.Do(func() {
+			s.done <- uint32(code)
+			// The process must not exit before the manager has heard.
+			<-s.stopped
+		})
+	}, nil
+}
+
+// serviceMain runs on a thread of the service manager's dispatcher for as
+// long as the service runs.
+func serviceMain(argc uint32, argv **uint16) uintptr {
+	s := activeService
+	h, _, err := procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(serviceNamePointer)), serviceHandlerCb, 0)
+	if h == 0 {
+		s.started <- fmt.Errorf("failed to register the service control handler: %w", err)
+		return 0
+	}
+	s.mu.Lock()
+	s.handle = h
+	s.status = serviceStatus{ServiceType: serviceWin32OwnProcess, CurrentState: serviceStartPending, WaitHint: 30000}
+	s.setStatusLocked()
+	s.status = serviceStatus{ServiceType: serviceWin32OwnProcess, CurrentState: serviceRunning,
+		ControlsAccepted: serviceAcceptStop | serviceAcceptShutdown | serviceAcceptParamChange}
+	s.setStatusLocked()
+	s.mu.Unlock()
+	s.started <- nil
+
+	code := <-s.done
+	s.mu.Lock()
+	s.status = serviceStatus{ServiceType: serviceWin32OwnProcess, CurrentState: serviceStopped, Win32ExitCode: code}
+	s.setStatusLocked()
+	s.mu.Unlock()
+	close(s.stopped)
+	return 0
+}
+
+// serviceHandler receives the controls of the service manager.
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	s := activeService
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		s.mu.Lock()
+		// A rollback can take a while; the hint keeps the manager waiting.
+		s.status = serviceStatus{ServiceType: serviceWin32OwnProcess, CurrentState: serviceStopPending, WaitHint: 120000}
+		s.setStatusLocked()
+		s.mu.Unlock()
+		slog.Warn("The service manager asked the service to stop; rolling back the current batch")
+		s.stop()
+	case serviceControlParamChange:
+		requestReload()
+	case serviceControlInterrogate:
+		s.mu.Lock()
+		s.setStatusLocked()
+		s.mu.Unlock()
+	}
+	return 0
+}
+
+func (s *windowsService) setStatusLocked() {
+	procSetServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&s.status)))
+}
+
+// installService registers the executable as the NVI_ETL service, started
+// automatically at boot with args (e.g. run -schedule "0 2 * * *") in the
+// current directory, where .env is read from. A crash is restarted after a
+// minute.
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("expected the command line of the service, e.g. service install run -schedule \"0 2 * * *\"")
+	}
+	if args[0] != cmdRun && args[0] != cmdServe {
+		return fmt.Errorf("the service runs run -schedule or serve, not %s", args[0])
+	}
+	command := []string{syscall.EscapeArg(exe), args[0], "-service", "-workdir", syscall.EscapeArg(dir)}
+	for _, a := range args[1:] {
+		command = append(command, syscall.EscapeArg(a))
+	}
+	if err := sc("create", windowsServiceName, "binPath=", strings.Join(command, " "), "start=", "delayed-auto", "DisplayName=", "NVI ETL ("+filepath.Base(dir)+")"); err != nil {
+		return err
+	}
+	if err := sc("description", windowsServiceName, "Loads the NVI sales data from MSSQL into the reporting database."); err != nil {
+		return err
+	}
+	if err := sc("failure", windowsServiceName, "reset=", "86400", "actions=", "restart/60000/restart/60000/none/0"); err != nil {
+		return err
+	}
+	slog.Info("Installed the Windows service; start it with sc start "+windowsServiceName, "service", windowsServiceName, "workdir", dir)
+	return nil
+}
+
+// uninstallService removes the NVI_ETL service. A running service is
+// removed once it stops.
+func uninstallService() error {
+	if err := sc("delete", windowsServiceName); err != nil {
+		return err
+	}
+	slog.Info("Removed the Windows service", "service", windowsServiceName)
+	return nil
+}
+
+func sc(args ...string) error {
+	out, err := exec.Command("sc.exe", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sc %s failed: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// exitInterrupted is the exit code of a run stopped by SIGINT or SIGTERM,
+// following the shell's 128 + SIGINT convention.
+const exitInterrupted = 130
+
+// shutdownContext returns a context that is cancelled on the first SIGINT
+// or SIGTERM, or by calling stop (the Windows service manager's stop).
+// Cancelling it aborts the source query and rolls back the open target
+// transaction; leases and the run record are still cleaned up. A second
+// signal gets the default behaviour and kills the process.
+func shutdownContext() (ctx context.Context, stop context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Warn("Stopping after rolling back the current batch; send the signal again to exit immediately", "signal", sig.String())
+			sdNotify("STOPPING=1")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
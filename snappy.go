@@ -0,0 +1,67 @@
+package main
+
+import "encoding/binary"
+
+// snappyEncode compresses src in the Snappy block format, as Parquet's
+// SNAPPY codec expects: the uncompressed length, then literals and copies
+// of earlier data found through a hash of the next four bytes. It trades
+// some ratio for simplicity against the reference encoder; any Snappy
+// decoder reads the result.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+	var table [1 << 14]int // position+1 of the last 4 bytes with that hash
+	lit := 0
+	for i := 0; i+4 <= len(src); {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := (cur * 0x1e35a7bd) >> 18
+		cand := table[h] - 1
+		table[h] = i + 1
+		if cand < 0 || i-cand > 0xffff || binary.LittleEndian.Uint32(src[cand:]) != cur {
+			i++
+			continue
+		}
+		n := 4
+		for i+n < len(src) && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = snappyLiteral(dst, src[lit:i])
+		dst = snappyCopy(dst, i-cand, n)
+		i += n
+		lit = i
+	}
+	return snappyLiteral(dst, src[lit:])
+}
+
+func snappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// snappyCopy emits copies with a two-byte offset, of at most 64 bytes each.
+// The pieces are split so none is shorter than four bytes.
+func snappyCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := min(length, 64)
+		if length > 64 && length < 68 {
+			n = 60
+		}
+		dst = append(dst, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
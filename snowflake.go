@@ -0,0 +1,335 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snowflakeDriver is the database/sql driver name of gosnowflake, which is
+// only linked into builds with the snowflake tag (snowflakedriver.go).
+const snowflakeDriver = "snowflake"
+
+// snowflakeNull marks NULL in the staged files, so that NULL and an empty
+// string stay apart.
+const snowflakeNull = `\N`
+
+// checkSnowflakeConn validates SNOWFLAKE_CONN for TARGET=snowflake.
+func checkSnowflakeConn(conn string) error {
+	switch {
+	case conn == "":
+		return fmt.Errorf("SNOWFLAKE_CONN (or SNOWFLAKE_CONN_SECRET) environment variable must be set for TARGET=snowflake. Check your .env file")
+	case !slices.Contains(sql.Drivers(), snowflakeDriver):
+		return fmt.Errorf("TARGET=snowflake needs the gosnowflake driver, which this binary was built without; build with -tags snowflake")
+	}
+	return nil
+}
+
+// snowflakeTableStage returns the table stage of table, which may be
+// qualified: @%sales, or @analytics.public.%sales.
+func snowflakeTableStage(table string) string {
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		return "@" + table[:i+1] + "%" + table[i+1:]
+	}
+	return "@%" + table
+}
+
+// snowflakeStageTable names the temporary table a batch is copied into
+// before it is merged into table.
+func snowflakeStageTable(table string) string {
+	return "etl_stage_" + strings.ReplaceAll(table, ".", "_")
+}
+
+// ensureSnowflakeTable creates the target table from TARGET_DDL or the
+// column mapping. The Postgres types of the mapping (TEXT, VARCHAR,
+// NUMERIC, INTEGER, DOUBLE PRECISION, DATE, TIMESTAMP) are all Snowflake
+// types too. Snowflake does not enforce the primary key; the merge is what
+// keeps keys unique.
+func ensureSnowflakeTable(ctx context.Context, db *sql.DB, cfg Config) error {
+	ddl := cfg.TargetDDL
+	if ddl == "" {
+		cols := insertColumns(cfg.Columns)
+		defs := make([]string, len(cols))
+		for i, c := range cols {
+			defs[i] = c.Target + " " + c.targetType()
+		}
+		ddl = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s, PRIMARY KEY (%s))", cfg.TargetTable, strings.Join(defs, ", "), keyOf(cols).Target)
+	}
+	if _, err := db.ExecContext(ctx, ddl); err != nil {
+		return fmt.Errorf("failed to create target table: %w", err)
+	}
+	slog.Info("Target table is ready", "table", cfg.TargetTable, "key", keyOf(cfg.Columns).Target)
+	return nil
+}
+
+// snowflakeSink is the rowSink of TARGET=snowflake. Each batch is written
+// to a gzip-compressed CSV file, PUT on the target table's stage, copied
+// into a temporary table and merged from there, so a batch lands all at
+// once and CONFLICT_ACTION works as with Postgres: nothing keeps the row
+// already loaded, update overwrites it if it changed, and replace deletes
+// and inserts it. Within a batch the first row of a key wins with nothing
+// and the last one otherwise, as with ON CONFLICT row by row. The temporary
+// table lives in the session, so the sink holds one connection.
+type snowflakeSink struct {
+	ctx   context.Context
+	db    *sql.DB
+	cfg   Config
+	runID string
+	cols  []column
+
+	conn      *sql.Conn
+	file      *os.File
+	gz        *gzip.Writer
+	w         *csv.Writer
+	record    []string
+	batchRows int
+	committed int
+	conflicts int
+}
+
+func newSnowflakeSink(ctx context.Context, cfg Config, runID string, db *sql.DB, cols []column) *snowflakeSink {
+	// Formats Snowflake reads with DATE_FORMAT and TIMESTAMP_FORMAT AUTO.
+	cfg.TargetDateFormat, cfg.TargetTimestampFormat = "2006-01-02", time.RFC3339Nano
+	return &snowflakeSink{ctx: ctx, db: db, cfg: cfg, runID: runID, cols: cols, record: make([]string, len(cols)+1)}
+}
+
+// begin starts a batch file, and on the first batch reserves the
+// connection and creates the stage table: the mapped columns plus etl_row,
+// the position of the row in its batch.
+func (s *snowflakeSink) begin() error {
+	s.batchRows = 0
+	if s.cfg.DryRun {
+		s.w = csv.NewWriter(io.Discard)
+		return nil
+	}
+	if s.conn == nil {
+		conn, err := s.db.Conn(s.ctx)
+		if err != nil {
+			return fmt.Errorf("failed to reserve target connection: %w", err)
+		}
+		s.conn = conn
+		defs := make([]string, len(s.cols))
+		for i, c := range s.cols {
+			defs[i] = c.Target + " " + c.targetType()
+		}
+		if _, err := s.conn.ExecContext(s.ctx, fmt.Sprintf("CREATE OR REPLACE TEMPORARY TABLE %s (%s, etl_row INTEGER)",
+			snowflakeStageTable(s.cfg.TargetTable), strings.Join(defs, ", "))); err != nil {
+			return fmt.Errorf("failed to create stage table: %w", err)
+		}
+	}
+	file, err := os.CreateTemp("", "nvi_etl-*.csv.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create batch file: %w", err)
+	}
+	s.file = file
+	s.gz = gzip.NewWriter(file)
+	s.w = csv.NewWriter(s.gz)
+	return nil
+}
+
+func (s *snowflakeSink) write(vals []any) error {
+	for i, c := range s.cols {
+		s.record[i] = snowflakeNull
+		if statValue(c, vals[i]) != nil {
+			s.record[i] = formatField(s.cfg, c, vals[i])
+		}
+	}
+	s.batchRows++
+	s.record[len(s.cols)] = strconv.Itoa(s.batchRows)
+	if err := s.w.Write(s.record); err != nil {
+		return fmt.Errorf("failed to write batch file: %w", err)
+	}
+	return nil
+}
+
+func (s *snowflakeSink) batchDone(rows int) bool {
+	return s.cfg.TxMode == txPerBatch && rows%s.cfg.CommitEvery == 0
+}
+
+func (s *snowflakeSink) flush() error {
+	s.w.Flush()
+	if err := s.w.Error(); err != nil {
+		return fmt.Errorf("failed to write batch file: %w", err)
+	}
+	return nil
+}
+
+// commit loads the batch file into the target table.
+func (s *snowflakeSink) commit(rows int) error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if s.cfg.DryRun || s.batchRows == 0 {
+		s.committed = rows
+		s.removeFile()
+		return nil
+	}
+	if err := s.gz.Close(); err != nil {
+		return fmt.Errorf("failed to write batch file: %w", err)
+	}
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("failed to write batch file: %w", err)
+	}
+
+	// PUT only uploads; nothing is loaded until COPY INTO, which PURGE
+	// then removes the file after.
+	stage := snowflakeTableStage(s.cfg.TargetTable) + "/nvi_etl/" + s.runID
+	if _, err := s.conn.ExecContext(s.ctx, fmt.Sprintf("PUT 'file://%s' %s AUTO_COMPRESS = FALSE OVERWRITE = TRUE", filepath.ToSlash(s.file.Name()), stage)); err != nil {
+		return fmt.Errorf("failed to upload batch: %w", err)
+	}
+
+	tx, err := s.conn.BeginTx(s.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	stageTable := snowflakeStageTable(s.cfg.TargetTable)
+	if _, err := tx.ExecContext(s.ctx, "DELETE FROM "+stageTable); err != nil {
+		return fmt.Errorf("failed to clear stage table: %w", err)
+	}
+	if _, err := tx.ExecContext(s.ctx, fmt.Sprintf(`
+		COPY INTO %s FROM %s/%s
+		FILE_FORMAT = (TYPE = CSV COMPRESSION = GZIP FIELD_OPTIONALLY_ENCLOSED_BY = '"'
+			ESCAPE_UNENCLOSED_FIELD = NONE NULL_IF = ('\\N') EMPTY_FIELD_AS_NULL = FALSE
+			DATE_FORMAT = AUTO TIMESTAMP_FORMAT = AUTO)
+		PURGE = TRUE`, stageTable, stage, filepath.Base(s.file.Name()))); err != nil {
+		return fmt.Errorf("failed to copy batch into stage table: %w", err)
+	}
+	written := 0
+	for _, stmt := range snowflakeMergeSQL(s.cfg, s.cols) {
+		res, err := tx.ExecContext(s.ctx, stmt)
+		if err != nil {
+			return fmt.Errorf("failed to merge batch into target table: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			written = int(n)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	s.removeFile()
+
+	if s.cfg.ConflictAction != conflictReplace {
+		s.conflicts += s.batchRows - written
+	}
+	etlMetrics.rowsInserted.add(s.cfg.TargetTable, float64(rows-s.committed))
+	slog.Debug("Committed batch", "table", s.cfg.TargetTable, "rows_committed", rows)
+	s.committed = rows
+	return nil
+}
+
+// snowflakeMergeSQL returns the statements that move the stage table into
+// the target table. The last one reports the rows it wrote.
+func snowflakeMergeSQL(cfg Config, cols []column) []string {
+	key := keyOf(cols).Target
+	targetList := make([]string, len(cols))
+	for i, c := range cols {
+		targetList[i] = c.Target
+	}
+	names := strings.Join(targetList, ", ")
+	order := "DESC"
+	if cfg.ConflictAction == conflictNothing {
+		order = "ASC"
+	}
+	source := fmt.Sprintf("(SELECT %s FROM %s QUALIFY ROW_NUMBER() OVER (PARTITION BY %s ORDER BY etl_row %s) = 1)",
+		names, snowflakeStageTable(cfg.TargetTable), key, order)
+
+	if cfg.ConflictAction == conflictReplace {
+		return []string{
+			fmt.Sprintf("DELETE FROM %s t USING %s s WHERE t.%s = s.%s", cfg.TargetTable, source, key, key),
+			fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", cfg.TargetTable, names, names, source),
+		}
+	}
+
+	insert := fmt.Sprintf("WHEN NOT MATCHED THEN INSERT (%s) VALUES (s.%s)", names, strings.Join(targetList, ", s."))
+	var update string
+	if cfg.ConflictAction == conflictUpdate {
+		var sets, changed []string
+		for _, c := range cols {
+			if c.Key {
+				continue
+			}
+			sets = append(sets, fmt.Sprintf("%s = s.%s", c.Target, c.Target))
+			// load_seq differs on every run; comparing it would rewrite every row.
+			if !c.Sequence {
+				changed = append(changed, fmt.Sprintf("t.%s IS DISTINCT FROM s.%s", c.Target, c.Target))
+			}
+		}
+		if len(changed) > 0 {
+			update = fmt.Sprintf("WHEN MATCHED AND (%s) THEN UPDATE SET %s ", strings.Join(changed, " OR "), strings.Join(sets, ", "))
+		}
+	}
+	return []string{fmt.Sprintf("MERGE INTO %s t USING %s s ON t.%s = s.%s %s%s", cfg.TargetTable, source, key, key, update, insert)}
+}
+
+func (s *snowflakeSink) removeFile() {
+	if s.file == nil {
+		return
+	}
+	s.file.Close()
+	os.Remove(s.file.Name())
+	s.file = nil
+}
+
+// abort drops the uncommitted batch and gives the connection back; the
+// stage table goes with the session.
+func (s *snowflakeSink) abort() {
+	s.removeFile()
+	if s.conn != nil {
+		s.conn.ExecContext(context.Background(), "DROP TABLE IF EXISTS "+snowflakeStageTable(s.cfg.TargetTable))
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *snowflakeSink) state() execer { return nil }
+
+func (s *snowflakeSink) rejectScan(rows sourceRows, err error) (bool, error) { return false, nil }
+
+func (s *snowflakeSink) rejectRow(stage string, vals []any, reason error) (bool, error) {
+	return false, nil
+}
+
+func (s *snowflakeSink) report(res *loadResult) { res.conflicts += s.conflicts }
+
+// loadSnowflake prepares the Snowflake target table of cfg and loads it,
+// in place of runTable.
+func loadSnowflake(ctx context.Context, cfg Config, sourceDB, targetDB *sql.DB) error {
+	if !cfg.DryRun {
+		if err := ensureSnowflakeTable(ctx, targetDB, cfg); err != nil {
+			return err
+		}
+	}
+	runID := newRunID()
+	slog.Info("Starting ETL run", "table", cfg.TargetTable, "run_id", runID, "source", sourceName(cfg), "target", targetSnowflake)
+	start := time.Now()
+	counts := startRunCounts(cfg.TargetTable)
+
+	count, err := runETLWithTxRetry(ctx, cfg, runID, sourceDB, targetDB)
+	etlMetrics.runDuration.observe(cfg.TargetTable, time.Since(start))
+	etlStatus.tableDone(cfg.TargetTable, runID, start, count, counts, err)
+	if err != nil {
+		return fmt.Errorf("run %s stopped after %d rows: %w", runID, count, err)
+	}
+	if cfg.DryRun {
+		slog.Info("DRY RUN complete", "table", cfg.TargetTable, "rows", count, "duration", time.Since(start))
+	} else {
+		slog.Info("ETL process completed successfully", "table", cfg.TargetTable, "run_id", runID, "rows", count, "duration", time.Since(start))
+	}
+
+	if err := checkExpectedRows(cfg, count); err != nil {
+		return exitCodeError{exitRowCountOutOfBand, fmt.Errorf("completeness check failed: %w", err)}
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build snowflake
+
+package main
+
+// The Snowflake driver is opt-in, so the default build does not carry it:
+//
+//	go get github.com/snowflakedb/gosnowflake
+//	go build -tags snowflake
+import _ "github.com/snowflakedb/gosnowflake"
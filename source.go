@@ -0,0 +1,623 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sourceRows is the part of *sql.Rows that runETL needs, so the cursor
+// reader can stand in for a plain streaming query.
+type sourceRows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+	Close() error
+}
+
+// querySource runs the source SELECT either as a plain streaming query
+// (the default) or through a server-side cursor when SOURCE_CURSOR is set.
+func querySource(ctx context.Context, db *sql.DB, cfg Config, query string, args ...any) (sourceRows, error) {
+	if !cfg.SourceCursor {
+		return db.QueryContext(ctx, query, args...)
+	}
+	return openCursor(ctx, db, query, cfg.SourceFetchSize, args...)
+}
+
+// checkTemporalSource makes sure the source table is system-versioned
+// before it is read FOR SYSTEM_TIME AS OF.
+func checkTemporalSource(ctx context.Context, db *sql.DB, table string) error {
+	var temporalType int
+	err := db.QueryRowContext(ctx, "SELECT temporal_type FROM sys.tables WHERE object_id = OBJECT_ID(@p1)", table).Scan(&temporalType)
+	if err != nil {
+		return fmt.Errorf("failed to look up source table %s: %w", table, err)
+	}
+	// 2 = SYSTEM_VERSIONED_TEMPORAL_TABLE
+	if temporalType != 2 {
+		return fmt.Errorf("source table %s is not a system-versioned temporal table, AS_OF cannot be used", table)
+	}
+	return nil
+}
+
+// Policies for ORDER_BY_POLICY, applied when fsno has no index on the
+// source and ORDER BY fsno would need a full sort.
+const (
+	orderByWarn      = "warn"
+	orderByUnordered = "unordered"
+	orderByRefuse    = "refuse"
+)
+
+// sourceKeyIndexed reports whether some index on the source table leads
+// with the key column, so ORDER BY can be served without a sort.
+func sourceKeyIndexed(ctx context.Context, db *sql.DB, table, keyColumn string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*)
+		FROM sys.index_columns ic
+		JOIN sys.columns c ON c.object_id = ic.object_id AND c.column_id = ic.column_id
+		WHERE ic.object_id = OBJECT_ID(@p1) AND c.name = @p2 AND ic.key_ordinal = 1`, table, keyColumn).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up indexes on source table %s: %w", table, err)
+	}
+	return n > 0, nil
+}
+
+// sourceOrdered decides whether the source is read in fsno order, applying
+// ORDER_BY_POLICY if fsno is not indexed.
+func sourceOrdered(ctx context.Context, db *sql.DB, cfg Config) (bool, error) {
+	keyColumn := keyOf(cfg.Columns).Source
+	lookup := sourceKeyIndexed
+	switch cfg.Source {
+	case sourceMySQL:
+		lookup = mysqlKeyIndexed
+	case sourceOracle:
+		lookup = oracleKeyIndexed
+	}
+	indexed, err := lookup(ctx, db, cfg.SourceTable, keyColumn)
+	if err != nil || indexed {
+		return true, err
+	}
+	switch cfg.OrderByPolicy {
+	case orderByRefuse:
+		return false, fmt.Errorf("%s has no index on %s, so ORDER BY %s would sort the whole table; add an index or change ORDER_BY_POLICY", cfg.SourceTable, keyColumn, keyColumn)
+	case orderByUnordered:
+		slog.Warn("Source key is not indexed; reading unordered, read restarts are disabled for this run", "table", cfg.TargetTable, "source_table", cfg.SourceTable, "key", keyColumn)
+		return false, nil
+	default:
+		slog.Warn("Source key is not indexed; ORDER BY will sort the whole table on the source", "table", cfg.TargetTable, "source_table", cfg.SourceTable, "key", keyColumn)
+		return true, nil
+	}
+}
+
+const sourceCursorName = "etl_source_cursor"
+
+// cursorRows reads the source through a declared MSSQL cursor, pulling
+// fetchSize rows per round-trip. Each FETCH comes back as its own result
+// set, so a batch is walked with NextResultSet.
+type cursorRows struct {
+	ctx       context.Context
+	conn      *sql.Conn
+	fetchSize int
+	rows      *sql.Rows
+	batchRows int
+	done      bool
+	err       error
+}
+
+func openCursor(ctx context.Context, db *sql.DB, query string, fetchSize int, args ...any) (*cursorRows, error) {
+	// The cursor lives on the session, so every fetch has to use the same connection.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve source connection for cursor: %w", err)
+	}
+
+	declare := fmt.Sprintf(`
+		DECLARE %[1]s CURSOR GLOBAL FORWARD_ONLY READ_ONLY FOR %[2]s;
+		OPEN %[1]s;`, sourceCursorName, query)
+	if _, err := conn.ExecContext(ctx, declare, args...); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open source cursor: %w", err)
+	}
+
+	return &cursorRows{ctx: ctx, conn: conn, fetchSize: fetchSize}, nil
+}
+
+func (c *cursorRows) fetch() error {
+	batch := fmt.Sprintf(`
+		SET NOCOUNT ON;
+		DECLARE @fetched INT = 0;
+		WHILE @fetched < %d
+		BEGIN
+			FETCH NEXT FROM %s;
+			IF @@FETCH_STATUS <> 0 BREAK;
+			SET @fetched += 1;
+		END`, c.fetchSize, sourceCursorName)
+
+	rows, err := c.conn.QueryContext(c.ctx, batch)
+	if err != nil {
+		return fmt.Errorf("failed to fetch from source cursor: %w", err)
+	}
+	c.rows = rows
+	c.batchRows = 0
+	return nil
+}
+
+func (c *cursorRows) Next() bool {
+	for c.err == nil && !c.done {
+		if c.rows == nil {
+			c.err = c.fetch()
+			continue
+		}
+		if c.rows.Next() {
+			c.batchRows++
+			return true
+		}
+		if c.rows.NextResultSet() {
+			continue
+		}
+		if err := c.rows.Err(); err != nil {
+			c.err = err
+			return false
+		}
+		c.rows.Close()
+		c.rows = nil
+		// A short batch means the cursor ran out of rows.
+		if c.batchRows < c.fetchSize {
+			c.done = true
+		}
+	}
+	return false
+}
+
+func (c *cursorRows) Scan(dest ...any) error {
+	return c.rows.Scan(dest...)
+}
+
+func (c *cursorRows) Err() error {
+	return c.err
+}
+
+func (c *cursorRows) Close() error {
+	if c.rows != nil {
+		c.rows.Close()
+	}
+	_, err := c.conn.ExecContext(context.Background(), fmt.Sprintf("CLOSE %[1]s; DEALLOCATE %[1]s;", sourceCursorName))
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// pickReadSource opens the MSSQL read replica and returns it if it is
+// reachable and its replication lag is within MaxReplicaLag. Otherwise it
+// falls back to the primary. The lag comes from the primary's view of the
+// availability group, matched to the replica by server name.
+func pickReadSource(ctx context.Context, primary *sql.DB, cfg Config) *sql.DB {
+	replica, err := openDB("sqlserver", cfg.MSSQLReplicaConn, "MSSQL_REPLICA_CONN", cfg)
+	if err != nil {
+		slog.Warn("Replica DSN is invalid; reading from primary", "error", err)
+		return primary
+	}
+	cfg.SourcePool.apply(replica)
+
+	var serverName string
+	if err := replica.QueryRowContext(ctx, "SELECT @@SERVERNAME").Scan(&serverName); err != nil {
+		slog.Warn("Replica is unreachable; reading from primary", "error", err)
+		replica.Close()
+		return primary
+	}
+
+	var lagSeconds sql.NullInt64
+	err = primary.QueryRowContext(ctx, `
+		SELECT drs.secondary_lag_seconds
+		FROM sys.dm_hadr_database_replica_states drs
+		JOIN sys.availability_replicas ar ON ar.replica_id = drs.replica_id
+		WHERE drs.database_id = DB_ID() AND ar.replica_server_name = @p1`, serverName).Scan(&lagSeconds)
+	if err != nil || !lagSeconds.Valid {
+		slog.Warn("Could not determine replica lag; reading from primary", "replica", serverName, "error", err)
+		replica.Close()
+		return primary
+	}
+
+	lag := time.Duration(lagSeconds.Int64) * time.Second
+	if lag > cfg.MaxReplicaLag {
+		slog.Info("Replica is too far behind; reading from primary", "replica", serverName, "lag", lag, "limit", cfg.MaxReplicaLag)
+		replica.Close()
+		return primary
+	}
+
+	slog.Info("Reading from replica", "replica", serverName, "lag", lag)
+	return replica
+}
+
+// sourceParam returns the placeholder for the query argument v and the
+// argument to pass to the source of type source: named (@name for MSSQL,
+// :name for Oracle), or positional (?) for MySQL, whose driver has no
+// named parameters. Positional arguments have to be passed in the order
+// their placeholders appear.
+func sourceParam(source, name string, v any) (string, any) {
+	switch source {
+	case sourceMySQL:
+		return "?", v
+	case sourceOracle:
+		return ":" + name, sql.Named(name, v)
+	}
+	return "@" + name, sql.Named(name, v)
+}
+
+// readPlan is what a run decided about its source read before starting it.
+type readPlan struct {
+	// ordered reads in fsno order (see ORDER_BY_POLICY).
+	ordered bool
+	// delta limits the read to rows changed within a rowversion range; nil
+	// reads the whole table.
+	delta *rowVersionRange
+	// since limits the read to an INCREMENTAL_COLUMN range; nil reads the
+	// whole table.
+	since *columnRange
+	// changes limits the read to rows changed since the last
+	// CHANGE_TRACKING version, unless it is nil or full.
+	changes *changeRange
+	// after and upTo limit the read to the fsno range (after, upTo] of one
+	// PARALLELISM worker; nil leaves that end open.
+	after, upTo any
+}
+
+// sourceQuery builds the extraction SELECT. With afterKey set it only
+// returns rows after that fsno, which is how an interrupted read resumes
+// and a paged read moves to its next page. limit, if not zero, caps the
+// rows of an ordered read for SOURCE_PAGE_SIZE.
+func sourceQuery(cfg Config, cols []column, afterKey any, plan readPlan, limit int) (string, []any) {
+	key := keyOf(cols).Source
+	sourceList := make([]string, len(cols))
+	for i, c := range cols {
+		sourceList[i] = c.Source
+	}
+
+	var asOf string
+	var args []any
+	param := func(name string, v any) string {
+		p, arg := sourceParam(cfg.Source, name, v)
+		args = append(args, arg)
+		return p
+	}
+	if !cfg.AsOf.IsZero() {
+		asOf = " FOR SYSTEM_TIME AS OF " + param("asof", cfg.AsOf)
+	}
+
+	var where []string
+	switch {
+	case cfg.SamplePercent > 0 && cfg.Source == sourceMySQL:
+		where = append(where, fmt.Sprintf("CRC32(%s) %% 100 < %d", key, cfg.SamplePercent))
+	case cfg.SamplePercent > 0 && cfg.Source == sourceOracle:
+		where = append(where, fmt.Sprintf("ORA_HASH(%s, 99) < %d", key, cfg.SamplePercent))
+	case cfg.SamplePercent > 0:
+		// CHECKSUM is deterministic, so every run picks the same rows. The
+		// mask keeps it non-negative (ABS would overflow on INT_MIN).
+		where = append(where, fmt.Sprintf("(CHECKSUM(%s) & 0x7fffffff) %% 100 < %d", key, cfg.SamplePercent))
+	}
+	if cfg.SourceFilter != "" {
+		where = append(where, "("+cfg.SourceFilter+")")
+		args = append(args, cfg.SourceFilterArgs...)
+	}
+	if d := plan.delta; d != nil {
+		if d.from != nil {
+			where = append(where, cfg.RowVersionColumn+" >= "+param("rvfrom", d.from))
+		}
+		where = append(where, cfg.RowVersionColumn+" < "+param("rvto", d.to))
+	}
+	if r := plan.since; r != nil {
+		if r.from != nil {
+			where = append(where, r.col.Source+" >= "+param("wmfrom", r.from))
+		}
+		where = append(where, r.col.Source+" <= "+param("wmto", r.to))
+	}
+	if c := plan.changes; c != nil && !c.full {
+		where = append(where, changedRowsFilter(cfg, key))
+		args = append(args, sql.Named("ctfrom", c.from))
+	}
+	if afterKey != nil {
+		where = append(where, key+" > "+param("afterkey", afterKey))
+	}
+	if plan.upTo != nil {
+		where = append(where, key+" <= "+param("upto", plan.upTo))
+	}
+	whereSQL := ""
+	if len(where) > 0 {
+		whereSQL = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	orderBy, top := "", ""
+	if plan.ordered {
+		orderBy = " ORDER BY " + key + winnerOrder(cfg.DedupWinner)
+		if limit > 0 {
+			top = fmt.Sprintf("TOP (%d) ", limit)
+		}
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s%s
+		FROM %s%s%s%s`, top, strings.Join(sourceList, ", "), cfg.SourceTable, asOf, whereSQL, orderBy)
+	return query, args
+}
+
+// restartingRows reads the source and, when a read times out or the
+// connection drops, reconnects and re-issues the query from the last fsno it
+// handed out. The read is ordered by fsno, so nothing is skipped or read
+// twice. A read counts as timed out when the driver reports a timeout, or
+// when no row arrives within SourceReadTimeout. An unordered read cannot be
+// resumed and is never restarted.
+//
+// With SOURCE_PAGE_SIZE an ordered read is split into pages of that many
+// rows, each its own short query after the last fsno of the page before.
+// A failed page is retried from where it failed, with MAX_READ_RESTARTS
+// counted per page.
+type restartingRows struct {
+	ctx  context.Context
+	db   *sql.DB
+	cfg  Config
+	cols []column
+	plan readPlan
+
+	keyIdx   int
+	lastKey  any
+	restarts int
+
+	pageSize  int // 0 reads in one query
+	pageRows  int
+	pageStart any
+	pages     int
+
+	rows     sourceRows
+	cancel   context.CancelFunc
+	deadline context.CancelFunc // SOURCE_QUERY_TIMEOUT
+	watchdog *time.Timer
+	stalled  atomic.Bool
+	err      error
+}
+
+func openSourceRows(ctx context.Context, db *sql.DB, cfg Config, cols []column, plan readPlan) (*restartingRows, error) {
+	// A range read starts, and a restart resumes, after the last key.
+	r := &restartingRows{ctx: ctx, db: db, cfg: cfg, cols: cols, plan: plan, keyIdx: -1, lastKey: plan.after, deadline: func() {}}
+	if plan.ordered {
+		r.pageSize = cfg.SourcePageSize
+	}
+	if cfg.SourceQueryTimeout > 0 {
+		// One deadline for the whole read, restarts included.
+		r.ctx, r.deadline = context.WithTimeoutCause(ctx, cfg.SourceQueryTimeout, errSourceQueryTimeout)
+	}
+	for i, c := range cols {
+		if c.Key {
+			r.keyIdx = i
+		}
+	}
+	if r.keyIdx < 0 {
+		r.pageSize = 0
+	}
+	for {
+		err := r.open()
+		if err == nil {
+			return r, nil
+		}
+		if !r.canRestart(err) {
+			r.deadline()
+			return nil, r.timedOut(err)
+		}
+	}
+}
+
+// timedOut names SOURCE_QUERY_TIMEOUT as the reason for err if the read ran
+// out of time, since the driver only reports a cancelled query.
+func (r *restartingRows) timedOut(err error) error {
+	if context.Cause(r.ctx) == errSourceQueryTimeout {
+		return fmt.Errorf("%w (%s): %v", errSourceQueryTimeout, r.cfg.SourceQueryTimeout, err)
+	}
+	return err
+}
+
+func (r *restartingRows) open() error {
+	ctx, cancel := context.WithCancel(r.ctx)
+	r.cancel = cancel
+	r.stalled.Store(false)
+	if r.cfg.SourceReadTimeout > 0 {
+		r.watchdog = time.AfterFunc(r.cfg.SourceReadTimeout, func() {
+			r.stalled.Store(true)
+			cancel()
+		})
+	}
+
+	query, args := sourceQuery(r.cfg, r.cols, r.lastKey, r.plan, r.pageSize)
+	rows, err := querySource(ctx, r.db, r.cfg, query, args...)
+	if err != nil {
+		r.stop()
+		return err
+	}
+	r.rows, r.pageRows, r.pageStart = rows, 0, r.lastKey
+	return nil
+}
+
+// nextPage moves a paged read on to its next page once the current one
+// has ended, and reports whether there can be one: a page shorter than
+// SOURCE_PAGE_SIZE was the last.
+func (r *restartingRows) nextPage() (bool, error) {
+	if r.pageSize == 0 || r.pageRows < r.pageSize {
+		return false, nil
+	}
+	if r.lastKey == r.pageStart {
+		return false, fmt.Errorf("none of the %d rows of the source page after %v could be read", r.pageSize, r.lastKey)
+	}
+	r.stop()
+	r.pages++
+	r.restarts = 0
+	slog.Debug("Reading the next source page", "table", r.cfg.TargetTable, "page", r.pages+1, "after_key", r.lastKey)
+	return true, nil
+}
+
+// stop tears down the current read.
+func (r *restartingRows) stop() {
+	if r.watchdog != nil {
+		r.watchdog.Stop()
+	}
+	if r.rows != nil {
+		r.rows.Close()
+		r.rows = nil
+	}
+	r.cancel()
+}
+
+// canRestart decides whether err is a read timeout or transient failure
+// worth another attempt, and logs the restart and waits out the backoff if
+// so.
+func (r *restartingRows) canRestart(err error) bool {
+	if r.ctx.Err() != nil || !r.stalled.Load() && !isTransient(err) {
+		return false
+	}
+	if !r.plan.ordered || r.keyIdx < 0 || r.restarts >= r.cfg.MaxReadRestarts {
+		return false
+	}
+	wait := retryBackoff(r.cfg, r.restarts)
+	r.restarts++
+	slog.Warn("Source read failed; reconnecting and resuming after the last key",
+		"table", r.cfg.TargetTable, "error", err, "after_key", r.lastKey, "wait", wait, "restart", r.restarts, "max_restarts", r.cfg.MaxReadRestarts)
+	return sleepContext(r.ctx, wait)
+}
+
+func (r *restartingRows) Next() bool {
+	for r.err == nil {
+		if r.rows == nil {
+			if err := r.open(); err != nil {
+				if !r.canRestart(err) {
+					r.err = r.timedOut(err)
+				}
+				continue
+			}
+		}
+		if r.rows.Next() {
+			if r.watchdog != nil {
+				r.watchdog.Reset(r.cfg.SourceReadTimeout)
+			}
+			r.pageRows++
+			return true
+		}
+		err := r.rows.Err()
+		if err == nil {
+			more, err := r.nextPage()
+			if err != nil {
+				r.err = err
+			}
+			if !more {
+				return false
+			}
+			continue
+		}
+		r.stop()
+		if !r.canRestart(err) {
+			r.err = r.timedOut(err)
+		}
+	}
+	return false
+}
+
+// Scan reads the current row and remembers its raw fsno (before any
+// transform) as the resume point.
+func (r *restartingRows) Scan(dest ...any) error {
+	if err := r.rows.Scan(dest...); err != nil {
+		return err
+	}
+	if r.keyIdx >= 0 {
+		if key := statValue(r.cols[r.keyIdx], dest[r.keyIdx]); key != nil {
+			r.lastKey = key
+		}
+	}
+	return nil
+}
+
+func (r *restartingRows) Err() error {
+	return r.err
+}
+
+func (r *restartingRows) Close() error {
+	if r.rows != nil {
+		r.stop()
+	}
+	r.deadline()
+	return nil
+}
+
+// isTimeout reports whether err looks like a network or query timeout.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "timeout")
+}
+
+// mssqlSource reads the source table from MSSQL (or its replica).
+type mssqlSource struct {
+	db  *sql.DB
+	cfg Config
+}
+
+// plan checks AS_OF, decides whether the read is ordered and, for the
+// incremental modes, which range of rows this run reads.
+func (s mssqlSource) plan(ctx context.Context, targetDB *sql.DB, cols []column) (readPlan, error) {
+	cfg := s.cfg
+	var plan readPlan
+	if !cfg.AsOf.IsZero() {
+		if err := checkTemporalSource(ctx, s.db, cfg.SourceTable); err != nil {
+			return plan, err
+		}
+		slog.Info("Reading the source as of a point in time", "table", cfg.TargetTable, "source_table", cfg.SourceTable, "as_of", cfg.AsOf.Format(time.RFC3339))
+	}
+	if cfg.SamplePercent > 0 {
+		slog.Info("Sampling the source by hash of the key", "table", cfg.TargetTable, "sample_percent", cfg.SamplePercent, "key", keyOf(cols).Source)
+	}
+	if cfg.SourceFilter != "" {
+		slog.Info("Reading only the source rows that match SOURCE_FILTER", "table", cfg.TargetTable, "filter", cfg.SourceFilter)
+	}
+
+	var err error
+	if plan.ordered, err = sourceOrdered(ctx, s.db, cfg); err != nil {
+		return plan, err
+	}
+	if cfg.SourcePageSize > 0 && !plan.ordered {
+		slog.Warn("The source is read unordered, so SOURCE_PAGE_SIZE is off for this run", "table", cfg.TargetTable)
+	}
+	if cfg.RowVersionColumn != "" {
+		if cfg.ConflictAction == conflictNothing {
+			slog.Warn("ROWVERSION_COLUMN reads updated rows, but CONFLICT_ACTION=nothing leaves rows already loaded unchanged; use update, replace or scd2", "table", cfg.TargetTable)
+		}
+		if plan.delta, err = planRowVersionRange(ctx, s.db, targetDB, cfg); err != nil {
+			return plan, err
+		}
+	}
+	if cfg.IncrementalColumn != "" {
+		col, _ := incrementalColumn(cols, cfg.IncrementalColumn)
+		if plan.since, err = planColumnRange(ctx, s.db, targetDB, cfg, col); err != nil {
+			return plan, err
+		}
+	}
+	if cfg.ChangeTracking {
+		if cfg.ConflictAction == conflictNothing {
+			slog.Warn("CHANGE_TRACKING reads updated rows, but CONFLICT_ACTION=nothing leaves rows already loaded unchanged; use update, replace or scd2", "table", cfg.TargetTable)
+		}
+		if plan.changes, err = planChangeRange(ctx, s.db, targetDB, cfg, cols); err != nil {
+			return plan, err
+		}
+	}
+	return plan, nil
+}
+
+func (s mssqlSource) extract(ctx context.Context, cols []column, plan readPlan) (sourceRows, error) {
+	return openSourceRows(ctx, s.db, s.cfg, cols, plan)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// parseSourceFilter checks SOURCE_FILTER, a boolean expression in the
+// source's SQL dialect such as region = 'Addis Ababa' AND date >= :from,
+// and binds its :name parameters to the values of SOURCE_FILTER_PARAMS
+// (from=2024-01-01;...). Parameters become query arguments of the source
+// type source (see sourceParam), never part of the SQL text. The
+// expression itself is trusted configuration, but it may only be one
+// expression: statement separators, comments, unbalanced quotes or
+// parentheses are rejected, so it cannot end the WHERE clause it is put in.
+func parseSourceFilter(filter, params, source string) (string, []any, error) {
+	values := map[string]string{}
+	for _, entry := range strings.Split(params, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !isFilterParamName(name) {
+			return "", nil, fmt.Errorf("invalid SOURCE_FILTER_PARAMS entry %q: expected name=value", entry)
+		}
+		values[name] = value
+	}
+
+	var b strings.Builder
+	var args []any
+	used := map[string]bool{}
+	depth := 0
+	var quote rune // the closing quote of the literal or identifier we are in
+	runes := []rune(filter)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if quote != 0 {
+			b.WriteRune(r)
+			if r == quote {
+				// A doubled quote is an escaped one, not the end.
+				if i+1 < len(runes) && runes[i+1] == quote {
+					b.WriteRune(runes[i+1])
+					i++
+				} else {
+					quote = 0
+				}
+			}
+			continue
+		}
+		switch {
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '[':
+			quote = ']'
+		case r == '`':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			if depth--; depth < 0 {
+				return "", nil, fmt.Errorf("invalid SOURCE_FILTER: unbalanced parentheses")
+			}
+		case r == ';':
+			return "", nil, fmt.Errorf("invalid SOURCE_FILTER: it must be a single expression without ;")
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-', r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			return "", nil, fmt.Errorf("invalid SOURCE_FILTER: comments are not allowed")
+		case r == ':' && i+1 < len(runes) && isFilterParamStart(runes[i+1]):
+			j := i + 1
+			for j < len(runes) && isFilterParamChar(runes[j]) {
+				j++
+			}
+			name := string(runes[i+1 : j])
+			value, ok := values[name]
+			if !ok {
+				return "", nil, fmt.Errorf("SOURCE_FILTER uses :%s, but SOURCE_FILTER_PARAMS does not set it", name)
+			}
+			p, arg := sourceParam(source, "filter_"+name, value)
+			// A named parameter is passed once however often it is used.
+			if p == "?" || !used[name] {
+				args = append(args, arg)
+			}
+			used[name] = true
+			b.WriteString(p)
+			i = j - 1
+			continue
+		}
+		b.WriteRune(r)
+	}
+	if quote != 0 {
+		return "", nil, fmt.Errorf("invalid SOURCE_FILTER: unterminated %c", quote)
+	}
+	if depth != 0 {
+		return "", nil, fmt.Errorf("invalid SOURCE_FILTER: unbalanced parentheses")
+	}
+	for name := range values {
+		if !used[name] {
+			return "", nil, fmt.Errorf("SOURCE_FILTER_PARAMS sets %s, but SOURCE_FILTER does not use :%s", name, name)
+		}
+	}
+	return strings.TrimSpace(b.String()), args, nil
+}
+
+func isFilterParamStart(r rune) bool { return r == '_' || unicode.IsLetter(r) }
+
+func isFilterParamChar(r rune) bool { return isFilterParamStart(r) || unicode.IsDigit(r) }
+
+func isFilterParamName(s string) bool {
+	for i, r := range s {
+		if !isFilterParamChar(r) || i == 0 && !isFilterParamStart(r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// filterClause returns SOURCE_FILTER as a WHERE clause for the queries
+// outside the load that read the source table, with its arguments.
+func filterClause(cfg Config) (string, []any) {
+	if cfg.SourceFilter == "" {
+		return "", nil
+	}
+	return " WHERE (" + cfg.SourceFilter + ")", cfg.SourceFilterArgs
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"text/tabwriter"
+)
+
+const sourceSchemaTableName = "etl_source_schema"
+
+// Actions for SOURCE_SCHEMA_CHECK.
+const (
+	sourceSchemaWarn = "warn"
+	sourceSchemaFail = "fail"
+	sourceSchemaOff  = "off"
+)
+
+// Statuses of the source schema report besides those of the target one.
+// Upper case ones are about mapped columns.
+const (
+	sourceChanged      = "CHANGED"
+	sourceChangedOther = "changed"
+	sourceAdded        = "added"
+	sourceRemoved      = "removed"
+)
+
+// sourceColumn is one column of the live source table. Type includes the
+// length, or precision and scale, and NOT NULL if the column has it.
+type sourceColumn struct {
+	Name string
+	Type string
+	kind int
+}
+
+// readSourceSchema reads the columns of the source table from the
+// source's own catalog.
+func readSourceSchema(ctx context.Context, db *sql.DB, cfg Config) ([]sourceColumn, error) {
+	schema, name := splitTableName(cfg.SourceTable)
+	var query string
+	var args []any
+	switch cfg.Source {
+	case sourceOracle:
+		query = `
+			SELECT column_name, data_type, COALESCE(char_length, 0), COALESCE(data_precision, 0), COALESCE(data_scale, 0), nullable
+			FROM all_tab_columns
+			WHERE owner = COALESCE(:owner, SYS_CONTEXT('USERENV', 'CURRENT_SCHEMA')) AND table_name = :name
+			ORDER BY column_id`
+		args = []any{sql.Named("owner", oracleName(schema)), sql.Named("name", oracleName(name))}
+	default:
+		current := "SCHEMA_NAME()"
+		if cfg.Source == sourceMySQL {
+			current = "DATABASE()"
+			schema, name = strings.Trim(schema, "`"), strings.Trim(name, "`")
+		}
+		schemaP, schemaArg := sourceParam(cfg.Source, "schema", schema)
+		nameP, nameArg := sourceParam(cfg.Source, "table", name)
+		query = fmt.Sprintf(`
+			SELECT COLUMN_NAME, DATA_TYPE, COALESCE(CHARACTER_MAXIMUM_LENGTH, 0), COALESCE(NUMERIC_PRECISION, 0), COALESCE(NUMERIC_SCALE, 0), IS_NULLABLE
+			FROM INFORMATION_SCHEMA.COLUMNS
+			WHERE TABLE_SCHEMA = COALESCE(NULLIF(%s, ''), %s) AND TABLE_NAME = %s
+			ORDER BY ORDINAL_POSITION`, schemaP, current, nameP)
+		args = []any{schemaArg, nameArg}
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source schema: %w", err)
+	}
+	defer rows.Close()
+	var cols []sourceColumn
+	for rows.Next() {
+		var colName, dataType, nullable string
+		var length, precision, scale int64
+		if err := rows.Scan(&colName, &dataType, &length, &precision, &scale, &nullable); err != nil {
+			return nil, fmt.Errorf("failed to read source schema: %w", err)
+		}
+		dataType = strings.ToLower(dataType)
+		typ := dataType
+		switch {
+		case length == -1:
+			typ += "(max)"
+		case length > 0:
+			typ += fmt.Sprintf("(%d)", length)
+		case precision > 0 && (dataType == "decimal" || dataType == "numeric" || dataType == "number"):
+			typ += fmt.Sprintf("(%d,%d)", precision, scale)
+		}
+		if !strings.HasPrefix(strings.ToUpper(nullable), "Y") {
+			typ += " NOT NULL"
+		}
+		cols = append(cols, sourceColumn{Name: colName, Type: typ, kind: sourceTypeKind(cfg.Source, dataType)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read source schema: %w", err)
+	}
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("source table %s not found or has no columns", cfg.SourceTable)
+	}
+	return cols, nil
+}
+
+// sourceTypeKind is the kind of value a source type scans as. On SQL
+// Server, timestamp is rowversion rather than a time.
+func sourceTypeKind(source, dataType string) int {
+	switch {
+	case dataType == "tinyint", dataType == "smallint", dataType == "mediumint", dataType == "int",
+		dataType == "integer", dataType == "bigint", dataType == "decimal", dataType == "numeric", dataType == "number",
+		dataType == "money", dataType == "smallmoney", dataType == "float", dataType == "real", dataType == "double",
+		dataType == "binary_float", dataType == "binary_double":
+		return kindNumeric
+	case strings.HasPrefix(dataType, "date"), dataType == "smalldatetime",
+		strings.HasPrefix(dataType, "timestamp") && source != sourceMSSQL:
+		return kindTime
+	}
+	return kindText
+}
+
+// mappedSourceNames returns the source columns a mapped column reads: one,
+// several for COALESCE_SOURCES, or none for an expression, LOAD_SEQ or
+// ROW_HASH.
+func mappedSourceNames(c column) []string {
+	if c.computed() {
+		return nil
+	}
+	names := []string{c.Source}
+	if inner, ok := strings.CutPrefix(c.Source, "COALESCE("); ok {
+		names = strings.Split(strings.TrimSuffix(inner, ")"), ",")
+	}
+	var plain []string
+	for _, n := range names {
+		n = strings.Trim(strings.TrimSpace(n), "[]`\"")
+		if plainIdentifier.MatchString(n) {
+			plain = append(plain, n)
+		}
+	}
+	return plain
+}
+
+// diffSourceSchema compares the live source columns with the mapping, and
+// with the columns recorded by the last run if there is one. It also
+// returns how many differences would fail the run.
+func diffSourceSchema(cfg Config, live []sourceColumn, last map[string]string) (diffs []schemaDiff, broken, changed int) {
+	byName := map[string]sourceColumn{}
+	for _, sc := range live {
+		byName[strings.ToLower(sc.Name)] = sc
+	}
+	mapped := map[string]bool{}
+	for _, c := range insertColumns(cfg.Columns) {
+		for _, name := range mappedSourceNames(c) {
+			key := strings.ToLower(name)
+			if mapped[key] {
+				continue
+			}
+			mapped[key] = true
+			sc, ok := byName[key]
+			switch {
+			case !ok:
+				expected := last[key]
+				if expected == "" {
+					expected = "mapped"
+				}
+				diffs = append(diffs, schemaDiff{name, expected, "-", schemaMissing})
+				broken++
+			case !c.scanText && !c.RawNumeric && c.kind() != kindText && sc.kind != c.kind():
+				diffs = append(diffs, schemaDiff{name, "read as " + normalizeType(c.Type), sc.Type, schemaMismatch})
+				broken++
+			case last != nil && last[key] != "" && last[key] != sc.Type:
+				diffs = append(diffs, schemaDiff{name, last[key], sc.Type, sourceChanged})
+				changed++
+			}
+		}
+	}
+	if last == nil {
+		return diffs, broken, changed
+	}
+	for _, sc := range live {
+		key := strings.ToLower(sc.Name)
+		switch {
+		case mapped[key]:
+		case last[key] == "":
+			diffs = append(diffs, schemaDiff{sc.Name, "-", sc.Type, sourceAdded})
+		case last[key] != sc.Type:
+			diffs = append(diffs, schemaDiff{sc.Name, last[key], sc.Type, sourceChangedOther})
+		}
+	}
+	for _, key := range sortedKeys(last) {
+		if _, ok := byName[key]; !ok && !mapped[key] {
+			diffs = append(diffs, schemaDiff{key, last[key], "-", sourceRemoved})
+		}
+	}
+	return diffs, broken, changed
+}
+
+// checkSourceSchema compares the source table with the mapping and with
+// the schema the last run saw, before anything is read, so a renamed or
+// retyped source column stops the run with a diff rather than a scan
+// error halfway through. Mapped columns that are gone or can no longer be
+// read as their target type always fail; other changes to mapped columns
+// fail with SOURCE_SCHEMA_CHECK=fail. With a Postgres target the schema is
+// then recorded in etl_source_schema for the next run.
+func checkSourceSchema(ctx context.Context, sourceDB, targetDB *sql.DB, cfg Config) error {
+	if cfg.SourceSchemaCheck == sourceSchemaOff || sourceDB == nil {
+		return nil
+	}
+	live, err := readSourceSchema(ctx, sourceDB, cfg)
+	if err != nil {
+		return err
+	}
+	var last map[string]string
+	if cfg.Target == targetPostgres {
+		if last, err = lastSourceSchema(ctx, targetDB, cfg.TargetTable); err != nil {
+			return err
+		}
+	}
+
+	diffs, broken, changed := diffSourceSchema(cfg, live, last)
+	if len(diffs) > 0 {
+		var b strings.Builder
+		tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "COLUMN\tEXPECTED\tACTUAL\tSTATUS")
+		for _, d := range diffs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.Column, d.Expected, d.Actual, d.Status)
+		}
+		tw.Flush()
+		if broken > 0 || changed > 0 && cfg.SourceSchemaCheck == sourceSchemaFail {
+			slog.Error("Source table has changed:\n"+b.String(), "table", cfg.TargetTable, "source_table", cfg.SourceTable)
+		} else {
+			slog.Warn("Source table has changed:\n"+b.String(), "table", cfg.TargetTable, "source_table", cfg.SourceTable)
+		}
+	}
+	switch {
+	case broken > 0:
+		return fmt.Errorf("%d mapped column(s) of source table %s are missing or can no longer be read as their target type; fix the column mapping", broken, cfg.SourceTable)
+	case changed > 0 && cfg.SourceSchemaCheck == sourceSchemaFail:
+		return fmt.Errorf("%d mapped column(s) of source table %s changed since the last run; check the mapping, then run once with SOURCE_SCHEMA_CHECK=warn to accept the change", changed, cfg.SourceTable)
+	}
+
+	if cfg.Target != targetPostgres || cfg.DryRun || last != nil && len(diffs) == 0 {
+		return nil
+	}
+	return saveSourceSchema(ctx, targetDB, cfg.TargetTable, live)
+}
+
+func ensureSourceSchemaTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			table_name VARCHAR(100) NOT NULL,
+			column_name VARCHAR(128) NOT NULL,
+			column_type VARCHAR(200) NOT NULL,
+			recorded_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (table_name, column_name)
+		)`, sourceSchemaTableName))
+	if err != nil {
+		return fmt.Errorf("failed to create source schema table: %w", err)
+	}
+	return nil
+}
+
+// lastSourceSchema returns the source columns recorded for table by the
+// last run, keyed by lower-case name, or nil if none were.
+func lastSourceSchema(ctx context.Context, db *sql.DB, table string) (map[string]string, error) {
+	if err := ensureSourceSchemaTable(ctx, db); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT column_name, column_type FROM %s WHERE table_name = $1", sourceSchemaTableName), table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the recorded source schema: %w", err)
+	}
+	defer rows.Close()
+	var last map[string]string
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, fmt.Errorf("failed to read the recorded source schema: %w", err)
+		}
+		if last == nil {
+			last = map[string]string{}
+		}
+		last[name] = typ
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the recorded source schema: %w", err)
+	}
+	return last, nil
+}
+
+// saveSourceSchema replaces the recorded source columns of table.
+func saveSourceSchema(ctx context.Context, db *sql.DB, table string, cols []sourceColumn) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to record the source schema: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE table_name = $1", sourceSchemaTableName), table); err != nil {
+		return fmt.Errorf("failed to record the source schema: %w", err)
+	}
+	for _, c := range cols {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (table_name, column_name, column_type) VALUES ($1, $2, $3)", sourceSchemaTableName), table, strings.ToLower(c.Name), c.Type); err != nil {
+			return fmt.Errorf("failed to record the source schema: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to record the source schema: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strings"
+)
+
+// sqlSource reads the source table from a database other than SQL Server:
+// MySQL or MariaDB (SOURCE=mysql) or Oracle (SOURCE=oracle). It shares the
+// extraction query and read restarts with mssqlSource, with the dialect
+// picked by sourceParam; only what relies on SQL Server features (AS_OF,
+// ROWVERSION_COLUMN, CHANGE_TRACKING, cursors, paging and the replica) is
+// left out, and rejected by the configuration.
+type sqlSource struct {
+	db  *sql.DB
+	cfg Config
+}
+
+// sqlSourceConn returns the driver, connection string, option name and
+// display name to open the source of cfg with.
+func sqlSourceConn(cfg Config) (driver, conn, option, name string) {
+	if cfg.Source == sourceOracle {
+		return oracleDriver, cfg.OracleConn, "ORACLE_CONN", "Oracle Source"
+	}
+	return mysqlDriver, cfg.MySQLConn, "MYSQL_CONN", "MySQL Source"
+}
+
+func (s sqlSource) plan(ctx context.Context, targetDB *sql.DB, cols []column) (readPlan, error) {
+	cfg := s.cfg
+	var plan readPlan
+	if cfg.SamplePercent > 0 {
+		slog.Info("Sampling the source by hash of the key", "table", cfg.TargetTable, "sample_percent", cfg.SamplePercent, "key", keyOf(cols).Source)
+	}
+	if cfg.SourceFilter != "" {
+		slog.Info("Reading only the source rows that match SOURCE_FILTER", "table", cfg.TargetTable, "filter", cfg.SourceFilter)
+	}
+
+	if cfg.Source == sourceOracle {
+		// An Oracle DATE is a date and a time of day.
+		for _, c := range cols {
+			if strings.EqualFold(c.Type, "DATE") && c.Source != "" {
+				slog.Info("Oracle DATE values carry a time of day, which a DATE column drops; map the column to TIMESTAMP to keep it", "table", cfg.TargetTable, "column", c.Target)
+			}
+		}
+	}
+
+	var err error
+	if plan.ordered, err = sourceOrdered(ctx, s.db, cfg); err != nil {
+		return plan, err
+	}
+	if cfg.IncrementalColumn != "" {
+		col, _ := incrementalColumn(cols, cfg.IncrementalColumn)
+		if plan.since, err = planColumnRange(ctx, s.db, targetDB, cfg, col); err != nil {
+			return plan, err
+		}
+	}
+	return plan, nil
+}
+
+func (s sqlSource) extract(ctx context.Context, cols []column, plan readPlan) (sourceRows, error) {
+	return openSourceRows(ctx, s.db, s.cfg, cols, plan)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const columnStatsTableName = "etl_column_stats"
+
+// Metrics for COLUMN_STATS. Null counts are cheap; distinct counts keep
+// every value of every column in memory for the run.
+const (
+	statNulls    = "nulls"
+	statDistinct = "distinct"
+	statMinMax   = "minmax"
+)
+
+// parseColumnStats parses COLUMN_STATS, a comma-separated list of metrics
+// or "all".
+func parseColumnStats(spec string) (map[string]bool, error) {
+	metrics := map[string]bool{}
+	for _, m := range strings.Split(spec, ",") {
+		m = strings.ToLower(strings.TrimSpace(m))
+		switch m {
+		case "":
+		case "all":
+			metrics[statNulls], metrics[statDistinct], metrics[statMinMax] = true, true, true
+		case statNulls, statDistinct, statMinMax:
+			metrics[m] = true
+		default:
+			return nil, fmt.Errorf("invalid COLUMN_STATS metric %q: expected nulls, distinct, minmax or all", m)
+		}
+	}
+	return metrics, nil
+}
+
+// columnProfile accumulates the metrics of one column over a run.
+type columnProfile struct {
+	nulls    int64
+	distinct map[string]struct{}
+	min, max any
+}
+
+// columnStats profiles the rows as they are written, so the figures
+// describe exactly what this run loaded, after transforms.
+type columnStats struct {
+	table    string
+	metrics  map[string]bool
+	cols     []column
+	rows     int64
+	profiles []columnProfile
+}
+
+func newColumnStats(cfg Config, cols []column) *columnStats {
+	if len(cfg.ColumnStats) == 0 {
+		return nil
+	}
+	metrics := cfg.ColumnStats
+	s := &columnStats{table: cfg.TargetTable, metrics: metrics, cols: cols, profiles: make([]columnProfile, len(cols))}
+	if metrics[statDistinct] {
+		for i := range s.profiles {
+			s.profiles[i].distinct = map[string]struct{}{}
+		}
+	}
+	return s
+}
+
+// add records one row. It is a no-op on a nil receiver so callers need not
+// check whether stats are enabled.
+func (s *columnStats) add(vals []any) {
+	if s == nil {
+		return
+	}
+	s.rows++
+	for i, c := range s.cols {
+		p := &s.profiles[i]
+		v := statValue(c, vals[i])
+		if v == nil {
+			p.nulls++
+			continue
+		}
+		if p.distinct != nil {
+			p.distinct[fmt.Sprint(v)] = struct{}{}
+		}
+		// Min/max would copy plaintext out of encrypted columns.
+		if s.metrics[statMinMax] && !c.Encrypted {
+			if p.min == nil || statLess(v, p.min) {
+				p.min = v
+			}
+			if p.max == nil || statLess(p.max, v) {
+				p.max = v
+			}
+		}
+	}
+}
+
+// statValue is the comparable form of a scanned value, or nil for NULL.
+func statValue(c column, v any) any {
+	if t, ok := v.(*sql.NullTime); ok && t.Valid {
+		return t.Time
+	}
+	return jsonValue(c, v)
+}
+
+// statLess orders two values of the same column. Numerics read with
+// NUMERIC_AS_STRING are compared as numbers, not as text.
+func statLess(a, b any) bool {
+	switch a := a.(type) {
+	case float64:
+		return a < b.(float64)
+	case int64:
+		return a < b.(int64)
+	case time.Time:
+		return a.Before(b.(time.Time))
+	case string:
+		ra, okA := new(big.Rat).SetString(a)
+		rb, okB := new(big.Rat).SetString(b.(string))
+		if okA && okB {
+			return ra.Cmp(rb) < 0
+		}
+		return a < b.(string)
+	}
+	return false
+}
+
+func statString(c column, v any) string {
+	if t, ok := v.(time.Time); ok {
+		return fmt.Sprint(jsonValue(c, &sql.NullTime{Time: t, Valid: true}))
+	}
+	return fmt.Sprint(v)
+}
+
+func ensureColumnStatsTable(ctx context.Context, tx execer) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			run_id VARCHAR(36) NOT NULL,
+			table_name VARCHAR(100) NOT NULL,
+			column_name VARCHAR(100) NOT NULL,
+			computed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			row_count BIGINT NOT NULL,
+			null_count BIGINT,
+			null_rate DOUBLE PRECISION,
+			distinct_count BIGINT,
+			min_value TEXT,
+			max_value TEXT,
+			PRIMARY KEY (run_id, table_name, column_name)
+		);
+	`, columnStatsTableName))
+	if err != nil {
+		return fmt.Errorf("failed to create column stats table: %w", err)
+	}
+	return nil
+}
+
+// save upserts the run's metrics into etl_column_stats. It runs in the
+// final load transaction, so the scorecard is stored only if the data is. Metrics that
+// were not requested are left NULL.
+func (s *columnStats) save(ctx context.Context, tx execer, runID string) error {
+	if s == nil {
+		return nil
+	}
+	if err := ensureColumnStatsTable(ctx, tx); err != nil {
+		return err
+	}
+
+	upsertSQL := fmt.Sprintf(`
+		INSERT INTO %s (run_id, table_name, column_name, row_count, null_count, null_rate, distinct_count, min_value, max_value)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (run_id, table_name, column_name) DO UPDATE SET
+			computed_at = now(), row_count = EXCLUDED.row_count,
+			null_count = EXCLUDED.null_count, null_rate = EXCLUDED.null_rate,
+			distinct_count = EXCLUDED.distinct_count,
+			min_value = EXCLUDED.min_value, max_value = EXCLUDED.max_value`, columnStatsTableName)
+
+	for i, c := range s.cols {
+		p := s.profiles[i]
+		var nulls, distinct sql.NullInt64
+		var nullRate sql.NullFloat64
+		var minVal, maxVal sql.NullString
+		if s.metrics[statNulls] {
+			nulls = sql.NullInt64{Int64: p.nulls, Valid: true}
+			if s.rows > 0 {
+				nullRate = sql.NullFloat64{Float64: float64(p.nulls) / float64(s.rows), Valid: true}
+			}
+		}
+		if p.distinct != nil {
+			distinct = sql.NullInt64{Int64: int64(len(p.distinct)), Valid: true}
+		}
+		if p.min != nil {
+			minVal = sql.NullString{String: statString(c, p.min), Valid: true}
+			maxVal = sql.NullString{String: statString(c, p.max), Valid: true}
+		}
+
+		if _, err := tx.ExecContext(ctx, upsertSQL, runID, s.table, c.Target, s.rows,
+			nulls, nullRate, distinct, minVal, maxVal); err != nil {
+			return fmt.Errorf("failed to save column stats for %s: %w", c.Target, err)
+		}
+	}
+	return nil
+}
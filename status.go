@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Process states reported by /status.
+const (
+	stateIdle    = "idle"
+	stateRunning = "running"
+	stateFailed  = "failed"
+)
+
+// tableStatus is the outcome of the last run into one target table.
+type tableStatus struct {
+	RunID    string    `json:"run_id,omitempty"`
+	LastRun  time.Time `json:"last_run"`
+	Duration float64   `json:"duration_seconds"`
+	Rows     int       `json:"rows"`
+	// The rows read from the source, and of those the ones written, the
+	// ones ON CONFLICT skipped, and the ones that could not be read or
+	// that the target refused.
+	RowsRead    int64 `json:"rows_read"`
+	RowsWritten int64 `json:"rows_written"`
+	RowsSkipped int64 `json:"rows_skipped"`
+	RowsErrored int64 `json:"rows_errored"`
+	// Watermark is where the next incremental run starts reading.
+	Watermark string `json:"watermark,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// processStatus is what the process has done since it started, for the
+// /healthz and /status endpoints. A failed run leaves the process failed
+// until a later run succeeds.
+type processStatus struct {
+	mu sync.Mutex
+
+	State     string                 `json:"state"`
+	Started   time.Time              `json:"started"`
+	LastRun   *time.Time             `json:"last_run,omitempty"`
+	NextRun   *time.Time             `json:"next_run,omitempty"`
+	Runs      int                    `json:"runs"`
+	Failures  int                    `json:"failures"`
+	LastError string                 `json:"last_error,omitempty"`
+	Tables    map[string]tableStatus `json:"tables"`
+}
+
+var etlStatus = &processStatus{State: stateIdle, Started: time.Now(), Tables: map[string]tableStatus{}}
+
+// runStarted marks the process as running. A failed earlier run stays in
+// LastError until a run succeeds.
+func (s *processStatus) runStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.State, s.LastRun, s.NextRun = stateRunning, &now, nil
+}
+
+func (s *processStatus) runFinished(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Runs++
+	if err != nil {
+		s.State, s.LastError = stateFailed, err.Error()
+		s.Failures++
+		return
+	}
+	s.State, s.LastError = stateIdle, ""
+}
+
+func (s *processStatus) scheduled(next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.NextRun = &next
+}
+
+// tableDone records the outcome of loading one table in run runID, with
+// the row counts since counts was taken.
+func (s *processStatus) tableDone(table, runID string, started time.Time, rows int, counts runCounts, err error) {
+	t := tableStatus{RunID: runID, LastRun: started, Duration: time.Since(started).Seconds(), Rows: rows, Watermark: takeWatermark(runID)}
+	t.RowsRead, t.RowsWritten, t.RowsSkipped, t.RowsErrored = counts.outcome()
+	if err != nil {
+		t.Error = err.Error()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Tables[table] = t
+}
+
+// writeStatus serves /status: the whole processStatus as JSON.
+func writeStatus(w http.ResponseWriter, _ *http.Request) {
+	etlStatus.mu.Lock()
+	defer etlStatus.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(etlStatus)
+}
+
+// writeHealth serves /healthz for load balancers and uptime monitors: 200
+// while the last run succeeded or none has finished yet, 503 after a
+// failed one.
+func writeHealth(w http.ResponseWriter, _ *http.Request) {
+	etlStatus.mu.Lock()
+	state, lastErr := etlStatus.State, etlStatus.LastError
+	etlStatus.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if state == stateFailed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		State string `json:"state"`
+		Error string `json:"error,omitempty"`
+	}{state, lastErr})
+}
+
+// tablesSince returns the tables whose last run started at or after t.
+func (s *processStatus) tablesSince(t time.Time) map[string]tableStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tables := map[string]tableStatus{}
+	for name, ts := range s.Tables {
+		if !ts.LastRun.Before(t) {
+			tables[name] = ts
+		}
+	}
+	return tables
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// stagingTableName is the shadow table a SWAP_LOAD run loads into.
+func stagingTableName(table string) string {
+	return table + "_staging"
+}
+
+// prepareStagingTable drops what a failed run left of the staging table and
+// creates it empty, as a copy of the live table's columns, defaults,
+// constraints and indexes.
+func prepareStagingTable(ctx context.Context, db *sql.DB, cfg Config) error {
+	staging := stagingTableName(cfg.TargetTable)
+	for _, stmt := range []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %s", staging),
+		fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING ALL)", staging, cfg.TargetTable),
+	} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to prepare staging table %s: %w", staging, err)
+		}
+	}
+	slog.Info("Staging table is ready", "table", cfg.TargetTable, "staging", staging)
+	return nil
+}
+
+// swapStagingTable replaces the live table with the loaded staging table in
+// one transaction: the live table is dropped and the staging table renamed
+// in its place, along with its indexes. Readers wait on the lock for the
+// moment it takes and then see the new table; they never see it half
+// loaded. Views on the live table make the DROP fail, which leaves both
+// tables as they were.
+func swapStagingTable(ctx context.Context, db *sql.DB, cfg Config) error {
+	staging := stagingTableName(cfg.TargetTable)
+	schema, live := splitTableName(cfg.TargetTable)
+	_, stagingName := splitTableName(staging)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to swap in %s: %w", staging, err)
+	}
+	defer tx.Rollback()
+	stmts := []string{
+		fmt.Sprintf("DROP TABLE %s", cfg.TargetTable),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", staging, live),
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to swap in %s: %s: %w", staging, stmt, err)
+		}
+	}
+
+	// LIKE names the copied indexes after the staging table; give them the
+	// live table's names back, so they do not pile up across runs.
+	rows, err := tx.QueryContext(ctx, `
+		SELECT c.relname
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		WHERE i.indrelid = to_regclass($1)`, cfg.TargetTable)
+	if err != nil {
+		return fmt.Errorf("failed to list the indexes of %s: %w", staging, err)
+	}
+	var indexes []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to list the indexes of %s: %w", staging, err)
+		}
+		indexes = append(indexes, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list the indexes of %s: %w", staging, err)
+	}
+	prefix := strings.ToLower(stagingName) + "_"
+	for _, name := range indexes {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		qualified := pq.QuoteIdentifier(name)
+		if schema != "" {
+			qualified = schema + "." + qualified
+		}
+		stmt := fmt.Sprintf("ALTER INDEX %s RENAME TO %s", qualified, pq.QuoteIdentifier(strings.ToLower(live)+"_"+strings.TrimPrefix(name, prefix)))
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to swap in %s: %s: %w", staging, stmt, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to swap in %s: %w", staging, err)
+	}
+	slog.Info("Swapped the staging table into place", "table", cfg.TargetTable, "staging", staging)
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// lagThrottle pauses the load while the target's streaming replicas are
+// further behind than max, so reporting queries on the replicas stay fresh
+// during big loads. Lag is sampled at most once per interval.
+type lagThrottle struct {
+	ctx      context.Context
+	db       *sql.DB
+	max      time.Duration
+	interval time.Duration
+
+	lastCheck time.Time
+	failed    bool
+
+	Engaged   int
+	Throttled time.Duration
+}
+
+func newLagThrottle(ctx context.Context, db *sql.DB, cfg Config) *lagThrottle {
+	return &lagThrottle{ctx: ctx, db: db, max: cfg.MaxReplicationLag, interval: cfg.ReplicationLagInterval}
+}
+
+// replicationLag returns the largest replay lag reported by the target's
+// replicas. It needs the pg_monitor role (or superuser) to see the lag columns.
+func (t *lagThrottle) replicationLag() (time.Duration, error) {
+	var seconds float64
+	err := t.db.QueryRowContext(t.ctx, `SELECT COALESCE(MAX(EXTRACT(EPOCH FROM replay_lag)), 0) FROM pg_stat_replication`).Scan(&seconds)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read replication lag: %w", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// wait blocks while replication lag is above the limit.
+func (t *lagThrottle) wait() {
+	if t == nil || t.failed || time.Since(t.lastCheck) < t.interval {
+		return
+	}
+
+	throttling := false
+	for {
+		lag, err := t.replicationLag()
+		t.lastCheck = time.Now()
+		if err != nil {
+			// Don't let monitoring stop the load; just stop throttling.
+			slog.Warn("Replication lag throttling disabled for this run", "error", err)
+			t.failed = true
+			return
+		}
+		if lag <= t.max {
+			if throttling {
+				slog.Info("Replication lag is back within the limit, resuming load", "lag", lag.Round(time.Millisecond))
+			}
+			return
+		}
+		if !throttling {
+			throttling = true
+			t.Engaged++
+			slog.Info("Replication lag is above the limit, pausing load", "lag", lag.Round(time.Millisecond), "limit", t.max)
+		}
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-time.After(t.interval):
+		}
+		t.Throttled += t.interval
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errSourceQueryTimeout is the cause of a source read cancelled by
+// SOURCE_QUERY_TIMEOUT. It is not retried: a rerun would most likely run
+// out of time again.
+var errSourceQueryTimeout = errors.New("source read exceeded SOURCE_QUERY_TIMEOUT")
+
+// statementGrace is how much longer than TARGET_STATEMENT_TIMEOUT the
+// client waits for a statement, so the server's own timeout, whose error
+// names the statement, normally comes first. The client deadline catches
+// a connection that stopped answering.
+const statementGrace = 10 * time.Second
+
+// statementContext bounds one statement sent to the target by
+// TARGET_STATEMENT_TIMEOUT, if set.
+func statementContext(ctx context.Context, cfg Config) (context.Context, context.CancelFunc) {
+	if cfg.TargetStatementTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, cfg.TargetStatementTimeout+statementGrace)
+}
+
+// targetSessionSetup is what every new target connection runs first: the
+// statement_timeout that makes Postgres cancel a runaway statement.
+func targetSessionSetup(cfg Config) []string {
+	if cfg.TargetStatementTimeout <= 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("SET statement_timeout = %d", cfg.TargetStatementTimeout.Milliseconds())}
+}
+
+// dsnConnector opens connections from a fixed connection string, like
+// sql.Open.
+type dsnConnector struct {
+	drv driver.Driver
+	dsn string
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) { return c.drv.Open(c.dsn) }
+
+func (c dsnConnector) Driver() driver.Driver { return c.drv }
+
+// sessionConnector runs setup on every connection inner makes, before the
+// pool hands it out.
+type sessionConnector struct {
+	inner driver.Connector
+	setup []string
+}
+
+func (c sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.inner.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("the database driver cannot run session setup statements")
+	}
+	for _, stmt := range c.setup {
+		if _, err := execer.ExecContext(ctx, stmt, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to set up the session: %s: %w", stmt, err)
+		}
+	}
+	return conn, nil
+}
+
+func (c sessionConnector) Driver() driver.Driver { return c.inner.Driver() }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var tokenizeInputs = []string{
+	"",
+	"FS-000123",
+	"Abebe Kebede",
+	"ACME plc, Addis Ababa 1000",
+	"Café Ñandú – 42", // non-ASCII passes through
+	"ቡና 7",
+}
+
+// class returns the tokenAlphabets index of c, or -1 for a character that
+// passes through.
+func class(c rune) int {
+	for i, alphabet := range tokenAlphabets {
+		if strings.ContainsRune(alphabet, c) {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestTokenizePreservesFormat(t *testing.T) {
+	tok := tokenizer{key: []byte("key-1")}
+	for _, s := range tokenizeInputs {
+		got := []rune(tok.Tokenize(s))
+		in := []rune(s)
+		if len(got) != len(in) {
+			t.Errorf("Tokenize(%q) = %q: %d characters, want %d", s, string(got), len(got), len(in))
+			continue
+		}
+		for i, c := range in {
+			if class(got[i]) != class(c) {
+				t.Errorf("Tokenize(%q) = %q: character %d changed class", s, string(got), i)
+			}
+			if class(c) < 0 && got[i] != c {
+				t.Errorf("Tokenize(%q) = %q: character %d %q did not pass through", s, string(got), i, c)
+			}
+		}
+	}
+}
+
+func TestTokenizeKeyed(t *testing.T) {
+	s := "FS-000123"
+	a := tokenizer{key: []byte("key-1")}
+	if x, y := a.Tokenize(s), a.Tokenize(s); x != y {
+		t.Errorf("same key gave %q and %q", x, y)
+	}
+	b := tokenizer{key: []byte("key-2")}
+	if x, y := a.Tokenize(s), b.Tokenize(s); x == y {
+		t.Errorf("different keys both gave %q", x)
+	}
+	if x := a.Tokenize(s); x == s {
+		t.Errorf("Tokenize(%q) left the value unchanged", s)
+	}
+}
+
+func TestDetokenize(t *testing.T) {
+	tok := tokenizer{key: []byte("key-1")}
+	for _, s := range tokenizeInputs {
+		if got := tok.Detokenize(tok.Tokenize(s)); got != s {
+			t.Errorf("Detokenize(Tokenize(%q)) = %q", s, got)
+		}
+	}
+}
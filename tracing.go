@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracerBatchSpans is how many ended spans are buffered before they are
+// exported, so a long run neither holds every span nor posts each one.
+const tracerBatchSpans = 512
+
+// tracerQueuedBatches is how many full batches may wait for the exporter.
+// Beyond that batches are dropped rather than holding up the load.
+const tracerQueuedBatches = 4
+
+// tracerTimeout bounds one export request, and how long the end of a run
+// waits for the last ones.
+const tracerTimeout = 10 * time.Second
+
+// OTLP span kinds and status codes.
+const (
+	otlpKindInternal = 1
+	otlpKindClient   = 3
+	otlpStatusError  = 2
+)
+
+// readOTLPSettings reads the standard OpenTelemetry exporter variables:
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is the full URL spans are posted to,
+// OTEL_EXPORTER_OTLP_ENDPOINT the base URL /v1/traces is added to, and
+// OTEL_EXPORTER_OTLP_HEADERS a list of key=value headers separated by ','.
+func readOTLPSettings() (endpoint string, headers map[string]string, err error) {
+	endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return "", nil, nil
+	}
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return "", nil, fmt.Errorf("invalid OTLP traces endpoint %q: expected an http:// or https:// URL (OTLP over gRPC is not supported)", endpoint)
+	}
+	for _, entry := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return "", nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry %q: expected key=value", entry)
+		}
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		// Values may be URL-encoded, as the specification allows.
+		if unescaped, err := url.QueryUnescape(strings.TrimSpace(v)); err == nil {
+			v = unescaped
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return endpoint, headers, nil
+}
+
+// tracer collects the spans of one run and exports them as OTLP/HTTP JSON
+// to OTEL_EXPORTER_OTLP_ENDPOINT, for a tracing backend to show next to
+// the database's own latency. Export is best effort, like OpenLineage: a
+// failure is logged and never fails the ETL. Batches are posted by a
+// goroutine of their own, so a slow or unreachable endpoint never stalls
+// the load.
+type tracer struct {
+	cfg     Config
+	traceID string
+	client  *http.Client
+	batches chan []map[string]any
+	done    chan struct{}
+
+	mu      sync.Mutex
+	spans   []map[string]any
+	dropped int
+}
+
+func newTracer(cfg Config) *tracer {
+	t := &tracer{cfg: cfg, traceID: randomHex(16), client: &http.Client{Timeout: tracerTimeout},
+		batches: make(chan []map[string]any, tracerQueuedBatches), done: make(chan struct{})}
+	go t.exportLoop()
+	return t
+}
+
+// span is one timed stage of a run. A nil span, as started without a
+// tracer, does nothing.
+type span struct {
+	t      *tracer
+	id     string
+	parent string
+	name   string
+	kind   int
+	start  time.Time
+	attrs  []any
+}
+
+type spanKey struct{}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startRunTrace starts the root span of a run, if tracing is configured,
+// and returns a context that the stages of the run start their spans
+// from.
+func startRunTrace(ctx context.Context, cfg Config, runID string) (context.Context, *span) {
+	if cfg.OTelEndpoint == "" {
+		return ctx, nil
+	}
+	t := newTracer(cfg)
+	root := &span{t: t, id: randomHex(8), name: "etl.run", kind: otlpKindInternal, start: time.Now(),
+		attrs: []any{"etl.table", cfg.TargetTable, "etl.run_id", runID, "etl.source", sourceName(cfg)}}
+	slog.Info("Tracing the run", "table", cfg.TargetTable, "run_id", runID, "trace_id", t.traceID)
+	return context.WithValue(ctx, spanKey{}, root), root
+}
+
+// startSpan starts a child of the span in ctx. attrs are key, value pairs.
+func startSpan(ctx context.Context, name string, attrs ...any) *span {
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		return nil
+	}
+	return &span{t: parent.t, id: randomHex(8), parent: parent.id, name: name, kind: otlpKindInternal, start: time.Now(), attrs: attrs}
+}
+
+// startDBSpan starts a span of a statement sent to a database, which
+// tracing backends show as a client call.
+func startDBSpan(ctx context.Context, name, system string, attrs ...any) *span {
+	s := startSpan(ctx, name, append([]any{"db.system", system}, attrs...)...)
+	if s != nil {
+		s.kind = otlpKindClient
+	}
+	return s
+}
+
+func (s *span) set(key string, value any) {
+	if s != nil {
+		s.attrs = append(s.attrs, key, value)
+	}
+}
+
+// end records the span, as failed if err is not nil.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.t.add(s.encode(time.Now(), err))
+}
+
+// endRun ends the root span of a run and exports what is left.
+func (s *span) endRun(rows int, err error) {
+	if s == nil {
+		return
+	}
+	s.set("etl.rows", rows)
+	s.end(err)
+	s.t.finish()
+}
+
+func (s *span) encode(end time.Time, err error) map[string]any {
+	attrs := make([]map[string]any, 0, len(s.attrs)/2)
+	for i := 0; i+1 < len(s.attrs); i += 2 {
+		attrs = append(attrs, otlpAttribute(fmt.Sprint(s.attrs[i]), s.attrs[i+1]))
+	}
+	out := map[string]any{
+		"traceId":           s.t.traceID,
+		"spanId":            s.id,
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+		"attributes":        attrs,
+	}
+	if s.parent != "" {
+		out["parentSpanId"] = s.parent
+	}
+	if err != nil {
+		out["status"] = map[string]any{"code": otlpStatusError, "message": err.Error()}
+	}
+	return out
+}
+
+// otlpAttribute encodes a key and value the way OTLP/JSON expects, with
+// 64-bit integers as strings.
+func otlpAttribute(key string, v any) map[string]any {
+	var value map[string]any
+	switch v := v.(type) {
+	case int:
+		value = map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		value = map[string]any{"doubleValue": v}
+	case bool:
+		value = map[string]any{"boolValue": v}
+	case time.Duration:
+		value = map[string]any{"doubleValue": float64(v) / float64(time.Millisecond)}
+	default:
+		value = map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+	return map[string]any{"key": key, "value": value}
+}
+
+// add buffers an ended span and hands a full batch to the exporter,
+// dropping it if the exporter is too far behind.
+func (t *tracer) add(encoded map[string]any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, encoded)
+	if len(t.spans) < tracerBatchSpans {
+		return
+	}
+	select {
+	case t.batches <- t.spans:
+	default:
+		t.dropped += len(t.spans)
+	}
+	t.spans = nil
+}
+
+func (t *tracer) exportLoop() {
+	defer close(t.done)
+	for spans := range t.batches {
+		if err := t.post(spans); err != nil {
+			slog.Warn("Failed to export trace spans", "table", t.cfg.TargetTable, "spans", len(spans), "error", err)
+		}
+	}
+}
+
+// finish exports the spans left at the end of a run. It waits for the
+// exporter for at most one request timeout, so an unreachable endpoint
+// does not hold up the end of the run either.
+func (t *tracer) finish() {
+	t.mu.Lock()
+	spans, dropped := t.spans, t.dropped
+	t.spans = nil
+	t.mu.Unlock()
+	if dropped > 0 {
+		slog.Warn("The trace exporter fell behind; spans were dropped", "table", t.cfg.TargetTable, "spans", dropped)
+	}
+	if len(spans) > 0 {
+		select {
+		case t.batches <- spans:
+		default:
+			slog.Warn("The trace exporter fell behind; spans were dropped", "table", t.cfg.TargetTable, "spans", len(spans))
+		}
+	}
+	close(t.batches)
+	select {
+	case <-t.done:
+	case <-time.After(tracerTimeout):
+		slog.Warn("Gave up waiting for the trace exporter", "table", t.cfg.TargetTable)
+	}
+}
+
+func (t *tracer) post(spans []map[string]any) error {
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []any{
+				otlpAttribute("service.name", t.cfg.OTelServiceName),
+			}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": openLineageProducer},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.cfg.OTelEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.OTelHeaders {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Stages of a row that batchTrace adds up.
+const (
+	stageTimeRead = iota
+	stageTimeTransform
+	stageTimeWrite
+	stageTimes
+)
+
+// batchTrace reports the load in spans of BATCH_SIZE rows. Reading,
+// transforming and writing alternate for every row, too quickly for a
+// span each, so a batch span carries the time spent in each stage as
+// attributes. A nil batchTrace does nothing.
+type batchTrace struct {
+	ctx   context.Context
+	size  int
+	span  *span
+	rows  int
+	last  time.Time
+	times [stageTimes]time.Duration
+}
+
+func newBatchTrace(ctx context.Context, size int) *batchTrace {
+	if ctx.Value(spanKey{}) == nil {
+		return nil
+	}
+	b := &batchTrace{ctx: ctx, size: size}
+	b.skip()
+	return b
+}
+
+// lap adds the time since the last lap to stage.
+func (b *batchTrace) lap(stage int) {
+	if b == nil {
+		return
+	}
+	now := time.Now()
+	if b.span == nil {
+		b.span = startSpan(b.ctx, "load.batch")
+		b.span.start = b.last
+	}
+	b.times[stage] += now.Sub(b.last)
+	b.last = now
+}
+
+// skip leaves the time since the last lap out of the batch, e.g. a commit,
+// which has a span of its own.
+func (b *batchTrace) skip() {
+	if b != nil {
+		b.last = time.Now()
+	}
+}
+
+// written counts a written row and ends the batch span every BATCH_SIZE
+// rows.
+func (b *batchTrace) written() {
+	if b == nil {
+		return
+	}
+	b.rows++
+	if b.rows >= b.size {
+		b.end(nil)
+	}
+}
+
+// end ends the batch span, unless it has nothing to report.
+func (b *batchTrace) end(err error) {
+	if b == nil || b.span == nil {
+		return
+	}
+	if b.rows == 0 && err == nil {
+		b.span = nil
+		b.times = [stageTimes]time.Duration{}
+		return
+	}
+	b.span.set("etl.rows", b.rows)
+	b.span.set("etl.read_ms", b.times[stageTimeRead])
+	b.span.set("etl.transform_ms", b.times[stageTimeTransform])
+	b.span.set("etl.write_ms", b.times[stageTimeWrite])
+	b.span.end(err)
+	b.span, b.rows, b.times = nil, 0, [stageTimes]time.Duration{}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// Text sanitization policies for SANITIZE_TEXT.
+const (
+	sanitizeOff     = "off"
+	sanitizeStrip   = "strip"
+	sanitizeReplace = "replace"
+)
+
+// sanitizeText removes (or replaces) null bytes and other control characters
+// that Postgres or downstream CSV/JSON consumers choke on. Tabs and line
+// breaks are kept. It reports whether the value was changed.
+func sanitizeText(s, policy, replacement string) (string, bool) {
+	if policy == sanitizeOff || strings.IndexFunc(s, isUnwantedControl) < 0 {
+		return s, false
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		if !isUnwantedControl(r) {
+			b.WriteRune(r)
+		} else if policy == sanitizeReplace {
+			b.WriteString(replacement)
+		}
+	}
+	return b.String(), true
+}
+
+func isUnwantedControl(r rune) bool {
+	return unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r'
+}
+
+// lookupEncoding resolves SOURCE_ENCODING. UTF-8 needs no transcoding and
+// returns nil.
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown encoding %q: %w", name, err)
+	}
+	if enc == nil {
+		return nil, fmt.Errorf("encoding %q is not supported", name)
+	}
+	if canonical, _ := ianaindex.IANA.Name(enc); canonical == "UTF-8" {
+		return nil, nil
+	}
+	return enc, nil
+}
+
+// transformStats counts what the transform step changed during a run.
+type transformStats struct {
+	Sanitized  int
+	Transcoded int
+}
+
+// transformRow applies the configured cleanups and column transforms to a
+// scanned row in place.
+func transformRow(cfg Config, cols []column, vals []any, stats *transformStats) {
+	for i, v := range vals {
+		s, ok := v.(*sql.NullString)
+		if ok && s.Valid && cols[i].isText() {
+			// Values that are already valid UTF-8 were decoded by the driver from
+			// the column collation; decoding them again would double-encode them.
+			if cfg.SourceEncoding != nil && !utf8.ValidString(s.String) {
+				// The charmap decoders map every byte, so this does not fail in practice.
+				if decoded, err := cfg.SourceEncoding.NewDecoder().String(s.String); err == nil {
+					s.String = decoded
+					stats.Transcoded++
+				}
+			}
+			if clean, changed := sanitizeText(s.String, cfg.SanitizeText, cfg.SanitizeReplacement); changed {
+				s.String = clean
+				stats.Sanitized++
+			}
+		}
+		for _, f := range cols[i].funcs {
+			vals[i] = f(vals[i])
+		}
+		if cols[i].Tokenized && s.Valid {
+			s.String = tokenizer{key: []byte(cfg.TokenizationKey)}.Tokenize(s.String)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// TestTransformRowSourceEncoding checks that SOURCE_ENCODING transcodes
+// legacy bytes and leaves text the driver already decoded alone.
+func TestTransformRowSourceEncoding(t *testing.T) {
+	enc, err := lookupEncoding("windows-1252")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{SourceEncoding: enc, SanitizeText: sanitizeOff}
+	cols := []column{{Source: "customer", Target: "customer", Type: "VARCHAR(100)"}}
+
+	tests := []struct {
+		name       string
+		in, want   string
+		transcoded int
+	}{
+		{"cp1252", "caf\xe9", "café", 1},
+		{"already UTF-8", "café", "café", 0},
+		{"ASCII", "cafe", "cafe", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &sql.NullString{String: tt.in, Valid: true}
+			var stats transformStats
+			transformRow(cfg, cols, []any{v}, &stats)
+			if v.String != tt.want {
+				t.Errorf("transformRow(%q) = %q, want %q", tt.in, v.String, tt.want)
+			}
+			if stats.Transcoded != tt.transcoded {
+				t.Errorf("Transcoded = %d, want %d", stats.Transcoded, tt.transcoded)
+			}
+		})
+	}
+}
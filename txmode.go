@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Transaction modes for TX_MODE.
+const (
+	// txSingle loads the whole run in one transaction: all or nothing.
+	txSingle = "single"
+	// txPerBatch commits every CommitEvery rows.
+	txPerBatch = "per-batch"
+	// txAutocommit writes without a transaction, so every statement (a row,
+	// or a batch with WRITE_METHOD=json) commits on its own.
+	txAutocommit = "autocommit"
+)
+
+// execer is the part of *sql.Tx and *sql.DB the writers use, so they can
+// write inside a transaction or, with TX_MODE=autocommit, without one.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// loadTarget is the rowSink of the Postgres target table. It holds the
+// open transaction (if any) and writer of a load and commits as often as
+// TX_MODE asks for.
+type loadTarget struct {
+	ctx      context.Context
+	db       *sql.DB
+	cfg      Config
+	cols     []column
+	throttle *lagThrottle
+	publish  *kafkaPublisher
+	parts    *partitioner
+	mirror   bool // a MIRROR_TARGETS copy, left out of the metrics
+	known    rowHashes
+
+	tx        *sql.Tx
+	target    execer
+	writer    rowWriter
+	dead      *deadLetters
+	committed int
+	chunks    int // transactions committed
+	conflicts int // from writers already committed
+	refused   int // rows dead-lettered by the target, as of the last commit
+	unchanged int // rows of this batch skipped by their ROW_HASH
+	started   time.Time
+}
+
+// begin starts a transaction, unless in autocommit mode, and prepares a
+// writer on it.
+func (l *loadTarget) begin() error {
+	l.started = time.Now()
+	l.target = l.db
+	if l.cfg.DryRun {
+		writer, err := newDryRunWriter(l.ctx, l.db, l.cfg, l.cols, l.committed)
+		if err != nil {
+			return err
+		}
+		l.writer = writer
+		return nil
+	}
+	if l.cfg.TxMode != txAutocommit {
+		tx, err := l.db.BeginTx(l.ctx, &sql.TxOptions{Isolation: l.cfg.TargetIsolation})
+		if err != nil {
+			return fmt.Errorf("failed to start target transaction: %w", err)
+		}
+		l.tx, l.target = tx, tx
+	}
+
+	writer, err := newRowWriter(l.ctx, l.target, l.cfg, l.cols, l.dead)
+	if err != nil {
+		return err
+	}
+	l.writer = writer
+	return nil
+}
+
+// write waits out replication lag, then writes one row. A row whose
+// ROW_HASH the target already has is skipped, and counts as a conflict the
+// upsert would have left alone.
+func (l *loadTarget) write(vals []any) error {
+	if l.known.unchanged(l.cols, vals) {
+		l.unchanged++
+		return nil
+	}
+	l.throttle.wait()
+	if err := l.parts.ensure(l.target, vals); err != nil {
+		return err
+	}
+	if err := l.writer.Write(vals); err != nil {
+		return fmt.Errorf("error executing insert statement: %w", err)
+	}
+	l.publish.add(vals)
+	return nil
+}
+
+func (l *loadTarget) flush() error {
+	if err := l.writer.Flush(); err != nil {
+		return fmt.Errorf("error executing insert statement: %w", err)
+	}
+	return nil
+}
+
+func (l *loadTarget) state() execer { return l.target }
+
+func (l *loadTarget) rejectScan(rows sourceRows, err error) (bool, error) {
+	if l.dead == nil {
+		return false, nil
+	}
+	return true, l.dead.rejectScan(l.ctx, l.target, rows, err)
+}
+
+func (l *loadTarget) rejectRow(stage string, vals []any, reason error) (bool, error) {
+	if l.dead == nil {
+		return false, nil
+	}
+	return true, l.dead.rejectRow(l.ctx, l.target, stage, vals, reason)
+}
+
+func (l *loadTarget) report(res *loadResult) {
+	res.conflicts = l.conflicts
+	res.rejected = l.dead.count(stageScan) + l.dead.count(stageInsert)
+	if l.throttle != nil {
+		res.engaged, res.throttled = l.throttle.Engaged, l.throttle.Throttled
+	}
+}
+
+// batchDone reports whether the rows written so far should be committed
+// before the load continues.
+func (l *loadTarget) batchDone(rows int) bool {
+	return l.cfg.TxMode == txPerBatch && rows%l.cfg.CommitEvery == 0
+}
+
+// commit flushes the writer and commits everything up to rows. The rows
+// are published to KAFKA_TOPIC just before, so a failed publish rolls the
+// batch back and a failed commit can only leave extra messages.
+func (l *loadTarget) commit(rows int) error {
+	if err := l.writer.Flush(); err != nil {
+		return fmt.Errorf("error executing insert statement: %w", err)
+	}
+	if err := l.publish.send(); err != nil {
+		return err
+	}
+	conflicts := l.writer.Conflicts() + l.unchanged
+	l.unchanged = 0
+	l.writer.Close()
+	l.writer = nil
+
+	if l.tx != nil {
+		sp := startDBSpan(l.ctx, "commit", "postgresql", "etl.rows", rows-l.committed)
+		err := l.tx.Commit()
+		sp.end(err)
+		if err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		l.tx = nil
+	}
+	l.parts.committed()
+	l.conflicts += conflicts
+	if l.cfg.DryRun || l.mirror {
+		l.committed = rows
+		return nil
+	}
+	refused := l.dead.count(stageInsert) - l.refused
+	l.refused += refused
+	etlMetrics.rowsInserted.add(l.cfg.TargetTable, float64(rows-l.committed-conflicts-refused))
+	etlMetrics.rowsConflicted.add(l.cfg.TargetTable, float64(conflicts))
+	etlMetrics.rowsRejected.add(l.cfg.TargetTable, float64(refused))
+	etlMetrics.batchDuration.observe(l.cfg.TargetTable, time.Since(l.started))
+	l.chunks++
+	slog.Debug("Committed batch", "table", l.cfg.TargetTable, "batch", l.chunks, "rows", rows-l.committed, "rows_committed", rows, "conflicts", conflicts, "duration", time.Since(l.started))
+	l.committed = rows
+	return nil
+}
+
+// abort rolls back whatever has not been committed. It does nothing after
+// the final commit.
+func (l *loadTarget) abort() {
+	l.publish.discard()
+	if l.writer == nil {
+		return
+	}
+	l.writer.Close()
+	if l.tx != nil {
+		l.tx.Rollback()
+		l.parts.rolledBack()
+	}
+	if l.cfg.DryRun {
+		return
+	}
+	switch l.cfg.TxMode {
+	case txPerBatch:
+		slog.Warn("TX_MODE=per-batch: the batches committed before the failure stay; a rerun skips them", "table", l.cfg.TargetTable, "batches_committed", l.chunks, "rows_committed", l.committed)
+	case txAutocommit:
+		slog.Warn("TX_MODE=autocommit: every row written before the failure stays committed; a rerun skips them", "table", l.cfg.TargetTable)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// columnRange is the slice of INCREMENTAL_COLUMN values one incremental run
+// reads: from the stored watermark (inclusive, nil on the first run) up to
+// the column's maximum when the run started (inclusive).
+type columnRange struct {
+	col      column
+	from, to any
+}
+
+// watermarkScope keys the watermark of an incremental column.
+func watermarkScope(cfg Config, col column) string {
+	return cfg.TargetTable + ":" + col.Target
+}
+
+// incrementalColumn finds INCREMENTAL_COLUMN (a source or target name) in
+// the mapping.
+func incrementalColumn(cols []column, name string) (column, bool) {
+	for _, c := range cols {
+		if c.Generated == "" && !c.computed() && (c.Source == name || c.Target == name) {
+			return c, true
+		}
+	}
+	return column{}, false
+}
+
+// watermarkText and parseWatermark convert a watermark to and from the
+// text stored in etl_watermarks.
+func watermarkText(v any) string {
+	switch v := v.(type) {
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func parseWatermark(col column, s string) (any, error) {
+	switch col.kind() {
+	case kindTime:
+		return parseTimestamp(s)
+	case kindNumeric:
+		if col.RawNumeric {
+			return s, nil
+		}
+		return strconv.ParseFloat(s, 64)
+	}
+	return s, nil
+}
+
+// planColumnRange reads the stored watermark and the column's current
+// maximum on the source. The range is inclusive at both ends: rows that
+// share the boundary value are read again on the next run and skipped by
+// ON CONFLICT, instead of being missed when they arrive after this run.
+// It returns nil when the source has no values to read.
+func planColumnRange(ctx context.Context, sourceDB, targetDB *sql.DB, cfg Config, col column) (*columnRange, error) {
+	exists, err := watermarksReadable(ctx, targetDB, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r := columnRange{col: col}
+	if exists {
+		var stored string
+		err := targetDB.QueryRowContext(ctx, fmt.Sprintf("SELECT value FROM %s WHERE scope = $1 AND value IS NOT NULL", watermarksTableName),
+			watermarkScope(cfg, col)).Scan(&stored)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return nil, fmt.Errorf("failed to read watermark: %w", err)
+		default:
+			if r.from, err = parseWatermark(col, stored); err != nil {
+				return nil, fmt.Errorf("invalid stored watermark %q for %s: %w", stored, col.Target, err)
+			}
+		}
+	}
+
+	max := col.scanDest()
+	if err := sourceDB.QueryRowContext(ctx, fmt.Sprintf("SELECT MAX(%s) FROM %s", col.Source, cfg.SourceTable)).Scan(max); err != nil {
+		return nil, fmt.Errorf("failed to read current maximum of %s: %w", col.Source, err)
+	}
+	if r.to = statValue(col, max); r.to == nil {
+		slog.Info("Incremental column has no values yet; reading the source in full", "table", cfg.TargetTable, "column", col.Source)
+		return nil, nil
+	}
+
+	if r.from == nil {
+		slog.Info("No watermark yet; reading rows up to the current maximum", "table", cfg.TargetTable, "column", col.Source, "to", watermarkText(r.to))
+	} else {
+		slog.Info("Reading rows within the watermark range", "table", cfg.TargetTable, "column", col.Source, "from", watermarkText(r.from), "to", watermarkText(r.to))
+	}
+	return &r, nil
+}
+
+// saveWatermark stores the upper bound of a finished read as the next
+// run's starting point. It runs in the final load transaction.
+func saveWatermark(ctx context.Context, db execer, cfg Config, r *columnRange) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s (scope, value) VALUES ($1, $2)
+		ON CONFLICT (scope) DO UPDATE SET value = EXCLUDED.value, updated_at = now()`, watermarksTableName),
+		watermarkScope(cfg, r.col), watermarkText(r.to))
+	if err != nil {
+		return fmt.Errorf("failed to save watermark: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var numericTypeRe = regexp.MustCompile(`(?i)^\s*NUMERIC\s*\(\s*(\d+)\s*,\s*(\d+)\s*\)\s*$`)
+
+// isNumericOverflow reports whether err is Postgres' "numeric field overflow".
+func isNumericOverflow(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "22003"
+}
+
+// integerDigits counts the digits left of the decimal point once v is
+// rounded to scale, which is what NUMERIC(p, s) has room for in p - s.
+func integerDigits(v *big.Rat, scale int) int {
+	s := new(big.Rat).Abs(v).FloatString(scale)
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		s = s[:i]
+	}
+	return len(strings.TrimLeft(s, "0"))
+}
+
+// numericValue extracts a scanned numeric value, whether it was read as a
+// float or, with NUMERIC_AS_STRING, as text.
+func numericValue(v any) (*big.Rat, bool) {
+	switch v := v.(type) {
+	case *sql.NullFloat64:
+		if v.Valid && !math.IsInf(v.Float64, 0) && !math.IsNaN(v.Float64) {
+			return new(big.Rat).SetFloat64(v.Float64), true
+		}
+	case *sql.NullString:
+		if v.Valid {
+			return new(big.Rat).SetString(strings.TrimSpace(v.String))
+		}
+	}
+	return nil, false
+}
+
+// widenForRow alters every NUMERIC column whose value in vals does not fit
+// its declared precision, keeping the scale. cols is updated to the new
+// types. It fails without altering anything if a column would need more
+// than maxPrecision digits.
+func widenForRow(ctx context.Context, tx execer, cfg Config, cols []column, vals []any) (bool, error) {
+	type change struct {
+		idx          int
+		newPrecision int
+		scale        int
+	}
+	var changes []change
+
+	for i, c := range cols {
+		m := numericTypeRe.FindStringSubmatch(c.Type)
+		v, ok := numericValue(vals[i])
+		if m == nil || c.Encrypted || !ok {
+			continue
+		}
+		precision, _ := strconv.Atoi(m[1])
+		scale, _ := strconv.Atoi(m[2])
+
+		need := integerDigits(v, scale) + scale
+		if need <= precision {
+			continue
+		}
+		if need > cfg.AutoWidenMaxPrecision {
+			return false, fmt.Errorf("column %s needs NUMERIC(%d, %d), above AUTO_WIDEN_MAX_PRECISION %d", c.Target, need, scale, cfg.AutoWidenMaxPrecision)
+		}
+		changes = append(changes, change{idx: i, newPrecision: need, scale: scale})
+	}
+
+	tables := []string{cfg.TargetTable}
+	if cfg.ConflictAction == conflictSCD2 {
+		tables = append(tables, cfg.HistoryTable)
+	}
+
+	for _, ch := range changes {
+		c := &cols[ch.idx]
+		newType := fmt.Sprintf("NUMERIC(%d, %d)", ch.newPrecision, ch.scale)
+		for _, table := range tables {
+			ddl := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", table, c.Target, newType)
+			if _, err := tx.ExecContext(ctx, ddl); err != nil {
+				return false, fmt.Errorf("failed to widen %s.%s: %w", table, c.Target, err)
+			}
+			slog.Warn("AUTO_WIDEN widened a column", "table", table, "column", c.Target, "from", c.Type, "to", newType)
+		}
+		c.Type = newType
+	}
+
+	return len(changes) > 0, nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Write methods for WRITE_METHOD.
+const (
+	writeInsert = "insert"
+	// writeJSON sends each batch as one JSON array and inserts it with
+	// jsonb_to_recordset, so a batch costs one parameter and one round-trip.
+	writeJSON = "json"
+	// writeCopy streams each batch with the COPY protocol and only falls
+	// back to per-row inserts for batches COPY cannot take as a whole.
+	writeCopy = "copy"
+)
+
+// rowWriter loads transformed source rows into the target inside the load
+// transaction. Write may buffer; Flush must be called before commit.
+// Conflicts counts the rows written so far that ON CONFLICT left alone.
+type rowWriter interface {
+	Write(vals []any) error
+	Flush() error
+	Close() error
+	Conflicts() int
+}
+
+func newRowWriter(ctx context.Context, target execer, cfg Config, cols []column, dead *deadLetters) (rowWriter, error) {
+	if cfg.WriteMethod == writeCopy {
+		tx, ok := target.(*sql.Tx)
+		if !ok {
+			return nil, fmt.Errorf("WRITE_METHOD=copy needs a transaction")
+		}
+		return &copyWriter{ctx: ctx, tx: tx, cfg: cfg, cols: cols, dead: dead}, nil
+	}
+	if cfg.WriteMethod == writeJSON {
+		stmt, err := target.PrepareContext(ctx, buildJSONInsertSQL(cfg, cols))
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare insert statement: %w", err)
+		}
+		return &jsonWriter{ctx: ctx, stmt: stmt, cfg: cfg, cols: cols}, nil
+	}
+
+	stmt, err := target.PrepareContext(ctx, buildInsertSQL(cfg, cols))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare insert statement: %w", err)
+	}
+	return &insertWriter{ctx: ctx, target: target, stmt: stmt, cfg: cfg, cols: cols, dead: dead}, nil
+}
+
+// insertWriter executes one prepared INSERT per row. With DEAD_LETTER a row
+// the target rejects goes to dead instead of failing the load.
+type insertWriter struct {
+	ctx       context.Context
+	target    execer
+	stmt      *sql.Stmt
+	cfg       Config
+	cols      []column
+	dead      *deadLetters
+	conflicts int
+}
+
+func (w *insertWriter) Write(vals []any) error {
+	args := vals
+	if hasEncrypted(w.cols) {
+		args = append(args, w.cfg.EncryptionKey)
+	}
+
+	affected, err := execInsert(w.ctx, w.target, w.stmt, w.cfg, w.cols, vals, args)
+	if err != nil && w.dead != nil && isDataError(err) {
+		return w.dead.rejectInsert(w.ctx, w.target, vals, err)
+	}
+	if err != nil {
+		slog.Error("Failed to insert row", "table", w.cfg.TargetTable, "key", rowKey(w.cols, vals), "error", err)
+		return err
+	}
+	if affected == 0 {
+		w.conflicts++
+	}
+	return nil
+}
+
+func (w *insertWriter) Flush() error { return nil }
+
+func (w *insertWriter) Close() error { return w.stmt.Close() }
+
+func (w *insertWriter) Conflicts() int { return w.conflicts }
+
+// execInsert runs the insert for one row and returns how many rows it
+// inserted or updated (0 on a conflict). With AUTO_WIDEN the insert runs
+// under a savepoint, so a numeric overflow can be undone, the column widened
+// and the row retried without losing the rest of the transaction. With
+// DEAD_LETTER a row the target rejects is rolled back to the savepoint, so
+// the transaction can go on. Outside a transaction (TX_MODE=autocommit) the
+// failed insert has no effect, so no savepoint is needed.
+func execInsert(ctx context.Context, target execer, stmt *sql.Stmt, cfg Config, cols []column, vals, args []any) (int64, error) {
+	ctx, cancel := statementContext(ctx, cfg)
+	defer cancel()
+	tx, inTx := target.(*sql.Tx)
+	if !cfg.AutoWiden && (!cfg.DeadLetter || !inTx) {
+		return rowsAffected(stmt.ExecContext(ctx, args...))
+	}
+	if !inTx {
+		affected, err := rowsAffected(stmt.ExecContext(ctx, args...))
+		if err != nil && isNumericOverflow(err) {
+			widened, wErr := widenForRow(ctx, target, cfg, cols, vals)
+			if wErr != nil {
+				return 0, fmt.Errorf("%w (auto-widen: %v)", err, wErr)
+			}
+			if widened {
+				affected, err = rowsAffected(stmt.ExecContext(ctx, args...))
+			}
+		}
+		return affected, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT etl_row"); err != nil {
+		return 0, err
+	}
+	affected, err := rowsAffected(stmt.ExecContext(ctx, args...))
+	if err != nil && cfg.AutoWiden && isNumericOverflow(err) {
+		if _, rbErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT etl_row"); rbErr != nil {
+			return 0, rbErr
+		}
+		widened, wErr := widenForRow(ctx, tx, cfg, cols, vals)
+		if wErr != nil {
+			return 0, fmt.Errorf("%w (auto-widen: %v)", err, wErr)
+		}
+		if widened {
+			affected, err = rowsAffected(stmt.ExecContext(ctx, args...))
+		}
+	}
+	if err != nil && cfg.DeadLetter && isDataError(err) {
+		if _, rbErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT etl_row"); rbErr != nil {
+			return 0, rbErr
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT etl_row")
+	return affected, err
+}
+
+// rowsAffected unwraps the result of an Exec into its row count.
+func rowsAffected(res sql.Result, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// jsonWriter buffers BatchSize rows and inserts them with one statement.
+type jsonWriter struct {
+	ctx       context.Context
+	stmt      *sql.Stmt
+	cfg       Config
+	cols      []column
+	batch     []map[string]any
+	conflicts int
+}
+
+func (w *jsonWriter) Write(vals []any) error {
+	row := make(map[string]any, len(w.cols))
+	for i, c := range w.cols {
+		row[c.Target] = jsonValue(c, vals[i])
+	}
+	w.batch = append(w.batch, row)
+
+	if len(w.batch) >= w.cfg.BatchSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+func (w *jsonWriter) Flush() (err error) {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	sp := startDBSpan(w.ctx, "insert.batch", "postgresql", "etl.rows", len(w.batch), "etl.write_method", writeJSON)
+	defer func() { sp.end(err) }()
+
+	payload, err := json.Marshal(w.batch)
+	if err != nil {
+		return fmt.Errorf("failed to encode batch as JSON: %w", err)
+	}
+	args := []any{string(payload)}
+	if hasEncrypted(w.cols) {
+		args = append(args, w.cfg.EncryptionKey)
+	}
+
+	ctx, cancel := statementContext(w.ctx, w.cfg)
+	defer cancel()
+	inserted, err := rowsAffected(w.stmt.ExecContext(ctx, args...))
+	if err != nil {
+		slog.Error("Failed to insert batch", "table", w.cfg.TargetTable, "rows", len(w.batch), "first_key", w.batch[0][keyOf(w.cols).Target], "error", err)
+		return err
+	}
+	w.conflicts += len(w.batch) - int(inserted)
+	w.batch = w.batch[:0]
+	return nil
+}
+
+func (w *jsonWriter) Close() error { return w.stmt.Close() }
+
+func (w *jsonWriter) Conflicts() int { return w.conflicts }
+
+// copyWriter buffers BatchSize rows and loads them with COPY under a
+// savepoint. COPY has no ON CONFLICT, so if a batch hits an existing key
+// (or a numeric overflow AUTO_WIDEN should handle) it is rolled back and
+// retried row by row with the normal INSERT.
+type copyWriter struct {
+	ctx      context.Context
+	tx       *sql.Tx
+	cfg      Config
+	cols     []column
+	batch    [][]any
+	dead     *deadLetters
+	fallback *insertWriter
+	fellBack int
+}
+
+func (w *copyWriter) Write(vals []any) error {
+	w.batch = append(w.batch, vals)
+	if len(w.batch) >= w.cfg.BatchSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+func (w *copyWriter) Flush() (err error) {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	sp := startDBSpan(w.ctx, "insert.batch", "postgresql", "etl.rows", len(w.batch), "etl.write_method", writeCopy)
+	defer func() { sp.end(err) }()
+	if _, err := w.tx.ExecContext(w.ctx, "SAVEPOINT etl_copy"); err != nil {
+		return err
+	}
+
+	err = w.copyBatch()
+	if err != nil && (isUniqueViolation(err) || isNumericOverflow(err) || w.dead != nil && isDataError(err)) {
+		sp.set("etl.fell_back", true)
+		if _, rbErr := w.tx.ExecContext(w.ctx, "ROLLBACK TO SAVEPOINT etl_copy"); rbErr != nil {
+			return rbErr
+		}
+		err = w.insertBatch()
+	}
+	if err != nil {
+		slog.Error("Failed to copy batch", "table", w.cfg.TargetTable, "rows", len(w.batch), "first_key", rowKey(w.cols, w.batch[0]), "error", err)
+		return err
+	}
+	if _, err := w.tx.ExecContext(w.ctx, "RELEASE SAVEPOINT etl_copy"); err != nil {
+		return err
+	}
+	w.batch = w.batch[:0]
+	return nil
+}
+
+func (w *copyWriter) copyBatch() error {
+	// pq.CopyIn quotes identifiers, so use the folded names Postgres gave
+	// the unquoted ones in the DDL.
+	targets := make([]string, len(w.cols))
+	for i, c := range w.cols {
+		targets[i] = strings.ToLower(c.Target)
+	}
+	ctx, cancel := statementContext(w.ctx, w.cfg)
+	defer cancel()
+	stmt, err := w.tx.PrepareContext(ctx, pq.CopyIn(strings.ToLower(w.cfg.TargetTable), targets...))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, vals := range w.batch {
+		if _, err := stmt.ExecContext(ctx, vals...); err != nil {
+			return err
+		}
+	}
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+func (w *copyWriter) insertBatch() error {
+	if w.fallback == nil {
+		stmt, err := w.tx.PrepareContext(w.ctx, buildInsertSQL(w.cfg, w.cols))
+		if err != nil {
+			return fmt.Errorf("failed to prepare insert statement: %w", err)
+		}
+		w.fallback = &insertWriter{ctx: w.ctx, target: w.tx, stmt: stmt, cfg: w.cfg, cols: w.cols, dead: w.dead}
+	}
+	w.fellBack++
+	for _, vals := range w.batch {
+		if err := w.fallback.Write(vals); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *copyWriter) Close() error {
+	if w.fellBack > 0 {
+		slog.Info("WRITE_METHOD=copy: some batches fell back to per-row inserts", "table", w.cfg.TargetTable, "batches", w.fellBack)
+	}
+	if w.fallback != nil {
+		return w.fallback.Close()
+	}
+	return nil
+}
+
+func (w *copyWriter) Conflicts() int {
+	if w.fallback == nil {
+		return 0
+	}
+	return w.fallback.Conflicts()
+}
+
+// isUniqueViolation reports whether err is Postgres' unique_violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// jsonValue converts a scanned value into something Postgres parses back
+// into the column type from JSON.
+func jsonValue(c column, v any) any {
+	switch v := v.(type) {
+	case *sql.NullString:
+		if v.Valid {
+			return v.String
+		}
+	case *sql.NullFloat64:
+		if v.Valid {
+			return v.Float64
+		}
+	case *sql.NullInt64:
+		if v.Valid {
+			return v.Int64
+		}
+	case *sql.NullTime:
+		if v.Valid {
+			if strings.HasPrefix(strings.ToUpper(c.Type), "DATE") {
+				return v.Time.Format("2006-01-02")
+			}
+			return v.Time.Format(time.RFC3339Nano)
+		}
+	}
+	return nil
+}
+
+// buildJSONInsertSQL returns the batch INSERT for WRITE_METHOD=json. $1 is
+// the JSON array of rows keyed by target column; if any column is
+// encrypted the encryption key follows as $2.
+func buildJSONInsertSQL(cfg Config, cols []column) string {
+	targets := make([]string, len(cols))
+	selects := make([]string, len(cols))
+	defs := make([]string, len(cols))
+	for i, c := range cols {
+		targets[i] = c.Target
+		defs[i] = fmt.Sprintf("%s %s", c.Target, c.Type)
+		selects[i] = "r." + c.Target
+		if c.Encrypted {
+			selects[i] = fmt.Sprintf("pgp_sym_encrypt(r.%s::text, $2)", c.Target)
+		}
+	}
+
+	onConflict := fmt.Sprintf(`
+		ON CONFLICT (%s) DO NOTHING`, conflictColumns(cfg, cols))
+	if cfg.ConflictAction == conflictUpdate {
+		onConflict = upsertClause(cfg, cols, "$2")
+	}
+
+	return fmt.Sprintf(`
+		INSERT INTO %s (%s)
+		SELECT %s
+		FROM jsonb_to_recordset($1::jsonb) AS r(%s)%s`,
+		cfg.TargetTable, strings.Join(targets, ", "), strings.Join(selects, ", "), strings.Join(defs, ", "), onConflict)
+}